@@ -0,0 +1,326 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// agendaSpan is a stretch of a doctor's day. Start and End are on the
+// day's wall clock. Blocked spans say why: off_shift (clinic hours outside
+// the doctor's shifts), closed (a closure; Note explains it), buffer (the
+// set-up or clean-up time around AppointmentID) or held (a slot offered to
+// a waitlisted patient).
+type agendaSpan struct {
+	Start         string    `json:"start"`
+	End           string    `json:"end"`
+	StartsAt      time.Time `json:"starts_at"`
+	EndsAt        time.Time `json:"ends_at"`
+	Minutes       int       `json:"minutes"`
+	Reason        string    `json:"reason,omitempty"`
+	Note          string    `json:"note,omitempty"`
+	LocationID    *uint     `json:"location_id,omitempty"`
+	AppointmentID *uint     `json:"appointment_id,omitempty"`
+}
+
+// doctorAgenda is one doctor's day: the appointments in start order
+// (cancelled ones included, though they take no time) and the free and
+// blocked spans within clinic hours, each in order.
+type doctorAgenda struct {
+	Doctor        string        `json:"doctor"`
+	Date          string        `json:"date"`
+	Weekday       string        `json:"weekday"`
+	TimeZone      string        `json:"time_zone"`
+	Open          string        `json:"open"`
+	Close         string        `json:"close"`
+	Appointments  []Appointment `json:"appointments"`
+	Free          []agendaSpan  `json:"free"`
+	Blocked       []agendaSpan  `json:"blocked"`
+	FreeMinutes   int           `json:"free_minutes"`
+	BookedMinutes int           `json:"booked_minutes"`
+}
+
+// span is a half-open stretch of time [from, until).
+type span struct {
+	from, until time.Time
+	locationID  *uint
+}
+
+func (s span) empty() bool { return !s.until.After(s.from) }
+
+// clip narrows s to [from, until).
+func (s span) clip(from, until time.Time) span {
+	if s.from.Before(from) {
+		s.from = from
+	}
+	if s.until.After(until) {
+		s.until = until
+	}
+	return s
+}
+
+// subtractSpans returns what is left of base once every span in cut is
+// taken out, in order.
+func subtractSpans(base []span, cut []span) []span {
+	sort.Slice(cut, func(i, j int) bool { return cut[i].from.Before(cut[j].from) })
+	var out []span
+	for _, b := range base {
+		for _, c := range cut {
+			if b.empty() {
+				break
+			}
+			if !c.until.After(b.from) || !c.from.Before(b.until) {
+				continue
+			}
+			if c.from.After(b.from) {
+				out = append(out, span{b.from, c.from, b.locationID})
+			}
+			b.from = c.until
+		}
+		if !b.empty() {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// agendaSpanFor renders s on loc's wall clock.
+func agendaSpanFor(s span, loc *time.Location) agendaSpan {
+	return agendaSpan{
+		Start:      s.from.In(loc).Format("15:04"),
+		End:        s.until.In(loc).Format("15:04"),
+		StartsAt:   s.from.In(loc),
+		EndsAt:     s.until.In(loc),
+		Minutes:    int(s.until.Sub(s.from) / time.Minute),
+		LocationID: s.locationID,
+	}
+}
+
+// buildAgenda works out doctor's day on date from the clinic hours, the
+// doctor's shifts (at locationID, if set), closures and the appointments
+// with their buffers. loc is the wall clock the day is read on.
+func buildAgenda(db *gorm.DB, doctor, date string, locationID *uint, loc *time.Location) (doctorAgenda, error) {
+	open, close := clinicHours()
+	ag := doctorAgenda{Doctor: doctor, Date: date, TimeZone: loc.String(), Open: open, Close: close,
+		Appointments: []Appointment{}, Free: []agendaSpan{}, Blocked: []agendaSpan{}}
+	dayStart, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		return ag, err
+	}
+	ag.Weekday = dayStart.Weekday().String()
+	dayOpen, err := localInstant(date, open, loc)
+	if err != nil {
+		return ag, err
+	}
+	dayClose, err := localInstant(date, close, loc)
+	if err != nil {
+		return ag, err
+	}
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	if err := db.Where("doctor = ? AND starts_at >= ? AND starts_at < ?", doctor, dayStart.UTC(), dayEnd.UTC()).
+		Order("starts_at, id").Find(&ag.Appointments).Error; err != nil {
+		return ag, err
+	}
+	hours := span{from: dayOpen, until: dayClose}
+
+	// The hours the doctor works: their shifts, or all of clinic hours for a
+	// doctor without any
+	shifts, err := doctorSchedules(db, doctor)
+	if err != nil {
+		return ag, err
+	}
+	working := []span{{dayOpen, dayClose, locationID}}
+	if len(shifts) > 0 {
+		working = nil
+		for _, s := range shiftsOn(shifts, locationID, dayStart.Weekday()) {
+			from, err1 := localInstant(date, s.StartTime, loc)
+			until, err2 := localInstant(date, s.EndTime, loc)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			lid := s.LocationID
+			if w := (span{from, until, &lid}).clip(dayOpen, dayClose); !w.empty() {
+				working = append(working, w)
+			}
+		}
+		sort.Slice(working, func(i, j int) bool { return working[i].from.Before(working[j].from) })
+	}
+	var blocked []agendaSpan
+	for _, s := range subtractSpans([]span{hours}, append([]span(nil), working...)) {
+		b := agendaSpanFor(s, loc)
+		b.Reason, b.LocationID = "off_shift", nil
+		blocked = append(blocked, b)
+	}
+
+	// A closure takes a whole shift, or the whole day
+	var unclosed []span
+	for _, w := range working {
+		cl, err := closureFor(db, Appointment{Doctor: doctor, Date: date, LocationID: w.locationID})
+		if err != nil {
+			return ag, err
+		}
+		if cl == nil {
+			unclosed = append(unclosed, w)
+			continue
+		}
+		b := agendaSpanFor(w, loc)
+		b.Reason, b.Note = "closed", cl.describe(date)
+		blocked = append(blocked, b)
+	}
+
+	// Appointments and their buffers take their time out of the open hours.
+	// Buffers are only reported where the doctor would otherwise be free, as
+	// time off shift or closed is blocked already.
+	busy, err := busyIntervals(db, doctor, dayStart, dayEnd, 0)
+	if err != nil {
+		return ag, err
+	}
+	var taken []span
+	for _, ap := range busy {
+		ap := ap
+		taken = append(taken, span{from: ap.BlockedFrom, until: ap.BlockedUntil})
+		if v := (span{from: ap.StartsAt, until: ap.EndsAt}).clip(dayStart, dayEnd); !v.empty() {
+			ag.BookedMinutes += int(v.until.Sub(v.from) / time.Minute)
+		}
+		for _, buf := range []span{{ap.BlockedFrom, ap.StartsAt, nil}, {ap.EndsAt, ap.BlockedUntil, nil}} {
+			for _, u := range unclosed {
+				if part := buf.clip(u.from, u.until); !part.empty() {
+					b := agendaSpanFor(part, loc)
+					b.Reason, b.AppointmentID = "buffer", &ap.ID
+					blocked = append(blocked, b)
+				}
+			}
+		}
+	}
+	// So does time held for a waitlisted patient until they answer the offer
+	holds, err := waitlistHolds(db, doctor, dayStart, dayEnd, nil)
+	if err != nil {
+		return ag, err
+	}
+	for _, o := range holds {
+		held := span{from: o.HeldFrom, until: o.HeldUntil}
+		taken = append(taken, held)
+		for _, u := range unclosed {
+			if part := held.clip(u.from, u.until); !part.empty() {
+				b := agendaSpanFor(part, loc)
+				b.Reason, b.Note = "held", "offered to the waitlist until "+o.ExpiresAt.In(loc).Format("15:04")
+				blocked = append(blocked, b)
+			}
+		}
+	}
+	for _, s := range subtractSpans(unclosed, taken) {
+		f := agendaSpanFor(s, loc)
+		ag.Free = append(ag.Free, f)
+		ag.FreeMinutes += f.Minutes
+	}
+	sort.SliceStable(blocked, func(i, j int) bool { return blocked[i].StartsAt.Before(blocked[j].StartsAt) })
+	if blocked != nil {
+		ag.Blocked = blocked
+	}
+	return ag, nil
+}
+
+// agendaParams reads the doctor from :id and ?location_id=, and the wall
+// clock to use: the branch's time zone, or the clinic's. Doctors are known
+// by name, so :id is the name in any form the booking rules accept
+// ("Dr.%20Kim", "kim") or with dashes for spaces ("dr-kim").
+func agendaParams(c *fiber.Ctx, db *gorm.DB) (string, *uint, *time.Location, error) {
+	raw, err := url.PathUnescape(c.Params("id"))
+	if err != nil || strings.TrimSpace(raw) == "" {
+		return "", nil, nil, fiber.NewError(fiber.StatusBadRequest, "invalid doctor")
+	}
+	doctor := ""
+	if len(tenantDoctors(db)) == 0 {
+		doctor = strings.TrimSpace(raw)
+	} else if canon, ok := canonicalDoctor(db, raw); ok {
+		doctor = canon
+	} else if canon, ok := canonicalDoctor(db, strings.ReplaceAll(raw, "-", " ")); ok {
+		doctor = canon
+	} else {
+		return "", nil, nil, fiber.NewError(fiber.StatusNotFound, "unknown doctor")
+	}
+	var locationID *uint
+	tz := ""
+	if rawID := strings.TrimSpace(c.Query("location_id")); rawID != "" {
+		id, err := strconv.ParseUint(rawID, 10, 64)
+		if err != nil {
+			return "", nil, nil, fiber.NewError(fiber.StatusBadRequest, "location_id must be a number")
+		}
+		var l Location
+		if err := db.First(&l, id).Error; err != nil {
+			return "", nil, nil, fiber.NewError(fiber.StatusNotFound, "unknown location")
+		}
+		locationID, tz = &l.ID, l.TimeZone
+	}
+	loc, err := zoneFor(tz)
+	if err != nil {
+		loc = clinicTZ()
+	}
+	return doctor, locationID, loc, nil
+}
+
+// agendaDate reads ?date= (YYYY-MM-DD, default today).
+func agendaDate(c *fiber.Ctx, loc *time.Location) (time.Time, error) {
+	raw := c.Query("date")
+	if raw == "" {
+		now := nowFunc().In(loc)
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc), nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", raw, loc)
+	if err != nil {
+		return day, fiber.NewError(fiber.StatusBadRequest, "date must be a date (YYYY-MM-DD)")
+	}
+	return day, nil
+}
+
+// doctorDayAgenda handles GET /admin/doctors/:id/agenda?date=.
+func doctorDayAgenda(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	doctor, locationID, loc, err := agendaParams(c, db)
+	if err != nil {
+		return err
+	}
+	day, err := agendaDate(c, loc)
+	if err != nil {
+		return err
+	}
+	ag, err := buildAgenda(db, doctor, day.Format("2006-01-02"), locationID, loc)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to build agenda")
+	}
+	return c.JSON(ag)
+}
+
+// doctorWeekAgenda handles GET /admin/doctors/:id/week?date=: the agendas
+// of the week (Sunday to Saturday, like shift weekdays) holding date.
+func doctorWeekAgenda(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	doctor, locationID, loc, err := agendaParams(c, db)
+	if err != nil {
+		return err
+	}
+	day, err := agendaDate(c, loc)
+	if err != nil {
+		return err
+	}
+	first := day.AddDate(0, 0, -int(day.Weekday()))
+	days := make([]doctorAgenda, 0, 7)
+	for i := 0; i < 7; i++ {
+		ag, err := buildAgenda(db, doctor, first.AddDate(0, 0, i).Format("2006-01-02"), locationID, loc)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to build agenda")
+		}
+		days = append(days, ag)
+	}
+	return c.JSON(fiber.Map{
+		"doctor": doctor,
+		"from":   first.Format("2006-01-02"),
+		"to":     first.AddDate(0, 0, 6).Format("2006-01-02"),
+		"days":   days,
+	})
+}
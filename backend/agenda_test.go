@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestBuildAgenda books a dental visit (5 minutes of buffer before, 10
+// after) at the end of Dr. Lee's morning shift, with the afternoon branch
+// closed: the buffer running past the shift is off-shift time, not buffer.
+func TestBuildAgenda(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:agenda?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	const date = "2030-01-07" // a Monday
+	morning := Location{Name: "Agenda Morning", TimeZone: "UTC"}
+	afternoon := Location{Name: "Agenda Afternoon", TimeZone: "UTC"}
+	mustCreate(t, db.Create(&morning).Error)
+	mustCreate(t, db.Create(&afternoon).Error)
+	mustCreate(t, db.Create(&[]DoctorSchedule{
+		{Doctor: "Dr. Lee", LocationID: morning.ID, Weekday: int(time.Monday), StartTime: "09:00", EndTime: "12:00"},
+		{Doctor: "Dr. Lee", LocationID: afternoon.ID, Weekday: int(time.Monday), StartTime: "13:00", EndTime: "17:00"},
+	}).Error)
+	mustCreate(t, db.Create(&Closure{LocationID: &afternoon.ID, DateFrom: date, DateTo: date, Reason: "Staff training"}).Error)
+	ap := Appointment{PatientName: "Grace Akinyi", Doctor: "Dr. Lee", Date: date, Time: "11:10", TimeZone: "UTC",
+		LocationID: &morning.ID, Reason: "dental", Status: StatusConfirmed}
+	resolveAppointmentType(db, &ap)
+	mustCreate(t, createWithStatus(db, &ap, PatientContact{}, "test", ""))
+
+	ag, err := buildAgenda(db, "Dr. Lee", date, nil, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBlocked := []string{
+		"08:00-09:00 off_shift",
+		"11:05-11:10 buffer",
+		"11:55-12:00 buffer",
+		"12:00-13:00 off_shift",
+		"13:00-17:00 closed",
+		"17:00-18:00 off_shift",
+	}
+	if got := describeSpans(ag.Blocked); !equalStrings(got, wantBlocked) {
+		t.Errorf("blocked = %q, want %q", got, wantBlocked)
+	}
+	if got, want := describeSpans(ag.Free), []string{"09:00-11:05 "}; !equalStrings(got, want) {
+		t.Errorf("free = %q, want %q", got, want)
+	}
+	if ag.FreeMinutes != 125 || ag.BookedMinutes != 45 {
+		t.Errorf("free %d, booked %d minutes; want 125 and 45", ag.FreeMinutes, ag.BookedMinutes)
+	}
+	if len(ag.Appointments) != 1 || ag.Appointments[0].ID != ap.ID {
+		t.Errorf("appointments = %+v, want the dental visit", ag.Appointments)
+	}
+	for _, b := range ag.Blocked {
+		if b.Reason == "buffer" && (b.AppointmentID == nil || *b.AppointmentID != ap.ID) {
+			t.Errorf("buffer %s-%s isn't tied to the dental visit", b.Start, b.End)
+		}
+		if b.Reason == "closed" && b.Note == "" {
+			t.Errorf("closed span %s-%s has no note", b.Start, b.End)
+		}
+	}
+}
+
+func describeSpans(spans []agendaSpan) []string {
+	out := make([]string, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, s.Start+"-"+s.End+" "+s.Reason)
+	}
+	return out
+}
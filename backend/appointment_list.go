@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// appointmentFilter is the set of conditions GET /admin/appointments (and
+// anything else that lists appointments for admins) accepts as query
+// parameters.
+type appointmentFilter struct {
+	Doctor     string
+	Statuses   []string
+	From       time.Time // inclusive, UTC
+	Until      time.Time // exclusive, UTC
+	Patient    string
+	LocationID *uint
+	Flagged    bool // only appointments on a closed day
+}
+
+// parseAppointmentFilter reads ?doctor=, ?status= (comma-separated),
+// ?from= and ?to= (YYYY-MM-DD in clinic time, inclusive), ?patient= (part of
+// the name), ?location_id= and ?flagged=true.
+func parseAppointmentFilter(c *fiber.Ctx, db *gorm.DB) (appointmentFilter, error) {
+	var f appointmentFilter
+	if d := strings.TrimSpace(c.Query("doctor")); d != "" {
+		f.Doctor = d
+		if canon, ok := canonicalDoctor(db, d); ok {
+			f.Doctor = canon
+		}
+	}
+	for _, s := range strings.Split(c.Query("status"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !isKnownStatus(s) {
+			return f, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unknown status %q (valid: %s)", s, strings.Join(statusOrder, ", ")))
+		}
+		f.Statuses = append(f.Statuses, s)
+	}
+	loc := clinicTZ()
+	if from := c.Query("from"); from != "" {
+		day, err := time.ParseInLocation("2006-01-02", from, loc)
+		if err != nil {
+			return f, fiber.NewError(fiber.StatusBadRequest, "from must be a date (YYYY-MM-DD)")
+		}
+		f.From = day.UTC()
+	}
+	if to := c.Query("to"); to != "" {
+		day, err := time.ParseInLocation("2006-01-02", to, loc)
+		if err != nil {
+			return f, fiber.NewError(fiber.StatusBadRequest, "to must be a date (YYYY-MM-DD)")
+		}
+		f.Until = day.AddDate(0, 0, 1).UTC()
+	}
+	f.Patient = strings.TrimSpace(c.Query("patient"))
+	if raw := strings.TrimSpace(c.Query("location_id")); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return f, fiber.NewError(fiber.StatusBadRequest, "location_id must be a number")
+		}
+		lid := uint(id)
+		f.LocationID = &lid
+	}
+	f.Flagged = c.QueryBool("flagged")
+	return f, nil
+}
+
+// likeEscaper protects the wildcards in user text used in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// apply adds the filter's conditions to q.
+func (f appointmentFilter) apply(q *gorm.DB) *gorm.DB {
+	if f.Doctor != "" {
+		q = q.Where("doctor = ?", f.Doctor)
+	}
+	if len(f.Statuses) > 0 {
+		q = q.Where("status IN ?", f.Statuses)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("starts_at >= ?", f.From)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("starts_at < ?", f.Until)
+	}
+	if f.Patient != "" {
+		q = q.Where(`patient_name LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(f.Patient)+"%")
+	}
+	if f.LocationID != nil {
+		q = q.Where("location_id = ?", *f.LocationID)
+	}
+	if f.Flagged {
+		q = q.Where("closure_id IS NOT NULL")
+	}
+	return q
+}
+
+// appointmentSortFields maps ?sort= to the column it orders by. Every order
+// ends with id so that rows with equal values keep a stable position.
+var appointmentSortFields = map[string]string{
+	"created_at":   "created_at",
+	"starts_at":    "starts_at",
+	"date":         "starts_at",
+	"patient_name": "patient_name",
+	"doctor":       "doctor",
+	"status":       "status",
+	"id":           "id",
+}
+
+// appointmentSort is an order for the appointment list.
+type appointmentSort struct {
+	Column string
+	Desc   bool
+}
+
+// parseAppointmentSort reads ?sort= and ?order= (asc or desc). The default
+// is newest first, as the list has always been.
+func parseAppointmentSort(c *fiber.Ctx) (appointmentSort, error) {
+	s := appointmentSort{Column: "created_at", Desc: true}
+	if field := c.Query("sort"); field != "" {
+		col, ok := appointmentSortFields[field]
+		if !ok {
+			return s, fiber.NewError(fiber.StatusBadRequest, "sort must be one of created_at, starts_at, patient_name, doctor, status or id")
+		}
+		s.Column, s.Desc = col, false
+	}
+	switch strings.ToLower(c.Query("order")) {
+	case "":
+	case "asc":
+		s.Desc = false
+	case "desc":
+		s.Desc = true
+	default:
+		return s, fiber.NewError(fiber.StatusBadRequest, "order must be asc or desc")
+	}
+	return s, nil
+}
+
+func (s appointmentSort) apply(q *gorm.DB) *gorm.DB {
+	dir := "ASC"
+	if s.Desc {
+		dir = "DESC"
+	}
+	if s.Column == "id" {
+		return q.Order("id " + dir)
+	}
+	return q.Order(s.Column + " " + dir).Order("id " + dir)
+}
+
+// listCursor marks the last row of a page: its sort value and id. It is
+// handed to clients as an opaque string and only valid for the same sort.
+type listCursor struct {
+	Column string `json:"c"`
+	Value  string `json:"v"`
+	ID     uint   `json:"id"`
+}
+
+func isTimeColumn(col string) bool { return col == "created_at" || col == "starts_at" }
+
+// cursorAfter builds the cursor for the row ap under sort s.
+func (s appointmentSort) cursorAfter(ap Appointment) string {
+	cur := listCursor{Column: s.Column, ID: ap.ID}
+	switch s.Column {
+	case "created_at":
+		cur.Value = ap.CreatedAt.Format(time.RFC3339Nano)
+	case "starts_at":
+		cur.Value = ap.StartsAt.Format(time.RFC3339Nano)
+	case "patient_name":
+		cur.Value = ap.PatientName
+	case "doctor":
+		cur.Value = ap.Doctor
+	case "status":
+		cur.Value = ap.Status
+	}
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// seek narrows q to the rows after cursor. Comparing (value, id) pairs lets
+// the database walk the index from the cursor instead of counting off an
+// offset, so deep pages cost the same as the first one.
+func (s appointmentSort) seek(q *gorm.DB, cursor string) (*gorm.DB, error) {
+	bad := fiber.NewError(fiber.StatusBadRequest, "invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return q, bad
+	}
+	var cur listCursor
+	if err := json.Unmarshal(raw, &cur); err != nil || cur.Column != s.Column {
+		return q, bad
+	}
+	op := ">"
+	if s.Desc {
+		op = "<"
+	}
+	if s.Column == "id" {
+		return q.Where("id "+op+" ?", cur.ID), nil
+	}
+	var value interface{} = cur.Value
+	if isTimeColumn(s.Column) {
+		t, err := time.Parse(time.RFC3339Nano, cur.Value)
+		if err != nil {
+			return q, bad
+		}
+		value = t
+	}
+	return q.Where(fmt.Sprintf("(%s %s ?) OR (%s = ? AND id %s ?)", s.Column, op, s.Column, op), value, value, cur.ID), nil
+}
+
+// appointmentPage is one page of GET /admin/appointments. Total counts every
+// row that matches the filter, not just this page.
+type appointmentPage struct {
+	Appointments []Appointment `json:"appointments"`
+	Total        int64         `json:"total"`
+	Page         int           `json:"page,omitempty"`
+	PageSize     int           `json:"page_size"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+}
+
+// maxPageSize caps ?page_size= (ADMIN_MAX_PAGE_SIZE, default 500).
+func maxPageSize() int {
+	return envInt("ADMIN_MAX_PAGE_SIZE", 500, 1)
+}
+
+// pageParams reads ?page= (from 1) and ?page_size= (default 50).
+func pageParams(c *fiber.Ctx) (page, size int, err error) {
+	page, size = 1, 50
+	if raw := c.Query("page"); raw != "" {
+		if page, err = strconv.Atoi(raw); err != nil || page < 1 {
+			return 0, 0, fiber.NewError(fiber.StatusBadRequest, "page must be a number from 1")
+		}
+	}
+	if raw := c.Query("page_size"); raw != "" {
+		if size, err = strconv.Atoi(raw); err != nil || size < 1 {
+			return 0, 0, fiber.NewError(fiber.StatusBadRequest, "page_size must be a positive number")
+		}
+	}
+	if max := maxPageSize(); size > max {
+		size = max
+	}
+	return page, size, nil
+}
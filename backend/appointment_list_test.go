@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestListAppointmentsPaging walks every sort two rows at a time, by cursor
+// and by page number, and checks the pages add up to the full order.
+func TestListAppointmentsPaging(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:paging?mode=memory&cache=shared")
+	// A tenant of its own keeps the sample data out of the pages
+	tenant := Tenant{Slug: "paging", Name: "Paging Clinic", WidgetKey: "paging-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+
+	var apps []Appointment
+	for i, name := range []string{"Zawadi Kamau", "Amani Ochieng", "Baraka Mwangi", "Amani Ochieng", "Chege 100%", "Dalia Hassan", "Baraka Mwangi"} {
+		ap := Appointment{PatientName: name, Doctor: []string{"Dr. Lee", "Dr. Kim"}[i%2],
+			Date: fmt.Sprintf("2030-01-%02d", 13-i%4), Time: fmt.Sprintf("%02d:00", 9+i), TimeZone: "UTC",
+			Reason: "checkup", Status: []string{StatusPending, StatusConfirmed, StatusCancelled}[i%3]}
+		mustCreate(t, createWithStatus(tdb, &ap, PatientContact{}, "test", ""))
+		apps = append(apps, ap)
+	}
+
+	token, err := createJWTToken(1, tenant.ID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Get("/admin/appointments", jwtMiddleware, listAppointments)
+	list := func(query url.Values) appointmentPage {
+		t.Helper()
+		status, body := call(t, app, "GET", "/admin/appointments?"+query.Encode(), token, "")
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: %d %s", query.Encode(), status, body)
+		}
+		var page appointmentPage
+		mustCreate(t, json.Unmarshal(body, &page))
+		return page
+	}
+	ids := func(apps []Appointment) []string {
+		out := make([]string, len(apps))
+		for i, ap := range apps {
+			out[i] = fmt.Sprint(ap.ID)
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		sort, order string
+		less        func(a, b Appointment) bool // nil: only check the pages agree
+	}{
+		{"", "", nil},
+		{"patient_name", "", func(a, b Appointment) bool { return a.PatientName < b.PatientName }},
+		{"patient_name", "desc", func(a, b Appointment) bool { return a.PatientName > b.PatientName }},
+		{"doctor", "", func(a, b Appointment) bool { return a.Doctor < b.Doctor }},
+		{"status", "desc", func(a, b Appointment) bool { return a.Status > b.Status }},
+		{"starts_at", "", func(a, b Appointment) bool { return a.StartsAt.Before(b.StartsAt) }},
+		{"id", "desc", func(a, b Appointment) bool { return false }},
+	} {
+		query := url.Values{"page_size": {"100"}}
+		if tc.sort != "" {
+			query.Set("sort", tc.sort)
+		}
+		if tc.order != "" {
+			query.Set("order", tc.order)
+		}
+		full := list(query)
+		if full.Total != int64(len(apps)) || len(full.Appointments) != len(apps) {
+			t.Fatalf("sort %q: %d of %d rows, want %d", tc.sort, len(full.Appointments), full.Total, len(apps))
+		}
+		if tc.less != nil {
+			// Ties keep id order, in the direction of the sort
+			want := append([]Appointment(nil), apps...)
+			desc := tc.order == "desc"
+			sort.SliceStable(want, func(i, j int) bool {
+				a, b := want[i], want[j]
+				if tc.less(a, b) || tc.less(b, a) {
+					return tc.less(a, b)
+				}
+				return (a.ID < b.ID) != desc
+			})
+			if got := ids(full.Appointments); !equalStrings(got, ids(want)) {
+				t.Errorf("sort %q %q: ids %v, want %v", tc.sort, tc.order, got, ids(want))
+			}
+		}
+
+		query.Set("page_size", "2")
+		var byCursor, byPage []Appointment
+		for n := 1; ; n++ {
+			page := list(query)
+			byCursor = append(byCursor, page.Appointments...)
+			if page.NextCursor == "" || n > len(apps) {
+				break
+			}
+			query.Set("cursor", page.NextCursor)
+		}
+		query.Del("cursor")
+		for n := 1; n <= 4; n++ {
+			query.Set("page", fmt.Sprint(n))
+			byPage = append(byPage, list(query).Appointments...)
+		}
+		query.Del("page")
+		if got, want := ids(byCursor), ids(full.Appointments); !equalStrings(got, want) {
+			t.Errorf("sort %q %q by cursor: ids %v, want %v", tc.sort, tc.order, got, want)
+		}
+		if got, want := ids(byPage), ids(full.Appointments); !equalStrings(got, want) {
+			t.Errorf("sort %q %q by page: ids %v, want %v", tc.sort, tc.order, got, want)
+		}
+	}
+
+	// Filters narrow both the rows and the total; % in a name is literal
+	for query, want := range map[string]int{
+		"doctor=Dr.%20Kim":              3,
+		"status=pending,cancelled":      5,
+		"patient=amani":                 2,
+		"patient=100%25":                1,
+		"patient=%25":                   1,
+		"from=2030-01-12&to=2030-01-12": 2,
+	} {
+		status, body := call(t, app, "GET", "/admin/appointments?"+query, token, "")
+		var page appointmentPage
+		if status != fiber.StatusOK || json.Unmarshal(body, &page) != nil {
+			t.Errorf("%s: %d %s", query, status, body)
+			continue
+		}
+		if page.Total != int64(want) || len(page.Appointments) != want {
+			t.Errorf("%s: %d rows of %d, want %d", query, len(page.Appointments), page.Total, want)
+		}
+	}
+
+	cursor := list(url.Values{"page_size": {"2"}, "sort": {"doctor"}}).NextCursor
+	for _, query := range []string{"sort=age", "order=up", "page=0", "page_size=x", "cursor=%21%21",
+		"sort=patient_name&cursor=" + cursor} {
+		if status, _ := call(t, app, "GET", "/admin/appointments?"+query, token, ""); status != fiber.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", query, status)
+		}
+	}
+}
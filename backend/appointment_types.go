@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// StringList is a []string stored as a JSON array in a text column.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]string(l))
+	return string(b), err
+}
+
+func (l *StringList) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("StringList: unsupported type %T", src)
+	}
+	if len(b) == 0 {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// AppointmentType is a kind of visit with its own slot length. Buffers block
+// the doctor's time before and after the visit (setup, cleaning) without
+// being part of it. An empty Doctors list means any doctor; Keywords map the
+// reason a patient gives in chat to the type. Resources lists the kinds of
+// room or device each visit needs one of (see Resource).
+type AppointmentType struct {
+	ID                  uint       `gorm:"primaryKey" json:"id"`
+	TenantID            uint       `gorm:"not null;default:1;uniqueIndex:idx_appointment_types_tenant_name,priority:1" json:"-"`
+	Name                string     `gorm:"size:100;uniqueIndex:idx_appointment_types_tenant_name,priority:2;not null" json:"name"`
+	DurationMinutes     int        `gorm:"not null" json:"duration_minutes"`
+	BufferBeforeMinutes int        `gorm:"not null;default:0" json:"buffer_before_minutes"`
+	BufferAfterMinutes  int        `gorm:"not null;default:0" json:"buffer_after_minutes"`
+	Doctors             StringList `gorm:"type:text" json:"doctors"`
+	Keywords            StringList `gorm:"type:text" json:"keywords"`
+	Resources           StringList `gorm:"type:text" json:"resources"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// allowsDoctor reports whether doctor may take this type of visit.
+func (t AppointmentType) allowsDoctor(doctor string) bool {
+	if len(t.Doctors) == 0 {
+		return true
+	}
+	for _, d := range t.Doctors {
+		if doctorKey(d) == doctorKey(doctor) {
+			return true
+		}
+	}
+	return false
+}
+
+// seedAppointmentTypes installs a starter catalogue for a tenant that has
+// none yet.
+func seedAppointmentTypes(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&AppointmentType{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	types := []AppointmentType{
+		{Name: "consultation", DurationMinutes: 30, Keywords: StringList{"consultation", "consult", "general", "sick", "ill", "fever", "cough", "headache", "pain"}},
+		{Name: "checkup", DurationMinutes: 30, BufferAfterMinutes: 5, Keywords: StringList{"checkup", "check-up", "check up", "routine", "annual", "physical", "screening", "exam", "examination"}},
+		{Name: "follow-up", DurationMinutes: 15, Keywords: StringList{"follow-up", "follow up", "followup", "review", "results"}},
+		{Name: "dental", DurationMinutes: 45, BufferBeforeMinutes: 5, BufferAfterMinutes: 10, Keywords: StringList{"dental", "dental checkup", "dentist", "tooth", "teeth", "toothache", "filling", "cleaning"}},
+		{Name: "surgery consult", DurationMinutes: 60, BufferAfterMinutes: 15, Keywords: StringList{"surgery", "surgical", "operation", "injury"}},
+		{Name: "vaccination", DurationMinutes: 15, Keywords: StringList{"vaccination", "vaccine", "jab", "shot", "immunization"}},
+		{Name: "therapy", DurationMinutes: 45, BufferAfterMinutes: 15, Keywords: StringList{"therapy", "physio", "physiotherapy", "treatment", "rehab"}},
+	}
+	return db.Create(&types).Error
+}
+
+// matchAppointmentType maps a free-text reason to a catalogue entry. The
+// longest keyword found as a whole word wins, so "dental checkup" is dental.
+func matchAppointmentType(db *gorm.DB, reason string) (AppointmentType, bool) {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if reason == "" {
+		return AppointmentType{}, false
+	}
+	var types []AppointmentType
+	if err := db.Find(&types).Error; err != nil {
+		return AppointmentType{}, false
+	}
+	var best AppointmentType
+	bestLen := 0
+	for _, t := range types {
+		for _, kw := range append(StringList{t.Name}, t.Keywords...) {
+			kw = strings.ToLower(strings.TrimSpace(kw))
+			if len(kw) <= bestLen {
+				continue
+			}
+			if regexp.MustCompile(`\b` + regexp.QuoteMeta(kw) + `\b`).MatchString(reason) {
+				best, bestLen = t, len(kw)
+			}
+		}
+	}
+	return best, bestLen > 0
+}
+
+// applyAppointmentType links ap to t and snapshots its duration and buffers,
+// so later catalogue edits don't move existing bookings. An explicit
+// duration on ap is kept.
+func applyAppointmentType(ap *Appointment, t AppointmentType) {
+	id := t.ID
+	ap.AppointmentTypeID = &id
+	if ap.DurationMinutes <= 0 {
+		ap.DurationMinutes = t.DurationMinutes
+	}
+	ap.BufferBeforeMinutes = t.BufferBeforeMinutes
+	ap.BufferAfterMinutes = t.BufferAfterMinutes
+}
+
+// resolveAppointmentType sets the type of ap from its AppointmentTypeID, or
+// from its reason when no type was given. An unknown ID is a violation.
+func resolveAppointmentType(db *gorm.DB, ap *Appointment) []PolicyViolation {
+	if ap.AppointmentTypeID != nil {
+		var t AppointmentType
+		if err := db.First(&t, *ap.AppointmentTypeID).Error; err != nil {
+			return []PolicyViolation{{"appointment_type_id", "unknown_type", fmt.Sprintf("Appointment type %d doesn't exist.", *ap.AppointmentTypeID)}}
+		}
+		applyAppointmentType(ap, t)
+		return nil
+	}
+	if t, ok := matchAppointmentType(db, ap.Reason); ok {
+		applyAppointmentType(ap, t)
+	}
+	return nil
+}
+
+// typeViolations checks that the appointment's doctor may take its type.
+func typeViolations(db *gorm.DB, ap Appointment) []PolicyViolation {
+	if ap.AppointmentTypeID == nil || ap.Doctor == "" {
+		return nil
+	}
+	var t AppointmentType
+	if err := db.First(&t, *ap.AppointmentTypeID).Error; err != nil || t.allowsDoctor(ap.Doctor) {
+		return nil
+	}
+	return []PolicyViolation{{"doctor", "doctor_not_allowed",
+		fmt.Sprintf("%s doesn't do %s appointments. Please choose %s.", ap.Doctor, t.Name, strings.Join(t.Doctors, " or "))}}
+}
+
+func listAppointmentTypes(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var types []AppointmentType
+	if err := db.Order("name").Find(&types).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to list appointment types")
+	}
+	return c.JSON(types)
+}
+
+func createAppointmentType(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in AppointmentType
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	in.ID = 0
+	if v := appointmentTypeViolations(db, &in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Create(&in).Error; err != nil {
+		return fiber.NewError(fiber.StatusConflict, "appointment type already exists")
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+func updateAppointmentType(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var t AppointmentType
+	if err := db.First(&t, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	id, created := t.ID, t.CreatedAt
+	if err := c.BodyParser(&t); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	t.ID, t.CreatedAt = id, created
+	if v := appointmentTypeViolations(db, &t); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Save(&t).Error; err != nil {
+		return fiber.NewError(fiber.StatusConflict, "appointment type already exists")
+	}
+	return c.JSON(t)
+}
+
+func deleteAppointmentType(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	if err := db.Delete(&AppointmentType{}, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// appointmentTypeViolations normalises an admin-supplied type and reports
+// what is wrong with it.
+func appointmentTypeViolations(db *gorm.DB, t *AppointmentType) []PolicyViolation {
+	t.Name = strings.ToLower(strings.TrimSpace(t.Name))
+	var out []PolicyViolation
+	if t.Name == "" {
+		out = append(out, PolicyViolation{"name", "required", "Name is required."})
+	}
+	if t.DurationMinutes <= 0 {
+		out = append(out, PolicyViolation{"duration_minutes", "invalid_duration", "Duration must be a positive number of minutes."})
+	}
+	if t.BufferBeforeMinutes < 0 || t.BufferAfterMinutes < 0 {
+		out = append(out, PolicyViolation{"buffer", "invalid_buffer", "Buffers can't be negative."})
+	}
+	for i, d := range t.Doctors {
+		if canon, ok := canonicalDoctor(db, d); ok {
+			t.Doctors[i] = canon
+		} else {
+			out = append(out, PolicyViolation{"doctors", "unknown_doctor", fmt.Sprintf("We don't have a doctor called %s.", d)})
+		}
+	}
+	for i, kind := range t.Resources {
+		t.Resources[i] = strings.ToLower(strings.TrimSpace(kind))
+		var n int64
+		if err := db.Model(&Resource{}).Where("kind = ?", t.Resources[i]).Count(&n).Error; err != nil || n == 0 {
+			out = append(out, PolicyViolation{"resources", "unknown_resource_kind", fmt.Sprintf("There's no resource of kind %q yet.", kind)})
+		}
+	}
+	return out
+}
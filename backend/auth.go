@@ -14,6 +14,7 @@ import (
 type authRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Tenant   string `json:"tenant"` // tenant slug, the default tenant if empty
 }
 
 type authResponse struct {
@@ -34,21 +35,25 @@ func checkPasswordHash(password, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-func createJWTToken(userID uint, email string) (string, error) {
+func createJWTToken(userID, tenant uint, email string) (string, error) {
 	secret := os.Getenv("JWT_SECRET")
 	if secret == "" {
 		secret = "supersecret"
 	}
 	claims := jwt.MapClaims{
-		"sub":   userID,
-		"email": email,
-		"exp":   time.Now().Add(24 * time.Hour).Unix(),
+		"sub":    userID,
+		"email":  email,
+		"tenant": tenant,
+		"exp":    time.Now().Add(24 * time.Hour).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(secret))
 }
 
-func registerHandler(c *fiber.Ctx) error {
+// createUser handles POST /admin/users: staff add a colleague to their own
+// practice. There is no public sign-up, and new users can't manage tenants.
+func createUser(c *fiber.Ctx) error {
+	db := tenantDB(c)
 	var req authRequest
 	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
@@ -64,7 +69,7 @@ func registerHandler(c *fiber.Ctx) error {
 	if err := db.Create(&user).Error; err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "user may already exist")
 	}
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "registered"})
+	return c.Status(fiber.StatusCreated).JSON(user)
 }
 
 func loginHandler(c *fiber.Ctx) error {
@@ -75,14 +80,18 @@ func loginHandler(c *fiber.Ctx) error {
 	if !validateEmail(req.Email) || len(req.Password) < 6 {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid email or password")
 	}
+	var tenant Tenant
+	if err := db.Where("slug = ?", choose(req.Tenant, "default")).First(&tenant).Error; err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
+	}
 	var user User
-	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
+	if err := forTenant(tenant.ID).Where("email = ?", req.Email).First(&user).Error; err != nil {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
 	}
 	if !checkPasswordHash(req.Password, user.Password) {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
 	}
-	tok, err := createJWTToken(user.ID, user.Email)
+	tok, err := createJWTToken(user.ID, tenant.ID, user.Email)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to create token")
 	}
@@ -90,17 +99,19 @@ func loginHandler(c *fiber.Ctx) error {
 }
 
 func ensureDefaultAdmin(email, password string) error {
+	db := forTenant(defaultTenantID)
 	if email == "" || password == "" {
 		return errors.New("email or password empty")
 	}
 	var count int64
 	db.Model(&User{}).Where("email = ?", email).Count(&count)
 	if count > 0 {
-		return nil
+		// Admins created before platform admins existed get the flag now
+		return db.Model(&User{}).Where("email = ?", email).Update("platform_admin", true).Error
 	}
 	hash, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
-	return db.Create(&User{Email: email, Password: hash}).Error
+	return db.Create(&User{Email: email, Password: hash, PlatformAdmin: true}).Error
 }
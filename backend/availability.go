@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// maxOfferedSlots is how many free times chat offers for a time window.
+const maxOfferedSlots = 3
+
+// busyIntervals returns the spans of the doctor's time (buffers included)
+// that overlap [from, until), ignoring cancelled appointments and the
+// appointment being moved (excludeID).
+func busyIntervals(db *gorm.DB, doctor string, from, until time.Time, excludeID uint) ([]Appointment, error) {
+	// Instants are stored as UTC text, so bounds must be UTC to compare
+	from, until = from.UTC(), until.UTC()
+	var apps []Appointment
+	err := db.Where("doctor = ? AND status <> ? AND id <> ? AND blocked_from < ? AND blocked_until > ?",
+		doctor, StatusCancelled, excludeID, until, from).
+		Order("blocked_from").Find(&apps).Error
+	return apps, err
+}
+
+// conflictingAppointment returns the first booking of the same doctor whose
+// blocked span overlaps ap's, if any.
+func conflictingAppointment(db *gorm.DB, ap Appointment) (*Appointment, error) {
+	if err := ap.normalizeSchedule(); err != nil || ap.StartsAt.IsZero() {
+		return nil, err
+	}
+	clash, err := busyIntervals(db, ap.Doctor, ap.BlockedFrom, ap.BlockedUntil, ap.ID)
+	if err != nil || len(clash) == 0 {
+		return nil, err
+	}
+	return &clash[0], nil
+}
+
+// waitlistHolds returns the open offers whose hold on the doctor's time
+// overlaps [from, until). A hold is busy for everyone but the patient it is
+// offered to, so offers for patientID (when set) are left out. Offers past
+// their expiry hold nothing, even before the background job closes them.
+func waitlistHolds(db *gorm.DB, doctor string, from, until time.Time, patientID *uint) ([]WaitlistOffer, error) {
+	q := db.Where("doctor = ? AND status = ? AND expires_at > ? AND held_from < ? AND held_until > ?",
+		doctor, "open", nowFunc().UTC(), until.UTC(), from.UTC())
+	if patientID != nil {
+		q = q.Where("entry_id NOT IN (?)", db.Model(&WaitlistEntry{}).Select("id").Where("patient_id = ?", *patientID))
+	}
+	var offers []WaitlistOffer
+	err := q.Order("held_from").Find(&offers).Error
+	return offers, err
+}
+
+// heldOffer returns the first open waitlist offer holding part of ap's
+// blocked span for another patient, if any.
+func heldOffer(db *gorm.DB, ap Appointment) (*WaitlistOffer, error) {
+	if err := ap.normalizeSchedule(); err != nil || ap.StartsAt.IsZero() {
+		return nil, err
+	}
+	holds, err := waitlistHolds(db, ap.Doctor, ap.BlockedFrom, ap.BlockedUntil, ap.PatientID)
+	if err != nil || len(holds) == 0 {
+		return nil, err
+	}
+	return &holds[0], nil
+}
+
+// errTimeTaken fails a write whose slot was booked, or held for a waitlisted
+// patient, after scheduleViolations passed it.
+var errTimeTaken = errors.New("this time was just booked")
+
+// claimSlot checks again, inside the writing transaction, that ap's time is
+// still free of the doctor's other bookings and of waitlist holds, and books
+// the resources it needs. scheduleViolations runs before the transaction, so
+// without this two requests could both pass it and double-book the doctor.
+func claimSlot(tx *gorm.DB, ap *Appointment) error {
+	if ap.Status != StatusCancelled {
+		clash, err := conflictingAppointment(tx, *ap)
+		if err != nil {
+			return err
+		}
+		held, err := heldOffer(tx, *ap)
+		if err != nil {
+			return err
+		}
+		if clash != nil || held != nil {
+			return errTimeTaken
+		}
+	}
+	return holdResources(tx, ap)
+}
+
+// lostSlotViolations reports a write that failed because its slot was taken
+// after the schedule check the way that check would have, or returns nil
+// for any other error.
+func lostSlotViolations(err error) []PolicyViolation {
+	switch {
+	case errors.Is(err, errTimeTaken):
+		return []PolicyViolation{{"time", "conflict", "That time was just booked by someone else."}}
+	case errors.Is(err, errResourceTaken):
+		return []PolicyViolation{{"time", "resource_unavailable", "A room or device that time needs was just booked by someone else."}}
+	}
+	return nil
+}
+
+// scheduleViolations checks ap against its appointment type, the doctor's
+// shifts, the doctor's other bookings, slots held for waitlisted patients
+// and the rooms or devices it needs. It reads the database, so it runs once
+// the field rules in validateBookingRules have passed.
+func scheduleViolations(db *gorm.DB, ap Appointment) ([]PolicyViolation, error) {
+	if v := typeViolations(db, ap); len(v) > 0 {
+		return v, nil
+	}
+	if v, err := rosterViolations(db, ap); err != nil || len(v) > 0 {
+		return v, err
+	}
+	clash, err := conflictingAppointment(db, ap)
+	if err != nil {
+		return nil, err
+	}
+	loc, zerr := zoneFor(ap.TimeZone)
+	if zerr != nil {
+		loc = clinicTZ()
+	}
+	if clash != nil {
+		return []PolicyViolation{{"time", "conflict", fmt.Sprintf("%s already has an appointment from %s to %s.",
+			ap.Doctor, clash.StartsAt.In(loc).Format("15:04"), clash.EndsAt.In(loc).Format("15:04"))}}, nil
+	}
+	held, err := heldOffer(db, ap)
+	if err != nil {
+		return nil, err
+	}
+	if held != nil {
+		return []PolicyViolation{{"time", "held", fmt.Sprintf("The %s slot with %s is held for a patient on the waitlist until %s.",
+			held.Time, ap.Doctor, held.ExpiresAt.In(loc).Format("15:04"))}}, nil
+	}
+	return resourceViolations(db, ap)
+}
+
+// freeSlots lists the times inside w on ap's date when a visit of ap's
+// length and buffers could start: on the SLOT_MINUTES grid, within clinic
+// hours and the doctor's shifts (at ap's branch, if set), with the doctor
+// and the resources its type needs free. Closed days have none, and times
+// closer than the policy's minimum notice are left out.
+//
+// A zero window means the whole day. When w.Near is set the slots closest
+// to it come first.
+func freeSlots(db *gorm.DB, ap Appointment, w TimeWindow) ([]string, error) {
+	open, close := clinicHours()
+	from, to := open, close
+	if w.From > from {
+		from = w.From
+	}
+	if w.To != "" && w.To < to {
+		to = w.To
+	}
+	fromMin, ok1 := clockMinutes(from)
+	toMin, ok2 := clockMinutes(to)
+	openMin, ok3 := clockMinutes(open)
+	closeMin, ok4 := clockMinutes(close)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, fmt.Errorf("invalid clinic hours %s-%s", open, close)
+	}
+	loc, err := zoneFor(ap.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	dayStart, err := time.ParseInLocation("2006-01-02", ap.Date, loc)
+	if err != nil {
+		return nil, err
+	}
+	if closed, err := closureFor(db, ap); err != nil || closed != nil {
+		return nil, err
+	}
+	busy, err := busyIntervals(db, ap.Doctor, dayStart.Add(-24*time.Hour), dayStart.Add(48*time.Hour), ap.ID)
+	if err != nil {
+		return nil, err
+	}
+	// So is time held for someone else on the waitlist
+	holds, err := waitlistHolds(db, ap.Doctor, dayStart.Add(-24*time.Hour), dayStart.Add(48*time.Hour), ap.PatientID)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range holds {
+		busy = append(busy, Appointment{BlockedFrom: o.HeldFrom, BlockedUntil: o.HeldUntil})
+	}
+	// A doctor with shifts is only offered inside them
+	shifts, err := doctorSchedules(db, ap.Doctor)
+	if err != nil {
+		return nil, err
+	}
+	rostered := len(shifts) > 0
+	shifts = shiftsOn(shifts, ap.LocationID, dayStart.Weekday())
+	// Rooms and devices the visit needs have to be free at the same time
+	pool, err := loadResourcePool(db, ap, dayStart.Add(-24*time.Hour), dayStart.Add(48*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	now := nowFunc().In(loc)
+	policy := currentPolicy()
+	earliest := now.Add(policy.MinLead)
+	duration := time.Duration(appointmentMinutes(ap)) * time.Minute
+	before := time.Duration(ap.BufferBeforeMinutes) * time.Minute
+	after := time.Duration(ap.BufferAfterMinutes) * time.Minute
+
+	// The whole appointment has to fit before closing
+	if last := closeMin - appointmentMinutes(ap); last+1 < toMin {
+		toMin = last + 1
+	}
+
+	step := policy.SlotMinutes
+	var slots []string
+	// Slots are aligned to opening time, not to the start of the window
+	for m := openMin; m < toMin; m += step {
+		if m < fromMin {
+			continue
+		}
+		slot := formatClock(m)
+		at, err := localInstant(ap.Date, slot, loc)
+		if err != nil || !at.After(now) || at.Before(earliest) {
+			// Skipped by a DST change, or too soon to book
+			continue
+		}
+		if overlapsAny(busy, at.Add(-before), at.Add(duration+after)) {
+			continue
+		}
+		if rostered && !fitsShift(shifts, slot, appointmentMinutes(ap)) {
+			continue
+		}
+		if _, missing := pool.pick(at.Add(-before), at.Add(duration+after)); missing != "" {
+			continue
+		}
+		slots = append(slots, slot)
+	}
+
+	if near, ok := clockMinutes(w.Near); ok {
+		sort.SliceStable(slots, func(i, j int) bool {
+			a, _ := clockMinutes(slots[i])
+			b, _ := clockMinutes(slots[j])
+			return absInt(a-near) < absInt(b-near)
+		})
+	}
+	return slots, nil
+}
+
+// overlapsAny reports whether [from, until) overlaps any blocked span in busy.
+func overlapsAny(busy []Appointment, from, until time.Time) bool {
+	for _, b := range busy {
+		if b.BlockedFrom.Before(until) && b.BlockedUntil.After(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// offerSlots picks the first maxOfferedSlots of slots (the best matches) and
+// puts them back in time order for the patient.
+func offerSlots(slots []string) []string {
+	if len(slots) > maxOfferedSlots {
+		slots = slots[:maxOfferedSlots]
+	}
+	offered := append([]string(nil), slots...)
+	sort.Strings(offered)
+	return offered
+}
+
+// slotOffer phrases the offered free times for the patient to pick from, or
+// says there are none.
+func slotOffer(doctor, date string, w TimeWindow, slots []string) string {
+	when := date
+	if w.Label != "" {
+		when += " " + w.Label
+	}
+	if len(slots) == 0 {
+		return fmt.Sprintf("Sorry, %s has no free times on %s. Would another time or day work for you?", doctor, when)
+	}
+	list := slots[0]
+	if len(slots) > 1 {
+		list = strings.Join(slots[:len(slots)-1], ", ") + " or " + slots[len(slots)-1]
+	}
+	return fmt.Sprintf("%s is free on %s at %s. Which time works for you?", doctor, when, list)
+}
+
+var ordinalPicks = map[string]int{
+	"first": 0, "1st": 0, "earliest": 0, "second": 1, "2nd": 1, "third": 2, "3rd": 2,
+}
+
+// pickOfferedSlot understands "the first one", "second" or "the earliest"
+// as a choice among the slots chat just offered.
+func pickOfferedSlot(message string, offered []string) (string, bool) {
+	for _, word := range strings.Fields(strings.ToLower(message)) {
+		word = strings.Trim(word, ".,!?")
+		if i, ok := ordinalPicks[word]; ok && i < len(offered) {
+			return offered[i], true
+		}
+		if (word == "last" || word == "latest") && len(offered) > 0 {
+			return offered[len(offered)-1], true
+		}
+	}
+	return "", false
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TestClaimSlotInsideTransaction writes bookings whose schedule check passed
+// before a clashing booking or waitlist hold was committed, as two racing
+// requests would, and checks the write itself refuses the slot.
+func TestClaimSlotInsideTransaction(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 7, 7, 0, 0, 0, time.UTC) }
+	initDatabase("file:claim?mode=memory&cache=shared")
+	tenant := Tenant{Slug: "claim", Name: "Claim Clinic", WidgetKey: "claim-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+
+	visit := func(patient, at string) Appointment {
+		ap := Appointment{PatientName: patient, Doctor: "Dr. Lee", Date: "2030-01-07", Time: at, TimeZone: "UTC",
+			Reason: "consultation", Status: StatusPending}
+		resolveAppointmentType(tdb, &ap)
+		return ap
+	}
+	countAt := func(at string) int64 {
+		var n int64
+		tdb.Model(&Appointment{}).Where("time = ? AND status <> ?", at, StatusCancelled).Count(&n)
+		return n
+	}
+
+	first := visit("Ann Wambui", "10:00")
+	mustCreate(t, createWithStatus(tdb, &first, PatientContact{}, "test", ""))
+
+	// A second booking of the same time loses, with nothing left behind
+	second := visit("Ben Otieno", "10:00")
+	err := createWithStatus(tdb, &second, PatientContact{}, "test", "")
+	if !errors.Is(err, errTimeTaken) {
+		t.Fatalf("double booking: got %v, want errTimeTaken", err)
+	}
+	if n := countAt("10:00"); n != 1 {
+		t.Errorf("%d bookings at 10:00, want 1", n)
+	}
+	if v := lostSlotViolations(err); len(v) != 1 || v[0].Code != "conflict" {
+		t.Errorf("violations for a lost slot: %+v, want one conflict", v)
+	}
+
+	// Moving a booking onto a taken time leaves it where it was
+	moving := visit("Carl Mwangi", "11:00")
+	mustCreate(t, createWithStatus(tdb, &moving, PatientContact{}, "test", ""))
+	moved := moving
+	moved.Time, moved.StartsAt = "10:00", time.Time{}
+	mustCreate(t, moved.normalizeSchedule())
+	err = tdb.Transaction(func(tx *gorm.DB) error {
+		return saveAppointmentChange(tx, &moved, moved.Status, true, "test", "")
+	})
+	if !errors.Is(err, errTimeTaken) {
+		t.Fatalf("reschedule onto a booking: got %v, want errTimeTaken", err)
+	}
+	var stored Appointment
+	if err := tdb.First(&stored, moving.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Time != "11:00" {
+		t.Errorf("rescheduled appointment stored at %s, want 11:00", stored.Time)
+	}
+
+	// No offer is made for a slot booked since it was freed, and an
+	// offered slot can't be booked by anyone else
+	entry := WaitlistEntry{PatientName: "Dina Achieng", Email: "dina@example.com", Doctor: "Dr. Lee",
+		DateFrom: "2030-01-07", Reason: "consultation"}
+	if v := joinWaitlist(tdb, &entry); len(v) > 0 {
+		t.Fatalf("join: %+v", v)
+	}
+	if err := makeWaitlistOffer(tdb, entry, visit("", "10:00")); !errors.Is(err, errTimeTaken) {
+		t.Errorf("offer of a booked slot: got %v, want errTimeTaken", err)
+	}
+	var offers int64
+	tdb.Model(&WaitlistOffer{}).Count(&offers)
+	if offers != 0 {
+		t.Errorf("%d offers for a booked slot, want 0", offers)
+	}
+	mustCreate(t, makeWaitlistOffer(tdb, entry, visit("", "12:00")))
+	other := visit("Eve Njeri", "12:00")
+	if err := createWithStatus(tdb, &other, PatientContact{}, "test", ""); !errors.Is(err, errTimeTaken) {
+		t.Errorf("booking a held slot: got %v, want errTimeTaken", err)
+	}
+	if n := countAt("12:00"); n != 0 {
+		t.Errorf("%d bookings at the held 12:00, want 0", n)
+	}
+}
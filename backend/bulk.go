@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// maxBulkItems caps how many appointments one bulk request may change.
+const maxBulkItems = 500
+
+// bulkRequest is the body of POST /admin/appointments/bulk. Action is
+// "status" (to Status), "cancel" or "reassign" (to Doctor). Reason goes in
+// the status history. With AllOrNothing one failure rolls back every change.
+type bulkRequest struct {
+	IDs          []uint `json:"ids"`
+	Action       string `json:"action"`
+	Status       string `json:"status"`
+	Doctor       string `json:"doctor"`
+	Reason       string `json:"reason"`
+	AllOrNothing bool   `json:"all_or_nothing"`
+}
+
+// bulkResult is the outcome for one appointment of a bulk request.
+type bulkResult struct {
+	ID          uint              `json:"id"`
+	OK          bool              `json:"ok"`
+	Appointment *Appointment      `json:"appointment,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Violations  []PolicyViolation `json:"violations,omitempty"`
+}
+
+// errBulkItem rolls one item back to its savepoint.
+var errBulkItem = errors.New("bulk item failed")
+
+// bulkRequestViolations checks the request itself before any appointment is
+// touched.
+func bulkRequestViolations(db *gorm.DB, req *bulkRequest) []PolicyViolation {
+	var out []PolicyViolation
+	if len(req.IDs) == 0 {
+		out = append(out, PolicyViolation{"ids", "required", "List the appointments to change in ids."})
+	} else if len(req.IDs) > maxBulkItems {
+		out = append(out, PolicyViolation{"ids", "too_many", fmt.Sprintf("At most %d appointments can be changed at once.", maxBulkItems)})
+	}
+	switch req.Action = strings.ToLower(strings.TrimSpace(req.Action)); req.Action {
+	case "status":
+		if !isKnownStatus(req.Status) {
+			out = append(out, PolicyViolation{"status", "invalid_status", fmt.Sprintf("status must be one of %s.", strings.Join(statusOrder, ", "))})
+		}
+	case "cancel":
+		req.Status = StatusCancelled
+	case "reassign":
+		if strings.TrimSpace(req.Doctor) == "" {
+			out = append(out, PolicyViolation{"doctor", "required", "Name the doctor to reassign the appointments to."})
+		} else if canon, ok := canonicalDoctor(db, req.Doctor); ok {
+			req.Doctor = canon
+		} else {
+			out = append(out, PolicyViolation{"doctor", "unknown_doctor",
+				fmt.Sprintf("We don't have a doctor called %s. Our doctors are %s.", req.Doctor, strings.Join(tenantDoctors(db), ", "))})
+		}
+	default:
+		out = append(out, PolicyViolation{"action", "invalid_action", "action must be status, cancel or reassign."})
+	}
+	return out
+}
+
+// bulkUpdateAppointments handles POST /admin/appointments/bulk. All changes
+// run in one transaction, in the order of ids, each behind its own
+// savepoint and with the same checks as PUT /admin/appointments/:id, so a
+// later item sees the earlier ones (two appointments reassigned into the
+// same slot conflict). Items that fail are rolled back alone and reported;
+// the rest are committed, unless all_or_nothing is set.
+func bulkUpdateAppointments(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var req bulkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	if v := bulkRequestViolations(db, &req); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	actor := adminActor(c)
+	results := make([]bulkResult, 0, len(req.IDs))
+	var freed []Appointment
+	failed := 0
+	seen := map[uint]bool{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, id := range req.IDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			res := bulkResult{ID: id}
+			var before Appointment
+			err := tx.Transaction(func(sp *gorm.DB) error {
+				var ap Appointment
+				if err := sp.First(&ap, id).Error; err != nil {
+					res.Error = "not found"
+					return errBulkItem
+				}
+				before = ap
+				rescheduled := false
+				if req.Action == "reassign" {
+					ap.Doctor = req.Doctor
+					rescheduled = doctorKey(ap.Doctor) != doctorKey(before.Doctor)
+				}
+				v, err := appointmentChangeViolations(sp, &ap, req.Status, rescheduled)
+				if err != nil {
+					return err
+				}
+				if len(v) > 0 {
+					res.Violations = v
+					return errBulkItem
+				}
+				if err := saveAppointmentChange(sp, &ap, before.Status, rescheduled, actor, req.Reason); err != nil {
+					return err
+				}
+				res.OK, res.Appointment = true, &ap
+				if before.Status != StatusCancelled && (ap.Status == StatusCancelled || rescheduled) {
+					freed = append(freed, before)
+				}
+				return nil
+			})
+			if errors.Is(err, errStatusChanged) {
+				res.Error = err.Error()
+			} else if err != nil && !errors.Is(err, errBulkItem) {
+				res.Error = "failed to update"
+			}
+			if !res.OK {
+				failed++
+			}
+			results = append(results, res)
+		}
+		if failed > 0 && req.AllOrNothing {
+			return errBulkItem
+		}
+		return nil
+	})
+	committed := err == nil
+	if err != nil && !errors.Is(err, errBulkItem) {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
+	}
+	status := fiber.StatusOK
+	if committed {
+		// Cancelled and moved appointments free their old slots for the waitlist
+		for _, ap := range freed {
+			offerFreedSlot(db, ap)
+		}
+	} else {
+		status = fiber.StatusUnprocessableEntity
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"committed": committed,
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
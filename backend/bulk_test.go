@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestBulkUpdate runs each bulk request against a fresh database and checks
+// which items succeeded, whether the transaction was committed and what was
+// stored afterwards.
+func TestBulkUpdate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 6, 9, 0, 0, 0, time.UTC) }
+	t.Setenv("CLINIC_DOCTORS", "Dr. Kim, Dr. Mercy, Dr. Lee")
+
+	type stored struct{ doctor, status string }
+	for i, tc := range []struct {
+		name    string
+		body    string // %[1]d is a, %[2]d b, %[3]d m and %[4]d done
+		code    int
+		ok      []bool
+		want    map[string]stored // by patient name
+		history int               // status changes recorded
+	}{
+		{"later items see earlier ones",
+			`{"ids": [%[2]d, %[3]d], "action": "reassign", "doctor": "dr kim"}`,
+			fiber.StatusOK, []bool{true, false},
+			map[string]stored{"B": {"Dr. Kim", StatusConfirmed}, "M": {"Dr. Mercy", StatusConfirmed}},
+			0},
+		{"partial reassign",
+			`{"ids": [%[1]d, %[2]d], "action": "reassign", "doctor": "Dr. Kim"}`,
+			fiber.StatusOK, []bool{false, true},
+			map[string]stored{"A": {"Dr. Lee", StatusConfirmed}, "B": {"Dr. Kim", StatusConfirmed}},
+			0},
+		{"all or nothing reassign",
+			`{"ids": [%[1]d, %[2]d], "action": "reassign", "doctor": "Dr. Kim", "all_or_nothing": true}`,
+			fiber.StatusUnprocessableEntity, []bool{false, true},
+			map[string]stored{"A": {"Dr. Lee", StatusConfirmed}, "B": {"Dr. Lee", StatusConfirmed}},
+			0},
+		{"partial cancel",
+			`{"ids": [%[1]d, %[4]d, 9999, %[1]d], "action": "cancel", "reason": "doctor away"}`,
+			fiber.StatusOK, []bool{true, false, false},
+			map[string]stored{"A": {"Dr. Lee", StatusCancelled}, "Done": {"Dr. Lee", StatusCompleted}},
+			1},
+		{"all or nothing cancel",
+			`{"ids": [%[1]d, %[4]d], "action": "cancel", "all_or_nothing": true}`,
+			fiber.StatusUnprocessableEntity, []bool{true, false},
+			map[string]stored{"A": {"Dr. Lee", StatusConfirmed}, "Done": {"Dr. Lee", StatusCompleted}},
+			0},
+		{"status change",
+			`{"ids": [%[1]d, %[2]d], "action": "status", "status": "checked_in"}`,
+			fiber.StatusOK, []bool{true, true},
+			map[string]stored{"A": {"Dr. Lee", StatusCheckedIn}, "B": {"Dr. Lee", StatusCheckedIn}},
+			2},
+	} {
+		initDatabase(fmt.Sprintf("file:bulk-%d?mode=memory&cache=shared", i))
+		db := forTenant(defaultTenantID)
+		ids := map[string]uint{}
+		for _, ap := range []Appointment{
+			{PatientName: "A", Doctor: "Dr. Lee", Time: "10:00", Status: StatusConfirmed},
+			{PatientName: "B", Doctor: "Dr. Lee", Time: "10:30", Status: StatusConfirmed},
+			{PatientName: "M", Doctor: "Dr. Mercy", Time: "10:30", Status: StatusConfirmed},
+			{PatientName: "Done", Doctor: "Dr. Lee", Time: "09:00", Status: StatusCompleted},
+			{PatientName: "C", Doctor: "Dr. Kim", Time: "10:00", Status: StatusConfirmed},
+		} {
+			ap := ap
+			ap.Date, ap.TimeZone, ap.Reason = "2030-01-07", "UTC", "checkup"
+			mustCreate(t, createWithStatus(db, &ap, PatientContact{}, "test", ""))
+			ids[ap.PatientName] = ap.ID
+		}
+		app := fiber.New()
+		app.Post("/admin/appointments/bulk", jwtMiddleware, bulkUpdateAppointments)
+		token, err := createJWTToken(1, defaultTenantID, "desk@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := fmt.Sprintf(tc.body, ids["A"], ids["B"], ids["M"], ids["Done"])
+		status, out := call(t, app, "POST", "/admin/appointments/bulk", token, body)
+		var res struct {
+			Committed bool         `json:"committed"`
+			Succeeded int          `json:"succeeded"`
+			Failed    int          `json:"failed"`
+			Results   []bulkResult `json:"results"`
+		}
+		if err := json.Unmarshal(out, &res); err != nil {
+			t.Fatalf("%s: %v in %s", tc.name, err, out)
+		}
+		if status != tc.code || res.Committed != (tc.code == fiber.StatusOK) {
+			t.Errorf("%s: %d committed %v, want %d", tc.name, status, res.Committed, tc.code)
+		}
+		var ok []bool
+		succeeded := 0
+		for _, r := range res.Results {
+			ok = append(ok, r.OK)
+			if r.OK {
+				succeeded++
+			}
+		}
+		if fmt.Sprint(ok) != fmt.Sprint(tc.ok) || res.Succeeded != succeeded || res.Failed != len(ok)-succeeded {
+			t.Errorf("%s: results %v (%d ok, %d failed), want %v", tc.name, ok, res.Succeeded, res.Failed, tc.ok)
+		}
+		for name, want := range tc.want {
+			var ap Appointment
+			mustCreate(t, db.First(&ap, ids[name]).Error)
+			if got := (stored{ap.Doctor, ap.Status}); got != want {
+				t.Errorf("%s: %s is %v, want %v", tc.name, name, got, want)
+			}
+		}
+		// Only committed status changes reach the history
+		var history int64
+		mustCreate(t, db.Model(&StatusChange{}).Where(`"from" <> ''`).Count(&history).Error)
+		if int(history) != tc.history {
+			t.Errorf("%s: %d status changes recorded, want %d", tc.name, history, tc.history)
+		}
+	}
+}
+
+func TestBulkRequestViolations(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	t.Setenv("CLINIC_DOCTORS", "Dr. Kim, Dr. Mercy, Dr. Lee")
+	initDatabase("file:bulk-request?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	for _, tc := range []struct {
+		req  bulkRequest
+		want []string
+	}{
+		{bulkRequest{IDs: []uint{1}, Action: " Cancel "}, nil},
+		{bulkRequest{Action: "cancel"}, []string{"required"}},
+		{bulkRequest{IDs: make([]uint, maxBulkItems+1), Action: "cancel"}, []string{"too_many"}},
+		{bulkRequest{IDs: []uint{1}, Action: "delete"}, []string{"invalid_action"}},
+		{bulkRequest{IDs: []uint{1}, Action: "status", Status: "archived"}, []string{"invalid_status"}},
+		{bulkRequest{IDs: []uint{1}, Action: "reassign"}, []string{"required"}},
+		{bulkRequest{IDs: []uint{1}, Action: "reassign", Doctor: "Dr. Who"}, []string{"unknown_doctor"}},
+	} {
+		req := tc.req
+		if got := violationCodes(bulkRequestViolations(db, &req)); !equalStrings(got, tc.want) {
+			t.Errorf("%+v: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+}
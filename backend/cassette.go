@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cassette is a JSONL file of recorded LLM traffic. "llm" entries hold one
+// request/response pair; "turn" entries hold the user message that caused them,
+// so a recorded session can be exported as a golden conversation.
+type cassetteEntry struct {
+	Kind       string        `json:"kind"`
+	Key        string        `json:"key,omitempty"`
+	Model      string        `json:"model,omitempty"`
+	Messages   []ChatMessage `json:"messages,omitempty"`
+	Response   string        `json:"response,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	SessionID  string        `json:"session_id,omitempty"`
+	Message    string        `json:"message,omitempty"`
+	RecordedAt time.Time     `json:"recorded_at"`
+}
+
+const (
+	cassetteKindLLM  = "llm"
+	cassetteKindTurn = "turn"
+)
+
+// cassetteKey identifies a request independent of when it was recorded.
+func cassetteKey(model string, messages []ChatMessage) string {
+	h := sha256.New()
+	h.Write([]byte(model))
+	for _, m := range messages {
+		h.Write([]byte{0})
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Content))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// cassetteRecorder forwards every call to the real client and appends the
+// exchange to the cassette file.
+type cassetteRecorder struct {
+	mu    sync.Mutex
+	inner LLMClient
+	f     *os.File
+	enc   *json.Encoder
+	names map[string][]string // names stated so far, by session
+}
+
+func newCassetteRecorder(path string, inner LLMClient) (*cassetteRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &cassetteRecorder{inner: inner, f: f, enc: json.NewEncoder(f), names: map[string][]string{}}, nil
+}
+
+func (r *cassetteRecorder) Complete(model string, messages []ChatMessage) (string, error) {
+	resp, err := r.inner.Complete(model, messages)
+	entry := cassetteEntry{
+		Kind:       cassetteKindLLM,
+		Key:        cassetteKey(model, messages),
+		Model:      model,
+		Messages:   messages,
+		Response:   resp,
+		RecordedAt: nowFunc(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	r.write(entry)
+	return resp, err
+}
+
+// recordTurn writes the chat message with emails, phone numbers, ID numbers
+// and the names the patient has given in the session replaced by
+// placeholders. Cassettes end up as test fixtures, so they never hold PII.
+func (r *cassetteRecorder) recordTurn(sessionID, message string) {
+	r.mu.Lock()
+	r.names[sessionID] = append(r.names[sessionID], detectPatientNames([]ChatMessage{{Role: "user", Content: message}})...)
+	names := r.names[sessionID]
+	r.mu.Unlock()
+	message = newPIIRedactor().redact(message, names)
+	r.write(cassetteEntry{Kind: cassetteKindTurn, SessionID: sessionID, Message: message, RecordedAt: nowFunc()})
+}
+
+func (r *cassetteRecorder) write(e cassetteEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		log.Printf("[cassette] write failed: %v", err)
+	}
+}
+
+// cassettePlayer serves recorded responses by request key with no network.
+// Identical requests are answered in recorded order; the last answer repeats.
+type cassettePlayer struct {
+	mu      sync.Mutex
+	entries map[string][]cassetteEntry
+	turns   []cassetteEntry
+}
+
+func loadCassette(path string) (*cassettePlayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &cassettePlayer{entries: map[string][]cassetteEntry{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e cassetteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		switch e.Kind {
+		case cassetteKindLLM:
+			p.entries[e.Key] = append(p.entries[e.Key], e)
+		case cassetteKindTurn:
+			p.turns = append(p.turns, e)
+		}
+	}
+	return p, scanner.Err()
+}
+
+func (p *cassettePlayer) Complete(model string, messages []ChatMessage) (string, error) {
+	key := cassetteKey(model, messages)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queue := p.entries[key]
+	if len(queue) == 0 {
+		return "", fmt.Errorf("cassette: no recording for request %s", key)
+	}
+	e := queue[0]
+	if len(queue) > 1 {
+		p.entries[key] = queue[1:]
+	}
+	if e.Error != "" {
+		return e.Response, errors.New(e.Error)
+	}
+	return e.Response, nil
+}
+
+// activeRecorder is set while LLM_CASSETTE_MODE=record so chat turns can be
+// written next to the LLM traffic they produce.
+var activeRecorder *cassetteRecorder
+
+func recordChatTurn(sessionID, message string) {
+	if activeRecorder != nil {
+		activeRecorder.recordTurn(sessionID, message)
+	}
+}
+
+// runCassetteExport turns the chat turns in a recorded cassette into golden
+// conversations. Each session is replayed against the cassette and the outcome
+// is written as the expectation, ready to be reviewed and added to the corpus.
+func runCassetteExport(args []string) int {
+	flags := flag.NewFlagSet("cassette-export", flag.ContinueOnError)
+	path := flags.String("cassette", "", "recorded cassette (JSONL)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "cassette-export: -cassette is required")
+		return 2
+	}
+	log.SetOutput(io.Discard)
+
+	player, err := loadCassette(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cassette-export: %v\n", err)
+		return 1
+	}
+	initDatabase("file:cassette-export?mode=memory&cache=shared")
+	// Recordings are redacted, so the replayed requests must be too
+	llmClient = redactingClient{inner: player}
+
+	var order []string
+	sessions := map[string][]cassetteEntry{}
+	for _, t := range player.turns {
+		if _, ok := sessions[t.SessionID]; !ok {
+			order = append(order, t.SessionID)
+		}
+		sessions[t.SessionID] = append(sessions[t.SessionID], t)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sessions[order[i]][0].RecordedAt.Before(sessions[order[j]][0].RecordedAt)
+	})
+
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	for _, sessionID := range order {
+		turns := sessions[sessionID]
+		gc := goldenConversation{
+			ID:  sessionID,
+			Now: turns[0].RecordedAt.In(clinicTZ()).Format("2006-01-02T15:04"),
+		}
+		setConversation("export-"+sessionID, ConversationState{})
+		var booked *Appointment
+		for _, t := range turns {
+			at := t.RecordedAt.In(clinicTZ())
+			nowFunc = func() time.Time { return at }
+			gc.Turns = append(gc.Turns, goldenTurn{User: t.Message})
+			resp, err := processChatMessage(forTenant(defaultTenantID), "export-"+sessionID, t.Message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cassette-export: %s: %v\n", sessionID, err)
+				break
+			}
+			if resp.Appointment != nil {
+				booked = resp.Appointment
+				break
+			}
+		}
+		got := getConversation("export-" + sessionID).Draft
+		if booked != nil {
+			got = *booked
+		}
+		gc.Expect = goldenExpect{
+			Doctor:      got.Doctor,
+			Date:        got.Date,
+			Time:        got.Time,
+			PatientName: got.PatientName,
+			Reason:      got.Reason,
+			Booked:      booked != nil,
+		}
+		if err := enc.Encode(gc); err != nil {
+			fmt.Fprintf(os.Stderr, "cassette-export: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
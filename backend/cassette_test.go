@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCassetteRecordReplay records two answers to the same request and a
+// session's chat turns, then replays the file with no client behind it.
+func TestCassetteRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	rec, err := newCassetteRecorder(path, &scriptedLLM{queue: []string{"first", "second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := []ChatMessage{{Role: "system", Content: "extract"}, {Role: "user", Content: "hello"}}
+	rec.recordTurn("s1", "Hi, my name is Kevin Leitich, call me on +254 712 345 678 or kevin@example.com")
+	rec.recordTurn("s1", "Kevin Leitich again, ID number 12345678")
+	for _, want := range []string{"first", "second"} {
+		if got, err := rec.Complete("model", request); got != want || err != nil {
+			t.Fatalf("recording: got %q, %v; want %q", got, err, want)
+		}
+	}
+	mustCreate(t, rec.f.Close())
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pii := range []string{"Kevin", "Leitich", "712 345", "kevin@example.com", "12345678"} {
+		if strings.Contains(string(raw), pii) {
+			t.Errorf("the cassette contains %q:\n%s", pii, raw)
+		}
+	}
+
+	player, err := loadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Identical requests are answered in recorded order; the last repeats
+	for _, want := range []string{"first", "second", "second"} {
+		if got, err := player.Complete("model", request); got != want || err != nil {
+			t.Errorf("replay: got %q, %v; want %q", got, err, want)
+		}
+	}
+	if _, err := player.Complete("model", request[:1]); err == nil {
+		t.Error("an unrecorded request was answered")
+	}
+	if _, err := player.Complete("other-model", request); err == nil {
+		t.Error("a request to another model was answered")
+	}
+	want := []string{"Hi, my name is [PERSON_1], call me on [PHONE_1] or [EMAIL_1]", "[PERSON_1] again, ID number [ID_1]"}
+	var got []string
+	for _, turn := range player.turns {
+		got = append(got, turn.Message)
+		if turn.SessionID != "s1" {
+			t.Errorf("turn recorded for session %q, want s1", turn.SessionID)
+		}
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("turns = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Closure is a span of days (DateFrom to DateTo, inclusive) on which nothing
+// can be booked: a public holiday when Doctor is empty, or one doctor being
+// away. LocationID narrows it to one branch. Appointments already booked
+// inside it are flagged through Appointment.ClosureID until an admin moves
+// or cancels them.
+type Closure struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	TenantID   uint      `gorm:"not null;default:1;index" json:"-"`
+	Doctor     string    `gorm:"size:255;index" json:"doctor"` // empty for the whole clinic
+	LocationID *uint     `gorm:"index" json:"location_id"`
+	DateFrom   string    `gorm:"size:10;not null;index" json:"date_from"`
+	DateTo     string    `gorm:"size:10;not null;index" json:"date_to"`
+	Reason     string    `gorm:"size:255" json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// covers reports whether the closure applies to ap: its date falls inside
+// the span, the doctor matches (clinic-wide closures match everyone) and so
+// does the branch.
+func (cl Closure) covers(ap Appointment) bool {
+	if ap.Date < cl.DateFrom || ap.Date > cl.DateTo {
+		return false
+	}
+	if cl.Doctor != "" && doctorKey(cl.Doctor) != doctorKey(ap.Doctor) {
+		return false
+	}
+	return cl.LocationID == nil || (ap.LocationID != nil && *ap.LocationID == *cl.LocationID)
+}
+
+// describe explains the closure to a patient for the given day.
+func (cl Closure) describe(date string) string {
+	who := "The clinic is closed"
+	switch {
+	case cl.Doctor != "":
+		who = cl.Doctor + " is away"
+	case cl.LocationID != nil:
+		who = "That branch is closed"
+	}
+	if cl.Reason != "" {
+		return fmt.Sprintf("%s on %s (%s).", who, date, cl.Reason)
+	}
+	return fmt.Sprintf("%s on %s.", who, date)
+}
+
+// closureFor returns the first closure covering ap, if any.
+func closureFor(db *gorm.DB, ap Appointment) (*Closure, error) {
+	if !isValidDate(ap.Date) {
+		return nil, nil
+	}
+	var cls []Closure
+	if err := db.Where("date_from <= ? AND date_to >= ?", ap.Date, ap.Date).Order("id").Find(&cls).Error; err != nil {
+		return nil, err
+	}
+	for _, cl := range cls {
+		if cl.covers(ap) {
+			return &cl, nil
+		}
+	}
+	return nil, nil
+}
+
+// closureViolations reports a booking that falls on a closed day.
+func closureViolations(db *gorm.DB, ap Appointment) []PolicyViolation {
+	cl, err := closureFor(db, ap)
+	if err != nil {
+		log.Printf("[closures] lookup failed: %v", err)
+		return nil
+	}
+	if cl == nil {
+		return nil
+	}
+	return []PolicyViolation{{"date", "closed", cl.describe(ap.Date) + " Please pick another day."}}
+}
+
+// openStatuses are the statuses a closure flags; final appointments are left alone.
+var openStatuses = []string{StatusPending, StatusConfirmed, StatusCheckedIn}
+
+// closureScope narrows q to the open appointments cl covers.
+func closureScope(q *gorm.DB, cl Closure) *gorm.DB {
+	q = q.Where("date >= ? AND date <= ? AND status IN ?", cl.DateFrom, cl.DateTo, openStatuses)
+	if cl.Doctor != "" {
+		q = q.Where("doctor = ?", cl.Doctor)
+	}
+	if cl.LocationID != nil {
+		q = q.Where("location_id = ?", *cl.LocationID)
+	}
+	return q
+}
+
+// flagClosure marks the open appointments cl covers that no other closure
+// has flagged yet, and returns how many it marked.
+func flagClosure(tx *gorm.DB, cl Closure) (int64, error) {
+	res := closureScope(tx.Model(&Appointment{}), cl).Where("closure_id IS NULL").Update("closure_id", cl.ID)
+	return res.RowsAffected, res.Error
+}
+
+// unflagClosure clears cl's flags and lets any other closure over the same
+// days claim the appointments instead.
+func unflagClosure(tx *gorm.DB, cl Closure) error {
+	if err := tx.Model(&Appointment{}).Where("closure_id = ?", cl.ID).Update("closure_id", nil).Error; err != nil {
+		return err
+	}
+	var others []Closure
+	if err := tx.Where("id <> ? AND date_from <= ? AND date_to >= ?", cl.ID, cl.DateTo, cl.DateFrom).Find(&others).Error; err != nil {
+		return err
+	}
+	for _, o := range others {
+		if _, err := flagClosure(tx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closureFieldViolations normalises an admin-supplied closure and reports
+// what is wrong with it.
+func closureFieldViolations(db *gorm.DB, cl *Closure) []PolicyViolation {
+	cl.Reason = strings.TrimSpace(cl.Reason)
+	cl.Doctor = strings.TrimSpace(cl.Doctor)
+	if cl.DateTo == "" {
+		cl.DateTo = cl.DateFrom
+	}
+	var out []PolicyViolation
+	if !isValidDate(cl.DateFrom) {
+		out = append(out, PolicyViolation{"date_from", "invalid_date", "date_from must be a date (YYYY-MM-DD)."})
+	}
+	if !isValidDate(cl.DateTo) {
+		out = append(out, PolicyViolation{"date_to", "invalid_date", "date_to must be a date (YYYY-MM-DD)."})
+	} else if cl.DateTo < cl.DateFrom {
+		out = append(out, PolicyViolation{"date_to", "invalid_range", "date_to can't be before date_from."})
+	}
+	if cl.Doctor != "" {
+		if canon, ok := canonicalDoctor(db, cl.Doctor); ok {
+			cl.Doctor = canon
+		} else {
+			out = append(out, PolicyViolation{"doctor", "unknown_doctor",
+				fmt.Sprintf("We don't have a doctor called %s. Our doctors are %s.", cl.Doctor, strings.Join(tenantDoctors(db), ", "))})
+		}
+	}
+	if cl.LocationID != nil {
+		var n int64
+		if err := db.Model(&Location{}).Where("id = ?", *cl.LocationID).Count(&n).Error; err != nil || n == 0 {
+			out = append(out, PolicyViolation{"location_id", "unknown_location", fmt.Sprintf("Location %d doesn't exist.", *cl.LocationID)})
+		}
+	}
+	return out
+}
+
+// closureAppointments lists the appointments flagged by closure id, earliest first.
+func closureAppointments(db *gorm.DB, id uint) ([]Appointment, error) {
+	var apps []Appointment
+	err := db.Where("closure_id = ?", id).Order("starts_at, id").Find(&apps).Error
+	return apps, err
+}
+
+// listClosures handles GET /admin/closures. ?from= and ?to= (YYYY-MM-DD)
+// keep the closures overlapping that range; ?doctor= keeps that doctor's
+// and the clinic-wide ones.
+func listClosures(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	q := db.Order("date_from, id")
+	if from := c.Query("from"); from != "" {
+		q = q.Where("date_to >= ?", from)
+	}
+	if to := c.Query("to"); to != "" {
+		q = q.Where("date_from <= ?", to)
+	}
+	if doctor := c.Query("doctor"); doctor != "" {
+		q = q.Where("doctor = ? OR doctor = ''", doctor)
+	}
+	var cls []Closure
+	if err := q.Find(&cls).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch")
+	}
+	return c.JSON(cls)
+}
+
+// getClosure handles GET /admin/closures/:id with the appointments it flagged.
+func getClosure(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var cl Closure
+	if err := db.First(&cl, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	apps, err := closureAppointments(db, cl.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load appointments")
+	}
+	return c.JSON(fiber.Map{"closure": cl, "appointments": apps})
+}
+
+// createClosure handles POST /admin/closures. The response lists the
+// existing appointments that now fall on a closed day.
+func createClosure(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in Closure
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	in.ID = 0
+	if v := closureFieldViolations(db, &in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&in).Error; err != nil {
+			return err
+		}
+		_, err := flagClosure(tx, in)
+		return err
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create")
+	}
+	apps, err := closureAppointments(db, in.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load appointments")
+	}
+	if len(apps) > 0 {
+		log.Printf("[closures] closure %d (%s..%s) flagged %d appointments", in.ID, in.DateFrom, in.DateTo, len(apps))
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"closure": in, "appointments": apps})
+}
+
+// updateClosure handles PUT /admin/closures/:id, flagging again for the new span.
+func updateClosure(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var cl Closure
+	if err := db.First(&cl, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	old := cl
+	id, created := cl.ID, cl.CreatedAt
+	if err := c.BodyParser(&cl); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	cl.ID, cl.CreatedAt = id, created
+	if v := closureFieldViolations(db, &cl); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&cl).Error; err != nil {
+			return err
+		}
+		if err := unflagClosure(tx, old); err != nil {
+			return err
+		}
+		_, err := flagClosure(tx, cl)
+		return err
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
+	}
+	apps, err := closureAppointments(db, cl.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load appointments")
+	}
+	return c.JSON(fiber.Map{"closure": cl, "appointments": apps})
+}
+
+// deleteClosure handles DELETE /admin/closures/:id, reopening its days.
+func deleteClosure(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var cl Closure
+	if err := db.First(&cl, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&cl).Error; err != nil {
+			return err
+		}
+		return unflagClosure(tx, cl)
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// closureResult is the outcome for one appointment of a bulk cancel or move.
+type closureResult struct {
+	AppointmentID uint              `json:"appointment_id"`
+	OK            bool              `json:"ok"`
+	Notified      bool              `json:"notified"` // the notifier can deliver the patient's message
+	Appointment   *Appointment      `json:"appointment,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Violations    []PolicyViolation `json:"violations,omitempty"`
+}
+
+// appointmentContact returns how to reach ap's patient.
+func appointmentContact(tx *gorm.DB, ap Appointment) PatientContact {
+	var p Patient
+	if ap.PatientID == nil || tx.First(&p, *ap.PatientID).Error != nil {
+		return PatientContact{}
+	}
+	return PatientContact{DOB: p.DOB, Phone: p.Phone, Email: p.Email}
+}
+
+// openClosureAppointments loads the closure from :id and the flagged
+// appointments that still need an admin's decision.
+func openClosureAppointments(c *fiber.Ctx, db *gorm.DB) (Closure, []Appointment, error) {
+	var cl Closure
+	if err := db.First(&cl, c.Params("id")).Error; err != nil {
+		return cl, nil, fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var apps []Appointment
+	if err := db.Where("closure_id = ? AND status IN ?", cl.ID, openStatuses).Order("starts_at, id").Find(&apps).Error; err != nil {
+		return cl, nil, fiber.NewError(fiber.StatusInternalServerError, "failed to load appointments")
+	}
+	return cl, apps, nil
+}
+
+// cancelClosureAppointments handles POST /admin/closures/:id/cancel,
+// cancelling every open appointment the closure flagged and queueing a
+// message to each patient saying why. A result is only marked notified when
+// the notifier can deliver that message; staff call the others. The body may
+// carry a reason for the status history.
+func cancelClosureAppointments(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var req statusRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+		}
+	}
+	cl, apps, err := openClosureAppointments(c, db)
+	if err != nil {
+		return err
+	}
+	reason := choose(strings.TrimSpace(req.Reason), cl.describe(cl.DateFrom))
+	actor := adminActor(c)
+	results := make([]closureResult, 0, len(apps))
+	for _, ap := range apps {
+		ap := ap
+		res := closureResult{AppointmentID: ap.ID}
+		if err := checkTransition(ap, StatusCancelled); err != nil {
+			// Checked-in visits are under way and finish normally
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+		var contact PatientContact
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := setStatus(tx, ap.ID, ap.Status, StatusCancelled); err != nil {
+				return err
+			}
+			if err := recordStatusChange(tx, ap.ID, ap.Status, StatusCancelled, actor, reason); err != nil {
+				return err
+			}
+			body := fmt.Sprintf("Sorry, %s: your appointment with %s on %s at %s has been cancelled. %s Please get in touch to book a new time.",
+				ap.PatientName, ap.Doctor, ap.Date, ap.Time, cl.describe(ap.Date))
+			contact = appointmentContact(tx, ap)
+			return notifyPatient(tx, contact, "Your appointment has been cancelled", body)
+		})
+		if errors.Is(err, errStatusChanged) {
+			res.Error = err.Error()
+		} else if err != nil {
+			res.Error = "failed to cancel"
+		} else {
+			ap.Status = StatusCancelled
+			res.OK, res.Appointment, res.Notified = true, &ap, canReach(contact)
+		}
+		results = append(results, res)
+	}
+	// The freed slots are on closed days, so there is nothing to offer the waitlist
+	return c.JSON(fiber.Map{"closure": cl, "results": results})
+}
+
+// closureRescheduleRequest is the body of POST /admin/closures/:id/reschedule.
+// Each appointment keeps its doctor unless Doctor is set, and moves to the
+// free slot closest to its old time on Date, or on the first day with one
+// within WithinDays (default 14) after the closure.
+type closureRescheduleRequest struct {
+	Doctor     string `json:"doctor"`
+	Date       string `json:"date"`
+	WithinDays int    `json:"within_days"`
+}
+
+// rescheduleClosureAppointments handles POST /admin/closures/:id/reschedule.
+// Appointments are moved earliest first, each in its own transaction, so one
+// that can't be placed doesn't hold up the rest. A message with the new time
+// is queued for every patient who is moved, and marked notified as in
+// cancelClosureAppointments.
+func rescheduleClosureAppointments(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var req closureRescheduleRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+		}
+	}
+	if req.Date != "" && !isValidDate(req.Date) {
+		return validationFailed(c, []PolicyViolation{{"date", "invalid_date", fmt.Sprintf("%s isn't a valid date.", req.Date)}})
+	}
+	if req.WithinDays <= 0 {
+		req.WithinDays = 14
+	}
+	if req.WithinDays > 90 {
+		return validationFailed(c, []PolicyViolation{{"within_days", "too_far", "within_days can be at most 90."}})
+	}
+	if req.Doctor != "" {
+		canon, ok := canonicalDoctor(db, req.Doctor)
+		if !ok {
+			return validationFailed(c, []PolicyViolation{{"doctor", "unknown_doctor",
+				fmt.Sprintf("We don't have a doctor called %s. Our doctors are %s.", req.Doctor, strings.Join(tenantDoctors(db), ", "))}})
+		}
+		req.Doctor = canon
+	}
+	cl, apps, err := openClosureAppointments(c, db)
+	if err != nil {
+		return err
+	}
+	results := make([]closureResult, 0, len(apps))
+	for _, ap := range apps {
+		res := closureResult{AppointmentID: ap.ID}
+		moved, v, err := closureSlot(db, ap, cl, req)
+		switch {
+		case err != nil:
+			res.Error = "failed to check availability"
+		case len(v) > 0:
+			res.Violations = v
+		default:
+			var contact PatientContact
+			err = db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Save(&moved).Error; err != nil {
+					return err
+				}
+				if err := claimSlot(tx, &moved); err != nil {
+					return err
+				}
+				body := fmt.Sprintf("Hello %s: %s Your appointment with %s on %s at %s has moved to %s on %s at %s. Let us know if that doesn't suit you.",
+					ap.PatientName, cl.describe(ap.Date), ap.Doctor, ap.Date, ap.Time, moved.Doctor, moved.Date, moved.Time)
+				contact = appointmentContact(tx, ap)
+				return notifyPatient(tx, contact, "Your appointment has moved", body)
+			})
+			if v := lostSlotViolations(err); len(v) > 0 {
+				res.Violations = v
+			} else if err != nil {
+				res.Error = "failed to reschedule"
+			} else {
+				res.OK, res.Appointment, res.Notified = true, &moved, canReach(contact)
+			}
+		}
+		results = append(results, res)
+	}
+	return c.JSON(fiber.Map{"closure": cl, "results": results})
+}
+
+// closureSlot finds where ap can go: the free slot nearest its old time on
+// the first day that has one, checked against the same rules as an admin
+// reschedule.
+func closureSlot(db *gorm.DB, ap Appointment, cl Closure, req closureRescheduleRequest) (Appointment, []PolicyViolation, error) {
+	moved := ap
+	moved.Doctor = choose(req.Doctor, ap.Doctor)
+	moved.ClosureID = nil
+	days := []string{req.Date}
+	if req.Date == "" {
+		// Another doctor may be free on the same day; closed days have no
+		// free slots
+		loc := clinicTZ()
+		day, _ := time.ParseInLocation("2006-01-02", ap.Date, loc)
+		last, _ := time.ParseInLocation("2006-01-02", cl.DateTo, loc)
+		last = last.AddDate(0, 0, req.WithinDays)
+		days = nil
+		for ; !day.After(last); day = day.AddDate(0, 0, 1) {
+			days = append(days, day.Format("2006-01-02"))
+		}
+	}
+	for _, d := range days {
+		moved.Date = d
+		slots, err := freeSlots(db, moved, TimeWindow{Near: ap.Time})
+		if err != nil {
+			return moved, nil, err
+		}
+		for _, t := range slots {
+			moved.Time = t
+			candidate := moved
+			if v := validateBookingRules(db, &candidate); len(v) > 0 {
+				break // the whole day is ruled out (too far ahead, for example)
+			}
+			v, err := scheduleViolations(db, candidate)
+			if err != nil {
+				return moved, nil, err
+			}
+			if len(v) == 0 {
+				return candidate, nil, nil
+			}
+		}
+	}
+	return ap, []PolicyViolation{{"date", "no_free_slot", fmt.Sprintf("%s has no free slot for this appointment between %s and %s.",
+		moved.Doctor, days[0], days[len(days)-1])}}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestClosureFlagCancelReschedule closes Dr. Lee's diary on one day and
+// moves its appointments, then on another and cancels them. Patients are
+// only reported notified when the notifier can reach them.
+func TestClosureFlagCancelReschedule(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig Notifier) { notifier = orig }(notifier)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	initDatabase("file:closures?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 6, 9, 0, 0, 0, time.UTC) }
+
+	book := func(name, email, date, at string) Appointment {
+		ap := Appointment{PatientName: name, Doctor: "Dr. Lee", Date: date, Time: at, TimeZone: "UTC",
+			Reason: "checkup", Status: StatusConfirmed}
+		mustCreate(t, createWithStatus(db, &ap, PatientContact{Email: email}, "test", ""))
+		return ap
+	}
+	first := book("Faith Atieno", "faith@example.com", "2030-01-08", "10:00")
+	second := book("Brian Mutua", "", "2030-01-08", "11:00")
+	third := book("Esther Wairimu", "esther@example.com", "2030-01-09", "10:00")
+	other := book("Kevin Omondi", "", "2030-01-10", "11:00") // on the day the others move to
+
+	token, err := createJWTToken(1, defaultTenantID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	admin := app.Group("/admin", jwtMiddleware)
+	admin.Post("/closures", createClosure)
+	admin.Post("/closures/:id/cancel", cancelClosureAppointments)
+	admin.Post("/closures/:id/reschedule", rescheduleClosureAppointments)
+
+	closeDays := func(from, to string) (Closure, []Appointment) {
+		var created struct {
+			Closure      Closure       `json:"closure"`
+			Appointments []Appointment `json:"appointments"`
+		}
+		status, body := call(t, app, "POST", "/admin/closures", token,
+			fmt.Sprintf(`{"doctor": "Dr. Lee", "date_from": %q, "date_to": %q, "reason": "conference"}`, from, to))
+		if status != fiber.StatusCreated {
+			t.Fatalf("create closure: %d %s", status, body)
+		}
+		mustCreate(t, json.Unmarshal(body, &created))
+		return created.Closure, created.Appointments
+	}
+	load := func(id uint) Appointment {
+		var ap Appointment
+		mustCreate(t, db.First(&ap, id).Error)
+		return ap
+	}
+	var out struct {
+		Results []closureResult `json:"results"`
+	}
+
+	moving, flagged := closeDays("2030-01-08", "2030-01-08")
+	if len(flagged) != 2 || flagged[0].ID != first.ID || flagged[1].ID != second.ID {
+		t.Fatalf("flagged %+v, want the two appointments on the 8th", flagged)
+	}
+	probe := Appointment{Doctor: "Dr. Lee", Date: "2030-01-08", Time: "15:00"}
+	if got := violationCodes(closureViolations(db, probe)); !equalStrings(got, []string{"closed"}) {
+		t.Errorf("booking on a closed day: %q, want closed", got)
+	}
+	probe.Doctor = "Dr. Kim"
+	if got := closureViolations(db, probe); len(got) > 0 {
+		t.Errorf("another doctor on Dr. Lee's closed day: %v", got)
+	}
+
+	// The 10th has 11:00 taken, so the second visit goes to the nearest free
+	// time, the earlier one on a tie. Only Faith can be emailed.
+	notifier = &outboxNotifier{channels: []string{"email"}}
+	status, body := call(t, app, "POST", fmt.Sprintf("/admin/closures/%d/reschedule", moving.ID), token, `{"date": "2030-01-10"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("reschedule: %d %s", status, body)
+	}
+	mustCreate(t, json.Unmarshal(body, &out))
+	if len(out.Results) != 2 {
+		t.Fatalf("%d results, want 2", len(out.Results))
+	}
+	if !out.Results[0].Notified || out.Results[1].Notified {
+		t.Errorf("notified = %v and %v, want only the patient with an email", out.Results[0].Notified, out.Results[1].Notified)
+	}
+	for _, tc := range []struct {
+		ap   Appointment
+		want string
+	}{{first, "10:00"}, {second, "10:30"}} {
+		got := load(tc.ap.ID)
+		if got.Date != "2030-01-10" || got.Time != tc.want || got.ClosureID != nil {
+			t.Errorf("%s moved to %s %s (closure %v), want 2030-01-10 %s and no closure",
+				tc.ap.PatientName, got.Date, got.Time, got.ClosureID, tc.want)
+		}
+	}
+	if got := load(other.ID); got.Time != "11:00" {
+		t.Errorf("the appointment already on the 10th moved to %s", got.Time)
+	}
+
+	cancelling, flagged := closeDays("2030-01-09", "2030-01-09")
+	if len(flagged) != 1 || flagged[0].ID != third.ID {
+		t.Fatalf("flagged %+v, want the appointment on the 9th", flagged)
+	}
+	// Nothing delivers email now, so Esther isn't reported as told
+	notifier = logNotifier{}
+	status, body = call(t, app, "POST", fmt.Sprintf("/admin/closures/%d/cancel", cancelling.ID), token, `{"reason": "doctor away"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("cancel: %d %s", status, body)
+	}
+	mustCreate(t, json.Unmarshal(body, &out))
+	if len(out.Results) != 1 || !out.Results[0].OK || out.Results[0].Notified {
+		t.Fatalf("cancel results = %+v, want one cancelled appointment, not notified", out.Results)
+	}
+	if got := load(third.ID); got.Status != StatusCancelled {
+		t.Errorf("flagged appointment is %s after the cancel, want cancelled", got.Status)
+	}
+	var change StatusChange
+	mustCreate(t, db.Where("appointment_id = ? AND \"to\" = ?", third.ID, StatusCancelled).First(&change).Error)
+	if change.Reason != "doctor away" || change.ChangedBy != "desk@example.com" {
+		t.Errorf("history entry = %+v, want the reason and the admin", change)
+	}
+
+	var notes []Notification
+	mustCreate(t, db.Order("id").Find(&notes).Error)
+	if len(notes) != 3 {
+		t.Fatalf("%d notifications, want one for each of the 2 moved and the cancelled patient", len(notes))
+	}
+	if !strings.Contains(notes[1].Body, "2030-01-10 at 10:30") || !strings.Contains(notes[2].Body, "cancelled") {
+		t.Errorf("notifications = %q and %q, want the new time and the cancellation", notes[1].Body, notes[2].Body)
+	}
+}
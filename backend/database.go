@@ -17,26 +17,92 @@ func initDatabase(dbPath string) {
 		log.Fatalf("failed to connect database: %v", err)
 	}
 
-	if err := db.AutoMigrate(&User{}, &Appointment{}); err != nil {
+	if err := registerTenantScope(db); err != nil {
+		log.Fatalf("failed to register tenant scope: %v", err)
+	}
+	// Names and emails used to be unique server-wide; they are now unique per tenant
+	for _, old := range []struct {
+		model interface{}
+		index string
+	}{{&User{}, "idx_users_email"}, {&AppointmentType{}, "idx_appointment_types_name"}, {&Location{}, "idx_locations_name"}} {
+		if m := db.Migrator(); m.HasIndex(old.model, old.index) {
+			if err := m.DropIndex(old.model, old.index); err != nil {
+				log.Fatalf("failed to drop index %s: %v", old.index, err)
+			}
+		}
+	}
+	if err := systemDB().AutoMigrate(&Tenant{}, &User{}, &Appointment{}, &AppointmentType{}, &StatusChange{}, &Patient{},
+		&WaitlistEntry{}, &WaitlistOffer{}, &Notification{}, &AppointmentSeries{}, &Location{}, &DoctorSchedule{},
+		&Resource{}, &ResourceBooking{}, &Closure{}); err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
+	if err := setupSearchIndex(systemDB()); err != nil {
+		log.Fatalf("failed to set up search index: %v", err)
+	}
+	if err := ensureDefaultTenant(); err != nil {
+		log.Fatalf("failed to create default tenant: %v", err)
+	}
+
+	def := forTenant(defaultTenantID)
+	_ = seedAppointmentTypes(def)
+	seedLocations(def)
+	seedSampleData(def)
+	backfillSchedule()
+	backfillPatients()
+}
 
-	seedSampleData()
+// backfillSchedule fills starts_at, ends_at, duration_minutes and the
+// blocked span for rows saved before those columns existed, reading Date and
+// Time in the row's zone (the clinic zone if unset). updated_at is left alone.
+func backfillSchedule() {
+	db := systemDB()
+	var apps []Appointment
+	err := db.Where("starts_at IS NULL OR starts_at <= ? OR ends_at IS NULL OR ends_at <= ? OR duration_minutes <= 0 OR "+
+		"blocked_from IS NULL OR blocked_from <= ? OR blocked_until IS NULL OR blocked_until <= ?",
+		time.Time{}, time.Time{}, time.Time{}, time.Time{}).Find(&apps).Error
+	if err != nil {
+		log.Printf("[db] schedule backfill failed: %v", err)
+		return
+	}
+	n := 0
+	for _, ap := range apps {
+		if err := ap.normalizeSchedule(); err != nil || ap.StartsAt.IsZero() {
+			log.Printf("[db] schedule backfill skipped appointment %d (%s %s): %v", ap.ID, ap.Date, ap.Time, err)
+			continue
+		}
+		err := db.Model(&Appointment{}).Where("id = ?", ap.ID).UpdateColumns(map[string]interface{}{
+			"time_zone":        ap.TimeZone,
+			"starts_at":        ap.StartsAt,
+			"ends_at":          ap.EndsAt,
+			"duration_minutes": ap.DurationMinutes,
+			"blocked_from":     ap.BlockedFrom,
+			"blocked_until":    ap.BlockedUntil,
+		}).Error
+		if err != nil {
+			log.Printf("[db] schedule backfill skipped appointment %d: %v", ap.ID, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("[db] Backfilled schedule for %d appointments", n)
+	}
 }
 
-func seedSampleData() {
+func seedSampleData(db *gorm.DB) {
 	var count int64
 	db.Model(&Appointment{}).Count(&count)
 	if count > 0 {
 		return
 	}
-	now := time.Now()
+	now := clinicNow()
 	samples := []Appointment{
-		{PatientName: "John Doe", Doctor: "Dr. Kim", Date: now.Format("2006-01-02"), Time: "10:00", Reason: "checkup", Status: "confirmed"},
-		{PatientName: "Jane Smith", Doctor: "Dr. Mercy", Date: now.AddDate(0, 0, 1).Format("2006-01-02"), Time: "11:00", Reason: "consultation", Status: "pending"},
-		{PatientName: "Alex Johnson", Doctor: "Dr. Lee", Date: now.AddDate(0, 0, 2).Format("2006-01-02"), Time: "15:30", Reason: "follow-up", Status: "pending"},
+		{PatientName: "John Doe", Doctor: "Dr. Kim", Date: now.Format("2006-01-02"), Time: "10:00", Reason: "checkup", Status: StatusConfirmed},
+		{PatientName: "Jane Smith", Doctor: "Dr. Mercy", Date: now.AddDate(0, 0, 1).Format("2006-01-02"), Time: "11:00", Reason: "consultation", Status: StatusPending},
+		{PatientName: "Alex Johnson", Doctor: "Dr. Lee", Date: now.AddDate(0, 0, 2).Format("2006-01-02"), Time: "15:30", Reason: "follow-up", Status: StatusPending},
 	}
 	for _, ap := range samples {
-		_ = db.Create(&ap).Error
+		resolveAppointmentType(db, &ap)
+		_ = createWithStatus(db, &ap, PatientContact{}, "seed", "")
 	}
 }
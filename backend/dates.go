@@ -0,0 +1,339 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/araddon/dateparse"
+)
+
+// DateOrder controls how ambiguous numeric dates such as 4/11 are read.
+type DateOrder int
+
+const (
+	DayFirst   DateOrder = iota // 4/11 is 4 November
+	MonthFirst                  // 4/11 is April 11
+)
+
+// configuredDateOrder reads DATE_ORDER ("dmy", the default, or "mdy").
+func configuredDateOrder() DateOrder {
+	return parseDateOrder(os.Getenv("DATE_ORDER"))
+}
+
+func parseDateOrder(s string) DateOrder {
+	if strings.EqualFold(strings.TrimSpace(s), "mdy") {
+		return MonthFirst
+	}
+	return DayFirst
+}
+
+// DateMatch is a date found in free text. Start and End are byte offsets of
+// the phrase that produced it, so callers can ignore it when looking for times.
+type DateMatch struct {
+	Date       time.Time
+	Start, End int
+}
+
+const monthNames = `january|february|march|april|may|june|july|august|september|october|november|december|jan|feb|mar|apr|jun|jul|aug|sept|sep|oct|nov|dec`
+const weekdayNames = `monday|tuesday|wednesday|thursday|friday|saturday|sunday|mon|tues|tue|wed|thurs|thu|fri|sat|sun`
+
+var (
+	isoDatePhraseRe  = regexp.MustCompile(`\b(\d{4})-(\d{1,2})-(\d{1,2})\b`)
+	numericDateRe    = regexp.MustCompile(`\b(\d{1,2})[/.-](\d{1,2})(?:[/.-](\d{4}|\d{2}))?\b`)
+	dayMonthRe       = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+(?:of\s+)?(` + monthNames + `)\.?(?:\s*,?\s*(\d{4}))?\b`)
+	monthDayRe       = regexp.MustCompile(`(?i)\b(` + monthNames + `)\.?\s+(?:the\s+)?(\d{1,2})(?:st|nd|rd|th)?(?:\s*,?\s*(\d{4}))?\b`)
+	dayAfterRe       = regexp.MustCompile(`(?i)\b(?:the\s+)?day\s+after\s+tomorrow\b`)
+	todayPhraseRe    = regexp.MustCompile(`(?i)\b(today|tonight|this\s+(?:morning|afternoon|evening))\b`)
+	tomorrowPhraseRe = regexp.MustCompile(`(?i)\b(tomorrow|tmrw|tmr)\b`)
+	inDurationRe     = regexp.MustCompile(`(?i)\bin\s+(\d{1,3}|a|an|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve)\s+(days?|weeks?|months?)\b`)
+	relWeekdayRe     = regexp.MustCompile(`(?i)\b(next|this|coming|on)?\s*(` + weekdayNames + `)\b`)
+	nextWeekRe       = regexp.MustCompile(`(?i)\bnext\s+week\b`)
+	endOfMonthRe     = regexp.MustCompile(`(?i)\b(?:the\s+)?end\s+of\s+(the\s+|this\s+|next\s+)?month\b`)
+	theNthRe         = regexp.MustCompile(`(?i)\bthe\s+(\d{1,2})(?:st|nd|rd|th)\b`)
+	clockLeadRe      = regexp.MustCompile(`\b(between|from|after|before|by|until|till|around|about)$`)
+)
+
+var numberWords = map[string]int{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+}
+
+// resolveDate finds the first date expression in text, resolved against now
+// (whose location is used for the result). Supported forms, in priority order:
+//
+//	2026-11-04                        ISO
+//	4/11/2026, 4.11.26                numeric with year, read per order
+//	4 November 2026, Nov 4th, 2026    month name with explicit year
+//	30th October, Oct 30              month name; rolls to next year if passed
+//	11/4                              numeric without year; rolls to next year if passed,
+//	                                  unless the day is named in words ("tomorrow 10.30")
+//	today, tomorrow, day after tomorrow
+//	in 3 days, in two weeks, in a month
+//	this Friday                       this week's Friday, or the next one if it has passed
+//	next Monday                       Monday of next week
+//	Friday, on Friday                 the next Friday after today
+//	next week                         Monday of next week
+//	end of the month, end of next month
+//	the 5th                           this month, or next month if passed
+func resolveDate(text string, now time.Time, order DateOrder) (DateMatch, bool) {
+	loc := now.Location()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	if m := isoDatePhraseRe.FindStringSubmatchIndex(text); m != nil {
+		y, mo, d := atoiAt(text, m, 1), atoiAt(text, m, 2), atoiAt(text, m, 3)
+		if t, ok := makeDate(y, mo, d, loc); ok {
+			return DateMatch{t, m[0], m[1]}, true
+		}
+	}
+
+	if m := numericDateRe.FindStringSubmatchIndex(text); m != nil && !isTimeContext(text, m[0], m[1]) {
+		if m[6] >= 0 {
+			// Full numeric date: dateparse handles 2- and 4-digit years and
+			// the day/month preference; it only understands "/" separators.
+			candidate := strings.NewReplacer(".", "/", "-", "/").Replace(text[m[0]:m[1]])
+			t, err := dateparse.ParseIn(candidate, loc,
+				dateparse.PreferMonthFirst(order == MonthFirst),
+				dateparse.RetryAmbiguousDateWithSwap(true))
+			if err == nil {
+				return DateMatch{time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc), m[0], m[1]}, true
+			}
+		}
+	}
+
+	for _, re := range []*regexp.Regexp{dayMonthRe, monthDayRe} {
+		m := re.FindStringSubmatchIndex(text)
+		if m == nil {
+			continue
+		}
+		var day int
+		var month string
+		if re == dayMonthRe {
+			day, month = atoiAt(text, m, 1), text[m[4]:m[5]]
+		} else {
+			month, day = text[m[2]:m[3]], atoiAt(text, m, 2)
+		}
+		mon := monthNameToNumber(strings.ToLower(month))
+		if m[6] >= 0 {
+			// Explicit year: let dateparse validate the full date.
+			candidate := strconv.Itoa(day) + " " + time.Month(mon).String() + " " + text[m[6]:m[7]]
+			if t, err := dateparse.ParseIn(candidate, loc); err == nil {
+				return DateMatch{time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc), m[0], m[1]}, true
+			}
+			continue
+		}
+		if t, ok := nextOccurrence(today, mon, day); ok {
+			return DateMatch{t, m[0], m[1]}, true
+		}
+	}
+
+	if m := numericDateRe.FindStringSubmatchIndex(text); m != nil && m[6] < 0 && !isTimeContext(text, m[0], m[1]) && !hasRelativeDay(text) {
+		a, b := atoiAt(text, m, 1), atoiAt(text, m, 2)
+		day, mon := a, b
+		if order == MonthFirst {
+			day, mon = b, a
+		}
+		if mon > 12 && day <= 12 && text[m[3]] == '/' {
+			// Only "/" is read the other way round: "10.30" and "9-17"
+			// are clock times, not 30 October or 17 September.
+			day, mon = mon, day
+		}
+		if t, ok := nextOccurrence(today, mon, day); ok {
+			return DateMatch{t, m[0], m[1]}, true
+		}
+	}
+
+	if m := dayAfterRe.FindStringIndex(text); m != nil {
+		return DateMatch{today.AddDate(0, 0, 2), m[0], m[1]}, true
+	}
+	if m := todayPhraseRe.FindStringIndex(text); m != nil {
+		return DateMatch{today, m[0], m[1]}, true
+	}
+	if m := tomorrowPhraseRe.FindStringIndex(text); m != nil {
+		return DateMatch{today.AddDate(0, 0, 1), m[0], m[1]}, true
+	}
+
+	if m := inDurationRe.FindStringSubmatchIndex(text); m != nil {
+		word := strings.ToLower(text[m[2]:m[3]])
+		n, err := strconv.Atoi(word)
+		if err != nil {
+			n = numberWords[word]
+		}
+		unit := strings.ToLower(text[m[4]:m[5]])
+		switch {
+		case strings.HasPrefix(unit, "day"):
+			return DateMatch{today.AddDate(0, 0, n), m[0], m[1]}, true
+		case strings.HasPrefix(unit, "week"):
+			return DateMatch{today.AddDate(0, 0, 7*n), m[0], m[1]}, true
+		default:
+			return DateMatch{addMonthsClamped(today, n), m[0], m[1]}, true
+		}
+	}
+
+	if m := nextWeekRe.FindStringIndex(text); m != nil && !relWeekdayRe.MatchString(text) {
+		return DateMatch{startOfWeek(today).AddDate(0, 0, 7), m[0], m[1]}, true
+	}
+
+	for _, m := range relWeekdayRe.FindAllStringSubmatchIndex(text, -1) {
+		wd, ok := parseWeekday(text[m[4]:m[5]])
+		if !ok || isAmbiguousWeekdayWord(text, m) {
+			continue
+		}
+		modifier := ""
+		if m[2] >= 0 {
+			modifier = strings.ToLower(text[m[2]:m[3]])
+		}
+		if (modifier == "" || modifier == "on") && nextWeekRe.MatchString(text) {
+			// "Tuesday next week", "next week on Tuesday"
+			modifier = "next"
+		}
+		var t time.Time
+		switch modifier {
+		case "next":
+			t = startOfWeek(today).AddDate(0, 0, 7+weekdayOffset(wd))
+		case "this":
+			t = startOfWeek(today).AddDate(0, 0, weekdayOffset(wd))
+			if t.Before(today) {
+				t = t.AddDate(0, 0, 7)
+			}
+		default:
+			days := (int(wd) - int(today.Weekday()) + 7) % 7
+			if days == 0 {
+				days = 7
+			}
+			t = today.AddDate(0, 0, days)
+		}
+		return DateMatch{t, m[0], m[1]}, true
+	}
+
+	if m := endOfMonthRe.FindStringSubmatchIndex(text); m != nil {
+		base := today
+		if m[2] >= 0 && strings.TrimSpace(strings.ToLower(text[m[2]:m[3]])) == "next" {
+			base = addMonthsClamped(time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, loc), 1)
+		}
+		last := time.Date(base.Year(), base.Month()+1, 0, 0, 0, 0, 0, loc)
+		return DateMatch{last, m[0], m[1]}, true
+	}
+
+	if m := theNthRe.FindStringSubmatchIndex(text); m != nil {
+		day := atoiAt(text, m, 1)
+		for i := 0; i < 3; i++ {
+			first := time.Date(today.Year(), today.Month()+time.Month(i), 1, 0, 0, 0, 0, loc)
+			if t, ok := makeDate(first.Year(), int(first.Month()), day, loc); ok && !t.Before(today) {
+				return DateMatch{t, m[0], m[1]}, true
+			}
+		}
+	}
+
+	return DateMatch{}, false
+}
+
+func atoiAt(text string, m []int, group int) int {
+	n, _ := strconv.Atoi(text[m[2*group]:m[2*group+1]])
+	return n
+}
+
+// makeDate builds a date and rejects overflow such as 31 November.
+func makeDate(y, mon, d int, loc *time.Location) (time.Time, bool) {
+	if mon < 1 || mon > 12 || d < 1 || d > 31 {
+		return time.Time{}, false
+	}
+	t := time.Date(y, time.Month(mon), d, 0, 0, 0, 0, loc)
+	if t.Day() != d {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// nextOccurrence returns the first mon/day on or after today. Looking a few
+// years ahead lets 29 February resolve to the next leap year.
+func nextOccurrence(today time.Time, mon, day int) (time.Time, bool) {
+	for y := today.Year(); y <= today.Year()+4; y++ {
+		if t, ok := makeDate(y, mon, day, today.Location()); ok && !t.Before(today) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// addMonthsClamped adds n months, clamping to the last day of the target month.
+func addMonthsClamped(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, 0, 0, 0, 0, t.Location())
+	last := time.Date(first.Year(), first.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	day := t.Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// startOfWeek returns the Monday of t's week.
+func startOfWeek(t time.Time) time.Time {
+	return t.AddDate(0, 0, -weekdayOffset(t.Weekday()))
+}
+
+// weekdayOffset is the number of days after Monday.
+func weekdayOffset(wd time.Weekday) int {
+	return (int(wd) + 6) % 7
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	switch strings.ToLower(s)[:3] {
+	case "mon":
+		return time.Monday, true
+	case "tue":
+		return time.Tuesday, true
+	case "wed":
+		return time.Wednesday, true
+	case "thu":
+		return time.Thursday, true
+	case "fri":
+		return time.Friday, true
+	case "sat":
+		return time.Saturday, true
+	case "sun":
+		return time.Sunday, true
+	}
+	return 0, false
+}
+
+// isAmbiguousWeekdayWord skips short forms that are usually ordinary words
+// ("sat down", "wed") unless a modifier like "next" makes the intent clear.
+func isAmbiguousWeekdayWord(text string, m []int) bool {
+	word := strings.ToLower(text[m[4]:m[5]])
+	return (word == "sat" || word == "sun" || word == "wed") && m[2] < 0
+}
+
+// isTimeContext reports whether a numeric match is not a date at all: a time
+// such as "10.30am", "at 10.30" or "between 2-4" ("from 4/11" is still a
+// date), or a fragment of a longer number like the "13-01" in "2025-13-01".
+func isTimeContext(text string, start, end int) bool {
+	rest := strings.ToLower(strings.TrimSpace(text[end:]))
+	before := strings.ToLower(strings.TrimSpace(text[:start]))
+	if start > 0 && strings.ContainsRune("-/.:", rune(text[start-1])) {
+		return true
+	}
+	return strings.HasPrefix(rest, "am") || strings.HasPrefix(rest, "pm") ||
+		strings.HasSuffix(before, " at") || before == "at" ||
+		(clockLeadRe.MatchString(before) && !strings.Contains(text[start:end], "/")) ||
+		(end < len(text) && strings.ContainsRune("-/:", rune(text[end])))
+}
+
+// hasRelativeDay reports whether text names its day in words ("tomorrow",
+// "next Monday"), which beats a yearless numeric match: in "next monday
+// 10.30" the numbers are a time, not 30 October.
+func hasRelativeDay(text string) bool {
+	if dayAfterRe.MatchString(text) || todayPhraseRe.MatchString(text) || tomorrowPhraseRe.MatchString(text) {
+		return true
+	}
+	for _, m := range relWeekdayRe.FindAllStringSubmatchIndex(text, -1) {
+		if _, ok := parseWeekday(text[m[4]:m[5]]); ok && m[2] >= 0 {
+			if mod := strings.ToLower(text[m[2]:m[3]]); mod == "next" || mod == "this" {
+				return true
+			}
+		}
+	}
+	return false
+}
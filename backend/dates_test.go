@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateCorpus(t *testing.T) {
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2025, 10, 20, 9, 0, 0, 0, time.UTC) }
+
+	cases := 0
+	err := eachCorpusCase("testdata/dates.jsonl", func(line int, raw []byte) error {
+		cases++
+		failure, err := checkDateCase(raw)
+		if err != nil {
+			t.Errorf("dates.jsonl:%d: %v", line, err)
+		} else if failure != "" {
+			t.Errorf("dates.jsonl:%d: %s", line, failure)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cases == 0 {
+		t.Fatal("dates.jsonl has no cases")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// goldenConversation is one line of the golden transcript corpus.
+type goldenConversation struct {
+	ID     string       `json:"id"`
+	Now    string       `json:"now"`
+	Turns  []goldenTurn `json:"turns"`
+	Expect goldenExpect `json:"expect"`
+}
+
+// goldenTurn is a user message plus the LLM completions to replay for it, in
+// call order. When the list runs out the fake LLM answers with a canned reply.
+// Reply, when set, is what the patient must be shown for the turn.
+type goldenTurn struct {
+	User  string   `json:"user"`
+	LLM   []string `json:"llm,omitempty"`
+	Reply string   `json:"reply,omitempty"`
+}
+
+type goldenExpect struct {
+	Doctor      string `json:"doctor"`
+	Date        string `json:"date"`
+	Time        string `json:"time"`
+	PatientName string `json:"patient_name"`
+	Reason      string `json:"reason"`
+	Booked      bool   `json:"booked"`
+}
+
+var evalFields = []string{"doctor", "date", "time", "patient_name", "reason"}
+
+func (e goldenExpect) field(name string) string {
+	switch name {
+	case "doctor":
+		return e.Doctor
+	case "date":
+		return e.Date
+	case "time":
+		return e.Time
+	case "patient_name":
+		return e.PatientName
+	case "reason":
+		return e.Reason
+	}
+	return ""
+}
+
+func appointmentField(a Appointment, name string) string {
+	return goldenExpect{Doctor: a.Doctor, Date: a.Date, Time: a.Time, PatientName: a.PatientName, Reason: a.Reason}.field(name)
+}
+
+// scriptedLLM serves recorded completions and never touches the network.
+type scriptedLLM struct {
+	queue []string
+}
+
+const scriptedFallbackReply = "Could you share a few more details?"
+
+func (s *scriptedLLM) Complete(model string, messages []ChatMessage) (string, error) {
+	if len(s.queue) == 0 {
+		return scriptedFallbackReply, nil
+	}
+	next := s.queue[0]
+	s.queue = s.queue[1:]
+	return next, nil
+}
+
+type fieldScore struct {
+	tp, fp, fn int
+}
+
+func (f fieldScore) precision() float64 {
+	if f.tp+f.fp == 0 {
+		return 1
+	}
+	return float64(f.tp) / float64(f.tp+f.fp)
+}
+
+func (f fieldScore) recall() float64 {
+	if f.tp+f.fn == 0 {
+		return 1
+	}
+	return float64(f.tp) / float64(f.tp+f.fn)
+}
+
+// runEval replays golden conversations through the dialogue engine and prints
+// per-field precision/recall and the booking success rate.
+func runEval(args []string) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	corpus := flags.String("corpus", "testdata/golden_conversations.jsonl", "golden conversations (JSONL)")
+	cassette := flags.String("cassette", "", "serve LLM traffic from a recorded cassette instead of the per-turn llm lists")
+	verbose := flags.Bool("v", false, "show server logs while replaying")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	convs, err := loadGoldenConversations(*corpus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return 1
+	}
+
+	initDatabase("file:eval?mode=memory&cache=shared")
+	var fake *scriptedLLM
+	if *cassette != "" {
+		player, _, err := withCassette(nil, "replay", *cassette, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+			return 1
+		}
+		llmClient = player
+	} else {
+		fake = &scriptedLLM{}
+		llmClient = fake
+	}
+
+	failed, err := evaluate(os.Stdout, convs, fake)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func loadGoldenConversations(path string) ([]goldenConversation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []goldenConversation
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var gc goldenConversation
+		if err := json.Unmarshal([]byte(text), &gc); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if gc.ID == "" {
+			gc.ID = fmt.Sprintf("line-%d", line)
+		}
+		out = append(out, gc)
+	}
+	return out, scanner.Err()
+}
+
+// evaluate writes a stable, line-oriented report so runs can be diffed, and
+// returns how many conversations didn't go as expected. When fake is nil the
+// current llmClient answers every turn.
+func evaluate(w io.Writer, convs []goldenConversation, fake *scriptedLLM) (int, error) {
+	scores := map[string]*fieldScore{}
+	for _, f := range evalFields {
+		scores[f] = &fieldScore{}
+	}
+	wantBooked, gotBooked, failed := 0, 0, 0
+
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+
+	for _, gc := range convs {
+		if gc.Now != "" {
+			fixed, err := time.ParseInLocation("2006-01-02T15:04", gc.Now, clinicTZ())
+			if err != nil {
+				return 0, fmt.Errorf("%s: invalid now %q (want YYYY-MM-DDTHH:MM)", gc.ID, gc.Now)
+			}
+			nowFunc = func() time.Time { return fixed }
+		} else {
+			nowFunc = time.Now
+		}
+
+		// Each conversation starts from an empty schedule and a fresh session.
+		if err := forTenant(defaultTenantID).Where("1 = 1").Delete(&Appointment{}).Error; err != nil {
+			return 0, err
+		}
+		sessionID := "eval-" + gc.ID
+		setConversation(sessionID, ConversationState{})
+		var booked *Appointment
+		var diffs []string
+		for i, turn := range gc.Turns {
+			if fake != nil {
+				fake.queue = append([]string(nil), turn.LLM...)
+			}
+			resp, err := processChatMessage(forTenant(defaultTenantID), sessionID, turn.User)
+			if err != nil {
+				return 0, fmt.Errorf("%s turn %d: %w", gc.ID, i+1, err)
+			}
+			if shown := choose(resp.Reply, resp.Message); turn.Reply != "" && shown != turn.Reply {
+				diffs = append(diffs, fmt.Sprintf("  %-12s want %q got %q", fmt.Sprintf("reply %d", i+1), turn.Reply, shown))
+			}
+			if resp.Appointment != nil {
+				booked = resp.Appointment
+				break
+			}
+		}
+
+		got := getConversation(sessionID).Draft
+		if booked != nil {
+			got = *booked
+		}
+
+		for _, f := range evalFields {
+			want := normalizeEvalValue(gc.Expect.field(f))
+			have := normalizeEvalValue(appointmentField(got, f))
+			s := scores[f]
+			switch {
+			case have != "" && have == want:
+				s.tp++
+			case have != "" && want == "":
+				s.fp++
+			case have == "" && want != "":
+				s.fn++
+			case have != want:
+				s.fp++
+				s.fn++
+			}
+			if have != want {
+				diffs = append(diffs, fmt.Sprintf("  %-12s want %q got %q", f, want, have))
+			}
+		}
+		if gc.Expect.Booked {
+			wantBooked++
+			if booked != nil {
+				gotBooked++
+			}
+		}
+		if gc.Expect.Booked != (booked != nil) {
+			diffs = append(diffs, fmt.Sprintf("  %-12s want %v got %v", "booked", gc.Expect.Booked, booked != nil))
+		}
+
+		status := "ok"
+		if len(diffs) > 0 {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%-4s %s\n", status, gc.ID)
+		for _, d := range diffs {
+			fmt.Fprintln(w, d)
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%-12s %4s %4s %4s %9s %7s\n", "field", "tp", "fp", "fn", "precision", "recall")
+	for _, f := range evalFields {
+		s := scores[f]
+		fmt.Fprintf(w, "%-12s %4d %4d %4d %9.3f %7.3f\n", f, s.tp, s.fp, s.fn, s.precision(), s.recall())
+	}
+	rate := 1.0
+	if wantBooked > 0 {
+		rate = float64(gotBooked) / float64(wantBooked)
+	}
+	fmt.Fprintf(w, "\nbooking success: %d/%d (%.3f)\n", gotBooked, wantBooked, rate)
+	return failed, nil
+}
+
+func normalizeEvalValue(v string) string {
+	return strings.ToLower(strings.Join(strings.Fields(v), " "))
+}
+
+// dateCase is one line of the date resolution corpus.
+type dateCase struct {
+	Text  string `json:"text"`
+	Now   string `json:"now"`
+	Order string `json:"order"`
+	TZ    string `json:"tz"`
+	Want  string `json:"want"`
+}
+
+// runDateEval checks resolveDate against a corpus pinned to a fixed clock and
+// exits non-zero on any mismatch.
+func runDateEval(args []string) int {
+	flags := flag.NewFlagSet("eval-dates", flag.ContinueOnError)
+	corpus := flags.String("corpus", "testdata/dates.jsonl", "date cases (JSONL)")
+	defaultNow := flags.String("now", "2025-10-20T09:00", "clock for cases without \"now\" (YYYY-MM-DDTHH:MM)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	now, err := time.ParseInLocation("2006-01-02T15:04", *defaultNow, time.UTC)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval-dates: invalid -now %q\n", *defaultNow)
+		return 2
+	}
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return now }
+	return runParserCorpus("eval-dates", "dates", *corpus, checkDateCase)
+}
+
+// checkDateCase checks one line of the date corpus. The clock is the case's
+// "now", or nowFunc for cases without one. It returns a description of the
+// mismatch, or "" when resolveDate gets it right.
+func checkDateCase(raw []byte) (string, error) {
+	var dc dateCase
+	if err := json.Unmarshal(raw, &dc); err != nil {
+		return "", err
+	}
+	now := nowFunc().UTC()
+	if dc.Now != "" {
+		var err error
+		if now, err = time.ParseInLocation("2006-01-02T15:04", dc.Now, time.UTC); err != nil {
+			return "", fmt.Errorf("invalid now %q", dc.Now)
+		}
+	}
+	if dc.TZ != "" {
+		loc, err := time.LoadLocation(dc.TZ)
+		if err != nil {
+			return "", err
+		}
+		now = now.In(loc)
+	}
+	got := ""
+	if dm, ok := resolveDate(dc.Text, now, parseDateOrder(dc.Order)); ok {
+		got = dm.Date.Format("2006-01-02")
+	}
+	if got == dc.Want {
+		return "", nil
+	}
+	return fmt.Sprintf("%q (now %s, order %s): want %q got %q", dc.Text, now.Format("2006-01-02T15:04"), orDefault(dc.Order, "dmy"), dc.Want, got), nil
+}
+
+// timeCase is one line of the time expression corpus. Want is "HH:MM" for an
+// exact time, "HH:MM-HH:MM" for a window, or empty when no time is expected.
+type timeCase struct {
+	Text string `json:"text"`
+	Want string `json:"want"`
+}
+
+// runTimeEval checks time extraction against a corpus using fixed clinic hours
+// (08:00-18:00 unless -open/-close say otherwise). Date phrases are ignored
+// the same way as in chat, resolved against 2025-10-20.
+func runTimeEval(args []string) int {
+	flags := flag.NewFlagSet("eval-times", flag.ContinueOnError)
+	corpus := flags.String("corpus", "testdata/times.jsonl", "time cases (JSONL)")
+	open := flags.String("open", "08:00", "clinic opening time")
+	close := flags.String("close", "18:00", "clinic closing time")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2025, 10, 20, 9, 0, 0, 0, time.UTC) }
+	return runParserCorpus("eval-times", "times", *corpus, func(raw []byte) (string, error) {
+		return checkTimeCase(raw, *open, *close)
+	})
+}
+
+// checkTimeCase checks one line of the time corpus against clinic hours
+// open-close, with date phrases resolved against nowFunc.
+func checkTimeCase(raw []byte, open, close string) (string, error) {
+	var tc timeCase
+	if err := json.Unmarshal(raw, &tc); err != nil {
+		return "", err
+	}
+	got := ""
+	if te, ok := resolveTime(withoutDate(tc.Text, nowFunc(), DayFirst), open, close); ok {
+		got = te.Exact
+		if te.IsWindow() {
+			got = te.Window.From + "-" + te.Window.To
+		}
+	}
+	if got == tc.Want {
+		return "", nil
+	}
+	return fmt.Sprintf("%q: want %q got %q", tc.Text, tc.Want, got), nil
+}
+
+// runParserCorpus runs check on every case in a JSONL corpus, prints failures
+// and a summary, and returns the exit code. check returns a description of
+// the mismatch, or "" on success.
+func runParserCorpus(cmd, noun, path string, check func(raw []byte) (string, error)) int {
+	passed, failed := 0, 0
+	err := eachCorpusCase(path, func(line int, raw []byte) error {
+		failure, err := check(raw)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if failure == "" {
+			passed++
+			return nil
+		}
+		failed++
+		fmt.Printf("FAIL %s:%d %s\n", path, line, failure)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		return 1
+	}
+	fmt.Printf("%s: %d passed, %d failed\n", noun, passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// eachCorpusCase calls fn with every case in a JSONL corpus and its line
+// number. Blank lines and "#" comments are skipped.
+func eachCorpusCase(path string, fn func(line int, raw []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := fn(line, []byte(text)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func orDefault(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
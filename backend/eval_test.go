@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGoldenConversations replays the golden corpus with each turn's
+// scripted completions, recording the LLM traffic, and then again with
+// only that recording served by the cassette player, both wired up the
+// way LLM_CASSETTE_MODE does.
+func TestGoldenConversations(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig LLMClient) { llmClient = orig }(llmClient)
+
+	convs, err := loadGoldenConversations("testdata/golden_conversations.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initDatabase("file:golden?mode=memory&cache=shared")
+	path := filepath.Join(t.TempDir(), "golden_cassette.jsonl")
+
+	t.Run("scripted", func(t *testing.T) {
+		fake := &scriptedLLM{}
+		client, _, err := withCassette(fake, "record", path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func(rec *cassetteRecorder) {
+			rec.f.Close()
+			activeRecorder = nil
+		}(activeRecorder)
+		llmClient = client
+		runGolden(t, convs, fake)
+	})
+	t.Run("cassette", func(t *testing.T) {
+		client, _, err := withCassette(nil, "replay", path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		llmClient = client
+		runGolden(t, convs, nil)
+	})
+}
+
+func runGolden(t *testing.T, convs []goldenConversation, fake *scriptedLLM) {
+	t.Helper()
+	var report bytes.Buffer
+	failed, err := evaluate(&report, convs, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed > 0 {
+		t.Errorf("%d of %d golden conversations failed:\n%s", failed, len(convs), report.String())
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// exportColumn is one column an export may carry. Number columns are
+// written as numbers in xlsx so spreadsheets can sum and sort them.
+type exportColumn struct {
+	Header string
+	Number bool
+	Value  func(ap Appointment) string
+}
+
+func optionalID(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*id), 10)
+}
+
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportColumns are the columns ?columns= may name.
+var exportColumns = map[string]exportColumn{
+	"id":                  {"ID", true, func(ap Appointment) string { return strconv.FormatUint(uint64(ap.ID), 10) }},
+	"patient_name":        {"Patient", false, func(ap Appointment) string { return ap.PatientName }},
+	"patient_id":          {"Patient ID", true, func(ap Appointment) string { return optionalID(ap.PatientID) }},
+	"doctor":              {"Doctor", false, func(ap Appointment) string { return ap.Doctor }},
+	"date":                {"Date", false, func(ap Appointment) string { return ap.Date }},
+	"time":                {"Time", false, func(ap Appointment) string { return ap.Time }},
+	"time_zone":           {"Time zone", false, func(ap Appointment) string { return ap.TimeZone }},
+	"duration_minutes":    {"Minutes", true, func(ap Appointment) string { return strconv.Itoa(ap.DurationMinutes) }},
+	"reason":              {"Reason", false, func(ap Appointment) string { return ap.Reason }},
+	"notes":               {"Notes", false, func(ap Appointment) string { return ap.Notes }},
+	"status":              {"Status", false, func(ap Appointment) string { return ap.Status }},
+	"starts_at":           {"Starts at (UTC)", false, func(ap Appointment) string { return exportTime(ap.StartsAt) }},
+	"ends_at":             {"Ends at (UTC)", false, func(ap Appointment) string { return exportTime(ap.EndsAt) }},
+	"appointment_type_id": {"Type ID", true, func(ap Appointment) string { return optionalID(ap.AppointmentTypeID) }},
+	"location_id":         {"Location ID", true, func(ap Appointment) string { return optionalID(ap.LocationID) }},
+	"series_id":           {"Series ID", true, func(ap Appointment) string { return optionalID(ap.SeriesID) }},
+	"closure_id":          {"Closure ID", true, func(ap Appointment) string { return optionalID(ap.ClosureID) }},
+	"created_at":          {"Created at (UTC)", false, func(ap Appointment) string { return exportTime(ap.CreatedAt) }},
+	"updated_at":          {"Updated at (UTC)", false, func(ap Appointment) string { return exportTime(ap.UpdatedAt) }},
+}
+
+// defaultExportColumns is what the front desk prints when no columns are
+// asked for.
+var defaultExportColumns = []string{"id", "patient_name", "doctor", "date", "time", "duration_minutes", "reason", "status"}
+
+// parseExportColumns reads ?columns= (comma-separated, in the order wanted).
+func parseExportColumns(raw string) ([]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return defaultExportColumns, nil
+	}
+	var cols []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if _, ok := exportColumns[name]; !ok {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unknown column %q", name))
+		}
+		seen[name] = true
+		cols = append(cols, name)
+	}
+	if len(cols) == 0 {
+		return defaultExportColumns, nil
+	}
+	return cols, nil
+}
+
+// exportAppointments handles GET /admin/appointments/export?format=csv|xlsx.
+// It takes the filters and sort of the list (without paging) and streams
+// the file as the rows are read, so an export of any size holds one batch
+// in memory at a time.
+func exportAppointments(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	format := strings.ToLower(choose(c.Query("format"), "csv"))
+	if format != "csv" && format != "xlsx" {
+		return fiber.NewError(fiber.StatusBadRequest, "format must be csv or xlsx")
+	}
+	f, err := parseAppointmentFilter(c, db)
+	if err != nil {
+		return err
+	}
+	order, err := parseAppointmentSort(c)
+	if err != nil {
+		return err
+	}
+	cols, err := parseExportColumns(c.Query("columns"))
+	if err != nil {
+		return err
+	}
+	src := &exportSource{db: db, filter: f, order: order}
+	// The first batch is read now so a failing query still gets a proper error
+	if err := src.fill(); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to export appointments")
+	}
+	name := "appointments-" + clinicNow().Format("2006-01-02") + "." + format
+	if format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+name+`"`)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		write := writeCSVExport
+		if format == "xlsx" {
+			write = writeXLSXExport
+		}
+		if err := write(w, src, cols); err != nil {
+			// The status line has gone out; all that is left is to cut the file short
+			log.Printf("[export] %s export stopped: %v", format, err)
+		}
+	})
+	return nil
+}
+
+// exportBatchSize is how many rows an export reads per query.
+const exportBatchSize = 1000
+
+// exportSource reads the rows of an export in batches, each query resuming
+// after the last row of the one before, as the list's cursor does. No read
+// stays open while the client downloads, so a slow download never holds up
+// bookings.
+type exportSource struct {
+	db     *gorm.DB
+	filter appointmentFilter
+	order  appointmentSort
+	batch  []Appointment
+	cursor string
+	done   bool
+}
+
+// fill reads the next batch.
+func (s *exportSource) fill() error {
+	q := s.order.apply(s.filter.apply(s.db))
+	if s.cursor != "" {
+		var err error
+		if q, err = s.order.seek(q, s.cursor); err != nil {
+			return err
+		}
+	}
+	s.batch = s.batch[:0]
+	if err := q.Limit(exportBatchSize).Find(&s.batch).Error; err != nil {
+		return err
+	}
+	if len(s.batch) < exportBatchSize {
+		s.done = true
+	} else {
+		s.cursor = s.order.cursorAfter(s.batch[len(s.batch)-1])
+	}
+	return nil
+}
+
+// each hands every row to fn, in order, one batch in memory at a time.
+func (s *exportSource) each(fn func(ap Appointment) error) error {
+	for {
+		for _, ap := range s.batch {
+			if err := fn(ap); err != nil {
+				return err
+			}
+		}
+		if s.done {
+			return nil
+		}
+		if err := s.fill(); err != nil {
+			return err
+		}
+	}
+}
+
+// spreadsheetSafe stops a spreadsheet from running text that looks like a
+// formula (a patient called "=HYPERLINK(...)").
+func spreadsheetSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func writeCSVExport(w *bufio.Writer, src *exportSource, cols []string) error {
+	out := csv.NewWriter(w)
+	record := make([]string, len(cols))
+	for i, name := range cols {
+		record[i] = exportColumns[name].Header
+	}
+	if err := out.Write(record); err != nil {
+		return err
+	}
+	n := 0
+	err := src.each(func(ap Appointment) error {
+		for i, name := range cols {
+			col := exportColumns[name]
+			record[i] = col.Value(ap)
+			if !col.Number {
+				record[i] = spreadsheetSafe(record[i])
+			}
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+		// Hand finished chunks to the client as we go
+		if n++; n%500 == 0 {
+			out.Flush()
+			if err := out.Error(); err != nil {
+				return err
+			}
+			return w.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// The fixed parts of a one-sheet workbook. Cells hold inline strings, so
+// there is no shared string table to build up in memory.
+var xlsxParts = []struct{ Name, Body string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Appointments" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	// Style 1 is the bold header row
+	{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border/></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+// xlsxColumn names the n-th column (from 0) the way spreadsheets do: A, B,
+// ..., Z, AA, ...
+func xlsxColumn(n int) string {
+	name := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		name = string(rune('A'+(n-1)%26)) + name
+	}
+	return name
+}
+
+// writeXLSXCell writes one cell; empty cells are left out.
+func writeXLSXCell(w io.Writer, ref, value string, number bool, style int) error {
+	if value == "" {
+		return nil
+	}
+	s := ""
+	if style > 0 {
+		s = fmt.Sprintf(` s="%d"`, style)
+	}
+	if number {
+		_, err := fmt.Fprintf(w, `<c r="%s"%s><v>%s</v></c>`, ref, s, value)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">`, ref, s); err != nil {
+		return err
+	}
+	if err := xml.EscapeText(w, []byte(value)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, `</t></is></c>`)
+	return err
+}
+
+// writeXLSXExport writes a workbook with one sheet. The zip is written as
+// a stream, each entry compressed on the way out.
+func writeXLSXExport(w *bufio.Writer, src *exportSource, cols []string) error {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		pw, err := zw.Create(part.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(pw, part.Body); err != nil {
+			return err
+		}
+	}
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	sw := bufio.NewWriter(sheet)
+	letters := make([]string, len(cols))
+	for i := range cols {
+		letters[i] = xlsxColumn(i)
+	}
+	io.WriteString(sw, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" state="frozen"/></sheetView></sheetViews>`+
+		`<sheetData><row r="1">`)
+	for i, name := range cols {
+		if err := writeXLSXCell(sw, letters[i]+"1", exportColumns[name].Header, false, 1); err != nil {
+			return err
+		}
+	}
+	io.WriteString(sw, `</row>`)
+	n := 1
+	err = src.each(func(ap Appointment) error {
+		n++
+		fmt.Fprintf(sw, `<row r="%d">`, n)
+		for i, name := range cols {
+			col := exportColumns[name]
+			if err := writeXLSXCell(sw, letters[i]+strconv.Itoa(n), col.Value(ap), col.Number, 0); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(sw, `</row>`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(sw, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParseExportColumns(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want []string
+		err  bool
+	}{
+		{"", defaultExportColumns, false},
+		{" , ", defaultExportColumns, false},
+		{"Doctor, id,doctor", []string{"doctor", "id"}, false},
+		{"id,age", nil, true},
+	} {
+		got, err := parseExportColumns(tc.raw)
+		if (err != nil) != tc.err || !equalStrings(got, tc.want) {
+			t.Errorf("%q: got %q, %v; want %q (error %v)", tc.raw, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	for n, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(n); got != want {
+			t.Errorf("xlsxColumn(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+// xlsxSheet is as much of a worksheet as the tests read back.
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Type   string `xml:"t,attr"`
+			Style  string `xml:"s,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX returns the cells of the first sheet of a workbook by reference
+// ("B2"), with numbers marked "#" and bold cells "*" in front.
+func readXLSX(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := map[string]*zip.File{}
+	for _, f := range zr.File {
+		parts[f.Name] = f
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/styles.xml"} {
+		if parts[name] == nil {
+			t.Errorf("workbook has no %s", name)
+		}
+	}
+	f := parts["xl/worksheets/sheet1.xml"]
+	if f == nil {
+		t.Fatal("workbook has no sheet")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var sheet xlsxSheet
+	if err := xml.NewDecoder(rc).Decode(&sheet); err != nil {
+		t.Fatal(err)
+	}
+	cells := map[string]string{}
+	for _, row := range sheet.Rows {
+		for _, c := range row.Cells {
+			v := c.Inline
+			if c.Type != "inlineStr" {
+				v = "#" + c.Value
+			}
+			if c.Style == "1" {
+				v = "*" + v
+			}
+			cells[c.Ref] = v
+		}
+	}
+	return cells
+}
+
+func TestExportAppointments(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:export?mode=memory&cache=shared")
+	// A tenant of its own keeps the sample data out of the file
+	tenant := Tenant{Slug: "export", Name: "Export Clinic", WidgetKey: "export-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+	for _, ap := range []Appointment{
+		{PatientName: `=HYPERLINK("http://x")`, Doctor: "Dr. Lee", Date: "2030-01-07", Time: "09:00", Reason: "rash & <itch>"},
+		{PatientName: "Amani Ochieng", Doctor: "Dr. Kim", Date: "2030-01-07", Time: "10:00", Reason: "checkup"},
+		{PatientName: "Baraka Mwangi", Doctor: "Dr. Lee", Date: "2030-01-08", Time: "09:00", Reason: "follow-up", DurationMinutes: 45},
+	} {
+		ap := ap
+		ap.TimeZone, ap.Status = "UTC", StatusConfirmed
+		mustCreate(t, createWithStatus(tdb, &ap, PatientContact{}, "test", ""))
+	}
+
+	token, err := createJWTToken(1, tenant.ID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Get("/admin/appointments/export", jwtMiddleware, exportAppointments)
+	export := func(query url.Values) []byte {
+		t.Helper()
+		status, body := call(t, app, "GET", "/admin/appointments/export?"+query.Encode(), token, "")
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: %d %s", query.Encode(), status, body)
+		}
+		return body
+	}
+	query := url.Values{"doctor": {"Dr. Lee"}, "sort": {"patient_name"}, "columns": {"patient_name,duration_minutes,reason,location_id"}}
+
+	// CSV text that a spreadsheet would run as a formula is quoted
+	records, err := csv.NewReader(bytes.NewReader(export(query))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Patient", "Minutes", "Reason", "Location ID"},
+		{`'=HYPERLINK("http://x")`, "30", "rash & <itch>", ""},
+		{"Baraka Mwangi", "45", "follow-up", ""},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(want) {
+		t.Errorf("csv = %q, want %q", records, want)
+	}
+
+	// xlsx holds inline strings, which a spreadsheet never runs, and numbers
+	query.Set("format", "xlsx")
+	cells := readXLSX(t, export(query))
+	wantCells := map[string]string{
+		"A1": "*Patient", "B1": "*Minutes", "C1": "*Reason", "D1": "*Location ID",
+		"A2": `=HYPERLINK("http://x")`, "B2": "#30", "C2": "rash & <itch>",
+		"A3": "Baraka Mwangi", "B3": "#45", "C3": "follow-up",
+	}
+	if fmt.Sprint(cells) != fmt.Sprint(wantCells) {
+		t.Errorf("xlsx cells = %q, want %q", cells, wantCells)
+	}
+
+	for _, bad := range []string{"format=pdf", "columns=id,age", "sort=age", "status=archived"} {
+		if status, body := call(t, app, "GET", "/admin/appointments/export?"+bad, token, ""); status != fiber.StatusBadRequest {
+			t.Errorf("%s: %d %s, want 400", bad, status, body)
+		}
+	}
+}
+
+// TestExportBatches exports more rows than one batch holds and checks that
+// every row comes out once, in order.
+func TestExportBatches(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:export-batches?mode=memory&cache=shared")
+	tenant := Tenant{Slug: "batches", Name: "Batch Clinic", WidgetKey: "batches-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+	rows := make([]Appointment, exportBatchSize+1)
+	for i := range rows {
+		rows[i] = Appointment{PatientName: fmt.Sprintf("Patient %d", i), Doctor: "Dr. Lee", Date: "2030-01-07",
+			Time: "09:00", TimeZone: "UTC", Reason: "checkup", Status: StatusConfirmed}
+	}
+	mustCreate(t, tdb.CreateInBatches(&rows, 200).Error)
+
+	token, err := createJWTToken(1, tenant.ID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Get("/admin/appointments/export", jwtMiddleware, exportAppointments)
+	status, body := call(t, app, "GET", "/admin/appointments/export?columns=id&sort=id&order=desc", token, "")
+	if status != fiber.StatusOK {
+		t.Fatalf("%d %s", status, body)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != len(rows)+1 {
+		t.Fatalf("exported %d rows, want %d", len(lines)-1, len(rows))
+	}
+	for i, line := range lines[1:] {
+		if id, _ := strconv.Atoi(strings.TrimSpace(line)); uint(id) != rows[len(rows)-1-i].ID {
+			t.Fatalf("row %d is appointment %s, want %d", i+1, line, rows[len(rows)-1-i].ID)
+		}
+	}
+}
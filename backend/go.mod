@@ -3,10 +3,11 @@ module github.com/example/doctor-appointment-chatbot/backend
 go 1.18
 
 require (
-	github.com/araddon/dateparse v0.0.0-20240209095650-3a10207752f6
+	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
 	github.com/gofiber/fiber/v2 v2.52.2
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	golang.org/x/crypto v0.29.0
+	golang.org/x/text v0.20.0
 	gorm.io/driver/sqlite v1.5.7
 	gorm.io/gorm v1.25.11
 )
@@ -26,5 +27,4 @@ require (
 	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/sys v0.27.0 // indirect
-	golang.org/x/text v0.20.0 // indirect
 )
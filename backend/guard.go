@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Input guard: patterns that try to override the system prompt or smuggle a
+// booking decision into the conversation.
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override|bypass)\b.{0,30}\b(previous|prior|above|earlier|all|your|the|these|system)\b.{0,20}\b(rules?|instructions?|prompts?|directions?|guidelines?)`),
+	regexp.MustCompile(`(?i)\b(system|developer|hidden)\s+(prompt|message|instructions?)\b`),
+	regexp.MustCompile(`(?i)\b(you are now|from now on you|act as an?|pretend (to be|you are)|roleplay as)\b`),
+	regexp.MustCompile(`(?i)\breturn\b.{0,20}\b(json|intent)\b`),
+	regexp.MustCompile(`(?i)["']?\bintent["']?\s*[:=]`),
+	regexp.MustCompile(`(?i)(^|\n)\s*(system|assistant)\s*:`),
+	regexp.MustCompile(`(?i)<\|?(system|im_start|im_end)\|?>`),
+	regexp.MustCompile(`(?i)\b(jailbreak|dan mode)\b`),
+}
+
+// offTopicRe matches requests that are clearly not about appointments.
+var offTopicRe = regexp.MustCompile(`(?i)\b(write (me )?(a|an|some) (poem|essay|story|song|code|program|script)|translate|capital of|recipe|weather|stock price|bitcoin|crypto|tell me a joke|homework|python|javascript)\b`)
+
+// bookingCueRe matches words that suggest the message belongs to a booking
+// conversation (including greetings and short acknowledgements).
+var bookingCueRe = regexp.MustCompile(`(?i)\b(appointments?|appoint|book\w*|schedul\w*|reschedul\w*|cancel\w*|doctors?|dr|visit|see|clinic|available|availability|slots?|time|date|today|tomorrow|morning|afternoon|evening|noon|week|month|mon(day)?|tue(s|sday)?|wed(nesday)?|thu(rs|rsday)?|fri(day)?|sat(urday)?|sun(day)?|jan(uary)?|feb(ruary)?|mar(ch)?|apr(il)?|may|june?|july?|aug(ust)?|sep(t|tember)?|oct(ober)?|nov(ember)?|dec(ember)?|name|reason|check-?up|consult\w*|exam\w*|pain|ache|\w+aches?|injury|surgery|treatment|therapy|routine|annual|physical|screening|dentist|dental|follow-?up|sick|ill|hurt|yes|no|ok|okay|sure|thanks?|thank you|hi|hello|hey|good (morning|afternoon|evening))\b|\d`)
+
+const (
+	injectionRefusal = "I can only help with booking doctor appointments. Which doctor, date and time would you like?"
+	offTopicRefusal  = "Sorry, I can only help with booking doctor appointments. Would you like to book one?"
+)
+
+func detectPromptInjection(message string) bool {
+	for _, re := range injectionPatterns {
+		if re.MatchString(message) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOffTopic reports whether message is unrelated to booking. Anything is
+// accepted while a booking is in progress (e.g. a bare name or reason), unless
+// it is an explicit off-topic request.
+func isOffTopic(message string, conv ConversationState) bool {
+	if offTopicRe.MatchString(message) {
+		return true
+	}
+	d := conv.Draft
+	inProgress := d.Doctor != "" || d.PatientName != "" || d.Date != "" || d.Time != "" || d.Reason != ""
+	return !inProgress && !bookingCueRe.MatchString(message)
+}
+
+// PolicyViolation describes why a proposed booking field was rejected.
+type PolicyViolation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// canonicalDoctor maps "doctor kim", "dr kim" or "Dr. Kim" to the tenant's
+// doctor list (CLINIC_DOCTORS for the default tenant). With no list every
+// name is accepted.
+func canonicalDoctor(db *gorm.DB, name string) (string, bool) {
+	doctors := tenantDoctors(db)
+	if len(doctors) == 0 {
+		return name, true
+	}
+	want := doctorKey(name)
+	for _, d := range doctors {
+		if doctorKey(d) == want {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+var doctorPrefixRe = regexp.MustCompile(`(?i)^(dr\.?|doctor)\s+`)
+
+func doctorKey(name string) string {
+	name = doctorPrefixRe.ReplaceAllString(strings.TrimSpace(name), "")
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// clinicHours returns the opening and closing time (HH:MM) from CLINIC_OPEN and CLINIC_CLOSE.
+func clinicHours() (string, string) {
+	return getEnv("CLINIC_OPEN", "08:00"), getEnv("CLINIC_CLOSE", "18:00")
+}
+
+// validateBookingRules checks the non-empty fields of a proposed booking
+// against the clinic's business rules and booking policy, on the wall clock
+// of the booking's time zone. Doctor names are canonicalised in place.
+func validateBookingRules(db *gorm.DB, ap *Appointment) []PolicyViolation {
+	var out []PolicyViolation
+	if ap.Doctor != "" {
+		if canon, ok := canonicalDoctor(db, ap.Doctor); ok {
+			ap.Doctor = canon
+		} else {
+			out = append(out, PolicyViolation{"doctor", "unknown_doctor",
+				fmt.Sprintf("We don't have a doctor called %s. Our doctors are %s.", ap.Doctor, strings.Join(tenantDoctors(db), ", "))})
+		}
+	}
+
+	loc, err := zoneFor(ap.TimeZone)
+	if err != nil {
+		out = append(out, PolicyViolation{"time_zone", "invalid_time_zone", err.Error()})
+		loc = clinicTZ()
+	}
+	now := nowFunc().In(loc)
+	policy := currentPolicy()
+	if ap.Date != "" {
+		if !isValidDate(ap.Date) {
+			out = append(out, PolicyViolation{"date", "invalid_date", fmt.Sprintf("%s isn't a valid date.", ap.Date)})
+		} else {
+			out = append(out, policy.checkDate(ap.Date, now)...)
+			out = append(out, closureViolations(db, *ap)...)
+		}
+	}
+	if ap.Time != "" {
+		open, close := clinicHours()
+		if !isValidTime(ap.Time) {
+			out = append(out, PolicyViolation{"time", "invalid_time", fmt.Sprintf("%s isn't a valid time.", ap.Time)})
+		} else if ap.Time < open || ap.Time >= close {
+			out = append(out, PolicyViolation{"time", "outside_hours", fmt.Sprintf("The clinic is open from %s to %s.", open, close)})
+		} else if dur := appointmentMinutes(*ap); ap.Time > formatClockOffset(close, -dur) {
+			out = append(out, PolicyViolation{"time", "ends_after_close",
+				fmt.Sprintf("A %d-minute appointment at %s would end after closing time (%s).", dur, ap.Time, close)})
+		} else {
+			out = append(out, policy.checkTime(ap.Date, ap.Time, loc, now)...)
+		}
+	}
+	return out
+}
+
+// appointmentMinutes is the booking's length, or the default for drafts.
+func appointmentMinutes(ap Appointment) int {
+	if ap.DurationMinutes > 0 {
+		return ap.DurationMinutes
+	}
+	return defaultDurationMinutes()
+}
+
+// formatClockOffset shifts an HH:MM time by mins minutes.
+func formatClockOffset(hhmm string, mins int) string {
+	at, ok := clockMinutes(hhmm)
+	if !ok {
+		return hhmm
+	}
+	return formatClock(at + mins)
+}
+
+// clearViolatingFields drops every field that failed validation so the
+// conversation asks for it again instead of keeping a bad value.
+func clearViolatingFields(ap *Appointment, violations []PolicyViolation) {
+	for _, v := range violations {
+		switch v.Field {
+		case "doctor":
+			ap.Doctor = ""
+		case "date":
+			ap.Date = ""
+		case "time":
+			ap.Time = ""
+		case "patient_name":
+			ap.PatientName = ""
+		case "location_id":
+			ap.LocationID = nil
+		}
+	}
+}
+
+func violationMessages(violations []PolicyViolation) string {
+	msgs := make([]string, 0, len(violations))
+	for _, v := range violations {
+		msgs = append(msgs, v.Message)
+	}
+	return strings.Join(msgs, " ")
+}
+
+// Output guard: replies that leak the prompt, contain raw JSON or claim a
+// booking that was never made are replaced with a plain follow-up question.
+// Only claims about the patient's own booking count; "Dr. Kim is booked at
+// 15:00" is the model reporting a conflict and reaches the patient.
+var unsafeReplyRe = regexp.MustCompile(`(?i)(you already have|absolute (critical )?rule|safety rules|"intent"|i've booked|i have booked|` +
+	`you('re| are) (now |all )?booked|your (appointment|visit|booking) (is|has been) (now )?(booked|confirmed)|` +
+	`booking is confirmed|appointment is confirmed)`)
+
+func guardModelReply(reply string, draft Appointment) string {
+	if unsafeReplyRe.MatchString(reply) || strings.Contains(reply, "{") {
+		return followUpQuestion(draft)
+	}
+	return reply
+}
+
+// followUpQuestion asks for whatever the draft is still missing.
+func followUpQuestion(draft Appointment) string {
+	var missing []string
+	if draft.Doctor == "" {
+		missing = append(missing, "which doctor you'd like to see")
+	}
+	if draft.Date == "" {
+		missing = append(missing, "the date")
+	}
+	if draft.Time == "" {
+		missing = append(missing, "the time")
+	}
+	if draft.PatientName == "" {
+		missing = append(missing, "your name")
+	}
+	switch len(missing) {
+	case 0:
+		return "What is the reason for your appointment?"
+	case 1:
+		return "Could you tell me " + missing[0] + "?"
+	}
+	return "Could you tell me " + strings.Join(missing[:len(missing)-1], ", ") + " and " + missing[len(missing)-1] + "?"
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 func chatHandler(c *fiber.Ctx) error {
@@ -13,19 +15,128 @@ func chatHandler(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
-	// Use session ID or generate a default one for conversation tracking
+	tenant, err := widgetTenant(c, req.WidgetKey)
+	if err != nil {
+		return err
+	}
+
+	// Use session ID or generate a default one for conversation tracking.
+	// Sessions are kept per tenant so two widgets can't share a conversation.
 	sessionID := req.SessionID
 	if sessionID == "" {
 		sessionID = "default"
 	}
+	if tenant.ID != defaultTenantID {
+		sessionID = fmt.Sprintf("%d:%s", tenant.ID, sessionID)
+	}
+
+	resp, err := processChatMessage(forTenant(tenant.ID), sessionID, req.Message)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create appointment")
+	}
+	return c.JSON(resp)
+}
+
+// processChatMessage runs one conversation turn for sessionID of the tenant
+// db is scoped to and books the appointment as soon as every required field
+// has been collected.
+func processChatMessage(db *gorm.DB, sessionID, message string) (ChatResponse, error) {
+	recordChatTurn(sessionID, message)
 
 	// Get conversation history
 	conv := getConversation(sessionID)
+
+	// Input guard: never pass injection attempts or off-topic requests to the model
+	if detectPromptInjection(message) {
+		log.Printf("[guard] session=%s blocked=injection", sessionID)
+		return ChatResponse{Reply: injectionRefusal}, nil
+	}
+	if isOffTopic(message, conv) {
+		log.Printf("[guard] session=%s blocked=off_topic", sessionID)
+		return ChatResponse{Reply: offTopicRefusal}, nil
+	}
 	
-	ap, reply, err := AskForAppointmentFromMessage("", req.Message, conv)
+	// The patient is answering our offer to join the waitlist
+	switch {
+	case conv.Waitlist == "asked" && noRe.MatchString(message):
+		conv.Waitlist = ""
+		reply := "No problem. Would another time or day work for you?"
+		conv.LastUserMessage, conv.LastAIMessage = message, reply
+		setConversation(sessionID, conv)
+		return ChatResponse{Reply: reply}, nil
+	case conv.Waitlist == "asked" && yesRe.MatchString(message):
+		conv.Waitlist = "joining"
+	case conv.Waitlist == "asked":
+		conv.Waitlist = "" // moved on, e.g. to another day
+	}
+
+	cfg, err := chatSettingsFor(db)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	ap, reply, err := AskForAppointmentFromMessage(cfg, message, conv)
 	if err != nil {
 		log.Printf("[Chat Error] %v", err)
 	}
+	log.Printf("[chat] session=%s prompt_version=%s", sessionID, cfg.Prompts.ID())
+
+	// A bare answer to our question about the reason ("headache") is the
+	// reason, unless it changes the day or time instead
+	if conv.AskedReason && strings.TrimSpace(ap.Reason) == "" {
+		_, hasDate := resolveDate(message, clinicNow(), configuredDateOrder())
+		_, hasTime := extractTime(message)
+		if !hasDate && !hasTime {
+			ap.Reason = strings.TrimRight(strings.TrimSpace(message), ".!")
+		}
+	}
+	conv.AskedReason = false
+
+	// "every Tuesday for 6 weeks" makes the booking a series; a later
+	// "for 8 weeks" or "until 30 November" says how long it runs
+	text := message
+	if everyRe.MatchString(message) {
+		conv.Repeat, conv.RepeatEnd = message, ""
+	} else if conv.Repeat != "" && mentionsSeriesEnd(message) {
+		conv.RepeatEnd = message
+	}
+	if conv.Repeat != "" {
+		text = withoutSeriesEnd(message)
+	}
+
+	// Dates and exact times parsed locally only fill in when the model found
+	// none. A window such as "tomorrow morning" replaces any time the model
+	// guessed, and a pick from the slots we just offered wins over both.
+	if ap.Date == "" || ap.Date == conv.Draft.Date {
+		if dm, ok := resolveDate(text, clinicNow(), configuredDateOrder()); ok {
+			ap.Date = dm.Date.Format("2006-01-02")
+		}
+	}
+	if slot, ok := pickOfferedSlot(message, conv.OfferedSlots); ok {
+		ap.Time = slot
+	} else if te, ok := extractTime(text); ok {
+		if te.IsWindow() {
+			ap.Time = ""
+			conv.Draft.Time = ""
+			conv.Window = te.Window
+		} else if ap.Time == "" || ap.Time == conv.Draft.Time {
+			ap.Time = te.Exact
+		}
+	}
+
+	// A phone number or email mentioned along the way identifies the patient
+	if contact := contactFromMessage(message); !contact.isZero() {
+		conv.Contact.Phone = choose(contact.Phone, conv.Contact.Phone)
+		conv.Contact.Email = choose(contact.Email, conv.Contact.Email)
+	}
+	// So does naming a branch ("at Westlands")
+	if l, ok := locationFromText(db, message); ok {
+		conv.Draft.LocationID = &l.ID
+	}
+
+	// Output guard: whatever the model (or local parser) proposed must satisfy
+	// the clinic's rules before it can reach the draft
+	violations := validateBookingRules(db, &ap)
+	clearViolatingFields(&ap, violations)
 
 	// Update conversation state with partial information
 	if ap.Doctor != "" || ap.PatientName != "" || ap.Date != "" || ap.Time != "" || ap.Reason != "" {
@@ -34,7 +145,7 @@ func chatHandler(c *fiber.Ctx) error {
 		conv.Draft.Date = choose(ap.Date, conv.Draft.Date)
 		conv.Draft.Time = choose(ap.Time, conv.Draft.Time)
 		conv.Draft.Reason = choose(ap.Reason, conv.Draft.Reason)
-		conv.LastUserMessage = req.Message
+		conv.LastUserMessage = message
 		conv.LastAIMessage = reply
 		setConversation(sessionID, conv)
 	}
@@ -62,6 +173,79 @@ func chatHandler(c *fiber.Ctx) error {
 	}
 	setConversation(sessionID, conv)
 
+	if conv.Draft.Time != "" {
+		conv.Window = TimeWindow{}
+		conv.OfferedSlots = nil
+		setConversation(sessionID, conv)
+	}
+
+	if conv.Waitlist == "joining" {
+		if conv.Draft.PatientName == "" {
+			reply = "Great! What's your name, and a phone number or email we can reach you on?"
+			conv.LastUserMessage, conv.LastAIMessage = message, reply
+			setConversation(sessionID, conv)
+			return ChatResponse{Reply: reply}, nil
+		}
+		reply = joinWaitlistFromChat(db, conv)
+		setConversation(sessionID, ConversationState{})
+		return ChatResponse{Reply: reply}, nil
+	}
+
+	if len(violations) > 0 {
+		log.Printf("[guard] session=%s rejected=%d fields", sessionID, len(violations))
+		return ChatResponse{Reply: violationMessages(violations) + " " + followUpQuestion(conv.Draft)}, nil
+	}
+
+	// Slot length and buffers come from the visit type, mapped from the reason;
+	// the branch, when known, sets the zone and the doctor's shifts
+	visit := conv.Draft
+	resolveAppointmentType(db, &visit)
+	resolveLocation(db, &visit)
+
+	// A time that overlaps another booking, or a slot held for someone on the
+	// waitlist, becomes a request for the nearest free ones
+	taken := ""
+	if conv.Draft.Time != "" && conv.Draft.Doctor != "" && isValidDate(conv.Draft.Date) {
+		clash, err := conflictingAppointment(db, visit)
+		if err != nil {
+			return ChatResponse{}, err
+		}
+		var held *WaitlistOffer
+		if clash == nil {
+			if held, err = heldOffer(db, visit); err != nil {
+				return ChatResponse{}, err
+			}
+		}
+		if clash != nil || held != nil {
+			taken = fmt.Sprintf("Sorry, %s is already booked at %s on %s. ", conv.Draft.Doctor, conv.Draft.Time, conv.Draft.Date)
+			conv.Window = TimeWindow{Near: conv.Draft.Time}
+			conv.Draft.Time = ""
+		}
+	}
+
+	// A time window is answered with concrete free slots to pick from
+	if conv.Draft.Time == "" && !conv.Window.IsZero() && conv.Draft.Doctor != "" && isValidDate(conv.Draft.Date) {
+		slots, err := freeSlots(db, visit, conv.Window)
+		if err != nil {
+			return ChatResponse{}, err
+		}
+		conv.OfferedSlots = offerSlots(slots)
+		reply = taken + slotOffer(conv.Draft.Doctor, conv.Draft.Date, conv.Window, conv.OfferedSlots)
+		if len(conv.OfferedSlots) == 0 {
+			// Nothing free: offer the waitlist for this day and window
+			reply = taken + waitlistQuestion(conv.Draft.Doctor, conv.Draft.Date, conv.Window)
+			conv.Waitlist, conv.WaitlistWindow = "asked", conv.Window
+			if conv.Window.Near != "" {
+				conv.WaitlistWindow = TimeWindow{} // "around the taken time" means any time that day
+			}
+			conv.Window = TimeWindow{}
+		}
+		conv.LastUserMessage = message
+		conv.LastAIMessage = reply
+		setConversation(sessionID, conv)
+		return ChatResponse{Reply: reply}, nil
+	}
+
 	// Check if we now have all required fields
 	updatedHasAll := conv.Draft.Doctor != "" && 
 		conv.Draft.PatientName != "" && 
@@ -70,13 +254,25 @@ func chatHandler(c *fiber.Ctx) error {
 
 	// CRITICAL: If we have all required fields, complete booking immediately - don't ask again
 	if updatedHasAll {
+		// Ask for the branch unless there is one, or the doctor only works at one
+		if v := resolveLocation(db, &conv.Draft); len(v) > 0 {
+			clearViolatingFields(&conv.Draft, v)
+			reply = v[0].Message
+			conv.LastUserMessage, conv.LastAIMessage = message, reply
+			setConversation(sessionID, conv)
+			return ChatResponse{Reply: reply}, nil
+		}
+
 		// Check if reason is missing - ask for it before completing booking
 		finalReason := choose(ap.Reason, conv.Draft.Reason)
 		if strings.TrimSpace(finalReason) == "" {
 			// We have all required fields except reason - ask for it ONLY
 			reasonReply := fmt.Sprintf("Perfect! I have all the details. What is the reason for your appointment with %s on %s at %s?", 
 				conv.Draft.Doctor, conv.Draft.Date, conv.Draft.Time)
-			return c.JSON(fiber.Map{"reply": reasonReply})
+			conv.AskedReason = true
+			conv.LastUserMessage, conv.LastAIMessage = message, reasonReply
+			setConversation(sessionID, conv)
+			return ChatResponse{Reply: reasonReply}, nil
 		}
 
 		// We have everything including reason - complete the booking immediately
@@ -93,96 +289,399 @@ func chatHandler(c *fiber.Ctx) error {
 			Date:        conv.Draft.Date,
 			Time:        finalTime,
 			Reason:      finalReason,
-			Status:      "pending",
+			Status:      StatusPending,
+			LocationID:  conv.Draft.LocationID,
+			TimeZone:    conv.Draft.TimeZone,
+		}
+
+		// Re-check the complete booking; a time can pass, or be taken, while
+		// the patient is typing
+		resolveAppointmentType(db, &finalApp)
+		v := validateBookingRules(db, &finalApp)
+		if len(v) == 0 {
+			if v, err = scheduleViolations(db, finalApp); err != nil {
+				return ChatResponse{}, err
+			}
+		}
+		if len(v) > 0 {
+			clearViolatingFields(&conv.Draft, v)
+			setConversation(sessionID, conv)
+			return ChatResponse{Reply: violationMessages(v) + " " + followUpQuestion(conv.Draft)}, nil
+		}
+
+		if conv.Repeat != "" {
+			rule, _, hasEnd := recurrenceFromText(conv.Repeat, finalApp.Date, clinicNow())
+			if conv.RepeatEnd != "" {
+				end := rule
+				end.Count, end.Until = 0, ""
+				if applyRecurrenceEnd(&end, conv.RepeatEnd, finalApp.Date, clinicNow()) {
+					rule, hasEnd = end, true
+				}
+			}
+			if !hasEnd {
+				reply = fmt.Sprintf("I can book that %s. How long should it run? For example \"for 6 weeks\", \"8 sessions\" or \"until 30 November\".", describeRule(rule))
+				conv.LastUserMessage, conv.LastAIMessage = message, reply
+				setConversation(sessionID, conv)
+				return ChatResponse{Reply: reply}, nil
+			}
+			res, v, err := bookSeries(db, finalApp, rule, conv.Contact, "chat", false)
+			if err != nil {
+				return ChatResponse{}, err
+			}
+			if len(v) > 0 {
+				// All or nothing: the patient picks another time or a shorter series
+				for _, p := range v {
+					if p.Field == "time" {
+						conv.Draft.Time = ""
+					}
+				}
+				reply = "I couldn't book the whole series. " + violationMessages(v) + " Would another time, or a shorter series, work for you?"
+				conv.LastUserMessage, conv.LastAIMessage = message, reply
+				setConversation(sessionID, conv)
+				return ChatResponse{Reply: reply}, nil
+			}
+			setConversation(sessionID, ConversationState{})
+			return ChatResponse{Message: seriesReply(db, res, rule), Appointment: &res.Appointments[0], Appointments: res.Appointments}, nil
 		}
 
 		// Generate confirmation message
-		reply = fmt.Sprintf("Perfect! I've booked your appointment with %s on %s at %s for %s. Thank you, %s!", 
-			finalApp.Doctor, finalApp.Date, finalApp.Time, finalApp.Reason, finalApp.PatientName)
+		reply = fmt.Sprintf("Perfect! I've booked your appointment with %s%s on %s at %s for %s. Thank you, %s!", 
+			finalApp.Doctor, atBranch(db, finalApp.LocationID), finalApp.Date, finalApp.Time, finalApp.Reason, finalApp.PatientName)
 
-		if err := db.Create(&finalApp).Error; err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "failed to create appointment")
+		if err := createWithStatus(db, &finalApp, conv.Contact, "chat", ""); err != nil {
+			v := lostSlotViolations(err)
+			if len(v) == 0 {
+				return ChatResponse{}, err
+			}
+			clearViolatingFields(&conv.Draft, v)
+			setConversation(sessionID, conv)
+			return ChatResponse{Reply: violationMessages(v) + " " + followUpQuestion(conv.Draft)}, nil
 		}
 		// Clear conversation state after successful booking
 		setConversation(sessionID, ConversationState{})
-		return c.JSON(ChatResponse{Message: reply, Appointment: &finalApp})
+		return ChatResponse{Message: reply, Appointment: &finalApp}, nil
 	}
 
 	if strings.TrimSpace(reply) == "" {
 		reply = "Hi! I can help you book an appointment. Which doctor and date work for you?"
 	}
-	return c.JSON(fiber.Map{"reply": strings.TrimSpace(reply)})
+	return ChatResponse{Reply: guardModelReply(strings.TrimSpace(reply), conv.Draft)}, nil
 }
 
+// listAppointments handles GET /admin/appointments: one page of the
+// appointments matching parseAppointmentFilter, ordered by ?sort= and
+// ?order=. ?cursor= (the previous page's next_cursor) pages by position in
+// the index and is the fast way through large lists; ?page= counts pages
+// from the start.
 func listAppointments(c *fiber.Ctx) error {
-	var apps []Appointment
-	if err := db.Order("created_at DESC").Find(&apps).Error; err != nil {
+	db := tenantDB(c)
+	f, err := parseAppointmentFilter(c, db)
+	if err != nil {
+		return err
+	}
+	order, err := parseAppointmentSort(c)
+	if err != nil {
+		return err
+	}
+	page, size, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+	res := appointmentPage{PageSize: size}
+	if err := f.apply(db.Model(&Appointment{})).Count(&res.Total).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to list appointments")
+	}
+	q := order.apply(f.apply(db))
+	if cursor := c.Query("cursor"); cursor != "" {
+		if q, err = order.seek(q, cursor); err != nil {
+			return err
+		}
+	} else {
+		res.Page = page
+		q = q.Offset((page - 1) * size)
+	}
+	// One extra row tells whether there is a next page
+	if err := q.Limit(size + 1).Find(&res.Appointments).Error; err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to list appointments")
 	}
-	return c.JSON(apps)
+	if len(res.Appointments) > size {
+		res.Appointments = res.Appointments[:size]
+		res.NextCursor = order.cursorAfter(res.Appointments[size-1])
+	}
+	if res.Appointments == nil {
+		res.Appointments = []Appointment{}
+	}
+	return c.JSON(res)
 }
 
 func createAppointment(c *fiber.Ctx) error {
+	db := tenantDB(c)
 	var in Appointment
 	if err := c.BodyParser(&in); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
 	}
+	var contact PatientContact
+	_ = c.BodyParser(&contact)
+	var repeat seriesRequest
+	_ = c.BodyParser(&repeat)
+	v := newAppointmentViolations(db, &in, contact)
+	var rule RRule
+	if strings.TrimSpace(repeat.RRule) != "" {
+		var err error
+		if rule, err = parseRRule(repeat.RRule); err != nil {
+			v = append(v, PolicyViolation{"rrule", "invalid_rrule", err.Error()})
+		}
+	}
+	if len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if rule.Freq != "" {
+		// A recurring booking: every occurrence is checked and booked together
+		res, v, err := bookSeries(db, in, rule, contact, adminActor(c), repeat.SkipConflicts)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to create")
+		}
+		if len(v) > 0 {
+			return validationFailed(c, v)
+		}
+		return c.Status(fiber.StatusCreated).JSON(res)
+	}
+	v, err := scheduleViolations(db, in)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to check availability")
+	}
+	if len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := createWithStatus(db, &in, contact, adminActor(c), ""); err != nil {
+		if v := lostSlotViolations(err); len(v) > 0 {
+			return validationFailed(c, v)
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create")
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+// newAppointmentViolations tidies a new appointment and checks it the way
+// POST /admin/appointments does, short of the schedule: patient, contact,
+// type, branch, initial status, required fields and the booking rules.
+func newAppointmentViolations(db *gorm.DB, in *Appointment, contact PatientContact) []PolicyViolation {
 	in.PatientName = strings.TrimSpace(in.PatientName)
 	in.Doctor = strings.TrimSpace(in.Doctor)
 	in.Reason = strings.TrimSpace(in.Reason)
+	in.Notes = strings.TrimSpace(in.Notes)
 	if in.Status == "" {
-		in.Status = "pending"
+		in.Status = StatusPending
 	}
-	if in.PatientName == "" || in.Doctor == "" || !isValidDate(in.Date) || !isValidTime(in.Time) {
-		return fiber.NewError(fiber.StatusBadRequest, "patient, doctor, valid date and time required")
-	}
-	if err := db.Create(&in).Error; err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to create")
+	v := append(resolvePatientID(db, in), contactViolations(contact)...)
+	v = append(v, resolveAppointmentType(db, in)...)
+	v = append(v, resolveLocation(db, in)...)
+	if in.Status != StatusPending && in.Status != StatusConfirmed {
+		// Later statuses are reached through the lifecycle, not set on creation
+		v = append(v, PolicyViolation{"status", "invalid_status",
+			fmt.Sprintf("New appointments must be %s or %s.", StatusPending, StatusConfirmed)})
 	}
-	return c.Status(fiber.StatusCreated).JSON(in)
+	_ = in.normalizeSchedule() // fills date/time from starts_at; problems are reported below
+	return append(v, append(requiredFieldViolations(*in), validateBookingRules(db, in)...)...)
 }
 
 func updateAppointment(c *fiber.Ctx) error {
+	db := tenantDB(c)
 	id := c.Params("id")
 	var ap Appointment
 	if err := db.First(&ap, id).Error; err != nil {
 		return fiber.NewError(fiber.StatusNotFound, "not found")
 	}
+	before := ap
 	var in Appointment
 	if err := c.BodyParser(&in); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
 	}
-
-	if in.Date != "" && !isValidDate(in.Date) {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid date")
+	var note statusNote
+	_ = c.BodyParser(&note)
+	var contact PatientContact
+	_ = c.BodyParser(&contact)
+	if v := contactViolations(contact); len(v) > 0 {
+		return validationFailed(c, v)
 	}
-	if in.Time != "" && !isValidTime(in.Time) {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid time")
+
+	if in.Date == "" && in.Time == "" && !in.StartsAt.IsZero() {
+		moved := Appointment{TimeZone: choose(in.TimeZone, ap.TimeZone), StartsAt: in.StartsAt}
+		_ = moved.normalizeSchedule()
+		in.Date, in.Time = moved.Date, moved.Time
 	}
 
-	ap.PatientName = choose(in.PatientName, ap.PatientName)
+	// Scheduling rules only apply when the slot itself changes, so past
+	// appointments can still be edited (e.g. their status or reason)
+	rescheduled := (in.Doctor != "" && in.Doctor != ap.Doctor) || (in.Date != "" && in.Date != ap.Date) ||
+		(in.Time != "" && in.Time != ap.Time) || (in.TimeZone != "" && in.TimeZone != ap.TimeZone) ||
+		(in.DurationMinutes > 0 && in.DurationMinutes != ap.DurationMinutes) ||
+		(in.AppointmentTypeID != nil && (ap.AppointmentTypeID == nil || *in.AppointmentTypeID != *ap.AppointmentTypeID)) ||
+		(in.LocationID != nil && (ap.LocationID == nil || *in.LocationID != *ap.LocationID))
+
+	// A new patient_id or name moves the appointment to that patient
+	relink := !contact.isZero() || (in.PatientName != "" && patientNameKey(in.PatientName) != patientNameKey(ap.PatientName))
+	if in.PatientID != nil {
+		ap.PatientID, relink = in.PatientID, false
+		if v := resolvePatientID(db, &ap); len(v) > 0 {
+			return validationFailed(c, v)
+		}
+	} else {
+		ap.PatientName = choose(in.PatientName, ap.PatientName)
+	}
 	ap.Doctor = choose(in.Doctor, ap.Doctor)
 	ap.Date = choose(in.Date, ap.Date)
 	ap.Time = choose(in.Time, ap.Time)
 	ap.Reason = choose(in.Reason, ap.Reason)
-	if in.Status != "" {
-		ap.Status = in.Status
+	ap.Notes = choose(strings.TrimSpace(in.Notes), ap.Notes)
+	ap.TimeZone = choose(in.TimeZone, ap.TimeZone)
+	if in.AppointmentTypeID != nil {
+		// A new type brings its own length unless one was sent with it
+		ap.AppointmentTypeID, ap.DurationMinutes = in.AppointmentTypeID, 0
+		if v := resolveAppointmentType(db, &ap); len(v) > 0 {
+			return validationFailed(c, v)
+		}
+	}
+	if in.DurationMinutes > 0 {
+		ap.DurationMinutes = in.DurationMinutes
+	}
+	if in.LocationID != nil && (ap.LocationID == nil || *in.LocationID != *ap.LocationID) {
+		// A new branch brings its own time zone unless one was sent with it
+		ap.LocationID, ap.TimeZone = in.LocationID, strings.TrimSpace(in.TimeZone)
+		if v := resolveLocation(db, &ap); len(v) > 0 {
+			return validationFailed(c, v)
+		}
+	}
+	from := ap.Status
+	v, err := appointmentChangeViolations(db, &ap, in.Status, rescheduled)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to check availability")
+	}
+	if len(v) > 0 {
+		return validationFailed(c, v)
 	}
 
-	if err := db.Save(&ap).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if relink {
+			if err := linkPatient(tx, &ap, contact); err != nil {
+				return err
+			}
+		}
+		return saveAppointmentChange(tx, &ap, from, rescheduled, adminActor(c), note.StatusReason)
+	})
+	if errors.Is(err, errStatusChanged) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if v := lostSlotViolations(err); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
 	}
+	// Cancelling or moving the appointment frees its old slot for the waitlist
+	if before.Status != StatusCancelled && (ap.Status == StatusCancelled || rescheduled) {
+		offerFreedSlot(db, before)
+	}
 	return c.JSON(ap)
 }
 
+// appointmentChangeViolations applies the rules of an admin edit to ap,
+// whose fields have already been changed: a new status (empty for none)
+// must be a legal transition, and a rescheduled appointment must not be
+// final and must pass the booking rules and the schedule checks.
+func appointmentChangeViolations(db *gorm.DB, ap *Appointment, status string, rescheduled bool) ([]PolicyViolation, error) {
+	from := ap.Status
+	if status != "" && status != ap.Status {
+		if err := checkTransition(*ap, status); err != nil {
+			return statusViolation(err), nil
+		}
+		ap.Status = status
+	}
+	if rescheduled && isFinalStatus(from) {
+		return []PolicyViolation{{"status", "final_status",
+			fmt.Sprintf("A %s appointment can't be rescheduled; book a new one instead.", from)}}, nil
+	}
+	if !rescheduled {
+		return nil, nil
+	}
+	if v := validateBookingRules(db, ap); len(v) > 0 {
+		return v, nil
+	}
+	// The new slot passed the closure check, so any flag no longer applies
+	ap.ClosureID = nil
+	return scheduleViolations(db, *ap)
+}
+
+// saveAppointmentChange writes an edit checked by appointmentChangeViolations
+// inside the caller's transaction: the row, the claim on a new slot and the
+// status history entry when the status moved on from from.
+func saveAppointmentChange(tx *gorm.DB, ap *Appointment, from string, rescheduled bool, actor, reason string) error {
+	if ap.Status != from {
+		if err := setStatus(tx, ap.ID, from, ap.Status); err != nil {
+			return err
+		}
+	}
+	if err := tx.Save(ap).Error; err != nil {
+		return err
+	}
+	if rescheduled {
+		if err := claimSlot(tx, ap); err != nil {
+			return err
+		}
+	}
+	if ap.Status == from {
+		return nil
+	}
+	return recordStatusChange(tx, ap.ID, from, ap.Status, actor, reason)
+}
+
 func deleteAppointment(c *fiber.Ctx) error {
+	db := tenantDB(c)
 	id := c.Params("id")
-	if err := db.Delete(&Appointment{}, id).Error; err != nil {
+	var ap Appointment
+	found := db.First(&ap, id).Error == nil
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("appointment_id = ?", id).Delete(&ResourceBooking{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Appointment{}, id).Error
+	})
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
 	}
+	if found && !isFinalStatus(ap.Status) {
+		offerFreedSlot(db, ap)
+	}
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
+// requiredFieldViolations reports the fields every booking must have.
+func requiredFieldViolations(ap Appointment) []PolicyViolation {
+	var out []PolicyViolation
+	if ap.PatientName == "" {
+		out = append(out, PolicyViolation{"patient_name", "required", "Patient name is required."})
+	}
+	if ap.Doctor == "" {
+		out = append(out, PolicyViolation{"doctor", "required", "Doctor is required."})
+	}
+	if ap.Date == "" {
+		out = append(out, PolicyViolation{"date", "required", "Date is required."})
+	}
+	if ap.Time == "" {
+		out = append(out, PolicyViolation{"time", "required", "Time is required."})
+	}
+	return out
+}
+
+// validationFailed answers 422 with every violation so the caller can show
+// each one next to its field.
+func validationFailed(c *fiber.Ctx, violations []PolicyViolation) error {
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+		"error":      "validation failed",
+		"violations": violations,
+	})
+}
+
 func choose(a, b string) string {
 	if strings.TrimSpace(a) != "" {
 		return strings.TrimSpace(a)
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// importColumns maps the header names a CSV import understands to the
+// field they fill. The headers of an export are accepted too, so an
+// exported file can be imported elsewhere.
+var importColumns = map[string]string{
+	"patient_name":        "patient_name",
+	"patient":             "patient_name",
+	"patient_id":          "patient_id",
+	"patient_phone":       "patient_phone",
+	"phone":               "patient_phone",
+	"patient_email":       "patient_email",
+	"email":               "patient_email",
+	"patient_dob":         "patient_dob",
+	"dob":                 "patient_dob",
+	"doctor":              "doctor",
+	"date":                "date",
+	"time":                "time",
+	"time_zone":           "time_zone",
+	"duration_minutes":    "duration_minutes",
+	"minutes":             "duration_minutes",
+	"reason":              "reason",
+	"notes":               "notes",
+	"status":              "status",
+	"appointment_type_id": "appointment_type_id",
+	"type_id":             "appointment_type_id",
+	"location_id":         "location_id",
+}
+
+// importHeaderKey folds a header cell ("Patient ID", "patient_id") to the
+// form importColumns uses.
+func importHeaderKey(h string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))), " ", "_")
+}
+
+// importLine is the outcome of one line of an import that failed.
+type importLine struct {
+	Line       int               `json:"line"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+// importReport sums up an import. Errors lists every line that failed,
+// with the line number in the file (the header is line 1).
+type importReport struct {
+	DryRun         bool         `json:"dry_run"`
+	Committed      bool         `json:"committed"`
+	Rows           int          `json:"rows"`
+	Valid          int          `json:"valid"`
+	Invalid        int          `json:"invalid"`
+	IgnoredColumns []string     `json:"ignored_columns,omitempty"`
+	Errors         []importLine `json:"errors"`
+}
+
+// errImportRollback undoes an import that is a dry run or has bad lines.
+var errImportRollback = errors.New("import rolled back")
+
+// importFileError is a file that can't be imported at all.
+type importFileError string
+
+func (e importFileError) Error() string { return string(e) }
+
+// importAppointments reads appointments from CSV and books them through the
+// checks of POST /admin/appointments, all in one transaction. Every line is
+// checked against the appointments already booked and the lines before it,
+// so two lines for the same slot conflict. Nothing is saved if any line
+// fails, and a dry run checks everything the same way and then rolls back.
+// The error is for a file that can't be read at all: an importFileError or
+// a *csv.ParseError, or one from the database.
+func importAppointments(db *gorm.DB, r io.Reader, actor string, dryRun bool) (importReport, error) {
+	rep := importReport{DryRun: dryRun, Errors: []importLine{}}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return rep, importFileError("the file is empty")
+	}
+	if err != nil {
+		return rep, err
+	}
+	fields := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, h := range header {
+		if f, ok := importColumns[importHeaderKey(h)]; ok && !seen[f] {
+			fields[i], seen[f] = f, true
+		} else if strings.TrimSpace(h) != "" {
+			rep.IgnoredColumns = append(rep.IgnoredColumns, strings.TrimSpace(h))
+		}
+	}
+	if !seen["patient_name"] && !seen["patient_id"] {
+		return rep, importFileError("the header needs a patient_name or patient_id column")
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			line, _ := cr.FieldPos(0)
+			if isBlankRecord(record) {
+				continue
+			}
+			rep.Rows++
+			v, err := importRecord(tx, fields, record, actor)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if len(v) > 0 {
+				rep.Invalid++
+				rep.Errors = append(rep.Errors, importLine{Line: line, Violations: v})
+			} else {
+				rep.Valid++
+			}
+		}
+		if dryRun || rep.Invalid > 0 {
+			return errImportRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errImportRollback) {
+		return rep, err
+	}
+	rep.Committed = err == nil
+	return rep, nil
+}
+
+func isBlankRecord(record []string) bool {
+	for _, cell := range record {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// importRecord checks one line and, if it passes, books it inside tx.
+func importRecord(tx *gorm.DB, fields, record []string, actor string) ([]PolicyViolation, error) {
+	var ap Appointment
+	var contact PatientContact
+	var v []PolicyViolation
+	id := func(field, raw string) *uint {
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || n == 0 {
+			v = append(v, PolicyViolation{field, "invalid_number", fmt.Sprintf("%s must be a number, not %q.", field, raw)})
+			return nil
+		}
+		u := uint(n)
+		return &u
+	}
+	for i, raw := range record {
+		if i >= len(fields) || fields[i] == "" {
+			continue
+		}
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		switch fields[i] {
+		case "patient_name":
+			ap.PatientName = raw
+		case "patient_id":
+			ap.PatientID = id("patient_id", raw)
+		case "patient_phone":
+			contact.Phone = raw
+		case "patient_email":
+			contact.Email = raw
+		case "patient_dob":
+			contact.DOB = raw
+		case "doctor":
+			ap.Doctor = raw
+		case "date":
+			ap.Date = raw
+		case "time":
+			ap.Time = raw
+		case "time_zone":
+			ap.TimeZone = raw
+		case "duration_minutes":
+			if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+				ap.DurationMinutes = n
+			} else {
+				v = append(v, PolicyViolation{"duration_minutes", "invalid_number", fmt.Sprintf("duration_minutes must be a number of minutes, not %q.", raw)})
+			}
+		case "reason":
+			ap.Reason = raw
+		case "notes":
+			ap.Notes = raw
+		case "status":
+			ap.Status = strings.ToLower(raw)
+		case "appointment_type_id":
+			ap.AppointmentTypeID = id("appointment_type_id", raw)
+		case "location_id":
+			ap.LocationID = id("location_id", raw)
+		}
+	}
+	if len(v) > 0 {
+		return v, nil
+	}
+	if v = newAppointmentViolations(tx, &ap, contact); len(v) > 0 {
+		return v, nil
+	}
+	v, err := scheduleViolations(tx, ap)
+	if err != nil || len(v) > 0 {
+		return v, err
+	}
+	return nil, insertWithStatus(tx, &ap, contact, actor, "imported from CSV")
+}
+
+// importUpload handles POST /admin/appointments/import. The CSV comes as a
+// multipart "file" field or as the request body; ?dry_run=true only checks
+// it. A dry run answers 200 whatever it finds, an import 201 when every line
+// was booked and 422 (with nothing saved) otherwise.
+func importUpload(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var r io.Reader = bytes.NewReader(c.Body())
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "could not read the uploaded file")
+		}
+		defer f.Close()
+		r = f
+	}
+	dryRun := c.QueryBool("dry_run")
+	rep, err := importAppointments(db, r, adminActor(c), dryRun)
+	var parseErr *csv.ParseError
+	var fileErr importFileError
+	switch {
+	case errors.As(err, &parseErr):
+		return fiber.NewError(fiber.StatusBadRequest, "invalid CSV: "+parseErr.Error())
+	case errors.As(err, &fileErr):
+		return fiber.NewError(fiber.StatusBadRequest, fileErr.Error())
+	case err != nil:
+		log.Printf("[import] failed: %v", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to import")
+	}
+	switch {
+	case dryRun:
+		return c.JSON(rep)
+	case rep.Committed:
+		return c.Status(fiber.StatusCreated).JSON(rep)
+	default:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(rep)
+	}
+}
+
+// runImport is `go run . import [-dry-run] [-tenant slug] file.csv`. It
+// imports into SQLITE_PATH and prints each failing line; the exit status is
+// 0 only when every line passed.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "check the file and report errors without saving anything")
+	slug := flags.String("tenant", "", "tenant slug (default: the default tenant)")
+	actor := flags.String("as", "import", "name recorded in the status history")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [-dry-run] [-tenant slug] [-as name] file.csv")
+		return 2
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	log.SetOutput(io.Discard)
+
+	initDatabase(getEnv("SQLITE_PATH", "appointments.db"))
+	tenant := defaultTenantID
+	if *slug != "" {
+		var t Tenant
+		if err := systemDB().Where("slug = ?", *slug).First(&t).Error; err != nil {
+			fmt.Fprintf(os.Stderr, "import: no tenant %q\n", *slug)
+			return 1
+		}
+		tenant = t.ID
+	}
+	rep, err := importAppointments(forTenant(tenant), f, *actor, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	for _, e := range rep.Errors {
+		for _, v := range e.Violations {
+			fmt.Printf("line %d: %s: %s\n", e.Line, v.Field, v.Message)
+		}
+	}
+	if len(rep.IgnoredColumns) > 0 {
+		fmt.Printf("ignored columns: %s\n", strings.Join(rep.IgnoredColumns, ", "))
+	}
+	switch {
+	case rep.Committed:
+		fmt.Printf("imported %d appointments\n", rep.Valid)
+	case *dryRun:
+		fmt.Printf("dry run: %d of %d rows would import, %d with errors\n", rep.Valid, rep.Rows, rep.Invalid)
+	default:
+		fmt.Printf("nothing imported: %d of %d rows have errors\n", rep.Invalid, rep.Rows)
+	}
+	if rep.Invalid > 0 {
+		return 1
+	}
+	return 0
+}
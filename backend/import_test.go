@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestImportDryRunAndCommit imports each file twice into a fresh tenant,
+// first as a dry run and then for real, and checks that both report the
+// same lines and that only a clean, real import saves anything.
+func TestImportDryRunAndCommit(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 6, 9, 0, 0, 0, time.UTC) }
+
+	for i, tc := range []struct {
+		name          string
+		file          string
+		valid         int
+		errors        []string // "line:code", in order
+		ignored       []string
+		savedOnCommit int
+	}{
+		{"export headers",
+			"\ufeffPatient,Doctor,Date,Time,Time zone,Minutes,Reason,Colour\n" +
+				"Amani Ochieng,Dr. Lee,2030-01-07,10:00,UTC,45,checkup,blue\n" +
+				"Baraka Mwangi,Dr. Lee,2030-01-07,11:00,UTC,,follow-up,\n",
+			2, nil, []string{"Colour"}, 2},
+		{"lines that clash with each other",
+			"patient_name,doctor,date,time,time_zone,duration_minutes,reason\n" +
+				"Amani Ochieng,Dr. Lee,2030-01-07,10:00,UTC,30,checkup\n" +
+				",,,,,,\n" +
+				"Baraka Mwangi,Dr. Lee,2030-01-07,10:15,UTC,30,checkup\n" +
+				"Chege Kamau,Dr. Lee,2030-01-07,12:00,UTC,half an hour,checkup\n" +
+				"Dalia Hassan,,2030-01-07,13:00,UTC,30,checkup\n",
+			1, []string{"4:conflict", "5:invalid_number", "6:required"}, nil, 0},
+		{"a line in the past",
+			"patient,doctor,date,time,time_zone,status\n" +
+				"Amani Ochieng,Dr. Lee,2030-01-07,10:00,UTC,confirmed\n" +
+				"Baraka Mwangi,Dr. Lee,2030-01-05,10:00,UTC,completed\n",
+			1, []string{"3:invalid_status", "3:past_date"}, nil, 0},
+	} {
+		initDatabase(fmt.Sprintf("file:import-%d?mode=memory&cache=shared", i))
+		tenant := Tenant{Slug: "import", Name: "Import Clinic", WidgetKey: "import-key"}
+		mustCreate(t, db.Create(&tenant).Error)
+		tdb := forTenant(tenant.ID)
+
+		for _, dryRun := range []bool{true, false} {
+			rep, err := importAppointments(tdb, strings.NewReader(tc.file), "desk@example.com", dryRun)
+			if err != nil {
+				t.Fatalf("%s (dry run %v): %v", tc.name, dryRun, err)
+			}
+			var errs []string
+			for _, e := range rep.Errors {
+				for _, v := range e.Violations {
+					errs = append(errs, fmt.Sprintf("%d:%s", e.Line, v.Code))
+				}
+			}
+			if rep.Valid != tc.valid || rep.Invalid != len(rep.Errors) || rep.Rows != rep.Valid+rep.Invalid ||
+				!equalStrings(errs, tc.errors) || !equalStrings(rep.IgnoredColumns, tc.ignored) {
+				t.Errorf("%s (dry run %v): %d valid, %d invalid of %d, errors %q, ignored %q; want %d valid, errors %q, ignored %q",
+					tc.name, dryRun, rep.Valid, rep.Invalid, rep.Rows, errs, rep.IgnoredColumns, tc.valid, tc.errors, tc.ignored)
+			}
+			wantSaved := 0
+			if !dryRun {
+				wantSaved = tc.savedOnCommit
+			}
+			var saved int64
+			mustCreate(t, tdb.Model(&Appointment{}).Count(&saved).Error)
+			if rep.DryRun != dryRun || rep.Committed != (wantSaved > 0) || int(saved) != wantSaved {
+				t.Errorf("%s (dry run %v): committed %v with %d saved, want %d saved", tc.name, dryRun, rep.Committed, saved, wantSaved)
+			}
+		}
+	}
+}
+
+func TestImportFileErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:import-files?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	var fileErr importFileError
+	var parseErr *csv.ParseError
+	for _, tc := range []struct {
+		file   string
+		target interface{}
+	}{
+		{"", &fileErr},
+		{"doctor,date,time\nDr. Lee,2030-01-07,10:00\n", &fileErr},
+		{"patient_name,reason\n\"Amani,checkup\n", &parseErr},
+	} {
+		if _, err := importAppointments(db, strings.NewReader(tc.file), "test", true); !errors.As(err, tc.target) {
+			t.Errorf("%q: got %v, want a %T", tc.file, err, tc.target)
+		}
+	}
+}
+
+func TestImportUpload(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 6, 9, 0, 0, 0, time.UTC) }
+	initDatabase("file:import-upload?mode=memory&cache=shared")
+	token, err := createJWTToken(1, defaultTenantID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Post("/admin/appointments/import", jwtMiddleware, importUpload)
+
+	good := "patient_name,doctor,date,time,time_zone,reason\nAmani Ochieng,Dr. Lee,2030-01-07,10:00,UTC,checkup\n"
+	bad := good + "Baraka Mwangi,Dr. Lee,2030-01-07,10:00,UTC,checkup\n"
+	for _, tc := range []struct {
+		query, file string
+		want        int
+	}{
+		{"?dry_run=true", bad, fiber.StatusOK},
+		{"", bad, fiber.StatusUnprocessableEntity},
+		{"", "", fiber.StatusBadRequest},
+		{"", good, fiber.StatusCreated},
+		// The first import took the slot
+		{"?dry_run=true", good, fiber.StatusOK},
+		{"", good, fiber.StatusUnprocessableEntity},
+	} {
+		if status, body := call(t, app, "POST", "/admin/appointments/import"+tc.query, token, tc.file); status != tc.want {
+			t.Errorf("%s with %d bytes: %d %s, want %d", tc.query, len(tc.file), status, body, tc.want)
+		}
+	}
+	var history []StatusChange
+	mustCreate(t, forTenant(defaultTenantID).Where("reason = ? AND changed_by = ?", "imported from CSV", "desk@example.com").
+		Find(&history).Error)
+	if len(history) != 1 {
+		t.Errorf("%d imported appointments in the history, want 1", len(history))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ChatMessage is one role-tagged message sent to the LLM. Sensitive lists
+// values inside Content (e.g. the patient's name) that must be redacted
+// before the message reaches an external provider; it is never sent.
+type ChatMessage struct {
+	Role      string   `json:"role"`
+	Content   string   `json:"content"`
+	Sensitive []string `json:"-"`
+}
+
+// LLMClient is the completion backend used by the dialogue engine.
+// Production uses Groq; the eval harness swaps in a scripted fake.
+type LLMClient interface {
+	Complete(model string, messages []ChatMessage) (string, error)
+}
+
+// groqClient sends messages to the Groq chat completions API, with
+// GROQ_API_KEY unless APIKey is set.
+type groqClient struct {
+	APIKey string
+}
+
+func (g groqClient) Complete(model string, messages []ChatMessage) (string, error) {
+	if g.APIKey != "" {
+		return queryGroqWithKey(g.APIKey, model, messages)
+	}
+	return QueryGroq(model, messages)
+}
+
+// ollamaClient sends messages to a local Ollama server.
+type ollamaClient struct{}
+
+func (ollamaClient) Complete(model string, messages []ChatMessage) (string, error) {
+	return QueryOllama(model, messages)
+}
+
+var llmClient LLMClient = groqClient{}
+
+// configureLLM selects the LLM client for the server from LLM_PROVIDER.
+// LLM_CASSETTE_MODE=record appends every exchange to LLM_CASSETTE; replay
+// answers from it offline. PII is redacted for external providers unless
+// <PROVIDER>_REDACT_PII=false, and always while a cassette is in use; local
+// Ollama receives raw text by default.
+func configureLLM() error {
+	provider := strings.ToLower(getEnv("LLM_PROVIDER", "groq"))
+	var client LLMClient
+	switch provider {
+	case "groq":
+		client = groqClient{}
+	case "ollama":
+		client = ollamaClient{}
+	default:
+		return fmt.Errorf("unknown LLM_PROVIDER %q (want groq or ollama)", provider)
+	}
+
+	client, redact, err := withCassette(client, os.Getenv("LLM_CASSETTE_MODE"), getEnv("LLM_CASSETTE", "llm_cassette.jsonl"),
+		getEnvBool(strings.ToUpper(provider)+"_REDACT_PII", provider != "ollama"))
+	if err != nil {
+		return err
+	}
+	log.Printf("[config] LLM provider: %s (redact PII: %v)", provider, redact)
+	llmClient = client
+	return nil
+}
+
+// withCassette puts the cassette of mode ("record", "replay" or "" for
+// none) at path in front of client, and redaction in front of both when
+// redact is set. A cassette turns redaction on regardless: recordings are
+// kept as test fixtures, so they never hold raw PII, and a replay has to
+// send the same redacted requests to find them. It reports whether
+// redaction is on.
+func withCassette(client LLMClient, mode, path string, redact bool) (LLMClient, bool, error) {
+	switch mode {
+	case "":
+	case "record":
+		rec, err := newCassetteRecorder(path, client)
+		if err != nil {
+			return nil, false, err
+		}
+		activeRecorder = rec
+		client = rec
+	case "replay":
+		player, err := loadCassette(path)
+		if err != nil {
+			return nil, false, err
+		}
+		client = player
+	default:
+		return nil, false, fmt.Errorf("unknown LLM_CASSETTE_MODE %q (want record or replay)", mode)
+	}
+	if mode != "" {
+		log.Printf("[config] LLM cassette %s mode: %s", mode, path)
+		redact = true
+	}
+	if redact {
+		client = redactingClient{inner: client}
+	}
+	return client, redact, nil
+}
+
+// llmClientFor builds the client for a tenant with its own provider or API
+// key. Redaction follows the same <PROVIDER>_REDACT_PII rule as the server.
+// Cassettes only apply to the server-wide client.
+func llmClientFor(provider, apiKey string) (LLMClient, error) {
+	provider = strings.ToLower(choose(provider, getEnv("LLM_PROVIDER", "groq")))
+	var client LLMClient
+	switch provider {
+	case "groq":
+		client = groqClient{APIKey: apiKey}
+	case "ollama":
+		client = ollamaClient{}
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q (want groq or ollama)", provider)
+	}
+	if getEnvBool(strings.ToUpper(provider)+"_REDACT_PII", provider != "ollama") {
+		client = redactingClient{inner: client}
+	}
+	return client, nil
+}
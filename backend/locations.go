@@ -0,0 +1,519 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Location is a branch of the clinic. Appointments at a branch are kept in
+// its TimeZone; Aliases are other names patients use for it in chat.
+type Location struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	TenantID  uint       `gorm:"not null;default:1;uniqueIndex:idx_locations_tenant_name,priority:1" json:"-"`
+	Name      string     `gorm:"size:100;uniqueIndex:idx_locations_tenant_name,priority:2;not null" json:"name"`
+	Address   string     `gorm:"size:500" json:"address"`
+	Phone     string     `gorm:"size:32" json:"phone"`
+	TimeZone  string     `gorm:"size:64" json:"time_zone"`
+	Aliases   StringList `gorm:"type:text" json:"aliases"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// DoctorSchedule is one weekly shift of a doctor at a branch, e.g. Dr. Kim
+// at Westlands on Mondays from 08:00 to 13:00. Weekday counts from Sunday
+// (0) to Saturday (6). A doctor with no shifts works any branch during
+// clinic hours; once a doctor has shifts, bookings must fall inside one.
+type DoctorSchedule struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	TenantID   uint      `gorm:"not null;default:1;index" json:"-"`
+	Doctor     string    `gorm:"size:255;not null;index:idx_schedule_doctor_location,priority:1" json:"doctor"`
+	LocationID uint      `gorm:"not null;index:idx_schedule_doctor_location,priority:2" json:"location_id"`
+	Weekday    int       `gorm:"not null" json:"weekday"`
+	StartTime  string    `gorm:"size:5;not null" json:"start_time"`
+	EndTime    string    `gorm:"size:5;not null" json:"end_time"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// seedLocations creates a branch for each entry of CLINIC_LOCATION_TIMEZONES
+// when there are none yet, so existing deployments keep their branch zones.
+// This is the only place the variable is read: afterwards the locations
+// table alone decides a branch's zone.
+func seedLocations(db *gorm.DB) {
+	var count int64
+	db.Model(&Location{}).Count(&count)
+	if count == 0 {
+		names := make([]string, 0)
+		zones := locationTimezones()
+		for name := range zones {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			loc := Location{Name: strings.ToUpper(name[:1]) + name[1:], TimeZone: zones[name]}
+			_ = db.Create(&loc).Error
+		}
+	}
+	migrateBranchZones(db)
+}
+
+// locationTimezones parses CLINIC_LOCATION_TIMEZONES, a comma separated list
+// of branch=zone pairs such as "westlands=Africa/Nairobi,london=Europe/London".
+func locationTimezones() map[string]string {
+	out := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("CLINIC_LOCATION_TIMEZONES"), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) != "" {
+			out[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	return out
+}
+
+// migrateBranchZones rewrites bookings saved with a branch name as their
+// time_zone, which CLINIC_LOCATION_TIMEZONES used to resolve, to the branch
+// itself: its location_id (if unset) and its zone.
+func migrateBranchZones(db *gorm.DB) {
+	locs, err := allLocations(db)
+	if err != nil {
+		log.Printf("[db] branch zone migration failed: %v", err)
+		return
+	}
+	for _, l := range locs {
+		if l.TimeZone == "" {
+			continue
+		}
+		for _, model := range []interface{}{&Appointment{}, &AppointmentSeries{}, &WaitlistOffer{}} {
+			named := func() *gorm.DB { return db.Model(model).Where("LOWER(time_zone) = ?", strings.ToLower(l.Name)) }
+			if err := named().Where("location_id IS NULL").Update("location_id", l.ID).Error; err != nil {
+				log.Printf("[db] branch zone migration failed: %v", err)
+			}
+			if err := named().Update("time_zone", l.TimeZone).Error; err != nil {
+				log.Printf("[db] branch zone migration failed: %v", err)
+			}
+		}
+	}
+}
+
+func allLocations(db *gorm.DB) ([]Location, error) {
+	var locs []Location
+	err := db.Order("name").Find(&locs).Error
+	return locs, err
+}
+
+// locationFromText finds the branch a chat message mentions by name or
+// alias, as a whole word; the longest match wins.
+func locationFromText(db *gorm.DB, text string) (Location, bool) {
+	text = strings.ToLower(text)
+	locs, err := allLocations(db)
+	if err != nil {
+		return Location{}, false
+	}
+	var best Location
+	bestLen := 0
+	for _, l := range locs {
+		for _, name := range append(StringList{l.Name}, l.Aliases...) {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || len(name) <= bestLen {
+				continue
+			}
+			if regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b`).MatchString(text) {
+				best, bestLen = l, len(name)
+			}
+		}
+	}
+	return best, bestLen > 0
+}
+
+// doctorSchedules returns every shift of doctor, matched like canonicalDoctor.
+func doctorSchedules(db *gorm.DB, doctor string) ([]DoctorSchedule, error) {
+	var all []DoctorSchedule
+	if err := db.Order("weekday, start_time").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	var out []DoctorSchedule
+	for _, s := range all {
+		if doctorKey(s.Doctor) == doctorKey(doctor) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// shiftsOn narrows shifts to the given weekday and, when set, branch.
+func shiftsOn(shifts []DoctorSchedule, locationID *uint, wd time.Weekday) []DoctorSchedule {
+	var out []DoctorSchedule
+	for _, s := range shifts {
+		if s.Weekday == int(wd) && (locationID == nil || s.LocationID == *locationID) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// fitsShift reports whether a visit of minutes starting at hhmm lies inside
+// one of shifts.
+func fitsShift(shifts []DoctorSchedule, hhmm string, minutes int) bool {
+	for _, s := range shifts {
+		if hhmm >= s.StartTime && formatClockOffset(hhmm, minutes) <= s.EndTime {
+			return true
+		}
+	}
+	return false
+}
+
+// appointmentWeekday is the weekday of ap's date, if it has a valid one.
+func appointmentWeekday(ap Appointment) (time.Weekday, bool) {
+	d, err := time.Parse("2006-01-02", ap.Date)
+	if err != nil {
+		return 0, false
+	}
+	return d.Weekday(), true
+}
+
+// candidateLocations lists the branches ap could be at: those where its
+// doctor has a shift (on its date, when known), or every branch for a doctor
+// without shifts.
+func candidateLocations(db *gorm.DB, ap Appointment) ([]Location, error) {
+	locs, err := allLocations(db)
+	if err != nil || ap.Doctor == "" {
+		return locs, err
+	}
+	shifts, err := doctorSchedules(db, ap.Doctor)
+	if err != nil || len(shifts) == 0 {
+		return locs, err
+	}
+	if wd, ok := appointmentWeekday(ap); ok {
+		shifts = shiftsOn(shifts, nil, wd)
+	}
+	works := map[uint]bool{}
+	for _, s := range shifts {
+		works[s.LocationID] = true
+	}
+	var out []Location
+	for _, l := range locs {
+		if works[l.ID] {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+// resolveLocation checks ap's branch, or picks it when only one branch is
+// possible for its doctor and date, and keeps the booking in the branch's
+// time zone unless one was given. With several branches and none chosen the
+// booking is incomplete.
+func resolveLocation(db *gorm.DB, ap *Appointment) []PolicyViolation {
+	if ap.LocationID == nil {
+		locs, err := candidateLocations(db, *ap)
+		if err != nil || len(locs) == 0 {
+			return nil
+		}
+		if len(locs) > 1 {
+			return []PolicyViolation{{"location_id", "required", locationQuestion(locs)}}
+		}
+		ap.LocationID = &locs[0].ID
+	}
+	var l Location
+	if err := db.First(&l, *ap.LocationID).Error; err != nil {
+		return []PolicyViolation{{"location_id", "unknown_location", fmt.Sprintf("Location %d doesn't exist.", *ap.LocationID)}}
+	}
+	if ap.TimeZone == "" {
+		ap.TimeZone = l.TimeZone
+	}
+	return nil
+}
+
+// atBranch names the branch for a confirmation, e.g. " at Westlands".
+func atBranch(db *gorm.DB, id *uint) string {
+	var l Location
+	if id == nil || db.First(&l, *id).Error != nil {
+		return ""
+	}
+	return " at " + l.Name
+}
+
+// locationQuestion asks which of locs the patient wants.
+func locationQuestion(locs []Location) string {
+	names := make([]string, len(locs))
+	for i, l := range locs {
+		names[i] = l.Name
+	}
+	list := names[0]
+	if len(names) > 1 {
+		list = strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+	}
+	return fmt.Sprintf("Which branch would you like to visit: %s?", list)
+}
+
+// rosterViolations checks ap against its doctor's shifts: the doctor must
+// work at its branch, on its weekday, for the whole visit.
+func rosterViolations(db *gorm.DB, ap Appointment) ([]PolicyViolation, error) {
+	wd, ok := appointmentWeekday(ap)
+	if ap.Doctor == "" || !ok || !isValidTime(ap.Time) {
+		return nil, nil
+	}
+	shifts, err := doctorSchedules(db, ap.Doctor)
+	if err != nil || len(shifts) == 0 {
+		return nil, err
+	}
+	here := shifts
+	branch := "that branch"
+	if ap.LocationID != nil {
+		var l Location
+		if db.First(&l, *ap.LocationID).Error == nil {
+			branch = l.Name
+		}
+		here = nil
+		for _, s := range shifts {
+			if s.LocationID == *ap.LocationID {
+				here = append(here, s)
+			}
+		}
+		if len(here) == 0 {
+			return []PolicyViolation{{"location_id", "doctor_not_at_location",
+				fmt.Sprintf("%s doesn't work at %s. %s", ap.Doctor, branch, describeShifts(db, ap.Doctor, shifts))}}, nil
+		}
+	}
+	today := shiftsOn(here, nil, wd)
+	if len(today) == 0 {
+		return []PolicyViolation{{"date", "not_scheduled",
+			fmt.Sprintf("%s doesn't work on %ss. %s", ap.Doctor, wd, describeShifts(db, ap.Doctor, here))}}, nil
+	}
+	if !fitsShift(today, ap.Time, appointmentMinutes(ap)) {
+		return []PolicyViolation{{"time", "not_scheduled",
+			fmt.Sprintf("%s isn't in at %s on %ss. %s", ap.Doctor, ap.Time, wd, describeShifts(db, ap.Doctor, today))}}, nil
+	}
+	return nil, nil
+}
+
+// describeShifts lists a doctor's shifts for the patient, e.g. "Dr. Kim
+// works Mondays 08:00-13:00 at Westlands."
+func describeShifts(db *gorm.DB, doctor string, shifts []DoctorSchedule) string {
+	names := map[uint]string{}
+	if locs, err := allLocations(db); err == nil {
+		for _, l := range locs {
+			names[l.ID] = l.Name
+		}
+	}
+	parts := make([]string, len(shifts))
+	for i, s := range shifts {
+		parts[i] = fmt.Sprintf("%ss %s-%s at %s", time.Weekday(s.Weekday), s.StartTime, s.EndTime, names[s.LocationID])
+	}
+	return fmt.Sprintf("%s works %s.", doctor, strings.Join(parts, ", "))
+}
+
+// locationFilter narrows an admin list to ?location_id=.
+func locationFilter(c *fiber.Ctx, q *gorm.DB) (*gorm.DB, error) {
+	raw := strings.TrimSpace(c.Query("location_id"))
+	if raw == "" {
+		return q, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return q, fiber.NewError(fiber.StatusBadRequest, "location_id must be a number")
+	}
+	return q.Where("location_id = ?", id), nil
+}
+
+func listLocations(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	locs, err := allLocations(db)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to list locations")
+	}
+	return c.JSON(locs)
+}
+
+func createLocation(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in Location
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	in.ID = 0
+	if v := locationViolations(&in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Create(&in).Error; err != nil {
+		return fiber.NewError(fiber.StatusConflict, "location already exists")
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+func updateLocation(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var l Location
+	if err := db.First(&l, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	id, created := l.ID, l.CreatedAt
+	if err := c.BodyParser(&l); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	l.ID, l.CreatedAt = id, created
+	if v := locationViolations(&l); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Save(&l).Error; err != nil {
+		return fiber.NewError(fiber.StatusConflict, "location already exists")
+	}
+	return c.JSON(l)
+}
+
+// deleteLocation removes a branch and its shifts. Branches with
+// appointments are kept so the bookings don't lose their place.
+func deleteLocation(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var l Location
+	if err := db.First(&l, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var used int64
+	db.Model(&Appointment{}).Where("location_id = ?", l.ID).Count(&used)
+	if used > 0 {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("%s has %d appointments", l.Name, used))
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("location_id = ?", l.ID).Delete(&DoctorSchedule{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&l).Error
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// locationViolations normalises an admin-supplied branch and reports what is
+// wrong with it.
+func locationViolations(l *Location) []PolicyViolation {
+	l.Name = strings.TrimSpace(l.Name)
+	l.TimeZone = strings.TrimSpace(l.TimeZone)
+	var out []PolicyViolation
+	if l.Name == "" {
+		out = append(out, PolicyViolation{"name", "required", "Name is required."})
+	}
+	if l.TimeZone != "" {
+		if _, err := time.LoadLocation(l.TimeZone); err != nil {
+			out = append(out, PolicyViolation{"time_zone", "invalid_time_zone", fmt.Sprintf("unknown time zone %q", l.TimeZone)})
+		}
+	}
+	if l.Phone != "" {
+		l.Phone = normalizePhone(l.Phone)
+	}
+	return out
+}
+
+// listDoctorSchedules handles GET /admin/doctor-schedules, optionally
+// filtered by ?doctor= and ?location_id=.
+func listDoctorSchedules(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	q, err := locationFilter(c, db.Order("doctor, weekday, start_time"))
+	if err != nil {
+		return err
+	}
+	var shifts []DoctorSchedule
+	if err := q.Find(&shifts).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to list schedules")
+	}
+	if d := strings.TrimSpace(c.Query("doctor")); d != "" {
+		mine := make([]DoctorSchedule, 0)
+		for _, s := range shifts {
+			if doctorKey(s.Doctor) == doctorKey(d) {
+				mine = append(mine, s)
+			}
+		}
+		shifts = mine
+	}
+	return c.JSON(shifts)
+}
+
+func createDoctorSchedule(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in DoctorSchedule
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	in.ID = 0
+	if v := doctorScheduleViolations(db, &in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Create(&in).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create")
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+func updateDoctorSchedule(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var s DoctorSchedule
+	if err := db.First(&s, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	id, created := s.ID, s.CreatedAt
+	if err := c.BodyParser(&s); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	s.ID, s.CreatedAt = id, created
+	if v := doctorScheduleViolations(db, &s); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Save(&s).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
+	}
+	return c.JSON(s)
+}
+
+func deleteDoctorSchedule(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	if err := db.Delete(&DoctorSchedule{}, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// doctorScheduleViolations normalises a shift and reports what is wrong
+// with it, including overlap with the doctor's other shifts that day.
+func doctorScheduleViolations(db *gorm.DB, s *DoctorSchedule) []PolicyViolation {
+	s.Doctor = strings.TrimSpace(s.Doctor)
+	var out []PolicyViolation
+	if s.Doctor == "" {
+		out = append(out, PolicyViolation{"doctor", "required", "Doctor is required."})
+	} else if canon, ok := canonicalDoctor(db, s.Doctor); ok {
+		s.Doctor = canon
+	} else {
+		out = append(out, PolicyViolation{"doctor", "unknown_doctor", fmt.Sprintf("We don't have a doctor called %s.", s.Doctor)})
+	}
+	if err := db.First(&Location{}, s.LocationID).Error; err != nil {
+		out = append(out, PolicyViolation{"location_id", "unknown_location", fmt.Sprintf("Location %d doesn't exist.", s.LocationID)})
+	}
+	if s.Weekday < 0 || s.Weekday > 6 {
+		out = append(out, PolicyViolation{"weekday", "invalid_weekday", "Weekday must be 0 (Sunday) to 6 (Saturday)."})
+	}
+	if !isValidTime(s.StartTime) || !isValidTime(s.EndTime) || s.EndTime <= s.StartTime {
+		out = append(out, PolicyViolation{"end_time", "invalid_range", "start_time and end_time must be HH:MM, with end_time after start_time."})
+	}
+	if len(out) > 0 {
+		return out
+	}
+	// A doctor can't be at two branches at once
+	shifts, _ := doctorSchedules(db, s.Doctor)
+	for _, o := range shiftsOn(shifts, nil, time.Weekday(s.Weekday)) {
+		if o.ID != s.ID && o.StartTime < s.EndTime && s.StartTime < o.EndTime {
+			out = append(out, PolicyViolation{"start_time", "overlapping_shift",
+				fmt.Sprintf("%s already works %s-%s that day.", s.Doctor, o.StartTime, o.EndTime)})
+		}
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestBranchZones seeds a branch from CLINIC_LOCATION_TIMEZONES over a
+// booking saved with the branch name as its zone, and checks the booking is
+// moved onto the branch and that the variable isn't consulted afterwards.
+func TestBranchZones(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:branchzones?mode=memory&cache=shared")
+	tenant := Tenant{Slug: "branches", Name: "Branch Clinic", WidgetKey: "branches-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+
+	ap := Appointment{PatientName: "Amina Njeri", Doctor: "Dr. Kim", Date: "2030-01-07", Time: "10:00",
+		TimeZone: "Africa/Nairobi", Reason: "checkup"}
+	mustCreate(t, tdb.Create(&ap).Error)
+	// As saved when the variable resolved branch names
+	mustCreate(t, systemDB().Exec("UPDATE appointments SET time_zone = ? WHERE id = ?", "Westlands", ap.ID).Error)
+
+	t.Setenv("CLINIC_LOCATION_TIMEZONES", "westlands=Africa/Nairobi")
+	seedLocations(tdb)
+	var branch Location
+	if err := tdb.Where("name = ?", "Westlands").First(&branch).Error; err != nil {
+		t.Fatalf("no branch seeded: %v", err)
+	}
+	if branch.TimeZone != "Africa/Nairobi" {
+		t.Errorf("seeded zone %q, want Africa/Nairobi", branch.TimeZone)
+	}
+	var got Appointment
+	if err := tdb.First(&got, ap.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.TimeZone != "Africa/Nairobi" || got.LocationID == nil || *got.LocationID != branch.ID {
+		t.Errorf("booking kept in %q at %v, want Africa/Nairobi at branch %d", got.TimeZone, got.LocationID, branch.ID)
+	}
+
+	// The locations table alone decides a branch's zone from now on
+	t.Setenv("CLINIC_LOCATION_TIMEZONES", "westlands=Europe/London")
+	if _, err := zoneFor("westlands"); err == nil {
+		t.Error("zoneFor still resolves a branch name from CLINIC_LOCATION_TIMEZONES")
+	}
+	mustCreate(t, tdb.Model(&branch).Update("time_zone", "Asia/Dubai").Error)
+	next := Appointment{Doctor: "Dr. Kim", Date: "2030-01-08", Time: "10:00", LocationID: &branch.ID}
+	if v := resolveLocation(tdb, &next); len(v) > 0 {
+		t.Fatalf("resolve branch: %+v", v)
+	}
+	if next.TimeZone != "Asia/Dubai" {
+		t.Errorf("new booking at the branch kept in %q, want Asia/Dubai", next.TimeZone)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -34,6 +35,9 @@ func loadEnvFile() {
 			value := strings.TrimSpace(parts[1])
 			if len(value) > 0 && ((value[0] == '"' && value[len(value)-1] == '"') || (value[0] == '\'' && value[len(value)-1] == '\'')) {
 				value = value[1 : len(value)-1]
+			} else if i := strings.Index(value, " #"); i >= 0 {
+				// Inline comment, e.g. LLM_PROVIDER=groq  # or ollama
+				value = strings.TrimSpace(value[:i])
 			}
 			if key != "" {
 				os.Setenv(key, value)
@@ -45,9 +49,37 @@ func loadEnvFile() {
 func main() {
 	loadEnvFile()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "eval":
+			os.Exit(runEval(os.Args[2:]))
+		case "eval-dates":
+			os.Exit(runDateEval(os.Args[2:]))
+		case "eval-times":
+			os.Exit(runTimeEval(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "cassette-export":
+			os.Exit(runCassetteExport(os.Args[2:]))
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+	}
+
 	port := getEnv("PORT", "8080")
 	dbPath := getEnv("SQLITE_PATH", "appointments.db")
 	initDatabase(dbPath)
+	if err := configureLLM(); err != nil {
+		log.Fatalf("failed to configure LLM: %v", err)
+	}
+	if _, err := currentPrompts(); err != nil {
+		log.Fatalf("failed to load prompts: %v", err)
+	}
+	if err := configureNotifier(); err != nil {
+		log.Fatalf("failed to configure notifier: %v", err)
+	}
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go runBackgroundJobs(jobsCtx)
 
 	// Ensure default admin exists
 	_ = ensureDefaultAdmin(getEnv("DEFAULT_ADMIN_EMAIL", "admin@example.com"), getEnv("DEFAULT_ADMIN_PASSWORD", "admin123"))
@@ -68,7 +100,7 @@ func main() {
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: allowedOrigins,
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-Widget-Key",
 		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
 		AllowCredentials: true,
 	}))
@@ -78,14 +110,70 @@ func main() {
 		return c.JSON(fiber.Map{"status": "ok", "time": time.Now()})
 	})
 	app.Post("/chat", chatHandler)
-	app.Post("/register", registerHandler)
+	app.Get("/widget/config", widgetConfig)
 	app.Post("/login", loginHandler)
+	app.Get("/waitlist/offers/:token", getWaitlistOffer)
+	app.Post("/waitlist/offers/:token/accept", acceptWaitlistOffer)
+	app.Post("/waitlist/offers/:token/decline", declineWaitlistOffer)
 
 	admin := app.Group("/admin", jwtMiddleware)
 	admin.Get("/appointments", listAppointments)
+	admin.Get("/appointments/search", searchAppointments)
+	admin.Get("/appointments/export", exportAppointments)
 	admin.Post("/appointments", createAppointment)
+	admin.Post("/appointments/bulk", bulkUpdateAppointments)
+	admin.Post("/appointments/import", importUpload)
 	admin.Put("/appointments/:id", updateAppointment)
 	admin.Delete("/appointments/:id", deleteAppointment)
+	admin.Post("/appointments/:id/confirm", statusAction(StatusConfirmed))
+	admin.Post("/appointments/:id/check-in", statusAction(StatusCheckedIn))
+	admin.Post("/appointments/:id/complete", statusAction(StatusCompleted))
+	admin.Post("/appointments/:id/cancel", statusAction(StatusCancelled))
+	admin.Post("/appointments/:id/no-show", statusAction(StatusNoShow))
+	admin.Get("/appointments/:id/history", statusHistory)
+	admin.Get("/appointment-statuses", listStatuses)
+	admin.Get("/series/:id", getSeries)
+	admin.Put("/series/:id", updateSeries)
+	admin.Post("/series/:id/cancel", cancelSeries)
+	admin.Get("/waitlist", listWaitlist)
+	admin.Post("/waitlist", createWaitlistEntry)
+	admin.Delete("/waitlist/:id", cancelWaitlistEntry)
+	admin.Get("/patients", listPatients)
+	admin.Post("/patients", createPatient)
+	admin.Get("/patients/:id", getPatient)
+	admin.Put("/patients/:id", updatePatient)
+	admin.Post("/patients/:id/merge", mergePatients)
+	admin.Get("/locations", listLocations)
+	admin.Post("/locations", createLocation)
+	admin.Put("/locations/:id", updateLocation)
+	admin.Delete("/locations/:id", deleteLocation)
+	admin.Get("/doctor-schedules", listDoctorSchedules)
+	admin.Post("/doctor-schedules", createDoctorSchedule)
+	admin.Put("/doctor-schedules/:id", updateDoctorSchedule)
+	admin.Delete("/doctor-schedules/:id", deleteDoctorSchedule)
+	admin.Get("/doctors/:id/agenda", doctorDayAgenda)
+	admin.Get("/doctors/:id/week", doctorWeekAgenda)
+	admin.Get("/resources", listResources)
+	admin.Get("/resources/utilization", resourceUtilization)
+	admin.Post("/resources", createResource)
+	admin.Put("/resources/:id", updateResource)
+	admin.Delete("/resources/:id", deleteResource)
+	admin.Get("/closures", listClosures)
+	admin.Post("/closures", createClosure)
+	admin.Get("/closures/:id", getClosure)
+	admin.Put("/closures/:id", updateClosure)
+	admin.Delete("/closures/:id", deleteClosure)
+	admin.Post("/closures/:id/cancel", cancelClosureAppointments)
+	admin.Post("/closures/:id/reschedule", rescheduleClosureAppointments)
+	admin.Post("/users", createUser)
+	admin.Get("/tenant", getTenant)
+	admin.Put("/tenant", updateTenant)
+	admin.Get("/tenants", platformAdmin, listTenants)
+	admin.Post("/tenants", platformAdmin, createTenant)
+	admin.Get("/appointment-types", listAppointmentTypes)
+	admin.Post("/appointment-types", createAppointmentType)
+	admin.Put("/appointment-types/:id", updateAppointmentType)
+	admin.Delete("/appointment-types/:id", deleteAppointmentType)
 
 	// ✅ Graceful shutdown handling
 	go func() {
@@ -100,6 +188,7 @@ func main() {
 	<-quit
 
 	log.Println("[shutdown] Gracefully shutting down server...")
+	stopJobs()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -116,3 +205,11 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// getEnvBool parses a boolean env variable, returning fallback if unset or invalid
+func getEnvBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
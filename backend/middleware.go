@@ -23,5 +23,21 @@ func jwtMiddleware(c *fiber.Ctx) error {
 	if err != nil || !tok.Valid {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
 	}
+	if claims, ok := tok.Claims.(jwt.MapClaims); ok {
+		if email, ok := claims["email"].(string); ok {
+			c.Locals("email", email) // recorded as the actor in status history
+		}
+		if sub, ok := claims["sub"].(float64); ok && sub > 0 {
+			c.Locals("user", uint(sub))
+		}
+		// Every query the request makes is limited to this tenant (see
+		// tenantDB). Tokens issued before tenants existed have none, and
+		// guessing one could show staff another practice's data.
+		id, ok := claims["tenant"].(float64)
+		if !ok || id <= 0 || db.First(&Tenant{}, uint(id)).Error != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "token has no valid tenant; sign in again")
+		}
+		c.Locals("tenant", uint(id))
+	}
 	return c.Next()
 }
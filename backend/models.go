@@ -2,37 +2,106 @@ package main
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type User struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Email     string    `gorm:"uniqueIndex;size:255;not null" json:"email"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	TenantID      uint      `gorm:"not null;default:1;uniqueIndex:idx_users_tenant_email,priority:1" json:"-"`
+	Email         string    `gorm:"uniqueIndex:idx_users_tenant_email,priority:2;size:255;not null" json:"email"`
+	Password      string    `json:"-"`
+	PlatformAdmin bool      `gorm:"not null;default:false" json:"platform_admin"` // manages every tenant; only DEFAULT_ADMIN_EMAIL
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
+// Appointment keeps the wall-clock Date and Time that clients send and see,
+// plus the same slot as real instants (StartsAt/EndsAt, UTC) for range
+// queries, overlap checks and sorting. BeforeSave keeps them in step.
+// BlockedFrom/BlockedUntil widen the slot by the type's buffers; that is the
+// span of the doctor's time no other booking may overlap.
 type Appointment struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	PatientName string    `gorm:"size:255;not null" json:"patient_name"`
-	Doctor      string    `gorm:"size:255;not null" json:"doctor"`
-	Date        string    `gorm:"size:10;not null" json:"date"`
-	Time        string    `gorm:"size:5;not null" json:"time"`
-	Reason      string    `gorm:"size:500" json:"reason"`
-	Status      string    `gorm:"size:50;default:pending" json:"status"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID                  uint      `gorm:"primaryKey" json:"id"`
+	TenantID            uint      `gorm:"not null;default:1;index;index:idx_appointments_tenant_starts,priority:1;index:idx_appointments_tenant_created,priority:1;index:idx_appointments_tenant_patient,priority:1;index:idx_appointments_tenant_status,priority:1" json:"-"`
+	PatientName         string    `gorm:"size:255;not null;index:idx_appointments_tenant_patient,priority:2" json:"patient_name"`
+	PatientID           *uint     `gorm:"index" json:"patient_id"`
+	Doctor              string    `gorm:"size:255;not null;index:idx_appointments_doctor_starts,priority:1;index:idx_appointments_doctor_blocked,priority:1" json:"doctor"`
+	Date                string    `gorm:"size:10;not null" json:"date"`
+	Time                string    `gorm:"size:5;not null" json:"time"`
+	Reason              string    `gorm:"size:500" json:"reason"`
+	Notes               string    `gorm:"type:text" json:"notes"` // staff only, never shown to patients
+	Status              string    `gorm:"size:50;default:pending;index:idx_appointments_tenant_status,priority:2" json:"status"`
+	TimeZone            string    `gorm:"size:64" json:"time_zone"`
+	StartsAt            time.Time `gorm:"index;index:idx_appointments_doctor_starts,priority:2;index:idx_appointments_tenant_starts,priority:2" json:"starts_at"`
+	EndsAt              time.Time `gorm:"index" json:"ends_at"`
+	DurationMinutes     int       `gorm:"not null;default:0" json:"duration_minutes"`
+	AppointmentTypeID   *uint     `gorm:"index" json:"appointment_type_id"`
+	SeriesID            *uint     `gorm:"index" json:"series_id"`
+	LocationID          *uint     `gorm:"index" json:"location_id"`
+	ClosureID           *uint     `gorm:"index" json:"closure_id"` // set while the slot falls on a closed day
+	BufferBeforeMinutes int       `gorm:"not null;default:0" json:"buffer_before_minutes"`
+	BufferAfterMinutes  int       `gorm:"not null;default:0" json:"buffer_after_minutes"`
+	BlockedFrom         time.Time `gorm:"index:idx_appointments_doctor_blocked,priority:2" json:"-"`
+	BlockedUntil        time.Time `json:"-"`
+	CreatedAt           time.Time `gorm:"index:idx_appointments_tenant_created,priority:2" json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// defaultDurationMinutes is the slot length used when a booking does not
+// specify one (DEFAULT_APPOINTMENT_MINUTES, default 30).
+func defaultDurationMinutes() int {
+	return envInt("DEFAULT_APPOINTMENT_MINUTES", 30, 1)
+}
+
+// normalizeSchedule fills the derived schedule fields. Date and Time win;
+// a client that only sends starts_at gets Date and Time from it. A missing
+// duration takes the default, and EndsAt and the blocked span follow from
+// StartsAt.
+func (a *Appointment) normalizeSchedule() error {
+	loc, err := zoneFor(a.TimeZone)
+	if err != nil {
+		return err
+	}
+	a.TimeZone = loc.String()
+	if a.DurationMinutes <= 0 {
+		a.DurationMinutes = defaultDurationMinutes()
+	}
+	if a.Date == "" && a.Time == "" && !a.StartsAt.IsZero() {
+		local := a.StartsAt.In(loc)
+		a.Date, a.Time = local.Format("2006-01-02"), local.Format("15:04")
+	}
+	if !isValidDate(a.Date) || !isValidTime(a.Time) {
+		return nil
+	}
+	at, err := localInstant(a.Date, a.Time, loc)
+	if err != nil {
+		return err
+	}
+	a.StartsAt = at.UTC()
+	a.EndsAt = a.StartsAt.Add(time.Duration(a.DurationMinutes) * time.Minute)
+	a.BlockedFrom = a.StartsAt.Add(-time.Duration(a.BufferBeforeMinutes) * time.Minute)
+	a.BlockedUntil = a.EndsAt.Add(time.Duration(a.BufferAfterMinutes) * time.Minute)
+	return nil
+}
+
+// BeforeSave keeps the schedule fields in step on every write.
+func (a *Appointment) BeforeSave(tx *gorm.DB) error {
+	return a.normalizeSchedule()
 }
 
 type ChatRequest struct {
 	Message   string `json:"message"`
 	SessionID string `json:"session_id"`
+	WidgetKey string `json:"widget_key"` // or the X-Widget-Key header
 }
 
 type ChatResponse struct {
 	Message     string       `json:"message,omitempty"`
 	Reply       string       `json:"reply,omitempty"`
 	Appointment *Appointment `json:"appointment,omitempty"`
+	// Appointments lists every occurrence when a series was booked
+	Appointments []Appointment `json:"appointments,omitempty"`
 }
 
 // In-memory conversation state per session
@@ -42,5 +111,13 @@ type ConversationState struct {
 	LastUserMessage string
 	LastAIMessage   string
 	Draft           Appointment
+	Window          TimeWindow     // preferred time window while no exact time is chosen
+	OfferedSlots    []string       // free times last offered for Window
+	Contact         PatientContact // phone or email the patient mentioned
+	Waitlist        string         // "asked" after offering the waitlist, "joining" while collecting the name
+	WaitlistWindow  TimeWindow     // the full window the waitlist would cover
+	Repeat          string         // the message asking for a repeating booking ("every Tuesday...")
+	RepeatEnd       string         // the message saying how long it runs, when Repeat didn't
+	AskedReason     bool           // our last reply asked for the reason for the visit
 	UpdatedAt       time.Time
 }
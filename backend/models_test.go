@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		in         Appointment
+		date, time string
+		starts     time.Time
+		minutes    int
+	}{
+		{"date and time", Appointment{Date: "2030-01-07", Time: "10:00", TimeZone: "UTC"},
+			"2030-01-07", "10:00", time.Date(2030, 1, 7, 10, 0, 0, 0, time.UTC), 30},
+		{"zone offset", Appointment{Date: "2030-01-07", Time: "10:00", TimeZone: "Africa/Nairobi", DurationMinutes: 45},
+			"2030-01-07", "10:00", time.Date(2030, 1, 7, 7, 0, 0, 0, time.UTC), 45},
+		{"starts_at only", Appointment{StartsAt: time.Date(2030, 1, 7, 7, 30, 0, 0, time.UTC), TimeZone: "Africa/Nairobi"},
+			"2030-01-07", "10:30", time.Date(2030, 1, 7, 7, 30, 0, 0, time.UTC), 30},
+		{"date and time win over starts_at", Appointment{Date: "2030-01-08", Time: "09:00", TimeZone: "UTC",
+			StartsAt: time.Date(2030, 1, 7, 7, 30, 0, 0, time.UTC)},
+			"2030-01-08", "09:00", time.Date(2030, 1, 8, 9, 0, 0, 0, time.UTC), 30},
+	} {
+		ap := tc.in
+		if err := ap.normalizeSchedule(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if ap.Date != tc.date || ap.Time != tc.time || !ap.StartsAt.Equal(tc.starts) || ap.DurationMinutes != tc.minutes {
+			t.Errorf("%s: got %s %s starting %v for %d minutes, want %s %s starting %v for %d",
+				tc.name, ap.Date, ap.Time, ap.StartsAt, ap.DurationMinutes, tc.date, tc.time, tc.starts, tc.minutes)
+		}
+		if want := ap.StartsAt.Add(time.Duration(ap.DurationMinutes) * time.Minute); !ap.EndsAt.Equal(want) {
+			t.Errorf("%s: ends at %v, want %v", tc.name, ap.EndsAt, want)
+		}
+	}
+
+	bad := Appointment{Date: "2030-01-07", Time: "10:00", TimeZone: "Mars/Olympus"}
+	if err := bad.normalizeSchedule(); err == nil {
+		t.Error("an unknown zone was accepted")
+	}
+}
+
+// TestBackfillSchedule clears the schedule columns of a saved row, as on a
+// database from before they existed, and checks the startup backfill.
+func TestBackfillSchedule(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:backfill?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	ap := Appointment{PatientName: "Amina Njeri", Doctor: "Dr. Kim", Date: "2030-01-07", Time: "10:00",
+		TimeZone: "Africa/Nairobi", Reason: "checkup"}
+	if err := db.Create(&ap).Error; err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Date(2029, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := systemDB().Exec("UPDATE appointments SET starts_at = NULL, ends_at = NULL, duration_minutes = 0, updated_at = ? WHERE id = ?",
+		stamp, ap.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backfillSchedule()
+	var got Appointment
+	if err := db.First(&got, ap.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2030, 1, 7, 7, 0, 0, 0, time.UTC); !got.StartsAt.Equal(want) {
+		t.Errorf("starts_at = %v, want %v", got.StartsAt, want)
+	}
+	if want := time.Date(2030, 1, 7, 7, 30, 0, 0, time.UTC); !got.EndsAt.Equal(want) || got.DurationMinutes != 30 {
+		t.Errorf("ends_at = %v after %d minutes, want %v after 30", got.EndsAt, got.DurationMinutes, want)
+	}
+	if !got.UpdatedAt.Equal(stamp) {
+		t.Errorf("updated_at = %v, want it kept at %v", got.UpdatedAt, stamp)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification is a message waiting in (or sent from) the outbox. Writing it
+// in the same transaction as the change that caused it means a message is
+// never lost or sent for a change that was rolled back; a background worker
+// delivers it later.
+type Notification struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	TenantID  uint       `gorm:"not null;default:1;index" json:"-"`
+	Channel   string     `gorm:"size:20;not null" json:"channel"` // email, sms or log
+	Recipient string     `gorm:"size:255" json:"recipient"`
+	Subject   string     `gorm:"size:255" json:"subject"`
+	Body      string     `gorm:"type:text" json:"body"`
+	Status    string     `gorm:"size:20;not null;default:pending;index" json:"status"` // pending, sent or failed
+	Attempts  int        `gorm:"not null;default:0" json:"attempts"`
+	LastError string     `gorm:"size:500" json:"last_error"`
+	SentAt    *time.Time `json:"sent_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// maxNotificationAttempts is how often delivery is tried before a
+// notification is marked failed.
+const maxNotificationAttempts = 5
+
+// Notifier delivers one notification. Production uses NOTIFIER; the default
+// only logs, which is enough until an email or SMS gateway is wired in.
+// Channels lists what it can deliver; notifications for other channels stay
+// pending in the outbox rather than being reported as sent.
+type Notifier interface {
+	Channels() []string
+	Send(n Notification) error
+}
+
+// logNotifier writes "log" notifications to the server log.
+type logNotifier struct{}
+
+func (logNotifier) Channels() []string { return []string{"log"} }
+
+func (logNotifier) Send(n Notification) error {
+	log.Printf("[notify] channel=%s to=%q subject=%q body=%q", n.Channel, n.Recipient, n.Subject, n.Body)
+	return nil
+}
+
+var notifier Notifier = logNotifier{}
+
+// configureNotifier selects the notifier from NOTIFIER.
+func configureNotifier() error {
+	switch name := strings.ToLower(getEnv("NOTIFIER", "log")); name {
+	case "log":
+		notifier = logNotifier{}
+	default:
+		return fmt.Errorf("unknown NOTIFIER %q (want log)", name)
+	}
+	return nil
+}
+
+// notifyPatient queues a message for the patient behind c, preferring
+// email, then SMS; with neither it only goes to the log.
+func notifyPatient(tx *gorm.DB, c PatientContact, subject, body string) error {
+	n := Notification{Subject: subject, Body: body, Status: "pending"}
+	n.Channel, n.Recipient = contactChannel(c)
+	return tx.Create(&n).Error
+}
+
+// contactChannel is the channel and recipient notifyPatient uses for c.
+func contactChannel(c PatientContact) (channel, recipient string) {
+	switch {
+	case c.Email != "":
+		return "email", c.Email
+	case c.Phone != "":
+		return "sms", c.Phone
+	}
+	return "log", ""
+}
+
+// canReach reports whether a message for c would reach the patient: they
+// have an email or phone, and the notifier delivers that channel.
+func canReach(c PatientContact) bool {
+	channel, _ := contactChannel(c)
+	if channel == "log" {
+		return false
+	}
+	for _, ch := range notifier.Channels() {
+		if ch == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// unreachableReason tells a patient why canReach is false for c.
+func unreachableReason(c PatientContact) string {
+	switch channel, _ := contactChannel(c); channel {
+	case "email":
+		return "we can't send email yet"
+	case "sms":
+		return "we can't send text messages yet"
+	}
+	return "we don't have a phone number or email for you"
+}
+
+// dispatchNotifications sends every pending notification in the outbox on
+// a channel the notifier delivers, and returns how many were delivered.
+func dispatchNotifications() int {
+	db := systemDB() // the outbox is shared by every tenant
+	var pending []Notification
+	err := db.Where("status = ? AND channel IN ?", "pending", notifier.Channels()).Order("id").Limit(100).Find(&pending).Error
+	if err != nil {
+		log.Printf("[notify] outbox read failed: %v", err)
+		return 0
+	}
+	sent := 0
+	for _, n := range pending {
+		updates := map[string]interface{}{"attempts": n.Attempts + 1}
+		if err := notifier.Send(n); err != nil {
+			updates["last_error"] = err.Error()
+			if n.Attempts+1 >= maxNotificationAttempts {
+				updates["status"] = "failed"
+			}
+			log.Printf("[notify] notification %d failed (attempt %d): %v", n.ID, n.Attempts+1, err)
+		} else {
+			now := nowFunc()
+			updates["status"], updates["sent_at"] = "sent", &now
+			sent++
+		}
+		if err := db.Model(&Notification{}).Where("id = ?", n.ID).Updates(updates).Error; err != nil {
+			log.Printf("[notify] notification %d: %v", n.ID, err)
+		}
+	}
+	return sent
+}
+
+// runBackgroundJobs expires stale waitlist offers and drains the outbox every
+// NOTIFY_INTERVAL_SECONDS until ctx is cancelled.
+func runBackgroundJobs(ctx context.Context) {
+	interval := time.Duration(envInt("NOTIFY_INTERVAL_SECONDS", 30, 1)) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expireWaitlistOffers()
+		dispatchNotifications()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"regexp"
@@ -14,8 +15,12 @@ import (
 )
 
 // QueryGroq sends a chat completion request to Groq API
-func QueryGroq(model, prompt string) (string, error) {
-	apiKey := os.Getenv("GROQ_API_KEY")
+func QueryGroq(model string, messages []ChatMessage) (string, error) {
+	return queryGroqWithKey(os.Getenv("GROQ_API_KEY"), model, messages)
+}
+
+// queryGroqWithKey is QueryGroq with a tenant's own API key
+func queryGroqWithKey(apiKey, model string, messages []ChatMessage) (string, error) {
 	if apiKey == "" {
 		return "", errors.New("GROQ_API_KEY not set")
 	}
@@ -30,7 +35,7 @@ func QueryGroq(model, prompt string) (string, error) {
 
 	payload := map[string]interface{}{
 		"model":                 model,
-		"messages":              []map[string]string{{"role": "user", "content": prompt}},
+		"messages":              messages,
 		"temperature":           0.8,
 		"max_completion_tokens": 512,
 		"top_p":                 1,
@@ -84,75 +89,55 @@ func QueryGroq(model, prompt string) (string, error) {
 	return strings.TrimSpace(result.Choices[0].Message.Content), nil
 }
 
-// AskForAppointmentFromMessage processes natural input and extracts intent
-func AskForAppointmentFromMessage(model, userMessage string, conv ConversationState) (Appointment, string, error) {
-	systemPrompt := `
-You are a friendly and conversational assistant that helps patients book doctor appointments.
-Your goal is to collect: doctor, date, time, patient name, and reason for appointment.
-
-IMPORTANT RULES:
-1. Extract information from the current message AND combine with any previous context provided
-2. If previous context has information (like doctor, date, time, patient name), USE IT - don't ignore it
-3. Extract patient names from:
-   - "Kevin Leitich, i want to see..." → extract "Kevin Leitich" 
-   - "my name is X" or "I'm X"
-   - Simple two capitalized words at start: "John Doe wants..."
-4. Extract doctor names from patterns like "Dr. Kim", "doctor Kim", "with Dr. Smith", "i want to see Dr. Angela"
-5. Extract dates from patterns like "4 nov", "november 4th", "tomorrow" - convert to YYYY-MM-DD format
-6. Extract times from patterns like "11am", "2pm", "4pm", "14:30" - MUST convert to 24-hour HH:MM format:
-   - "4pm" -> "16:00" (4 + 12 = 16)
-   - "11am" -> "11:00"
-   - "2:30pm" -> "14:30" (2 + 12 = 14)
-   - "12pm" -> "12:00"
-   - "12am" -> "00:00"
-7. Extract reason from phrases like "for checkup", "because of headache", "I need a checkup"
-
-CRITICAL: If you have doctor, date, time, and patient_name (from current message OR previous context), return JSON immediately.
-
-If all required details (doctor, date, time, patient_name) are provided, return JSON:
-{
-  "intent": "book",
-  "doctor": "Dr. Kim",
-  "date": "2025-11-04",
-  "time": "11:00",
-  "patient_name": "John Doe",
-  "reason": "checkup",
-  "reply": "Perfect! I've booked your appointment with Dr. Kim on November 4th at 11:00 AM for checkup. Thank you!"
-}
-
-If any REQUIRED information (doctor, date, time, patient_name) is missing, DO NOT return JSON. 
-ABSOLUTE RULE: If previous context has some fields, DO NOT ask for them again - only ask for what's missing.
-Check the "You ALREADY have" section - NEVER ask for anything listed there.
-`
+// QueryOllama sends a chat request to a local Ollama server
+func QueryOllama(model string, messages []ChatMessage) (string, error) {
+	if model == "" {
+		model = getEnv("OLLAMA_MODEL", "phi3")
+	}
+	baseURL := strings.TrimRight(getEnv("OLLAMA_URL", "http://localhost:11434"), "/")
 
-	// Build context from conversation history
-	contextStr := ""
-	if conv.Draft.Doctor != "" {
-		contextStr += fmt.Sprintf("You ALREADY have: Doctor = %s. ", conv.Draft.Doctor)
+	payload := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+		"stream":   false,
+		"options":  map[string]interface{}{"temperature": 0.8},
 	}
-	if conv.Draft.Date != "" {
-		contextStr += fmt.Sprintf("You ALREADY have: Date = %s. ", conv.Draft.Date)
+	body, _ := json.Marshal(payload)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Post(baseURL+"/api/chat", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
 	}
-	if conv.Draft.Time != "" {
-		contextStr += fmt.Sprintf("You ALREADY have: Time = %s. ", conv.Draft.Time)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
-	if conv.Draft.PatientName != "" {
-		contextStr += fmt.Sprintf("You ALREADY have: Patient name = %s. ", conv.Draft.PatientName)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Ollama error (status %d): %s", resp.StatusCode, string(data))
 	}
-	if conv.Draft.Reason != "" {
-		contextStr += fmt.Sprintf("You ALREADY have: Reason = %s. ", conv.Draft.Reason)
+
+	var result struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
 	}
-	if conv.LastUserMessage != "" {
-		contextStr += fmt.Sprintf("Previous user message: %s. ", conv.LastUserMessage)
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("failed to parse Ollama response: %w (response: %s)", err, string(data))
 	}
+	return strings.TrimSpace(result.Message.Content), nil
+}
 
-	fullPrompt := systemPrompt
-	if contextStr != "" {
-		fullPrompt += "\n\n" + contextStr
+// AskForAppointmentFromMessage processes natural input and extracts intent
+func AskForAppointmentFromMessage(cfg chatSettings, userMessage string, conv ConversationState) (Appointment, string, error) {
+	systemPrompt, err := cfg.Prompts.Render(promptExtract, newPromptData(cfg, conv, userMessage))
+	if err != nil {
+		return Appointment{}, "Sorry, something went wrong on our side.", err
 	}
-	fullPrompt += "\n\nCurrent user message: " + userMessage
 
-	raw, err := QueryGroq(model, fullPrompt)
+	raw, err := cfg.Client.Complete(cfg.Model, buildChatMessages(systemPrompt, conv, userMessage))
 	if err != nil {
 		return Appointment{}, "Sorry, I couldn’t reach the Groq API.", err
 	}
@@ -228,7 +213,7 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 			Status:      "pending",
 		}
 		// Return partial appointment so handler can update conversation state
-		reply, err := AskConversationalReply(model, userMessage, conv)
+		reply, err := AskConversationalReply(cfg, userMessage, conv)
 		if err != nil {
 			return Appointment{}, "I'm here to help! Could you please rephrase that?", err
 		}
@@ -236,7 +221,7 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 	}
 
 	// Extract reason from patterns like "for Dentist", "for checkup", etc.
-	reasonRe := regexp.MustCompile(`(?i)\b(?:for|because of|reason is|need)\s+([a-zA-Z]+(?:\s+[a-zA-Z]+)?)\b`)
+	reasonRe := regexp.MustCompile(`(?i)\b(?:for|because of|reason is|need)\s+(?:an?\s+|the\s+|my\s+)?([a-zA-Z]+(?:\s+[a-zA-Z]+)?)\b`)
 	var extractedReason string
 	if matches := reasonRe.FindStringSubmatch(userMessage); len(matches) > 1 {
 		extractedReason = strings.TrimSpace(matches[1])
@@ -315,7 +300,7 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 			Reason:      choose(partialApp.Reason, conv.Draft.Reason),
 			Status:      "pending",
 		}
-		reply, err := AskConversationalReply(model, userMessage, conv)
+		reply, err := AskConversationalReply(cfg, userMessage, conv)
 		if err != nil {
 			return Appointment{}, "I'm here to help! Could you please rephrase that?", err
 		}
@@ -332,7 +317,7 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 			Reason:      choose(extractedReason, conv.Draft.Reason),
 			Status:      "pending",
 		}
-		reply, err := AskConversationalReply(model, userMessage, conv)
+		reply, err := AskConversationalReply(cfg, userMessage, conv)
 		if err != nil {
 			return Appointment{}, "I'm here to help! Could you please rephrase that?", err
 		}
@@ -350,7 +335,7 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 			Reason:      conv.Draft.Reason,
 			Status:      "pending",
 		}
-		reply, err := AskConversationalReply(model, userMessage, conv)
+		reply, err := AskConversationalReply(cfg, userMessage, conv)
 		if err != nil {
 			return Appointment{}, "I'm here to help! Could you please rephrase that?", err
 		}
@@ -460,7 +445,7 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 	}
 
 	// Fallback to conversational reply
-	reply, err := AskConversationalReply(model, userMessage, conv)
+	reply, err := AskConversationalReply(cfg, userMessage, conv)
 	if err != nil {
 		return Appointment{}, "I'm here to help! Could you please rephrase that?", err
 	}
@@ -469,119 +454,13 @@ Check the "You ALREADY have" section - NEVER ask for anything listed there.
 }
 
 // AskConversationalReply creates friendly follow-up messages
-func AskConversationalReply(model, message string, conv ConversationState) (string, error) {
-	// Build context about what we already know
-	contextInfo := ""
-	missingFields := []string{}
-	
-	if conv.Draft.Doctor != "" {
-		contextInfo += fmt.Sprintf("You already have the doctor: %s. ", conv.Draft.Doctor)
-	} else {
-		missingFields = append(missingFields, "doctor")
-	}
-	if conv.Draft.Date != "" {
-		contextInfo += fmt.Sprintf("You already have the date: %s. ", conv.Draft.Date)
-	} else {
-		missingFields = append(missingFields, "date")
-	}
-	if conv.Draft.Time != "" {
-		contextInfo += fmt.Sprintf("You already have the time: %s. ", conv.Draft.Time)
-	} else {
-		missingFields = append(missingFields, "time")
-	}
-	if conv.Draft.PatientName != "" {
-		contextInfo += fmt.Sprintf("You already have the patient name: %s. ", conv.Draft.PatientName)
-	} else {
-		missingFields = append(missingFields, "patient name")
-	}
-	if conv.Draft.Reason != "" {
-		contextInfo += fmt.Sprintf("You already have the reason: %s. ", conv.Draft.Reason)
-	} else {
-		missingFields = append(missingFields, "reason")
-	}
-
-	missingStr := ""
-	if len(missingFields) > 0 {
-		missingStr = " You still need: " + strings.Join(missingFields, ", ") + "."
-	}
-
-	// Build what we have vs what we need
-	hasFields := []string{}
-	if conv.Draft.Doctor != "" {
-		hasFields = append(hasFields, "doctor ("+conv.Draft.Doctor+")")
-	}
-	if conv.Draft.PatientName != "" {
-		hasFields = append(hasFields, "patient name ("+conv.Draft.PatientName+")")
-	}
-	if conv.Draft.Date != "" {
-		hasFields = append(hasFields, "date ("+conv.Draft.Date+")")
-	}
-	if conv.Draft.Time != "" {
-		hasFields = append(hasFields, "time ("+conv.Draft.Time+")")
-	}
-	if conv.Draft.Reason != "" {
-		hasFields = append(hasFields, "reason ("+conv.Draft.Reason+")")
-	}
-
-	hasStr := ""
-	if len(hasFields) > 0 {
-		hasStr = "You ALREADY HAVE: " + strings.Join(hasFields, ", ") + ". "
+func AskConversationalReply(cfg chatSettings, message string, conv ConversationState) (string, error) {
+	prompt, err := cfg.Prompts.Render(promptReply, newPromptData(cfg, conv, message))
+	if err != nil {
+		return "", err
 	}
 
-	prompt := `
-You are a warm, friendly assistant helping patients book appointments.
-
-` + hasStr + missingStr + `
-
-ABSOLUTE CRITICAL RULES - YOU MUST FOLLOW THESE:
-1. NEVER EVER ask for information that is listed in "You ALREADY HAVE" above
-2. ONLY ask for what is in the "still need" list - nothing else
-3. If the "still need" list is empty, you have everything - confirm the booking or ask only for reason
-4. DO NOT mention or reference information you already have in your questions
-5. If you have doctor, date, time, and patient name - you MUST complete the booking (ask for reason if missing, but don't re-ask for other fields)
-
-EXAMPLE:
-- If you ALREADY HAVE: patient name (Kevin Leitich), doctor (Dr. Wangechi)
-- And user says "3 nov"
-- You should respond: "Great! What time works best for you?" (ONLY ask for time, NOT name or doctor)
-
-Keep responses short and natural.
-
-Current conversation state:
-- Doctor: ` + func() string {
-		if conv.Draft.Doctor != "" {
-			return conv.Draft.Doctor
-		}
-		return "NOT PROVIDED YET"
-	}() + `
-- Patient Name: ` + func() string {
-		if conv.Draft.PatientName != "" {
-			return conv.Draft.PatientName
-		}
-		return "NOT PROVIDED YET"
-	}() + `
-- Date: ` + func() string {
-		if conv.Draft.Date != "" {
-			return conv.Draft.Date
-		}
-		return "NOT PROVIDED YET"
-	}() + `
-- Time: ` + func() string {
-		if conv.Draft.Time != "" {
-			return conv.Draft.Time
-		}
-		return "NOT PROVIDED YET"
-	}() + `
-- Reason: ` + func() string {
-		if conv.Draft.Reason != "" {
-			return conv.Draft.Reason
-		}
-		return "NOT PROVIDED YET"
-	}() + `
-
-User just said: ` + message
-
-	resp, err := QueryGroq(model, prompt)
+	resp, err := cfg.Client.Complete(cfg.Model, buildChatMessages(prompt, conv, message))
 	if err != nil {
 		return "", err
 	}
@@ -595,6 +474,6 @@ User just said: ` + message
 
 // SaveAppointment simulates DB persistence
 func SaveAppointment(a Appointment) error {
-	fmt.Printf("✅ [Saved Appointment] %+v\n", a)
+	log.Printf("✅ [Saved Appointment] %+v", a)
 	return nil
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Patient is a person with appointments. NameKey is the normalised name used
+// for matching, so "John Doe" and "john  doe" are the same key. Phone is
+// kept as digits (with a leading + when given) and Email in lower case.
+type Patient struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  uint      `gorm:"not null;default:1;index" json:"-"`
+	Name      string    `gorm:"size:255;not null" json:"name"`
+	NameKey   string    `gorm:"size:255;index;not null" json:"-"`
+	DOB       string    `gorm:"size:10" json:"dob"`
+	Phone     string    `gorm:"size:32;index" json:"phone"`
+	Email     string    `gorm:"size:255;index" json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var nonNameCharRe = regexp.MustCompile(`[^\p{L}\p{N}' -]+`)
+
+// patientNameKey lower-cases a name and collapses punctuation and spacing.
+func patientNameKey(name string) string {
+	name = nonNameCharRe.ReplaceAllString(strings.ToLower(name), " ")
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// normalizePhone keeps the digits of a phone number and a leading +.
+func normalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	var b strings.Builder
+	for i, r := range phone {
+		if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalize tidies the patient's fields before matching or saving.
+func (p *Patient) normalize() {
+	p.Name = strings.Join(strings.Fields(p.Name), " ")
+	p.NameKey = patientNameKey(p.Name)
+	p.Phone = normalizePhone(p.Phone)
+	p.Email = strings.ToLower(strings.TrimSpace(p.Email))
+	p.DOB = strings.TrimSpace(p.DOB)
+}
+
+// BeforeSave keeps NameKey and the contact fields normalised on every write.
+func (p *Patient) BeforeSave(tx *gorm.DB) error {
+	p.normalize()
+	return nil
+}
+
+// patientViolations checks the fields of a patient record.
+func patientViolations(p Patient) []PolicyViolation {
+	var out []PolicyViolation
+	if p.NameKey == "" {
+		out = append(out, PolicyViolation{"name", "required", "Patient name is required."})
+	}
+	if p.DOB != "" {
+		if !isValidDate(p.DOB) {
+			out = append(out, PolicyViolation{"dob", "invalid_date", fmt.Sprintf("%s isn't a valid date of birth.", p.DOB)})
+		} else if p.DOB > clinicNow().Format("2006-01-02") {
+			out = append(out, PolicyViolation{"dob", "future_date", "Date of birth can't be in the future."})
+		}
+	}
+	if p.Phone != "" && countDigits(p.Phone) < 7 {
+		out = append(out, PolicyViolation{"phone", "invalid_phone", fmt.Sprintf("%s isn't a valid phone number.", p.Phone)})
+	}
+	if p.Email != "" && !validateEmail(p.Email) {
+		out = append(out, PolicyViolation{"email", "invalid_email", fmt.Sprintf("%s isn't a valid email address.", p.Email)})
+	}
+	return out
+}
+
+// compatible reports whether nothing known about p contradicts want: every
+// field set on both sides must agree.
+func (p Patient) compatible(want Patient) bool {
+	differ := func(a, b string) bool { return a != "" && b != "" && a != b }
+	return !differ(p.DOB, want.DOB) && !differ(p.Phone, want.Phone) && !differ(p.Email, want.Email)
+}
+
+// namesAgree reports whether two name keys can belong to one person: equal,
+// or every word of the shorter one appears in the longer ("john" and
+// "john doe").
+func namesAgree(a, b string) bool {
+	if a == "" || b == "" || a == b {
+		return true
+	}
+	short, long := strings.Fields(a), strings.Fields(b)
+	if len(short) > len(long) {
+		short, long = long, short
+	}
+	words := map[string]bool{}
+	for _, w := range long {
+		words[w] = true
+	}
+	for _, w := range short {
+		if !words[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPatient finds the existing record for want. Email, then phone, then
+// name plus date of birth identify a patient, as long as the names agree
+// (families often share a phone). A name alone matches only when exactly one
+// patient has it and none of their details contradict want.
+func matchPatient(tx *gorm.DB, want Patient) (*Patient, error) {
+	want.normalize()
+	var found []Patient
+	for _, q := range []struct {
+		cond  string
+		value string
+	}{{"email = ?", want.Email}, {"phone = ?", want.Phone}} {
+		if q.value == "" {
+			continue
+		}
+		if err := tx.Where(q.cond, q.value).Order("id").Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for i := range found {
+			if namesAgree(found[i].NameKey, want.NameKey) {
+				return &found[i], nil
+			}
+		}
+	}
+	if want.NameKey == "" {
+		return nil, nil
+	}
+	if err := tx.Where("name_key = ?", want.NameKey).Order("id").Find(&found).Error; err != nil {
+		return nil, err
+	}
+	if want.DOB != "" {
+		for i := range found {
+			if found[i].DOB == want.DOB {
+				return &found[i], nil
+			}
+		}
+	}
+	if len(found) == 1 && found[0].compatible(want) {
+		return &found[0], nil
+	}
+	return nil, nil
+}
+
+// findOrCreatePatient returns the patient matching want, filling in any
+// contact details the record was missing, or creates a new one.
+func findOrCreatePatient(tx *gorm.DB, want Patient) (Patient, error) {
+	want.normalize()
+	p, err := matchPatient(tx, want)
+	if err != nil {
+		return Patient{}, err
+	}
+	if p == nil {
+		want.ID = 0
+		err := tx.Create(&want).Error
+		return want, err
+	}
+	updates := map[string]interface{}{}
+	if p.DOB == "" && want.DOB != "" {
+		updates["dob"] = want.DOB
+	}
+	if p.Phone == "" && want.Phone != "" {
+		updates["phone"] = want.Phone
+	}
+	if p.Email == "" && want.Email != "" {
+		updates["email"] = want.Email
+	}
+	if len(updates) > 0 {
+		if err := tx.Model(p).Updates(updates).Error; err != nil {
+			return Patient{}, err
+		}
+	}
+	return *p, nil
+}
+
+// linkPatient points ap at the patient matching its name and contact,
+// creating the patient when needed.
+func linkPatient(tx *gorm.DB, ap *Appointment, contact PatientContact) error {
+	p, err := findOrCreatePatient(tx, Patient{Name: ap.PatientName, DOB: contact.DOB, Phone: contact.Phone, Email: contact.Email})
+	if err != nil {
+		return err
+	}
+	ap.PatientID = &p.ID
+	return nil
+}
+
+// resolvePatientID checks an explicit patient_id and takes the patient's name
+// for the appointment.
+func resolvePatientID(db *gorm.DB, ap *Appointment) []PolicyViolation {
+	if ap.PatientID == nil {
+		return nil
+	}
+	var p Patient
+	if err := db.First(&p, *ap.PatientID).Error; err != nil {
+		return []PolicyViolation{{"patient_id", "unknown_patient", fmt.Sprintf("Patient %d doesn't exist.", *ap.PatientID)}}
+	}
+	ap.PatientName = p.Name
+	return nil
+}
+
+// contactViolations checks the optional contact details sent with a booking.
+func contactViolations(c PatientContact) []PolicyViolation {
+	p := Patient{Name: "-", DOB: c.DOB, Phone: c.Phone, Email: c.Email}
+	p.normalize()
+	return patientViolations(p)
+}
+
+// PatientContact carries optional patient details sent alongside an
+// appointment (admin body fields, or picked up in chat).
+type PatientContact struct {
+	DOB   string `json:"patient_dob"`
+	Phone string `json:"patient_phone"`
+	Email string `json:"patient_email"`
+}
+
+func (c PatientContact) isZero() bool {
+	return strings.TrimSpace(c.DOB) == "" && strings.TrimSpace(c.Phone) == "" && strings.TrimSpace(c.Email) == ""
+}
+
+// contactFromMessage picks an email address or phone number out of a chat
+// message, using the same patterns as PII redaction.
+func contactFromMessage(message string) PatientContact {
+	var c PatientContact
+	c.Email = emailRe.FindString(message)
+	for _, m := range phoneRe.FindAllString(message, -1) {
+		if countDigits(m) >= 9 && !isoDateRe.MatchString(m) {
+			c.Phone = strings.TrimSpace(m)
+			break
+		}
+	}
+	return c
+}
+
+// backfillPatients links appointments saved before patients existed, by
+// name. updated_at is left alone.
+func backfillPatients() {
+	var apps []Appointment
+	if err := systemDB().Where("patient_id IS NULL AND patient_name <> ''").Order("id").Find(&apps).Error; err != nil {
+		log.Printf("[db] patient backfill failed: %v", err)
+		return
+	}
+	n := 0
+	for _, ap := range apps {
+		// Patients are matched within the appointment's own tenant
+		db := forTenant(ap.TenantID)
+		if err := linkPatient(db, &ap, PatientContact{}); err != nil {
+			log.Printf("[db] patient backfill skipped appointment %d: %v", ap.ID, err)
+			continue
+		}
+		if err := db.Model(&Appointment{}).Where("id = ?", ap.ID).UpdateColumn("patient_id", ap.PatientID).Error; err != nil {
+			log.Printf("[db] patient backfill skipped appointment %d: %v", ap.ID, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("[db] Linked %d appointments to patients", n)
+	}
+}
+
+// listPatients handles GET /admin/patients. ?q= searches name, phone and
+// email.
+func listPatients(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	q := db.Order("name")
+	if s := strings.TrimSpace(c.Query("q")); s != "" {
+		like := "%" + strings.ToLower(s) + "%"
+		q = q.Where("name_key LIKE ? OR email LIKE ? OR (? <> '' AND phone LIKE ?)",
+			"%"+patientNameKey(s)+"%", like, normalizePhone(s), "%"+normalizePhone(s)+"%")
+	}
+	var patients []Patient
+	if err := q.Find(&patients).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to list patients")
+	}
+	return c.JSON(patients)
+}
+
+// getPatient handles GET /admin/patients/:id with the patient's
+// appointments, most recent first.
+func getPatient(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var p Patient
+	if err := db.First(&p, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var apps []Appointment
+	if err := db.Where("patient_id = ?", p.ID).Order("starts_at DESC, id DESC").Find(&apps).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load appointments")
+	}
+	return c.JSON(fiber.Map{"patient": p, "appointments": apps})
+}
+
+func createPatient(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in Patient
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	in.ID = 0
+	in.normalize()
+	if v := patientViolations(in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if dup, err := matchPatient(db, in); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to check for duplicates")
+	} else if dup != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "patient already exists", "patient": dup})
+	}
+	if err := db.Create(&in).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create")
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+// updatePatient handles PUT /admin/patients/:id. A new name is copied to the
+// patient's appointments so lists stay consistent.
+func updatePatient(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var p Patient
+	if err := db.First(&p, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var in Patient
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	p.Name = choose(in.Name, p.Name)
+	p.DOB = choose(in.DOB, p.DOB)
+	p.Phone = choose(in.Phone, p.Phone)
+	p.Email = choose(in.Email, p.Email)
+	p.normalize()
+	if v := patientViolations(p); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&p).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Appointment{}).Where("patient_id = ?", p.ID).UpdateColumn("patient_name", p.Name).Error
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
+	}
+	return c.JSON(p)
+}
+
+// mergePatients handles POST /admin/patients/:id/merge with
+// {"duplicate_id": n}: the duplicate's appointments, series and waitlist
+// entries move to :id, details :id lacks are copied over, and the duplicate
+// is deleted, all in one transaction.
+func mergePatients(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var req struct {
+		DuplicateID uint `json:"duplicate_id"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.DuplicateID == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "duplicate_id is required")
+	}
+	var keep, dup Patient
+	if err := db.First(&keep, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	if keep.ID == req.DuplicateID {
+		return fiber.NewError(fiber.StatusBadRequest, "a patient can't be merged into itself")
+	}
+	if err := db.First(&dup, req.DuplicateID).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "duplicate not found")
+	}
+	keep.DOB = choose(keep.DOB, dup.DOB)
+	keep.Phone = choose(keep.Phone, dup.Phone)
+	keep.Email = choose(keep.Email, dup.Email)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&Appointment{}, &AppointmentSeries{}, &WaitlistEntry{}} {
+			if err := tx.Model(model).Where("patient_id = ?", dup.ID).
+				UpdateColumns(map[string]interface{}{"patient_id": keep.ID, "patient_name": keep.Name}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&dup).Error; err != nil {
+			return err
+		}
+		return tx.Save(&keep).Error
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to merge")
+	}
+	return c.JSON(keep)
+}
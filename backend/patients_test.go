@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestMergePatients merges a duplicate that has an appointment, a series
+// and a waitlist entry, and checks all three move to the kept patient.
+func TestMergePatients(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:merge?mode=memory&cache=shared")
+	tenant := Tenant{Slug: "merge", Name: "Merge Clinic", WidgetKey: "merge-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+
+	keep, err := findOrCreatePatient(tdb, Patient{Name: "Ann Wambui", Phone: "+254700000001"})
+	mustCreate(t, err)
+	dup, err := findOrCreatePatient(tdb, Patient{Name: "Anne Wambui", Email: "ann@example.com"})
+	mustCreate(t, err)
+	if keep.ID == dup.ID {
+		t.Fatal("the duplicate was matched to the kept patient")
+	}
+	ap := Appointment{PatientName: dup.Name, PatientID: &dup.ID, Doctor: "Dr. Lee", Date: "2030-01-07", Time: "10:00",
+		TimeZone: "UTC", Reason: "checkup", Status: StatusPending}
+	mustCreate(t, createWithStatus(tdb, &ap, PatientContact{}, "test", ""))
+	series := AppointmentSeries{RRule: "FREQ=WEEKLY;COUNT=2", PatientID: &dup.ID, PatientName: dup.Name, Doctor: "Dr. Lee",
+		StartDate: "2030-01-14", Time: "10:00", TimeZone: "UTC", Status: "active"}
+	mustCreate(t, tdb.Create(&series).Error)
+	entry := WaitlistEntry{PatientID: &dup.ID, PatientName: dup.Name, Email: dup.Email, Doctor: "Dr. Lee",
+		DateFrom: "2030-01-07", DateTo: "2030-01-21", Status: "waiting"}
+	mustCreate(t, tdb.Create(&entry).Error)
+
+	token, err := createJWTToken(1, tenant.ID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Post("/admin/patients/:id/merge", jwtMiddleware, mergePatients)
+	status, body := call(t, app, "POST", fmt.Sprintf("/admin/patients/%d/merge", keep.ID), token,
+		fmt.Sprintf(`{"duplicate_id": %d}`, dup.ID))
+	if status != fiber.StatusOK {
+		t.Fatalf("merge: %d %s", status, body)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		model interface{}
+		id    uint
+	}{
+		{"appointment", &Appointment{}, ap.ID},
+		{"series", &AppointmentSeries{}, series.ID},
+		{"waitlist entry", &WaitlistEntry{}, entry.ID},
+	} {
+		var got struct {
+			PatientID   *uint
+			PatientName string
+		}
+		if err := tdb.Model(tc.model).Where("id = ?", tc.id).Select("patient_id, patient_name").Scan(&got).Error; err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got.PatientID == nil || *got.PatientID != keep.ID || got.PatientName != keep.Name {
+			t.Errorf("%s belongs to %v %q, want %d %q", tc.name, got.PatientID, got.PatientName, keep.ID, keep.Name)
+		}
+	}
+	var merged Patient
+	if err := tdb.First(&merged, keep.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if merged.Email != "ann@example.com" {
+		t.Errorf("kept patient's email = %q, want the duplicate's", merged.Email)
+	}
+	if tdb.First(&Patient{}, dup.ID).Error == nil {
+		t.Error("the duplicate still exists")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// BookingPolicy holds the clinic's scheduling limits. Both chat and the admin
+// API check bookings against it (see validateBookingRules).
+type BookingPolicy struct {
+	MinLead       time.Duration // BOOKING_MIN_LEAD_MINUTES: notice needed before a booking
+	MaxDaysAhead  int           // BOOKING_MAX_DAYS_AHEAD: furthest bookable day from today
+	SameDayCutoff string        // BOOKING_SAME_DAY_CUTOFF: HH:MM after which today is closed; empty disables
+	SlotMinutes   int           // SLOT_MINUTES: start times are aligned to this grid from opening time
+}
+
+// currentPolicy reads the booking policy from the environment.
+func currentPolicy() BookingPolicy {
+	return BookingPolicy{
+		MinLead:       time.Duration(envInt("BOOKING_MIN_LEAD_MINUTES", 60, 0)) * time.Minute,
+		MaxDaysAhead:  envInt("BOOKING_MAX_DAYS_AHEAD", 90, 0),
+		SameDayCutoff: getEnv("BOOKING_SAME_DAY_CUTOFF", ""),
+		SlotMinutes:   slotMinutes(),
+	}
+}
+
+// slotMinutes returns the booking granularity from SLOT_MINUTES (default 15).
+func slotMinutes() int {
+	n := envInt("SLOT_MINUTES", 15, 1)
+	if n > 24*60 {
+		return 15
+	}
+	return n
+}
+
+// envInt reads a non-negative integer setting, falling back when it is
+// missing, malformed or below min.
+func envInt(key string, fallback, min int) int {
+	n, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil || n < min {
+		return fallback
+	}
+	return n
+}
+
+// checkDate validates a booking day (YYYY-MM-DD) against the horizon and the
+// same-day cutoff. now must be on the booking's wall clock.
+func (p BookingPolicy) checkDate(date string, now time.Time) []PolicyViolation {
+	today := now.Format("2006-01-02")
+	if date < today {
+		return []PolicyViolation{{"date", "past_date", fmt.Sprintf("%s is in the past.", date)}}
+	}
+	var out []PolicyViolation
+	last := time.Date(now.Year(), now.Month(), now.Day()+p.MaxDaysAhead, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
+	if date > last {
+		out = append(out, PolicyViolation{"date", "too_far_ahead",
+			fmt.Sprintf("We only take bookings up to %d days ahead (until %s).", p.MaxDaysAhead, last)})
+	}
+	if date == today && p.SameDayCutoff != "" && now.Format("15:04") >= p.SameDayCutoff {
+		out = append(out, PolicyViolation{"date", "same_day_cutoff",
+			fmt.Sprintf("Same-day bookings close at %s. Please choose another day.", p.SameDayCutoff)})
+	}
+	return out
+}
+
+// checkTime validates a start time (HH:MM) against the slot grid and, when
+// date is a valid day that has not passed, the minimum notice in loc.
+func (p BookingPolicy) checkTime(date, hhmm string, loc *time.Location, now time.Time) []PolicyViolation {
+	var out []PolicyViolation
+	open, _ := clinicHours()
+	if openMin, ok := clockMinutes(open); ok {
+		if at, ok := clockMinutes(hhmm); ok && p.SlotMinutes > 1 && (at-openMin)%p.SlotMinutes != 0 {
+			earlier := at - ((at-openMin)%p.SlotMinutes+p.SlotMinutes)%p.SlotMinutes
+			out = append(out, PolicyViolation{"time", "off_grid",
+				fmt.Sprintf("Appointments start every %d minutes, e.g. %s or %s.",
+					p.SlotMinutes, formatClock(earlier), formatClock(earlier+p.SlotMinutes))})
+		}
+	}
+
+	if !isValidDate(date) || date < now.Format("2006-01-02") {
+		return out
+	}
+	at, err := localInstant(date, hhmm, loc)
+	if err != nil {
+		return append(out, PolicyViolation{"time", "nonexistent_time",
+			fmt.Sprintf("%s doesn't exist on %s because the clocks go forward.", hhmm, date)})
+	}
+	switch {
+	case !at.After(now):
+		out = append(out, PolicyViolation{"time", "past_time", fmt.Sprintf("%s on %s has already passed.", hhmm, date)})
+	case at.Before(now.Add(p.MinLead)):
+		out = append(out, PolicyViolation{"time", "too_soon",
+			fmt.Sprintf("Appointments must be booked at least %s in advance.", humanDuration(p.MinLead))})
+	}
+	return out
+}
+
+// humanDuration renders whole hours and minutes, e.g. "2 hours" or "1 hour 30 minutes".
+func humanDuration(d time.Duration) string {
+	h, m := int(d.Hours()), int(d.Minutes())%60
+	unit := func(n int, word string) string {
+		if n == 1 {
+			return "1 " + word
+		}
+		return strconv.Itoa(n) + " " + word + "s"
+	}
+	switch {
+	case h == 0:
+		return unit(m, "minute")
+	case m == 0:
+		return unit(h, "hour")
+	}
+	return unit(h, "hour") + " " + unit(m, "minute")
+}
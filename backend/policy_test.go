@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// violationCodes lists the codes of vs, in order.
+func violationCodes(vs []PolicyViolation) []string {
+	var out []string
+	for _, v := range vs {
+		out = append(out, v.Code)
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBookingPolicy(t *testing.T) {
+	policy := BookingPolicy{MinLead: time.Hour, MaxDaysAhead: 30, SameDayCutoff: "16:00", SlotMinutes: 15}
+	now := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	late := time.Date(2030, 1, 7, 16, 30, 0, 0, time.UTC)
+	spring := time.Date(2030, 3, 1, 9, 0, 0, 0, time.UTC)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		date, time string
+		loc        *time.Location
+		now        time.Time
+		want       []string
+	}{
+		{"tomorrow on the grid", "2030-01-08", "10:15", time.UTC, now, nil},
+		{"yesterday", "2030-01-06", "10:00", time.UTC, now, []string{"past_date"}},
+		{"last day of the horizon", "2030-02-06", "10:00", time.UTC, now, nil},
+		{"past the horizon", "2030-02-07", "10:00", time.UTC, now, []string{"too_far_ahead"}},
+		{"off the grid", "2030-01-08", "10:20", time.UTC, now, []string{"off_grid"}},
+		{"earlier today", "2030-01-07", "08:30", time.UTC, now, []string{"past_time"}},
+		{"inside the lead time", "2030-01-07", "09:45", time.UTC, now, []string{"too_soon"}},
+		{"after the lead time", "2030-01-07", "10:00", time.UTC, now, nil},
+		{"today after the cutoff", "2030-01-07", "17:45", time.UTC, late, []string{"same_day_cutoff"}},
+		{"tomorrow after the cutoff", "2030-01-08", "09:00", time.UTC, late, nil},
+		{"skipped by the clocks", "2030-03-10", "02:30", newYork, spring, []string{"nonexistent_time"}},
+	} {
+		got := violationCodes(append(policy.checkDate(tc.date, tc.now.In(tc.loc)),
+			policy.checkTime(tc.date, tc.time, tc.loc, tc.now.In(tc.loc))...))
+		if !equalStrings(got, tc.want) {
+			t.Errorf("%s: %s %s got %q, want %q", tc.name, tc.date, tc.time, got, tc.want)
+		}
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Minute:                  "1 minute",
+		45 * time.Minute:             "45 minutes",
+		time.Hour:                    "1 hour",
+		2 * time.Hour:                "2 hours",
+		90 * time.Minute:             "1 hour 30 minutes",
+		25*time.Hour + 1*time.Minute: "25 hours 1 minute",
+	} {
+		if got := humanDuration(d); got != want {
+			t.Errorf("humanDuration(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Prompt templates live in prompts/<version>/*.tmpl. The embedded copy is used
+// unless PROMPT_DIR points at a directory with the same layout on disk.
+//
+//go:embed prompts
+var embeddedPrompts embed.FS
+
+const (
+	promptExtract = "extract.tmpl"
+	promptReply   = "reply.tmpl"
+)
+
+// PromptField is a piece of already collected information shown to the model.
+type PromptField struct {
+	Label string
+	Value string
+}
+
+// PromptData holds the variables available to every prompt template.
+type PromptData struct {
+	Today       string
+	Weekday     string
+	ExampleDate string
+	ClinicName  string
+	Doctors     []string
+	Have        []PromptField
+	Missing     []string
+	Draft       Appointment
+
+	// PreviousMessage and UserMessage splice the patient's text into the
+	// system prompt, as v1 does. Later versions get it as chat messages and
+	// must not use them.
+	PreviousMessage string
+	UserMessage     string
+}
+
+// PromptSet is a parsed, versioned set of prompt templates.
+type PromptSet struct {
+	Version string
+	Hash    string
+	tmpl    *template.Template
+}
+
+// ID identifies the exact prompt text used, e.g. "v2@3f2a9c1d".
+func (p *PromptSet) ID() string {
+	return p.Version + "@" + p.Hash
+}
+
+// Render executes the named template with data.
+func (p *PromptSet) Render(name string, data PromptData) (string, error) {
+	var buf bytes.Buffer
+	if err := p.tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", fmt.Errorf("render prompt %s (%s): %w", name, p.ID(), err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+var promptFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+}
+
+// loadPromptSet parses every template in <version>/ of fsys.
+func loadPromptSet(fsys fs.FS, version string) (*PromptSet, error) {
+	names, err := fs.Glob(fsys, version+"/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no prompt templates found for version %q", version)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	root := template.New(version).Funcs(promptFuncs)
+	for _, name := range names {
+		src, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(name))
+		h.Write(src)
+		base := name[strings.LastIndex(name, "/")+1:]
+		if _, err := root.New(base).Parse(string(src)); err != nil {
+			return nil, fmt.Errorf("parse prompt %s: %w", name, err)
+		}
+	}
+	for _, required := range []string{promptExtract, promptReply} {
+		if root.Lookup(required) == nil {
+			return nil, fmt.Errorf("prompt version %q is missing %s", version, required)
+		}
+	}
+	return &PromptSet{
+		Version: version,
+		Hash:    hex.EncodeToString(h.Sum(nil))[:8],
+		tmpl:    root,
+	}, nil
+}
+
+var (
+	promptsMu    sync.Mutex
+	promptsCache = map[string]*PromptSet{}
+)
+
+// currentPrompts returns the prompt set selected by PROMPT_VERSION and PROMPT_DIR.
+func currentPrompts() (*PromptSet, error) {
+	return promptsFor(getEnv("PROMPT_VERSION", "v2"))
+}
+
+// promptsFor returns the prompt set of version from PROMPT_DIR or the
+// embedded copy, loading each version once.
+func promptsFor(version string) (*PromptSet, error) {
+	promptsMu.Lock()
+	defer promptsMu.Unlock()
+	if ps, ok := promptsCache[version]; ok {
+		return ps, nil
+	}
+	var fsys fs.FS
+	if dir := os.Getenv("PROMPT_DIR"); dir != "" {
+		fsys = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(embeddedPrompts, "prompts")
+		if err != nil {
+			return nil, fmt.Errorf("open embedded prompts: %w", err)
+		}
+		fsys = sub
+	}
+	ps, err := loadPromptSet(fsys, version)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[config] Using prompt version %s", ps.ID())
+	promptsCache[version] = ps
+	return ps, nil
+}
+
+// clinicDoctors returns the doctors listed in CLINIC_DOCTORS (comma separated).
+func clinicDoctors() []string {
+	var out []string
+	for _, d := range strings.Split(os.Getenv("CLINIC_DOCTORS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// newPromptData fills the shared template variables from the tenant's
+// settings and the conversation. From v2 on templates leave user text out;
+// it is sent to the model as separate user-role messages (see
+// buildChatMessages). Only v1 still reads it from the prompt data.
+func newPromptData(cfg chatSettings, conv ConversationState, userMessage string) PromptData {
+	now := clinicNow()
+	data := PromptData{
+		Today:       now.Format("2006-01-02"),
+		Weekday:     now.Weekday().String(),
+		ExampleDate: now.AddDate(0, 0, 1).Format("2006-01-02"),
+		ClinicName:  cfg.ClinicName,
+		Doctors:     cfg.Doctors,
+		Draft:       conv.Draft,
+
+		PreviousMessage: conv.LastUserMessage,
+		UserMessage:     userMessage,
+	}
+	fields := []struct{ label, value, missing string }{
+		{"Doctor", conv.Draft.Doctor, "doctor"},
+		{"Patient name", conv.Draft.PatientName, "patient name"},
+		{"Date", conv.Draft.Date, "date"},
+		{"Time", choose(conv.Draft.Time, conv.Window.Label), "time"},
+		{"Reason", conv.Draft.Reason, "reason"},
+	}
+	for _, f := range fields {
+		if f.value != "" {
+			data.Have = append(data.Have, PromptField{Label: f.label, Value: f.value})
+		} else {
+			data.Missing = append(data.Missing, f.missing)
+		}
+	}
+	return data
+}
+
+// buildChatMessages keeps the system prompt and user content in separate roles.
+// The previous exchange is replayed as history so the model has context
+// without user text ever being spliced into the system prompt.
+func buildChatMessages(system string, conv ConversationState, userMessage string) []ChatMessage {
+	msgs := []ChatMessage{{Role: "system", Content: system}}
+	if conv.Draft.PatientName != "" {
+		msgs[0].Sensitive = []string{conv.Draft.PatientName}
+	}
+	if conv.LastUserMessage != "" {
+		msgs = append(msgs, ChatMessage{Role: "user", Content: conv.LastUserMessage})
+		if conv.LastAIMessage != "" {
+			msgs = append(msgs, ChatMessage{Role: "assistant", Content: conv.LastAIMessage})
+		}
+	}
+	return append(msgs, ChatMessage{Role: "user", Content: userMessage})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPromptVersions(t *testing.T) {
+	conv := ConversationState{Draft: Appointment{Doctor: "Dr. Kim"}, LastUserMessage: "I need Dr. Kim"}
+	for _, tc := range []struct {
+		version  string
+		userText bool // whether the templates splice in the patient's text
+	}{
+		{"v1", true},
+		{"v2", false},
+	} {
+		ps, err := promptsFor(tc.version)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.version, err)
+		}
+		data := newPromptData(chatSettings{Prompts: ps, Doctors: []string{"Dr. Kim"}}, conv, "tomorrow at 10am")
+		for _, name := range []string{promptExtract, promptReply} {
+			out, err := ps.Render(name, data)
+			if err != nil {
+				t.Errorf("%s %s: %v", tc.version, name, err)
+				continue
+			}
+			if got := strings.Contains(out, "tomorrow at 10am"); got != tc.userText {
+				t.Errorf("%s %s: contains the user's message = %v, want %v", tc.version, name, got, tc.userText)
+			}
+		}
+	}
+}
+
+func TestCurrentPromptsUnknownVersion(t *testing.T) {
+	t.Setenv("PROMPT_VERSION", "v0")
+	if ps, err := currentPrompts(); err == nil {
+		t.Errorf("PROMPT_VERSION=v0 loaded %s, want an error", ps.ID())
+	}
+	t.Setenv("PROMPT_VERSION", "v2")
+	if _, err := currentPrompts(); err != nil {
+		t.Errorf("PROMPT_VERSION=v2: %v", err)
+	}
+}
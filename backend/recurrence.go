@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSeriesOccurrences caps how many appointments one series may create.
+const maxSeriesOccurrences = 52
+
+// RRule is the supported subset of an RFC 5545 recurrence rule:
+// FREQ=DAILY|WEEKLY|MONTHLY, INTERVAL, BYDAY (weekly only), and COUNT or
+// UNTIL. Every series must end.
+type RRule struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    string // YYYY-MM-DD, inclusive
+	ByDay    []time.Weekday
+}
+
+var rruleDays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// parseRRule reads a rule such as "FREQ=WEEKLY;BYDAY=TU;COUNT=6", with or
+// without the "RRULE:" prefix.
+func parseRRule(s string) (RRule, error) {
+	r := RRule{Interval: 1}
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("invalid rule part %q", part)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "FREQ":
+			if val != "DAILY" && val != "WEEKLY" && val != "MONTHLY" {
+				return r, fmt.Errorf("FREQ must be DAILY, WEEKLY or MONTHLY, not %s", val)
+			}
+			r.Freq = val
+		case "INTERVAL", "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return r, fmt.Errorf("%s must be a positive number", key)
+			}
+			if key == "INTERVAL" {
+				r.Interval = n
+			} else {
+				r.Count = n
+			}
+		case "UNTIL":
+			val = strings.SplitN(val, "T", 2)[0]
+			if len(val) == 8 {
+				val = val[:4] + "-" + val[4:6] + "-" + val[6:]
+			}
+			if !isValidDate(val) {
+				return r, fmt.Errorf("UNTIL must be a date such as 20251230")
+			}
+			r.Until = val
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				wd, ok := rruleDays[strings.TrimSpace(d)]
+				if !ok {
+					return r, fmt.Errorf("unknown BYDAY value %q", d)
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		default:
+			return r, fmt.Errorf("%s is not supported", key)
+		}
+	}
+	switch {
+	case r.Freq == "":
+		return r, fmt.Errorf("FREQ is required")
+	case r.Count == 0 && r.Until == "":
+		return r, fmt.Errorf("COUNT or UNTIL is required")
+	case r.Count > 0 && r.Until != "":
+		return r, fmt.Errorf("use COUNT or UNTIL, not both")
+	case len(r.ByDay) > 0 && r.Freq != "WEEKLY":
+		return r, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY")
+	}
+	return r, nil
+}
+
+// String renders the rule in canonical form.
+func (r RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, wd := range r.ByDay {
+			days = append(days, strings.ToUpper(wd.String()[:2]))
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != "" {
+		parts = append(parts, "UNTIL="+strings.ReplaceAll(r.Until, "-", ""))
+	}
+	return strings.Join(parts, ";")
+}
+
+// dates lists the occurrence days (YYYY-MM-DD) starting on start, which
+// counts as the first occurrence when it matches the rule.
+func (r RRule) dates(start string) ([]string, error) {
+	first, err := time.Parse("2006-01-02", start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start date %q", start)
+	}
+	var out []string
+	done := func(d time.Time) bool {
+		return (r.Count > 0 && len(out) >= r.Count) || (r.Until != "" && d.Format("2006-01-02") > r.Until)
+	}
+	add := func(d time.Time) error {
+		if len(out) == maxSeriesOccurrences {
+			return fmt.Errorf("a series can have at most %d appointments", maxSeriesOccurrences)
+		}
+		out = append(out, d.Format("2006-01-02"))
+		return nil
+	}
+
+	switch r.Freq {
+	case "DAILY":
+		for d := first; !done(d); d = d.AddDate(0, 0, r.Interval) {
+			if err := add(d); err != nil {
+				return nil, err
+			}
+		}
+	case "WEEKLY":
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{first.Weekday()}
+		}
+		offsets := make([]int, 0, len(days))
+		for _, wd := range days {
+			offsets = append(offsets, weekdayOffset(wd))
+		}
+		sort.Ints(offsets)
+		week := startOfWeek(first)
+		for {
+			for _, off := range offsets {
+				d := week.AddDate(0, 0, off)
+				if d.Before(first) {
+					continue
+				}
+				if done(d) {
+					return out, nil
+				}
+				if err := add(d); err != nil {
+					return nil, err
+				}
+			}
+			week = week.AddDate(0, 0, 7*r.Interval)
+		}
+	case "MONTHLY":
+		// Months without the start's day (e.g. the 31st) are skipped
+		for i := 0; ; i += r.Interval {
+			d, ok := makeDate(first.Year(), int(first.Month())+i, first.Day(), time.UTC)
+			if ok && done(d) {
+				break
+			}
+			if !ok {
+				if i > 12*10 {
+					break
+				}
+				continue
+			}
+			if err := add(d); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+var (
+	everyRe = regexp.MustCompile(`(?i)\b(?:every\s+(other\s+|(\d+|two|three|four)\s+)?(day|weekday|week|month|mon(?:day)?|tue(?:s|sday)?|wed(?:nesday)?|thu(?:rs|rsday)?|fri(?:day)?|sat(?:urday)?|sun(?:day)?)s?|(daily|weekly|fortnightly|biweekly|monthly))\b`)
+	forRe   = regexp.MustCompile(`(?i)\bfor\s+(?:the\s+next\s+)?(\d+|a|an|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve)\s+(days?|weeks?|months?|times|sessions|visits)\b`)
+	timesRe = regexp.MustCompile(`(?i)\b(\d+|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve)\s+(times|sessions|visits)\b`)
+	untilRe = regexp.MustCompile(`(?i)\b(?:until|till|through)\s+(.+)$`)
+)
+
+// recurrenceFromText reads "every Tuesday for 6 weeks", "weekly, 4 sessions"
+// or "every other day until 30th November" starting on date (YYYY-MM-DD).
+// hasEnd is false when the patient asked for a repeat without saying for how
+// long; the rule then has no COUNT or UNTIL yet.
+func recurrenceFromText(text, date string, now time.Time) (rule RRule, found, hasEnd bool) {
+	m := everyRe.FindStringSubmatch(text)
+	if m == nil {
+		return RRule{}, false, false
+	}
+	rule = RRule{Freq: "WEEKLY", Interval: 1}
+	if strings.TrimSpace(strings.ToLower(m[1])) == "other" {
+		rule.Interval = 2
+	} else if m[2] != "" {
+		rule.Interval = wordNumber(m[2])
+	}
+	switch unit := strings.ToLower(m[3] + m[4]); unit {
+	case "day", "daily":
+		rule.Freq = "DAILY"
+	case "weekday":
+		rule.ByDay = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	case "week", "weekly":
+	case "fortnightly", "biweekly":
+		rule.Interval = 2
+	case "month", "monthly":
+		rule.Freq = "MONTHLY"
+	default:
+		if wd, ok := parseWeekday(unit); ok {
+			rule.ByDay = []time.Weekday{wd}
+		}
+	}
+	return rule, true, applyRecurrenceEnd(&rule, text, date, now)
+}
+
+// applyRecurrenceEnd sets COUNT or UNTIL from "for 6 weeks", "4 sessions" or
+// "until <date>" in text, and reports whether it found one. Bare numbers
+// aren't accepted: "6" on its own reads as a time.
+func applyRecurrenceEnd(rule *RRule, text, date string, now time.Time) bool {
+	start, err := time.Parse("2006-01-02", date)
+	if m := forRe.FindStringSubmatch(text); m != nil {
+		n := wordNumber(m[1])
+		unit := strings.TrimSuffix(strings.ToLower(m[2]), "s")
+		if unit == "time" || unit == "session" || unit == "visit" {
+			rule.Count = n
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		// The series covers n units from the first appointment
+		end := start
+		switch unit {
+		case "day":
+			end = start.AddDate(0, 0, n)
+		case "week":
+			end = start.AddDate(0, 0, 7*n)
+		case "month":
+			end = start.AddDate(0, n, 0)
+		}
+		rule.Until = end.AddDate(0, 0, -1).Format("2006-01-02")
+		return true
+	}
+	if m := timesRe.FindStringSubmatch(text); m != nil {
+		rule.Count = wordNumber(m[1])
+		return true
+	}
+	if m := untilRe.FindStringSubmatch(text); m != nil {
+		if dm, ok := resolveDate(m[1], now, configuredDateOrder()); ok {
+			rule.Until = dm.Date.Format("2006-01-02")
+			return true
+		}
+	}
+	return false
+}
+
+// mentionsSeriesEnd reports whether text says how long a series runs.
+func mentionsSeriesEnd(text string) bool {
+	return forRe.MatchString(text) || timesRe.MatchString(text) || untilRe.MatchString(text)
+}
+
+// withoutSeriesEnd blanks an "until <date>" phrase so the end of a series is
+// never read as the date of its first appointment.
+func withoutSeriesEnd(text string) string {
+	if m := untilRe.FindStringIndex(text); m != nil {
+		return text[:m[0]] + strings.Repeat(" ", m[1]-m[0])
+	}
+	return text
+}
+
+func wordNumber(s string) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return numberWords[strings.ToLower(s)]
+}
+
+// describeRule phrases a rule for the patient, e.g. "every Tuesday".
+func describeRule(r RRule) string {
+	every := "every"
+	if r.Interval == 2 {
+		every = "every other"
+	} else if r.Interval > 2 {
+		every = fmt.Sprintf("every %d", r.Interval)
+	}
+	switch {
+	case r.Freq == "DAILY":
+		return every + " day"
+	case r.Freq == "MONTHLY":
+		return every + " month"
+	case len(r.ByDay) == 5 && r.Interval == 1:
+		return "every weekday"
+	case len(r.ByDay) > 0:
+		var days []string
+		for _, wd := range r.ByDay {
+			days = append(days, wd.String())
+		}
+		return every + " " + strings.Join(days, " and ")
+	}
+	return every + " week"
+}
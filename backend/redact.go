@@ -0,0 +1,139 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PII patterns replaced before a request leaves for an external provider.
+var (
+	emailRe       = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phoneRe       = regexp.MustCompile(`\+?\(?\d[\d\s().-]{7,}\d`)
+	idKeywordRe   = regexp.MustCompile(`(?i)\b(?:national id|id|passport|nhif|ssn|insurance|patient)(?:\s*(?:no\.?|number|#))?\s*[:#]?\s*([A-Z0-9][A-Z0-9-]{4,})\b`)
+	longDigitRe   = regexp.MustCompile(`\b\d{6,}\b`)
+	isoDateRe     = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+	statedNameRe  = regexp.MustCompile(`(?:[Mm]y name is|I'm|I am|[Tt]his is|[Nn]ame:)\s+([A-Z][a-zA-Z'-]+(?:\s+[A-Z][a-zA-Z'-]+)?)`)
+	leadingNameRe = regexp.MustCompile(`^([A-Z][a-zA-Z'-]+\s+[A-Z][a-zA-Z'-]+)\s*,`)
+	bareNameRe    = regexp.MustCompile(`^[A-Z][a-zA-Z'-]+(?:\s+[A-Z][a-zA-Z'-]+){0,2}$`)
+	placeholderRe = regexp.MustCompile(`\[?\b(PERSON|PHONE|EMAIL|ID)_(\d+)\b\]?`)
+)
+
+// piiRedactor swaps PII for stable placeholders such as [PERSON_1] and
+// remembers the mapping so replies can be restored. Use one per request.
+type piiRedactor struct {
+	byValue  map[string]string
+	byHolder map[string]string
+	counts   map[string]int
+}
+
+func newPIIRedactor() *piiRedactor {
+	return &piiRedactor{byValue: map[string]string{}, byHolder: map[string]string{}, counts: map[string]int{}}
+}
+
+func (r *piiRedactor) placeholder(kind, value string) string {
+	key := kind + "\x00" + strings.ToLower(value)
+	if p, ok := r.byValue[key]; ok {
+		return p
+	}
+	r.counts[kind]++
+	p := "[" + kind + "_" + strconv.Itoa(r.counts[kind]) + "]"
+	r.byValue[key] = p
+	r.byHolder[p] = value
+	return p
+}
+
+// redact replaces emails, phone numbers, ID numbers and the given names.
+func (r *piiRedactor) redact(text string, names []string) string {
+	text = emailRe.ReplaceAllStringFunc(text, func(m string) string { return r.placeholder("EMAIL", m) })
+	text = phoneRe.ReplaceAllStringFunc(text, func(m string) string {
+		if countDigits(m) < 9 || isoDateRe.MatchString(m) {
+			return m
+		}
+		return r.placeholder("PHONE", strings.TrimSpace(m))
+	})
+	text = idKeywordRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := idKeywordRe.FindStringSubmatch(m)
+		if countDigits(sub[1]) == 0 {
+			return m
+		}
+		return strings.Replace(m, sub[1], r.placeholder("ID", sub[1]), 1)
+	})
+	text = longDigitRe.ReplaceAllStringFunc(text, func(m string) string { return r.placeholder("ID", m) })
+
+	// Longest names first so "Kevin Leitich" wins over "Kevin".
+	sorted := append([]string(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, name := range sorted {
+		name = strings.TrimSpace(name)
+		if len(name) < 2 {
+			continue
+		}
+		re := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(name) + `\b`)
+		text = re.ReplaceAllStringFunc(text, func(m string) string { return r.placeholder("PERSON", name) })
+	}
+	return text
+}
+
+// restore puts the original values back, tolerating a model that dropped the brackets.
+func (r *piiRedactor) restore(text string) string {
+	return placeholderRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := placeholderRe.FindStringSubmatch(m)
+		if v, ok := r.byHolder["["+sub[1]+"_"+sub[2]+"]"]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+func countDigits(s string) int {
+	n := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// detectPatientNames finds names the patient stated about themselves. A short
+// capitalised answer right after we asked for a name counts as a name too.
+func detectPatientNames(messages []ChatMessage) []string {
+	var names []string
+	for i, m := range messages {
+		names = append(names, m.Sensitive...)
+		if m.Role != "user" {
+			continue
+		}
+		content := strings.TrimSpace(m.Content)
+		for _, sub := range statedNameRe.FindAllStringSubmatch(content, -1) {
+			names = append(names, sub[1])
+		}
+		if sub := leadingNameRe.FindStringSubmatch(content); sub != nil {
+			names = append(names, sub[1])
+		}
+		if i > 0 && messages[i-1].Role == "assistant" &&
+			strings.Contains(strings.ToLower(messages[i-1].Content), "name") && bareNameRe.MatchString(content) {
+			names = append(names, content)
+		}
+	}
+	return names
+}
+
+// redactingClient strips PII from every message before calling the wrapped
+// provider and restores it in the reply.
+type redactingClient struct {
+	inner LLMClient
+}
+
+func (c redactingClient) Complete(model string, messages []ChatMessage) (string, error) {
+	r := newPIIRedactor()
+	names := detectPatientNames(messages)
+	out := make([]ChatMessage, len(messages))
+	for i, m := range messages {
+		out[i] = ChatMessage{Role: m.Role, Content: r.redact(m.Content, names)}
+	}
+	resp, err := c.inner.Complete(model, out)
+	return r.restore(resp), err
+}
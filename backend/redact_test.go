@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCassetteHoldsNoPII records through a provider that doesn't ask for
+// redaction, as a local Ollama server doesn't, and checks that neither the
+// LLM traffic nor the chat turns in the file contain the patient's details.
+func TestCassetteHoldsNoPII(t *testing.T) {
+	defer func(orig *cassetteRecorder) { activeRecorder = orig }(activeRecorder)
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	fake := &scriptedLLM{queue: []string{"Thanks [PERSON_1], we'll confirm by email to [EMAIL_1]."}}
+	client, redact, err := withCassette(fake, "record", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !redact {
+		t.Error("recording a cassette left redaction off")
+	}
+	message := "I'm Kevin Leitich, reach me at kevin@example.com or +254 712 345 678"
+	request := []ChatMessage{
+		{Role: "system", Content: "You help Kevin Leitich book.", Sensitive: []string{"Kevin Leitich"}},
+		{Role: "user", Content: message},
+	}
+	recordChatTurn("s1", message)
+	want := "Thanks Kevin Leitich, we'll confirm by email to kevin@example.com."
+	if got, err := client.Complete("model", request); got != want || err != nil {
+		t.Errorf("recording: got %q, %v; want %q", got, err, want)
+	}
+	mustCreate(t, activeRecorder.f.Close())
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pii := range []string{"Kevin", "Leitich", "kevin@example.com", "712 345 678"} {
+		if strings.Contains(string(raw), pii) {
+			t.Errorf("the cassette contains %q:\n%s", pii, raw)
+		}
+	}
+
+	// The replay redacts the same request the same way, so it is found
+	client, _, err = withCassette(nil, "replay", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Complete("model", request); got != want || err != nil {
+		t.Errorf("replay: got %q, %v; want %q", got, err, want)
+	}
+}
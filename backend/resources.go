@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Resource is a room or device some visits need, such as an ultrasound
+// machine. Kind groups interchangeable resources: a type that needs an
+// "ultrasound" takes any free resource of that kind. A resource with a
+// LocationID only serves that branch.
+type Resource struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	TenantID   uint      `gorm:"not null;default:1;uniqueIndex:idx_resources_tenant_name,priority:1" json:"-"`
+	Name       string    `gorm:"size:100;uniqueIndex:idx_resources_tenant_name,priority:2;not null" json:"name"`
+	Kind       string    `gorm:"size:100;not null;index" json:"kind"`
+	LocationID *uint     `gorm:"index" json:"location_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ResourceBooking holds a resource for an appointment. The resource is busy
+// for the appointment's blocked span, buffers included, until the
+// appointment is cancelled.
+type ResourceBooking struct {
+	ID            uint `gorm:"primaryKey" json:"id"`
+	TenantID      uint `gorm:"not null;default:1;index" json:"-"`
+	AppointmentID uint `gorm:"not null;index" json:"appointment_id"`
+	ResourceID    uint `gorm:"not null;index" json:"resource_id"`
+}
+
+// resourceHold is one held span of a resource.
+type resourceHold struct {
+	ResourceID   uint
+	BlockedFrom  time.Time
+	BlockedUntil time.Time
+}
+
+// resourceHolds returns the spans of resources ids held by appointments other
+// than excludeID that overlap [from, until).
+func resourceHolds(db *gorm.DB, ids []uint, from, until time.Time, excludeID uint) ([]resourceHold, error) {
+	var holds []resourceHold
+	if len(ids) == 0 {
+		return holds, nil
+	}
+	err := db.Model(&Appointment{}).
+		Select("resource_bookings.resource_id, appointments.blocked_from, appointments.blocked_until").
+		Joins("JOIN resource_bookings ON resource_bookings.appointment_id = appointments.id").
+		Where("resource_bookings.resource_id IN ? AND appointments.status <> ? AND appointments.id <> ? AND appointments.blocked_from < ? AND appointments.blocked_until > ?",
+			ids, StatusCancelled, excludeID, until.UTC(), from.UTC()).
+		Scan(&holds).Error
+	return holds, err
+}
+
+// resourcePool is what a visit could use: the resources of each kind its
+// type needs and when they are already held.
+type resourcePool struct {
+	typeName string
+	needs    []string
+	byKind   map[string][]Resource
+	held     map[uint][]Appointment // spans per resource, for overlapsAny
+}
+
+// loadResourcePool collects the resources ap's type needs at ap's branch and
+// their holds between from and until.
+func loadResourcePool(db *gorm.DB, ap Appointment, from, until time.Time) (resourcePool, error) {
+	pool := resourcePool{byKind: map[string][]Resource{}, held: map[uint][]Appointment{}}
+	if ap.AppointmentTypeID == nil {
+		return pool, nil
+	}
+	var t AppointmentType
+	if err := db.First(&t, *ap.AppointmentTypeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return pool, nil
+		}
+		return pool, err
+	}
+	pool.typeName, pool.needs = t.Name, t.Resources
+	if len(pool.needs) == 0 {
+		return pool, nil
+	}
+	var rs []Resource
+	q := db.Where("kind IN ?", []string(pool.needs))
+	if ap.LocationID != nil {
+		q = q.Where("location_id IS NULL OR location_id = ?", *ap.LocationID)
+	}
+	if err := q.Order("name").Find(&rs).Error; err != nil {
+		return pool, err
+	}
+	ids := make([]uint, 0, len(rs))
+	for _, r := range rs {
+		pool.byKind[r.Kind] = append(pool.byKind[r.Kind], r)
+		ids = append(ids, r.ID)
+	}
+	holds, err := resourceHolds(db, ids, from, until, ap.ID)
+	if err != nil {
+		return pool, err
+	}
+	for _, h := range holds {
+		pool.held[h.ResourceID] = append(pool.held[h.ResourceID], Appointment{BlockedFrom: h.BlockedFrom, BlockedUntil: h.BlockedUntil})
+	}
+	return pool, nil
+}
+
+// pick chooses one free resource per needed kind for [from, until). When a
+// kind has nothing free it returns that kind instead.
+func (p resourcePool) pick(from, until time.Time) ([]Resource, string) {
+	var picked []Resource
+	taken := map[uint]bool{}
+	for _, kind := range p.needs {
+		found := false
+		for _, r := range p.byKind[kind] {
+			if taken[r.ID] || overlapsAny(p.held[r.ID], from, until) {
+				continue
+			}
+			picked, taken[r.ID], found = append(picked, r), true, true
+			break
+		}
+		if !found {
+			return nil, kind
+		}
+	}
+	return picked, ""
+}
+
+// resourceViolations checks that every resource ap's type needs has one
+// free for ap's blocked span.
+func resourceViolations(db *gorm.DB, ap Appointment) ([]PolicyViolation, error) {
+	if err := ap.normalizeSchedule(); err != nil || ap.StartsAt.IsZero() {
+		return nil, err
+	}
+	pool, err := loadResourcePool(db, ap, ap.BlockedFrom, ap.BlockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	_, missing := pool.pick(ap.BlockedFrom, ap.BlockedUntil)
+	if missing == "" {
+		return nil, nil
+	}
+	if len(pool.byKind[missing]) == 0 {
+		return []PolicyViolation{{"appointment_type_id", "resource_missing",
+			fmt.Sprintf("%s appointments need a %s, and there isn't one%s.", capitalize(pool.typeName), missing, atBranch(db, ap.LocationID))}}, nil
+	}
+	return []PolicyViolation{{"time", "resource_unavailable",
+		fmt.Sprintf("No %s is free at %s on %s.", missing, ap.Time, ap.Date)}}, nil
+}
+
+var errResourceTaken = errors.New("a resource this appointment needs was just booked")
+
+// holdResources books the resources ap needs for its current slot, replacing
+// any it held before. Callers check resourceViolations first; a resource
+// taken in between fails the transaction.
+func holdResources(tx *gorm.DB, ap *Appointment) error {
+	if err := tx.Where("appointment_id = ?", ap.ID).Delete(&ResourceBooking{}).Error; err != nil {
+		return err
+	}
+	if ap.Status == StatusCancelled || ap.StartsAt.IsZero() {
+		return nil
+	}
+	pool, err := loadResourcePool(tx, *ap, ap.BlockedFrom, ap.BlockedUntil)
+	if err != nil {
+		return err
+	}
+	picked, missing := pool.pick(ap.BlockedFrom, ap.BlockedUntil)
+	if missing != "" {
+		return errResourceTaken
+	}
+	for _, r := range picked {
+		if err := tx.Create(&ResourceBooking{AppointmentID: ap.ID, ResourceID: r.ID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func listResources(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	q, err := locationFilter(c, db)
+	if err != nil {
+		return err
+	}
+	if kind := c.Query("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	var rs []Resource
+	if err := q.Order("kind, name").Find(&rs).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch")
+	}
+	return c.JSON(rs)
+}
+
+func createResource(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in Resource
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	in.ID = 0
+	if v := resourceFieldViolations(db, &in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Create(&in).Error; err != nil {
+		return fiber.NewError(fiber.StatusConflict, "a resource with this name already exists")
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+func updateResource(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var r Resource
+	if err := db.First(&r, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	id, created := r.ID, r.CreatedAt
+	if err := c.BodyParser(&r); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	r.ID, r.CreatedAt = id, created
+	if v := resourceFieldViolations(db, &r); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Save(&r).Error; err != nil {
+		return fiber.NewError(fiber.StatusConflict, "a resource with this name already exists")
+	}
+	return c.JSON(r)
+}
+
+// deleteResource handles DELETE /admin/resources/:id. A resource held by an
+// upcoming appointment can't be removed until those are moved or cancelled.
+func deleteResource(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var r Resource
+	if err := db.First(&r, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	holds, err := resourceHolds(db, []uint{r.ID}, nowFunc(), time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), 0)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to check bookings")
+	}
+	if len(holds) > 0 {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("%s is booked for %d upcoming appointments", r.Name, len(holds)))
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("resource_id = ?", r.ID).Delete(&ResourceBooking{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&r).Error
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to delete")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// resourceFieldViolations normalises an admin-supplied resource and reports
+// what is wrong with it.
+func resourceFieldViolations(db *gorm.DB, r *Resource) []PolicyViolation {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Kind = strings.ToLower(strings.TrimSpace(r.Kind))
+	var out []PolicyViolation
+	if r.Name == "" {
+		out = append(out, PolicyViolation{"name", "required", "Name is required."})
+	}
+	if r.Kind == "" {
+		out = append(out, PolicyViolation{"kind", "required", "Kind is required, e.g. \"exam room\" or \"ultrasound\"."})
+	}
+	if r.LocationID != nil {
+		var n int64
+		if err := db.Model(&Location{}).Where("id = ?", *r.LocationID).Count(&n).Error; err != nil || n == 0 {
+			out = append(out, PolicyViolation{"location_id", "unknown_location", fmt.Sprintf("Location %d doesn't exist.", *r.LocationID)})
+		}
+	}
+	return out
+}
+
+// resourceUsage is one resource's line in the utilization report.
+type resourceUsage struct {
+	Resource      Resource `json:"resource"`
+	Appointments  int      `json:"appointments"`
+	BookedMinutes int      `json:"booked_minutes"`
+	OpenMinutes   int      `json:"open_minutes"`
+	Utilization   float64  `json:"utilization"` // booked / open, 0..1
+}
+
+// resourceUtilization handles GET /admin/resources/utilization. For each
+// resource it sums the time held between ?from= and ?to= (YYYY-MM-DD,
+// inclusive; today to six days ahead by default) against clinic hours on
+// those days. ?location_id= and ?kind= narrow the resources.
+func resourceUtilization(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	today := clinicNow()
+	from := choose(c.Query("from"), today.Format("2006-01-02"))
+	to := choose(c.Query("to"), today.AddDate(0, 0, 6).Format("2006-01-02"))
+	if !isValidDate(from) || !isValidDate(to) || to < from {
+		return fiber.NewError(fiber.StatusBadRequest, "from and to must be dates (YYYY-MM-DD) with from <= to")
+	}
+	loc := clinicTZ()
+	start, _ := time.ParseInLocation("2006-01-02", from, loc)
+	last, _ := time.ParseInLocation("2006-01-02", to, loc)
+	end := last.AddDate(0, 0, 1)
+	days := int(math.Round(end.Sub(start).Hours() / 24))
+	if days > 366 {
+		return fiber.NewError(fiber.StatusBadRequest, "the range can cover at most a year")
+	}
+	open, close := clinicHours()
+	openMin, _ := clockMinutes(open)
+	closeMin, _ := clockMinutes(close)
+
+	q, err := locationFilter(c, db)
+	if err != nil {
+		return err
+	}
+	if kind := c.Query("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	var rs []Resource
+	if err := q.Order("kind, name").Find(&rs).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch")
+	}
+	ids := make([]uint, 0, len(rs))
+	for _, r := range rs {
+		ids = append(ids, r.ID)
+	}
+	holds, err := resourceHolds(db, ids, start, end, 0)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch")
+	}
+
+	out := make([]resourceUsage, 0, len(rs))
+	for _, r := range rs {
+		u := resourceUsage{Resource: r, OpenMinutes: days * (closeMin - openMin)}
+		for _, h := range holds {
+			if h.ResourceID != r.ID {
+				continue
+			}
+			// Only the part of the hold inside the range counts
+			a, b := h.BlockedFrom, h.BlockedUntil
+			if a.Before(start) {
+				a = start
+			}
+			if b.After(end) {
+				b = end
+			}
+			u.Appointments++
+			u.BookedMinutes += int(b.Sub(a).Minutes())
+		}
+		if u.OpenMinutes > 0 {
+			u.Utilization = math.Round(float64(u.BookedMinutes)/float64(u.OpenMinutes)*1000) / 1000
+		}
+		out = append(out, u)
+	}
+	return c.JSON(fiber.Map{"from": from, "to": to, "resources": out})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestResourceConflicts books scans, which need an ultrasound, for two
+// doctors at the same time: the second waits for a second machine.
+func TestResourceConflicts(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	initDatabase("file:resources?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 6, 9, 0, 0, 0, time.UTC) }
+
+	scan := AppointmentType{Name: "scan", DurationMinutes: 30, Resources: StringList{"ultrasound"}}
+	mri := AppointmentType{Name: "mri", DurationMinutes: 60, Resources: StringList{"mri scanner"}}
+	mustCreate(t, db.Create(&scan).Error)
+	mustCreate(t, db.Create(&mri).Error)
+	first := Resource{Name: "Ultrasound 1", Kind: "ultrasound"}
+	mustCreate(t, db.Create(&first).Error)
+
+	visit := func(doctor, at string, typ AppointmentType) Appointment {
+		ap := Appointment{PatientName: "Patient of " + doctor, Doctor: doctor, Date: "2030-01-07", Time: at,
+			TimeZone: "UTC", Reason: typ.Name, Status: StatusConfirmed, AppointmentTypeID: &typ.ID}
+		if v := resolveAppointmentType(db, &ap); len(v) > 0 {
+			t.Fatalf("type: %v", v)
+		}
+		return ap
+	}
+	codes := func(ap Appointment) []string {
+		v, err := scheduleViolations(db, ap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return violationCodes(v)
+	}
+
+	lee := visit("Dr. Lee", "10:00", scan)
+	if got := codes(lee); len(got) > 0 {
+		t.Fatalf("first scan: %q", got)
+	}
+	mustCreate(t, createWithStatus(db, &lee, PatientContact{}, "test", ""))
+
+	for _, tc := range []struct {
+		name string
+		ap   Appointment
+		want []string
+	}{
+		{"same time, machine taken", visit("Dr. Kim", "10:00", scan), []string{"resource_unavailable"}},
+		{"overlapping the end", visit("Dr. Kim", "10:15", scan), []string{"resource_unavailable"}},
+		{"right after", visit("Dr. Kim", "10:30", scan), nil},
+		{"no such machine", visit("Dr. Kim", "14:00", mri), []string{"resource_missing"}},
+	} {
+		if got := codes(tc.ap); !equalStrings(got, tc.want) {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	second := Resource{Name: "Ultrasound 2", Kind: "ultrasound"}
+	mustCreate(t, db.Create(&second).Error)
+	kim := visit("Dr. Kim", "10:00", scan)
+	if got := codes(kim); len(got) > 0 {
+		t.Fatalf("scan with a second machine: %q", got)
+	}
+	mustCreate(t, createWithStatus(db, &kim, PatientContact{}, "test", ""))
+	var held []ResourceBooking
+	mustCreate(t, db.Where("appointment_id IN ?", []uint{lee.ID, kim.ID}).Order("appointment_id").Find(&held).Error)
+	if len(held) != 2 || held[0].ResourceID != first.ID || held[1].ResourceID != second.ID {
+		t.Errorf("holds = %+v, want Ultrasound 1 for Dr. Lee and 2 for Dr. Kim", held)
+	}
+
+	// Cancelling frees the machine for a third doctor
+	if got := codes(visit("Dr. Mercy", "10:00", scan)); !equalStrings(got, []string{"resource_unavailable"}) {
+		t.Errorf("third scan: %q, want resource_unavailable", got)
+	}
+	mustCreate(t, transitionStatus(db, &lee, StatusCancelled, "test", ""))
+	if got := codes(visit("Dr. Mercy", "10:00", scan)); len(got) > 0 {
+		t.Errorf("third scan after a cancel: %q", got)
+	}
+
+	token, err := createJWTToken(1, defaultTenantID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Get("/admin/resources/utilization", jwtMiddleware, resourceUtilization)
+	status, body := call(t, app, "GET", "/admin/resources/utilization?from=2030-01-06&to=2030-01-08&kind=ultrasound", token, "")
+	if status != fiber.StatusOK {
+		t.Fatalf("utilization: %d %s", status, body)
+	}
+	var report struct {
+		Resources []resourceUsage `json:"resources"`
+	}
+	mustCreate(t, json.Unmarshal(body, &report))
+	booked := map[string]int{}
+	for _, u := range report.Resources {
+		booked[u.Resource.Name] = u.BookedMinutes
+	}
+	if booked["Ultrasound 1"] != 0 || booked["Ultrasound 2"] != 30 {
+		t.Errorf("booked minutes = %v, want Ultrasound 1 free (cancelled) and 30 on Ultrasound 2", booked)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// Appointment search covers the patient's name, the reason and the admin
+// notes. Built with the sqlite_fts5 tag it runs on an FTS5 index
+// (search_fts5.go); otherwise it scans the rows (search_scan.go). Both match
+// every word of the query as a prefix and allow a typo or two in longer
+// words, and return the same result shape.
+
+// searchHit is one appointment found by a search. Higher scores rank first.
+// Highlights hold the matching fields, HTML-escaped, with the matched words
+// wrapped in <mark>.
+type searchHit struct {
+	Appointment Appointment       `json:"appointment"`
+	Score       float64           `json:"score"`
+	Highlights  map[string]string `json:"highlights"`
+}
+
+// searchWeights rank a match in the name above one in the reason, and both
+// above one in the notes.
+var searchWeights = map[string]float64{"patient_name": 10, "reason": 4, "notes": 1}
+
+// Highlight markers used while the text is still raw; they become <mark>
+// tags once the text has been escaped.
+const markOpen, markClose = "\x02", "\x03"
+
+var searchWordRe = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// searchTriggers keep the FTS5 index in step with appointments.
+var searchTriggers = []string{"appointment_search_ai", "appointment_search_ad", "appointment_search_au"}
+
+// maxSearchTerms bounds how many words of a query are used.
+const maxSearchTerms = 8
+
+// foldWord lower-cases s and strips accents, so "Zoë" and "zoe" compare
+// equal, as the FTS5 tokenizer (remove_diacritics) does.
+func foldWord(s string) string {
+	ascii := true
+	for i := 0; i < len(s) && ascii; i++ {
+		ascii = s[i] < utf8.RuneSelf
+	}
+	if ascii {
+		return strings.ToLower(s)
+	}
+	folded, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
+
+// searchTerms splits a query into folded words.
+func searchTerms(q string) []string {
+	words := searchWordRe.FindAllString(foldWord(q), -1)
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+	return words
+}
+
+// typoBudget is how many edits a query word may be away from a match:
+// none for short words, where a typo would match almost anything, or for
+// numbers.
+func typoBudget(term string) int {
+	if strings.IndexFunc(term, unicode.IsDigit) >= 0 {
+		return 0 // numbers are matched as typed
+	}
+	switch n := utf8.RuneCountInString(term); {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the Levenshtein distance between a and b, or max+1 as
+// soon as it is clear the distance is more than max.
+func editDistance(a, b []rune, max int) int {
+	if absInt(len(a)-len(b)) > max {
+		return max + 1
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			best = minInt(best, cur[j])
+		}
+		if best > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// matchQuality scores how well word (folded) answers the query term:
+// 1 for the same word, 0.8 for a prefix, less for each typo, and 0 for no
+// match. A word is also a typo match when its start is within the budget of
+// the term, so "jonat" finds "jonathan".
+func matchQuality(term, word string) float64 {
+	switch {
+	case word == term:
+		return 1
+	case strings.HasPrefix(word, term):
+		return 0.8
+	}
+	budget := typoBudget(term)
+	if budget == 0 {
+		return 0
+	}
+	t, w := []rune(term), []rune(word)
+	d := editDistance(t, w, budget)
+	if len(w) > len(t) {
+		d = minInt(d, editDistance(t, w[:len(t)], budget))
+	}
+	if d > budget {
+		return 0
+	}
+	return 0.6 - 0.2*float64(d-1)
+}
+
+// markedHTML escapes text that carries the raw highlight markers and turns
+// the markers into <mark> tags.
+func markedHTML(text string) string {
+	s := html.EscapeString(text)
+	return strings.NewReplacer(markOpen, "<mark>", markClose, "</mark>").Replace(s)
+}
+
+// searchLimit reads ?limit= (default 20, at most 100).
+func searchLimit(c *fiber.Ctx) (int, error) {
+	raw := c.Query("limit")
+	if raw == "" {
+		return 20, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "limit must be a positive number")
+	}
+	if n > 100 {
+		n = 100
+	}
+	return n, nil
+}
+
+// searchAppointments handles GET /admin/appointments/search?q=. The list
+// filters (doctor, status, from, to, location_id, flagged) narrow the
+// appointments searched.
+func searchAppointments(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	terms := searchTerms(c.Query("q"))
+	if len(terms) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "q must contain at least one word")
+	}
+	f, err := parseAppointmentFilter(c, db)
+	if err != nil {
+		return err
+	}
+	f.Patient = "" // the query already searches names
+	limit, err := searchLimit(c)
+	if err != nil {
+		return err
+	}
+	hits, err := runSearch(db, f, terms, limit)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "search failed")
+	}
+	if hits == nil {
+		hits = []searchHit{}
+	}
+	return c.JSON(fiber.Map{"query": strings.Join(terms, " "), "mode": searchMode, "results": hits})
+}
+
+// loadSearchHits fills in the appointments for ranked ids, keeping the
+// order of ids.
+func loadSearchHits(db *gorm.DB, ids []uint, scores map[uint]float64, highlights map[uint]map[string]string) ([]searchHit, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var apps []Appointment
+	if err := db.Where("id IN ?", ids).Find(&apps).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]Appointment, len(apps))
+	for _, ap := range apps {
+		byID[ap.ID] = ap
+	}
+	hits := make([]searchHit, 0, len(ids))
+	for _, id := range ids {
+		if ap, ok := byID[id]; ok {
+			hits = append(hits, searchHit{Appointment: ap, Score: scores[id], Highlights: highlights[id]})
+		}
+	}
+	return hits, nil
+}
+
+// rankIDs returns the ids of scores, best first, at most limit of them.
+func rankIDs(scores map[uint]float64, limit int) []uint {
+	ids := make([]uint, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j] // newer first on a tie
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
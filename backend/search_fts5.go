@@ -0,0 +1,191 @@
+//go:build sqlite_fts5
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// searchMode tells clients which engine answered.
+const searchMode = "fts5"
+
+// appointment_search indexes appointments through external content, so the
+// text is stored once; triggers keep it in step with every write.
+var searchIndexDDL = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS appointment_search USING fts5(patient_name, reason, notes,
+		content='appointments', content_rowid='id', tokenize='unicode61 remove_diacritics 2', prefix='2 3')`,
+	// One row per word per appointment, so typo candidates can be limited
+	// to the words of the caller's tenant; the old row vocabulary mixed them
+	`DROP TABLE IF EXISTS appointment_search_vocab`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS appointment_search_terms USING fts5vocab(appointment_search, instance)`,
+}
+
+var searchTriggerDDL = []string{
+	`CREATE TRIGGER appointment_search_ai AFTER INSERT ON appointments BEGIN
+		INSERT INTO appointment_search(rowid, patient_name, reason, notes) VALUES (new.id, new.patient_name, new.reason, new.notes);
+	END`,
+	`CREATE TRIGGER appointment_search_ad AFTER DELETE ON appointments BEGIN
+		INSERT INTO appointment_search(appointment_search, rowid, patient_name, reason, notes) VALUES ('delete', old.id, old.patient_name, old.reason, old.notes);
+	END`,
+	`CREATE TRIGGER appointment_search_au AFTER UPDATE OF patient_name, reason, notes ON appointments BEGIN
+		INSERT INTO appointment_search(appointment_search, rowid, patient_name, reason, notes) VALUES ('delete', old.id, old.patient_name, old.reason, old.notes);
+		INSERT INTO appointment_search(rowid, patient_name, reason, notes) VALUES (new.id, new.patient_name, new.reason, new.notes);
+	END`,
+}
+
+// setupSearchIndex creates the index. When the triggers are missing (a new
+// database, or one last opened by a build without FTS5) the index may be
+// stale, so it is rebuilt from the appointments.
+func setupSearchIndex(d *gorm.DB) error {
+	for _, stmt := range searchIndexDDL {
+		if err := d.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	var n int64
+	if err := d.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ?", searchTriggers).Scan(&n).Error; err != nil {
+		return err
+	}
+	if int(n) == len(searchTriggers) {
+		return nil
+	}
+	return d.Transaction(func(tx *gorm.DB) error {
+		for _, name := range searchTriggers {
+			if err := tx.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+		for _, stmt := range searchTriggerDDL {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		log.Printf("[search] Rebuilding the appointment search index")
+		return tx.Exec("INSERT INTO appointment_search(appointment_search) VALUES ('rebuild')").Error
+	})
+}
+
+// ftsRow is one match with its rank (bm25, lower is better) and the fields
+// with highlight markers.
+type ftsRow struct {
+	ID       uint
+	Rank     float64
+	HlName   string
+	HlReason string
+	HlNotes  string
+}
+
+// runSearch matches every term as a prefix first. If that finds fewer than
+// limit appointments, it searches again with each term widened to the
+// indexed words a typo or two away, and ranks those matches lower.
+func runSearch(db *gorm.DB, f appointmentFilter, terms []string, limit int) ([]searchHit, error) {
+	exact := make([]string, len(terms))
+	for i, t := range terms {
+		exact[i] = fmt.Sprintf(`"%s"*`, t)
+	}
+	scores := map[uint]float64{}
+	highlights := map[uint]map[string]string{}
+	// bm25 is negative, lower being better; a typo match counts half
+	collect := func(rows []ftsRow, weight float64) {
+		for _, r := range rows {
+			if _, seen := scores[r.ID]; seen {
+				continue
+			}
+			scores[r.ID] = -r.Rank * weight
+			hl := map[string]string{}
+			for name, text := range map[string]string{"patient_name": r.HlName, "reason": r.HlReason, "notes": r.HlNotes} {
+				if strings.Contains(text, markOpen) {
+					hl[name] = markedHTML(text)
+				}
+			}
+			highlights[r.ID] = hl
+		}
+	}
+	rows, err := ftsQuery(db, f, strings.Join(exact, " "), limit)
+	if err != nil {
+		return nil, err
+	}
+	collect(rows, 1)
+	if len(rows) < limit {
+		fuzzy := make([]string, len(terms))
+		widened := false
+		for i, t := range terms {
+			cands, err := typoCandidates(db, t)
+			if err != nil {
+				return nil, err
+			}
+			alts := []string{exact[i]}
+			for _, c := range cands {
+				alts = append(alts, fmt.Sprintf(`"%s"`, c))
+			}
+			widened = widened || len(cands) > 0
+			fuzzy[i] = "(" + strings.Join(alts, " OR ") + ")"
+		}
+		if widened {
+			more, err := ftsQuery(db, f, strings.Join(fuzzy, " "), limit)
+			if err != nil {
+				return nil, err
+			}
+			collect(more, 0.5)
+		}
+	}
+	return loadSearchHits(db, rankIDs(scores, limit), scores, highlights)
+}
+
+// ftsQuery runs one MATCH against the index, joined to the filtered
+// appointments so tenant scoping and the list filters apply.
+func ftsQuery(db *gorm.DB, f appointmentFilter, expr string, limit int) ([]ftsRow, error) {
+	sel := fmt.Sprintf("appointments.id AS id, bm25(appointment_search, %g, %g, %g) AS rank, "+
+		"highlight(appointment_search, 0, ?, ?) AS hl_name, highlight(appointment_search, 1, ?, ?) AS hl_reason, "+
+		"snippet(appointment_search, 2, ?, ?, '…', 16) AS hl_notes",
+		searchWeights["patient_name"], searchWeights["reason"], searchWeights["notes"])
+	var rows []ftsRow
+	err := f.apply(db.Model(&Appointment{})).
+		Select(sel, markOpen, markClose, markOpen, markClose, markOpen, markClose).
+		Joins("JOIN appointment_search ON appointment_search.rowid = appointments.id").
+		Where("appointment_search MATCH ?", expr).
+		Order("rank").Limit(limit).
+		Scan(&rows).Error
+	return rows, err
+}
+
+// maxTypoCandidates bounds how many indexed words one query term widens to.
+const maxTypoCandidates = 20
+
+// typoCandidates lists words of the tenant's appointments within term's
+// typo budget that its prefix query does not already find, closest first.
+// Like most fuzzy search, it trusts the first letter, which keeps the
+// vocabulary scan short.
+func typoCandidates(db *gorm.DB, term string) ([]string, error) {
+	budget := typoBudget(term)
+	if budget == 0 {
+		return nil, nil
+	}
+	first, size := utf8.DecodeRuneInString(term)
+	var words []string
+	if err := db.Model(&Appointment{}).
+		Joins("JOIN appointment_search_terms ON appointment_search_terms.doc = appointments.id").
+		Where("appointment_search_terms.term >= ? AND appointment_search_terms.term < ?", term[:size], string(first+1)).
+		Distinct().Pluck("appointment_search_terms.term", &words).Error; err != nil {
+		return nil, err
+	}
+	quality := map[string]float64{}
+	var out []string
+	for _, w := range words {
+		if q := matchQuality(term, w); q > 0 && q < 0.8 {
+			quality[w] = q
+			out = append(out, w)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return quality[out[i]] > quality[out[j]] })
+	if len(out) > maxTypoCandidates {
+		out = out[:maxTypoCandidates]
+	}
+	return out, nil
+}
@@ -0,0 +1,117 @@
+//go:build !sqlite_fts5
+
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// searchMode tells clients which engine answered.
+const searchMode = "scan"
+
+// setupSearchIndex has no index to build without FTS5. It drops the
+// triggers an FTS5 build leaves behind, since they would make every write to
+// appointments fail in a binary without the module; the FTS5 build rebuilds
+// its index when it finds them gone.
+func setupSearchIndex(d *gorm.DB) error {
+	for _, name := range searchTriggers {
+		if err := d.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchRow is the part of an appointment the scan reads.
+type searchRow struct {
+	ID          uint
+	PatientName string
+	Reason      string
+	Notes       string
+}
+
+// runSearch reads the filtered appointments in batches and scores each one
+// in Go. Every term has to match a word in one of the fields. Only the rows
+// that make the cut are highlighted.
+func runSearch(db *gorm.DB, f appointmentFilter, terms []string, limit int) ([]searchHit, error) {
+	scores := map[uint]float64{}
+	matched := map[uint]searchRow{}
+	var batch []searchRow
+	q := f.apply(db.Model(&Appointment{})).Select("id, patient_name, reason, notes")
+	err := q.FindInBatches(&batch, 2000, func(tx *gorm.DB, _ int) error {
+		for _, r := range batch {
+			if score, ok := scoreFields(r.fields(), terms); ok {
+				scores[r.ID], matched[r.ID] = score, r
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := rankIDs(scores, limit)
+	highlights := map[uint]map[string]string{}
+	for _, id := range ids {
+		hl := map[string]string{}
+		for name, text := range matched[id].fields() {
+			if marked, any := markWords(text, terms); any {
+				hl[name] = markedHTML(marked)
+			}
+		}
+		highlights[id] = hl
+	}
+	return loadSearchHits(db, ids, scores, highlights)
+}
+
+func (r searchRow) fields() map[string]string {
+	return map[string]string{"patient_name": r.PatientName, "reason": r.Reason, "notes": r.Notes}
+}
+
+// splitWords cuts folded text into words, like searchWordRe but cheaper.
+func splitWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) })
+}
+
+// scoreFields adds up, for each term, its best weighted match in any field.
+// ok is false when some term matches nowhere.
+func scoreFields(fields map[string]string, terms []string) (float64, bool) {
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for name, text := range fields {
+			for _, word := range splitWords(foldWord(text)) {
+				if s := searchWeights[name] * matchQuality(term, word); s > best {
+					best = s
+				}
+			}
+		}
+		if best == 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
+
+// markWords wraps the words of text that match any term in the highlight
+// markers.
+func markWords(text string, terms []string) (string, bool) {
+	var b strings.Builder
+	last, found := 0, false
+	for _, loc := range searchWordRe.FindAllStringIndex(text, -1) {
+		word := foldWord(text[loc[0]:loc[1]])
+		for _, term := range terms {
+			if matchQuality(term, word) > 0 {
+				b.WriteString(text[last:loc[0]])
+				b.WriteString(markOpen + text[loc[0]:loc[1]] + markClose)
+				last, found = loc[1], true
+				break
+			}
+		}
+	}
+	b.WriteString(text[last:])
+	return b.String(), found
+}
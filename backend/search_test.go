@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestRunSearch runs under both engines: go test for the scan and
+// go test -tags sqlite_fts5 for the FTS5 index.
+func TestRunSearch(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:search-" + searchMode + "?mode=memory&cache=shared")
+	// A tenant of its own keeps the sample data out of the results
+	tenant := Tenant{Slug: "search", Name: "Search Clinic", WidgetKey: "search-key"}
+	mustCreate(t, db.Create(&tenant).Error)
+	tdb := forTenant(tenant.ID)
+
+	byName := map[string]uint{}
+	for i, ap := range []Appointment{
+		{PatientName: "Jonathan Mwangi", Reason: "knee pain"},
+		{PatientName: "Mary Jonas", Reason: "checkup", Notes: "follow up with jonathan's physio"},
+		{PatientName: "Zoë Akinyi", Reason: "<b>rash</b> & itching"},
+		{PatientName: "Peter Otieno", Reason: "flu", Notes: "Jonathan called"},
+	} {
+		ap := ap
+		ap.Doctor, ap.Date, ap.Time, ap.TimeZone, ap.Status = "Dr. Lee", "2030-01-07", fmt.Sprintf("%02d:00", 9+i), "UTC", StatusConfirmed
+		mustCreate(t, createWithStatus(tdb, &ap, PatientContact{}, "test", ""))
+		byName[ap.PatientName] = ap.ID
+	}
+	nameOf := map[uint]string{}
+	for name, id := range byName {
+		nameOf[id] = name
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string // best first; only the first is checked for order
+		hl    map[string]string
+	}{
+		{"jonat", []string{"Jonathan Mwangi", "Mary Jonas", "Peter Otieno"},
+			map[string]string{"patient_name": "<mark>Jonathan</mark> Mwangi"}},
+		{"jonathn", []string{"Jonathan Mwangi", "Mary Jonas", "Peter Otieno"}, nil},
+		{"zoe", []string{"Zoë Akinyi"}, map[string]string{"patient_name": "<mark>Zoë</mark> Akinyi"}},
+		{"rash", []string{"Zoë Akinyi"}, map[string]string{"reason": "&lt;b&gt;<mark>rash</mark>&lt;/b&gt; &amp; itching"}},
+		{"mary checkup", []string{"Mary Jonas"}, nil},
+		{"mary flu", nil, nil},
+		{"flo", nil, nil}, // too short for a typo
+	} {
+		hits, err := runSearch(tdb, appointmentFilter{}, searchTerms(tc.query), 20)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		var got []string
+		for _, h := range hits {
+			got = append(got, nameOf[h.Appointment.ID])
+		}
+		if len(got) != len(tc.want) || (len(got) > 0 && got[0] != tc.want[0]) || !sameSet(got, tc.want) {
+			t.Errorf("%s [%s]: %q, want %q", tc.query, searchMode, got, tc.want)
+			continue
+		}
+		for field, want := range tc.hl {
+			if got := hits[0].Highlights[field]; got != want {
+				t.Errorf("%s [%s]: %s highlight %q, want %q", tc.query, searchMode, field, got, want)
+			}
+		}
+	}
+
+	// The list filters narrow what is searched
+	f := appointmentFilter{Statuses: []string{StatusCancelled}}
+	if hits, err := runSearch(tdb, f, searchTerms("jonathan"), 20); err != nil || len(hits) > 0 {
+		t.Errorf("search among cancelled appointments: %d hits, %v", len(hits), err)
+	}
+	if hits, err := runSearch(tdb, appointmentFilter{}, searchTerms("jonathan"), 1); err != nil || len(hits) != 1 ||
+		hits[0].Appointment.ID != byName["Jonathan Mwangi"] {
+		t.Errorf("limit 1: %+v, %v; want only the name match", hits, err)
+	}
+}
+
+func sameSet(a, b []string) bool {
+	seen := map[string]int{}
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// AppointmentSeries is a repeating booking such as "every Tuesday at 10:00
+// for 6 weeks". Each occurrence is a normal Appointment with SeriesID set, so
+// availability, status and the waitlist treat it like any other booking; the
+// series keeps the rule and the details the occurrences were made from.
+type AppointmentSeries struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	TenantID          uint      `gorm:"not null;default:1;index" json:"-"`
+	RRule             string    `gorm:"size:255;not null" json:"rrule"`
+	PatientID         *uint     `gorm:"index" json:"patient_id"`
+	PatientName       string    `gorm:"size:255;not null" json:"patient_name"`
+	Doctor            string    `gorm:"size:255;not null;index" json:"doctor"`
+	LocationID        *uint     `json:"location_id"`
+	StartDate         string    `gorm:"size:10;not null" json:"start_date"`
+	Time              string    `gorm:"size:5;not null" json:"time"`
+	TimeZone          string    `gorm:"size:64" json:"time_zone"`
+	Reason            string    `gorm:"size:500" json:"reason"`
+	AppointmentTypeID *uint     `json:"appointment_type_id"`
+	DurationMinutes   int       `gorm:"not null;default:0" json:"duration_minutes"`
+	Status            string    `gorm:"size:20;not null;default:active" json:"status"` // active or cancelled
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// seriesResult is what booking a series returns: the series, the
+// appointments made and the dates left out with skip_conflicts.
+type seriesResult struct {
+	Series       AppointmentSeries `json:"series"`
+	Appointments []Appointment     `json:"appointments"`
+	Skipped      []PolicyViolation `json:"skipped,omitempty"`
+}
+
+// onDate prefixes each violation with the occurrence it belongs to.
+func onDate(date string, v []PolicyViolation) []PolicyViolation {
+	out := make([]PolicyViolation, len(v))
+	for i, p := range v {
+		p.Message = fmt.Sprintf("On %s: %s", date, p.Message)
+		out[i] = p
+	}
+	return out
+}
+
+// occurrenceViolations checks one occurrence against the booking rules and
+// the doctor's other bookings.
+func occurrenceViolations(db *gorm.DB, ap *Appointment) ([]PolicyViolation, error) {
+	if v := validateBookingRules(db, ap); len(v) > 0 {
+		return v, nil
+	}
+	return scheduleViolations(db, *ap)
+}
+
+// bookSeries books one appointment per date of rule, starting on
+// template.Date, all in one transaction. Every occurrence is checked like a
+// single booking. By default any problem rejects the whole series; with
+// skipConflicts the dates that can't be booked are left out and reported.
+func bookSeries(db *gorm.DB, template Appointment, rule RRule, contact PatientContact, actor string, skipConflicts bool) (seriesResult, []PolicyViolation, error) {
+	var res seriesResult
+	dates, err := rule.dates(template.Date)
+	if err != nil {
+		return res, []PolicyViolation{{"rrule", "invalid_rrule", err.Error()}}, nil
+	}
+	var violations []PolicyViolation
+	for _, date := range dates {
+		ap := template
+		ap.ID, ap.Date, ap.StartsAt = 0, date, time.Time{}
+		if err := ap.normalizeSchedule(); err != nil {
+			return res, nil, err
+		}
+		v, err := occurrenceViolations(db, &ap)
+		if err != nil {
+			return res, nil, err
+		}
+		switch {
+		case len(v) == 0:
+			res.Appointments = append(res.Appointments, ap)
+		case skipConflicts:
+			res.Skipped = append(res.Skipped, onDate(date, v)...)
+		default:
+			violations = append(violations, onDate(date, v)...)
+		}
+	}
+	if len(violations) > 0 {
+		return res, violations, nil
+	}
+	if len(res.Appointments) == 0 {
+		return res, append([]PolicyViolation{{"rrule", "no_occurrences", "None of the dates in this series can be booked."}}, res.Skipped...), nil
+	}
+
+	first := res.Appointments[0]
+	res.Series = AppointmentSeries{
+		RRule: rule.String(), PatientID: template.PatientID, PatientName: template.PatientName,
+		Doctor: first.Doctor, LocationID: first.LocationID, StartDate: template.Date, Time: first.Time, TimeZone: first.TimeZone,
+		Reason: template.Reason, AppointmentTypeID: template.AppointmentTypeID,
+		DurationMinutes: first.DurationMinutes, Status: "active",
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&res.Series).Error; err != nil {
+			return err
+		}
+		for i := range res.Appointments {
+			ap := &res.Appointments[i]
+			ap.SeriesID, ap.PatientID = &res.Series.ID, res.Series.PatientID
+			if err := insertWithStatus(tx, ap, contact, actor, ""); err != nil {
+				return err
+			}
+			// Every occurrence belongs to the patient the first was linked to
+			if res.Series.PatientID == nil && ap.PatientID != nil {
+				res.Series.PatientID = ap.PatientID
+				if err := tx.Model(&res.Series).Update("patient_id", ap.PatientID).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if v := lostSlotViolations(err); len(v) > 0 {
+		return res, onDate(template.Date, v), nil
+	}
+	return res, nil, err
+}
+
+// upcomingOccurrences returns the series' appointments that haven't started
+// and aren't final, which is what a series edit or cancel applies to.
+func upcomingOccurrences(db *gorm.DB, seriesID uint) ([]Appointment, error) {
+	var apps []Appointment
+	err := db.Where("series_id = ? AND starts_at >= ? AND status NOT IN ?",
+		seriesID, nowFunc().UTC(), []string{StatusCompleted, StatusCancelled, StatusNoShow}).
+		Order("starts_at").Find(&apps).Error
+	return apps, err
+}
+
+// getSeries handles GET /admin/series/:id with every occurrence, oldest first.
+func getSeries(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var s AppointmentSeries
+	if err := db.First(&s, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var apps []Appointment
+	if err := db.Where("series_id = ?", s.ID).Order("starts_at").Find(&apps).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load series")
+	}
+	return c.JSON(fiber.Map{"series": s, "appointments": apps})
+}
+
+// updateSeries handles PUT /admin/series/:id. Doctor, time, reason, type and
+// duration changes apply to every upcoming occurrence, or to none if any of
+// them would break a rule or clash. Past and final occurrences are kept as
+// they were; to change a single occurrence, edit that appointment.
+func updateSeries(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var s AppointmentSeries
+	if err := db.First(&s, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	if s.Status == "cancelled" {
+		return fiber.NewError(fiber.StatusConflict, "the series is cancelled")
+	}
+	var in Appointment
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	apps, err := upcomingOccurrences(db, s.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load series")
+	}
+
+	before := append([]Appointment(nil), apps...)
+	var violations []PolicyViolation
+	for i := range apps {
+		ap := &apps[i]
+		ap.Doctor = choose(in.Doctor, ap.Doctor)
+		ap.Time = choose(in.Time, ap.Time)
+		ap.Reason = choose(in.Reason, ap.Reason)
+		if in.AppointmentTypeID != nil {
+			ap.AppointmentTypeID, ap.DurationMinutes = in.AppointmentTypeID, 0
+			if v := resolveAppointmentType(db, ap); len(v) > 0 {
+				return validationFailed(c, v)
+			}
+		}
+		if in.DurationMinutes > 0 {
+			ap.DurationMinutes = in.DurationMinutes
+		}
+		if err := ap.normalizeSchedule(); err != nil {
+			return validationFailed(c, []PolicyViolation{{"time_zone", "invalid_time_zone", err.Error()}})
+		}
+		v, err := occurrenceViolations(db, ap)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to check availability")
+		}
+		violations = append(violations, onDate(ap.Date, v)...)
+	}
+	if len(violations) > 0 {
+		return validationFailed(c, violations)
+	}
+
+	if len(apps) > 0 {
+		s.Doctor, s.Time, s.Reason = apps[0].Doctor, apps[0].Time, apps[0].Reason
+		s.AppointmentTypeID, s.DurationMinutes = apps[0].AppointmentTypeID, apps[0].DurationMinutes
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range apps {
+			apps[i].ClosureID = nil // every occurrence passed the closure check above
+			if err := tx.Save(&apps[i]).Error; err != nil {
+				return err
+			}
+			if err := claimSlot(tx, &apps[i]); err != nil {
+				return err
+			}
+		}
+		return tx.Save(&s).Error
+	})
+	if v := lostSlotViolations(err); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
+	}
+	for i, old := range before {
+		if old.Doctor != apps[i].Doctor || !old.BlockedFrom.Equal(apps[i].BlockedFrom) || !old.BlockedUntil.Equal(apps[i].BlockedUntil) {
+			offerFreedSlot(db, old)
+		}
+	}
+	return c.JSON(fiber.Map{"series": s, "appointments": apps})
+}
+
+// cancelSeries handles POST /admin/series/:id/cancel. Every upcoming
+// occurrence is cancelled with a history entry and its slot offered to the
+// waitlist; past occurrences keep their status.
+func cancelSeries(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var s AppointmentSeries
+	if err := db.First(&s, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var req statusRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+		}
+	}
+	apps, err := upcomingOccurrences(db, s.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load series")
+	}
+	var cancelled []Appointment
+	actor := adminActor(c)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, ap := range apps {
+			// Checked-in visits are under way and finish normally
+			if checkTransition(ap, StatusCancelled) != nil {
+				continue
+			}
+			if err := setStatus(tx, ap.ID, ap.Status, StatusCancelled); err != nil {
+				return err
+			}
+			if err := recordStatusChange(tx, ap.ID, ap.Status, StatusCancelled, actor, req.Reason); err != nil {
+				return err
+			}
+			cancelled = append(cancelled, ap)
+		}
+		return tx.Model(&s).Update("status", "cancelled").Error
+	})
+	if errors.Is(err, errStatusChanged) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to cancel")
+	}
+	for _, ap := range cancelled {
+		offerFreedSlot(db, ap)
+	}
+	return c.JSON(fiber.Map{"series": s, "cancelled": len(cancelled)})
+}
+
+// seriesRequest carries the recurrence fields of POST /admin/appointments.
+type seriesRequest struct {
+	RRule         string `json:"rrule"`
+	SkipConflicts bool   `json:"skip_conflicts"`
+}
+
+// seriesReply phrases a booked series for the patient.
+func seriesReply(db *gorm.DB, res seriesResult, rule RRule) string {
+	first, last := res.Appointments[0], res.Appointments[len(res.Appointments)-1]
+	return fmt.Sprintf("Perfect! I've booked %d appointments with %s%s, %s at %s from %s to %s, for %s. Thank you, %s!",
+		len(res.Appointments), first.Doctor, atBranch(db, first.LocationID), describeRule(rule), first.Time, first.Date, last.Date, first.Reason, first.PatientName)
+}
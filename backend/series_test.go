@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRRuleDates(t *testing.T) {
+	for _, tc := range []struct {
+		rule, start string
+		want        []string
+		err         bool
+	}{
+		{"FREQ=WEEKLY;COUNT=3", "2030-01-07", []string{"2030-01-07", "2030-01-14", "2030-01-21"}, false},
+		{"RRULE:FREQ=WEEKLY;BYDAY=MO,TH;COUNT=4", "2030-01-07", []string{"2030-01-07", "2030-01-10", "2030-01-14", "2030-01-17"}, false},
+		{"FREQ=DAILY;INTERVAL=2;UNTIL=20300111", "2030-01-07", []string{"2030-01-07", "2030-01-09", "2030-01-11"}, false},
+		{"FREQ=MONTHLY;COUNT=3", "2030-01-15", []string{"2030-01-15", "2030-02-15", "2030-03-15"}, false},
+		{"FREQ=WEEKLY", "2030-01-07", nil, true},
+		{"FREQ=WEEKLY;COUNT=2;UNTIL=20300301", "2030-01-07", nil, true},
+		{"FREQ=DAILY;BYDAY=MO;COUNT=2", "2030-01-07", nil, true},
+		{"FREQ=YEARLY;COUNT=2", "2030-01-07", nil, true},
+		{"FREQ=DAILY;COUNT=60", "2030-01-07", nil, true},
+	} {
+		rule, err := parseRRule(tc.rule)
+		var got []string
+		if err == nil {
+			got, err = rule.dates(tc.start)
+		}
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %v", tc.rule, err, tc.err)
+			continue
+		}
+		if !equalStrings(got, tc.want) {
+			t.Errorf("%s from %s = %q, want %q", tc.rule, tc.start, got, tc.want)
+		}
+	}
+}
+
+// TestSeriesEditAndCancel books a weekly series, then edits and cancels it
+// after the first occurrence has passed, which must stay as it was.
+func TestSeriesEditAndCancel(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	initDatabase("file:series?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 6, 9, 0, 0, 0, time.UTC) }
+
+	rule, err := parseRRule("FREQ=WEEKLY;COUNT=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := Appointment{PatientName: "Joy Chebet", Doctor: "Dr. Lee", Date: "2030-01-07", Time: "10:00",
+		TimeZone: "UTC", Reason: "physio", Status: StatusConfirmed}
+	blocker := Appointment{PatientName: "Paul Kariuki", Doctor: "Dr. Lee", Date: "2030-01-21", Time: "10:00",
+		TimeZone: "UTC", Reason: "checkup", Status: StatusConfirmed}
+	mustCreate(t, createWithStatus(db, &blocker, PatientContact{}, "test", ""))
+
+	// The 21st is taken: the series is refused, or booked without that date
+	if _, v, err := bookSeries(db, template, rule, PatientContact{}, "test", false); err != nil || len(v) == 0 {
+		t.Fatalf("conflicting series: violations %v, error %v; want a refusal", v, err)
+	}
+	res, v, err := bookSeries(db, template, rule, PatientContact{}, "test", true)
+	if err != nil || len(v) > 0 {
+		t.Fatalf("series with skip_conflicts: violations %v, error %v", v, err)
+	}
+	if len(res.Appointments) != 3 || len(res.Skipped) == 0 {
+		t.Fatalf("booked %d, skipped %v; want 3 booked and the 21st skipped", len(res.Appointments), res.Skipped)
+	}
+
+	token, err := createJWTToken(1, defaultTenantID, "desk@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	admin := app.Group("/admin", jwtMiddleware)
+	admin.Put("/series/:id", updateSeries)
+	admin.Post("/series/:id/cancel", cancelSeries)
+	path := fmt.Sprintf("/admin/series/%d", res.Series.ID)
+	occurrences := func() map[string]Appointment {
+		var apps []Appointment
+		mustCreate(t, db.Where("series_id = ?", res.Series.ID).Find(&apps).Error)
+		out := map[string]Appointment{}
+		for _, ap := range apps {
+			out[ap.Date] = ap
+		}
+		return out
+	}
+
+	nowFunc = func() time.Time { return time.Date(2030, 1, 7, 12, 0, 0, 0, time.UTC) }
+	// Moving the series to 11:00 would now clash with the blocker on the 28th
+	blocker.Date, blocker.Time = "2030-01-28", "11:00"
+	mustCreate(t, db.Save(&blocker).Error)
+	if status, body := call(t, app, "PUT", path, token, `{"time": "11:00"}`); status != fiber.StatusUnprocessableEntity {
+		t.Errorf("clashing edit: %d %s, want 422", status, body)
+	}
+	if got := occurrences()["2030-01-14"].Time; got != "10:00" {
+		t.Errorf("a refused edit moved the 14th to %s", got)
+	}
+	if status, body := call(t, app, "PUT", path, token, `{"time": "11:30"}`); status != fiber.StatusOK {
+		t.Fatalf("edit: %d %s", status, body)
+	}
+	for date, want := range map[string]string{"2030-01-07": "10:00", "2030-01-14": "11:30", "2030-01-28": "11:30"} {
+		if got := occurrences()[date].Time; got != want {
+			t.Errorf("after the edit %s is at %s, want %s", date, got, want)
+		}
+	}
+
+	status, body := call(t, app, "POST", path+"/cancel", token, `{"reason": "moved away"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("cancel: %d %s", status, body)
+	}
+	var out struct {
+		Cancelled int `json:"cancelled"`
+	}
+	mustCreate(t, json.Unmarshal(body, &out))
+	if out.Cancelled != 2 {
+		t.Errorf("cancelled %d occurrences, want the 2 upcoming", out.Cancelled)
+	}
+	for date, want := range map[string]string{"2030-01-07": StatusConfirmed, "2030-01-14": StatusCancelled, "2030-01-28": StatusCancelled} {
+		if got := occurrences()[date].Status; got != want {
+			t.Errorf("after the cancel %s is %s, want %s", date, got, want)
+		}
+	}
+	if status, _ := call(t, app, "PUT", path, token, `{"time": "12:00"}`); status != fiber.StatusConflict {
+		t.Errorf("editing a cancelled series: %d, want 409", status)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Appointment statuses. A booking starts pending (or confirmed when staff
+// enter it), is confirmed, checked in on arrival and completed after the
+// visit. Cancelled, completed and no_show are final.
+const (
+	StatusPending   = "pending"
+	StatusConfirmed = "confirmed"
+	StatusCheckedIn = "checked_in"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+	StatusNoShow    = "no_show"
+)
+
+// statusOrder lists every status in lifecycle order.
+var statusOrder = []string{StatusPending, StatusConfirmed, StatusCheckedIn, StatusCompleted, StatusCancelled, StatusNoShow}
+
+// statusTransitions lists, for each status, the statuses it may move to.
+var statusTransitions = map[string][]string{
+	StatusPending:   {StatusConfirmed, StatusCancelled},
+	StatusConfirmed: {StatusCheckedIn, StatusCancelled, StatusNoShow},
+	StatusCheckedIn: {StatusCompleted},
+	StatusCompleted: {},
+	StatusCancelled: {},
+	StatusNoShow:    {},
+}
+
+// StatusChange records one status transition. From is empty for the status
+// an appointment was created with. ChangedBy is the admin's email, or
+// "chat" for bookings made by patients.
+type StatusChange struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	TenantID      uint      `gorm:"not null;default:1;index" json:"-"`
+	AppointmentID uint      `gorm:"index;not null" json:"appointment_id"`
+	From          string    `gorm:"size:50" json:"from"`
+	To            string    `gorm:"size:50;not null" json:"to"`
+	ChangedBy     string    `gorm:"size:255" json:"changed_by"`
+	Reason        string    `gorm:"size:500" json:"reason"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func isKnownStatus(s string) bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// isFinalStatus reports whether s is an end state (completed, cancelled, no_show).
+func isFinalStatus(s string) bool {
+	next, ok := statusTransitions[s]
+	return ok && len(next) == 0
+}
+
+// errIllegalTransition is returned for a status change the lifecycle forbids.
+type errIllegalTransition struct{ From, To string }
+
+func (e errIllegalTransition) Error() string {
+	if next := statusTransitions[e.From]; len(next) > 0 {
+		return fmt.Sprintf("a %s appointment can't become %s (allowed: %s)", e.From, e.To, strings.Join(next, ", "))
+	}
+	return fmt.Sprintf("a %s appointment can't become %s (%s is final)", e.From, e.To, e.From)
+}
+
+var errNotStarted = errors.New("the appointment hasn't started yet")
+
+// errStatusChanged is returned when the status changed under us, between
+// reading the appointment and updating it.
+var errStatusChanged = errors.New("the appointment's status was changed in the meantime; reload it and try again")
+
+// checkTransition reports whether ap may move to status to now. Completing
+// or marking a no-show only makes sense once the appointment has started.
+func checkTransition(ap Appointment, to string) error {
+	if !isKnownStatus(to) {
+		return fmt.Errorf("unknown status %q (valid: %s)", to, strings.Join(statusOrder, ", "))
+	}
+	allowed := false
+	for _, s := range statusTransitions[ap.Status] {
+		allowed = allowed || s == to
+	}
+	if !allowed {
+		return errIllegalTransition{From: ap.Status, To: to}
+	}
+	if (to == StatusNoShow || to == StatusCompleted) && !ap.StartsAt.IsZero() && nowFunc().Before(ap.StartsAt) {
+		return fmt.Errorf("%w, so it can't be marked %s", errNotStarted, to)
+	}
+	return nil
+}
+
+// transitionStatus moves ap to status to and records who did it and why, in
+// one transaction.
+func transitionStatus(db *gorm.DB, ap *Appointment, to, actor, reason string) error {
+	if err := checkTransition(*ap, to); err != nil {
+		return err
+	}
+	from := ap.Status
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := setStatus(tx, ap.ID, from, to); err != nil {
+			return err
+		}
+		return recordStatusChange(tx, ap.ID, from, to, actor, reason)
+	})
+}
+
+// setStatus moves appointment id from status from to status to, failing
+// with errStatusChanged if it no longer has status from.
+func setStatus(tx *gorm.DB, id uint, from, to string) error {
+	res := tx.Model(&Appointment{}).Where("id = ? AND status = ?", id, from).Update("status", to)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errStatusChanged
+	}
+	return nil
+}
+
+func recordStatusChange(tx *gorm.DB, id uint, from, to, actor, reason string) error {
+	return tx.Create(&StatusChange{AppointmentID: id, From: from, To: to, ChangedBy: actor, Reason: strings.TrimSpace(reason)}).Error
+}
+
+// createWithStatus inserts a new appointment together with the history
+// entry for its initial status, linking it to its patient (found by name and
+// contact, or created) unless a patient is already set.
+func createWithStatus(db *gorm.DB, ap *Appointment, contact PatientContact, actor, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return insertWithStatus(tx, ap, contact, actor, reason)
+	})
+}
+
+// insertWithStatus is createWithStatus inside the caller's transaction. It
+// fails with errTimeTaken if the slot was taken since it was checked.
+func insertWithStatus(tx *gorm.DB, ap *Appointment, contact PatientContact, actor, reason string) error {
+	if ap.PatientID == nil {
+		if err := linkPatient(tx, ap, contact); err != nil {
+			return err
+		}
+	}
+	if err := tx.Create(ap).Error; err != nil {
+		return err
+	}
+	if err := claimSlot(tx, ap); err != nil {
+		return err
+	}
+	return recordStatusChange(tx, ap.ID, "", ap.Status, actor, reason)
+}
+
+// adminActor names the signed-in admin for the status history.
+func adminActor(c *fiber.Ctx) string {
+	if email, ok := c.Locals("email").(string); ok && email != "" {
+		return email
+	}
+	return "admin"
+}
+
+type statusRequest struct {
+	Reason string `json:"reason"`
+}
+
+// statusNote carries the reason for a status change made through
+// PUT /admin/appointments/:id.
+type statusNote struct {
+	StatusReason string `json:"status_reason"`
+}
+
+// statusAction handles POST /admin/appointments/:id/<action>, moving the
+// appointment to status to. The body may carry a reason.
+func statusAction(to string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := tenantDB(c)
+		var ap Appointment
+		if err := db.First(&ap, c.Params("id")).Error; err != nil {
+			return fiber.NewError(fiber.StatusNotFound, "not found")
+		}
+		var req statusRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+			}
+		}
+		if err := transitionStatus(db, &ap, to, adminActor(c), req.Reason); err != nil {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		ap.Status = to
+		if to == StatusCancelled {
+			offerFreedSlot(db, ap)
+		}
+		return c.JSON(ap)
+	}
+}
+
+// statusHistory handles GET /admin/appointments/:id/history, oldest first.
+func statusHistory(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var ap Appointment
+	if err := db.First(&ap, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var changes []StatusChange
+	if err := db.Where("appointment_id = ?", ap.ID).Order("created_at, id").Find(&changes).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load history")
+	}
+	return c.JSON(changes)
+}
+
+// listStatuses handles GET /admin/appointment-statuses so clients can offer
+// only the transitions the server will accept.
+func listStatuses(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"statuses": statusOrder, "transitions": statusTransitions})
+}
+
+// statusViolation reports an illegal status for a create or update.
+func statusViolation(err error) []PolicyViolation {
+	code := "invalid_status"
+	var illegal errIllegalTransition
+	switch {
+	case errors.As(err, &illegal):
+		code = "illegal_transition"
+	case errors.Is(err, errNotStarted):
+		code = "not_started"
+	}
+	return []PolicyViolation{{"status", code, err.Error()}}
+}
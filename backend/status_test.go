@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckTransition(t *testing.T) {
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	now := time.Date(2030, 1, 7, 12, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	earlier, later := now.Add(-time.Hour), now.Add(time.Hour)
+
+	for _, tc := range []struct {
+		from, to string
+		starts   time.Time
+		want     string // the violation code, "" when allowed
+	}{
+		{StatusPending, StatusConfirmed, later, ""},
+		{StatusPending, StatusCancelled, later, ""},
+		{StatusPending, StatusCheckedIn, later, "illegal_transition"},
+		{StatusPending, StatusCompleted, earlier, "illegal_transition"},
+		{StatusConfirmed, StatusCheckedIn, later, ""},
+		{StatusConfirmed, StatusNoShow, earlier, ""},
+		{StatusConfirmed, StatusNoShow, later, "not_started"},
+		{StatusConfirmed, StatusPending, later, "illegal_transition"},
+		{StatusCheckedIn, StatusCompleted, earlier, ""},
+		{StatusCheckedIn, StatusCompleted, later, "not_started"},
+		{StatusCheckedIn, StatusCancelled, earlier, "illegal_transition"},
+		{StatusCompleted, StatusCancelled, earlier, "illegal_transition"},
+		{StatusCancelled, StatusConfirmed, later, "illegal_transition"},
+		{StatusNoShow, StatusCheckedIn, earlier, "illegal_transition"},
+		{StatusConfirmed, "archived", later, "invalid_status"},
+	} {
+		err := checkTransition(Appointment{Status: tc.from, StartsAt: tc.starts}, tc.to)
+		got := ""
+		if err != nil {
+			got = statusViolation(err)[0].Code
+		}
+		if got != tc.want {
+			t.Errorf("%s -> %s: got %q (%v), want %q", tc.from, tc.to, got, err, tc.want)
+		}
+	}
+
+	for _, s := range statusOrder {
+		if final := isFinalStatus(s); final != (s == StatusCompleted || s == StatusCancelled || s == StatusNoShow) {
+			t.Errorf("isFinalStatus(%s) = %v", s, final)
+		}
+	}
+}
+
+func TestTransitionStatusRecordsHistory(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	initDatabase("file:status-history?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	ap := Appointment{PatientName: "Ann Wambui", Doctor: "Dr. Kim", Date: "2030-01-07", Time: "10:00",
+		TimeZone: "UTC", Reason: "checkup", Status: StatusPending}
+	if err := createWithStatus(db, &ap, PatientContact{}, "chat", ""); err != nil {
+		t.Fatal(err)
+	}
+	nowFunc = func() time.Time { return time.Date(2030, 1, 7, 11, 0, 0, 0, time.UTC) }
+	for _, to := range []string{StatusConfirmed, StatusCheckedIn, StatusCompleted} {
+		if err := transitionStatus(db, &ap, to, "desk@example.com", "step "+to); err != nil {
+			t.Fatalf("-> %s: %v", to, err)
+		}
+		ap.Status = to
+	}
+	var illegal errIllegalTransition
+	if err := transitionStatus(db, &ap, StatusCancelled, "desk@example.com", ""); !errors.As(err, &illegal) {
+		t.Errorf("cancelling a completed visit: got %v, want an illegal transition", err)
+	}
+
+	var changes []StatusChange
+	if err := db.Where("appointment_id = ?", ap.ID).Order("id").Find(&changes).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []string{" -> pending by chat", "pending -> confirmed by desk@example.com",
+		"confirmed -> checked_in by desk@example.com", "checked_in -> completed by desk@example.com"}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.From+" -> "+c.To+" by "+c.ChangedBy)
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+	var stored Appointment
+	if err := db.First(&stored, ap.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusCompleted {
+		t.Errorf("status = %q, want completed", stored.Status)
+	}
+}
+
+func TestTransitionStatusRefusesStaleStatus(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:status?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	ap := Appointment{PatientName: "Ann Wambui", Doctor: "Dr. Kim", Date: "2030-01-07", Time: "10:00", Reason: "checkup", Status: StatusPending}
+	if err := createWithStatus(db, &ap, PatientContact{}, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	stale := ap
+	if err := transitionStatus(db, &ap, StatusConfirmed, "test", ""); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	// stale still reads pending, so cancelling it would skip the confirmed step
+	if err := transitionStatus(db, &stale, StatusCancelled, "test", ""); !errors.Is(err, errStatusChanged) {
+		t.Fatalf("stale cancel: got %v, want errStatusChanged", err)
+	}
+	var got Appointment
+	if err := db.First(&got, ap.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusConfirmed {
+		t.Errorf("status = %q, want %q", got.Status, StatusConfirmed)
+	}
+	var changes int64
+	db.Model(&StatusChange{}).Where("appointment_id = ?", ap.ID).Count(&changes)
+	if changes != 2 {
+		t.Errorf("%d history entries, want 2 (created, confirmed)", changes)
+	}
+}
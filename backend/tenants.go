@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultTenantID is the practice that data from before tenants existed
+// belongs to.
+const defaultTenantID uint = 1
+
+// Tenant is one practice hosted by this server. Every other table carries a
+// TenantID, and queries made through tenantDB or forTenant only ever see the
+// current tenant's rows. Doctors, ClinicName and PromptVersion feed the chat
+// prompts; LLMProvider, LLMModel and LLMAPIKey pick its model, falling back
+// to the server's LLM_* settings when empty.
+type Tenant struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Slug           string     `gorm:"size:64;uniqueIndex;not null" json:"slug"`
+	Name           string     `gorm:"size:255;not null" json:"name"`
+	WidgetKey      string     `gorm:"size:64;uniqueIndex;not null" json:"widget_key"`
+	Doctors        StringList `gorm:"type:text" json:"doctors"`
+	ClinicName     string     `gorm:"size:255" json:"clinic_name"`
+	WelcomeMessage string     `gorm:"size:500" json:"welcome_message"`
+	PrimaryColor   string     `gorm:"size:16" json:"primary_color"`
+	LogoURL        string     `gorm:"size:500" json:"logo_url"`
+	PromptVersion  string     `gorm:"size:32" json:"prompt_version"`
+	LLMProvider    string     `gorm:"size:16" json:"llm_provider"`
+	LLMModel       string     `gorm:"size:100" json:"llm_model"`
+	LLMAPIKey      string     `gorm:"size:255" json:"llm_api_key,omitempty"` // write-only, see redacted
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// redacted hides the API key and reports whether one is set instead.
+func (t Tenant) redacted() fiber.Map {
+	return fiber.Map{"tenant": withoutKey(t), "llm_api_key_set": t.LLMAPIKey != ""}
+}
+
+func withoutKey(t Tenant) Tenant {
+	t.LLMAPIKey = ""
+	return t
+}
+
+type tenantKey struct{}
+type allTenantsKey struct{}
+
+var errNoTenant = errors.New("query on a tenant table without a tenant")
+
+// errRawTenantSQL refuses hand-written SQL, which the tenant condition
+// can't be added to, on a tenant handle or a tenant table.
+var errRawTenantSQL = errors.New("raw SQL can't be limited to a tenant; use the query builder or systemDB")
+
+// forTenant returns a handle whose queries are limited to tenant id and
+// whose inserts are stamped with it.
+func forTenant(id uint) *gorm.DB {
+	return db.WithContext(context.WithValue(context.Background(), tenantKey{}, id))
+}
+
+// systemDB returns a handle that deliberately sees every tenant, for
+// migrations and background jobs. Handlers never use it for tenant data.
+func systemDB() *gorm.DB {
+	return db.WithContext(context.WithValue(context.Background(), allTenantsKey{}, true))
+}
+
+// tenantDB returns the handle for the tenant of the request, as set by
+// jwtMiddleware or the chat widget key.
+func tenantDB(c *fiber.Ctx) *gorm.DB {
+	return forTenant(requestTenant(c))
+}
+
+// requestTenant is the tenant jwtMiddleware resolved for the request, or 0
+// without one. There is no fallback to the default tenant: a 0 handle fails
+// every tenant query instead of reaching that practice's rows.
+func requestTenant(c *fiber.Ctx) uint {
+	id, _ := c.Locals("tenant").(uint)
+	return id
+}
+
+// tenantID reports the tenant a scoped handle belongs to, or 0 for
+// systemDB and the bare handle.
+func tenantID(tx *gorm.DB) uint {
+	id, _ := tx.Statement.Context.Value(tenantKey{}).(uint)
+	return id
+}
+
+// tenantOf loads the tenant a scoped handle belongs to.
+func tenantOf(tx *gorm.DB) Tenant {
+	var t Tenant
+	if err := db.First(&t, tenantID(tx)).Error; err != nil {
+		log.Printf("[tenant] failed to load tenant %d: %v", tenantID(tx), err)
+	}
+	return t
+}
+
+// registerTenantScope installs the callbacks that keep tenants apart: reads,
+// updates and deletes on any model with a TenantID get a tenant_id
+// condition, and inserts get the tenant stamped. A statement on such a model
+// without a tenant (and not made through systemDB) fails rather than
+// touching every tenant's rows.
+func registerTenantScope(d *gorm.DB) error {
+	cb := d.Callback()
+	if err := cb.Create().Before("gorm:create").Register("tenant:stamp", stampTenant); err != nil {
+		return err
+	}
+	if err := cb.Query().Before("gorm:query").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("gorm:row").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	if err := cb.Raw().Before("gorm:raw").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("tenant:scope", func(tx *gorm.DB) {
+		stampTenant(tx)
+		scopeTenant(tx)
+	}); err != nil {
+		return err
+	}
+	return cb.Delete().Before("gorm:delete").Register("tenant:scope", scopeTenant)
+}
+
+// statementTenant returns the tenant of the statement and whether the
+// model is tenant-owned at all. Unscoped statements on tenant models,
+// including those on forTenant(0), are failed here unless they come from
+// systemDB, and so is raw SQL (Raw, Exec)
+// on a tenant handle or a tenant model.
+func statementTenant(tx *gorm.DB) (uint, bool) {
+	stmt := tx.Statement
+	id, scoped := stmt.Context.Value(tenantKey{}).(uint)
+	owned := stmt.Schema != nil && stmt.Schema.LookUpField("TenantID") != nil
+	if stmt.SQL.Len() > 0 {
+		if (scoped || owned) && !transactionControl(stmt.SQL.String()) && stmt.Context.Value(allTenantsKey{}) == nil {
+			tx.AddError(errRawTenantSQL)
+		}
+		return 0, false
+	}
+	if !owned {
+		return 0, false
+	}
+	if scoped && id != 0 {
+		return id, true
+	}
+	// forTenant(0), from a request with no tenant, is no tenant at all; an
+	// insert would otherwise land in the default one via TenantID's default
+	if stmt.Context.Value(allTenantsKey{}) == nil {
+		tx.AddError(errNoTenant)
+	}
+	return 0, false
+}
+
+// transactionControl reports whether sql is one of the savepoint statements
+// GORM itself runs for nested transactions.
+func transactionControl(sql string) bool {
+	sql = strings.ToUpper(strings.TrimSpace(sql))
+	return strings.HasPrefix(sql, "SAVEPOINT ") || strings.HasPrefix(sql, "RELEASE ") ||
+		strings.HasPrefix(sql, "ROLLBACK TO ")
+}
+
+func scopeTenant(tx *gorm.DB) {
+	if id, ok := statementTenant(tx); ok {
+		tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "tenant_id"}, Value: id},
+		}})
+	}
+}
+
+func stampTenant(tx *gorm.DB) {
+	id, ok := statementTenant(tx)
+	if !ok {
+		return
+	}
+	field := tx.Statement.Schema.LookUpField("TenantID")
+	ctx, rv := tx.Statement.Context, tx.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := field.Set(ctx, reflect.Indirect(rv.Index(i)), id); err != nil {
+				tx.AddError(err)
+			}
+		}
+	case reflect.Struct:
+		if err := field.Set(ctx, rv, id); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
+
+// ensureDefaultTenant creates the default practice from the CLINIC_* and
+// WIDGET_KEY settings the single-practice server used.
+func ensureDefaultTenant() error {
+	var count int64
+	if err := db.Model(&Tenant{}).Where("id = ?", defaultTenantID).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	key := getEnv("WIDGET_KEY", "")
+	if key == "" {
+		var err error
+		if key, err = offerToken(); err != nil {
+			return err
+		}
+	}
+	return db.Create(&Tenant{ID: defaultTenantID, Slug: "default", Name: getEnv("CLINIC_NAME", "Default clinic"), WidgetKey: key}).Error
+}
+
+// tenantDoctors lists the tenant's doctors. The default tenant falls back
+// to CLINIC_DOCTORS.
+func tenantDoctors(tx *gorm.DB) []string {
+	t := tenantOf(tx)
+	if len(t.Doctors) > 0 || t.ID != defaultTenantID {
+		return t.Doctors
+	}
+	return clinicDoctors()
+}
+
+// chatSettings is what one tenant's chat runs with.
+type chatSettings struct {
+	Prompts    *PromptSet
+	Client     LLMClient
+	Model      string
+	ClinicName string
+	Doctors    []string
+}
+
+// chatSettingsFor resolves the tenant's prompts, model and clinic details,
+// using the server-wide settings for anything the tenant leaves empty.
+func chatSettingsFor(tx *gorm.DB) (chatSettings, error) {
+	t := tenantOf(tx)
+	ps, err := currentPrompts()
+	if err != nil {
+		return chatSettings{}, err
+	}
+	cfg := chatSettings{Prompts: ps, Client: llmClient, Model: t.LLMModel, ClinicName: t.ClinicName, Doctors: tenantDoctors(tx)}
+	if t.ID == defaultTenantID && cfg.ClinicName == "" {
+		cfg.ClinicName = getEnv("CLINIC_NAME", "")
+	}
+	if t.PromptVersion != "" {
+		ps, err := promptsFor(t.PromptVersion)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Prompts = ps
+	}
+	if t.LLMProvider != "" || t.LLMAPIKey != "" {
+		client, err := llmClientFor(t.LLMProvider, t.LLMAPIKey)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Client = client
+	}
+	return cfg, nil
+}
+
+// widgetTenant resolves the tenant of a chat widget from the X-Widget-Key
+// header, or key when the header is absent. A widget without a key gets 400
+// rather than the default tenant's chat.
+func widgetTenant(c *fiber.Ctx, key string) (Tenant, error) {
+	key = choose(c.Get("X-Widget-Key"), key)
+	var t Tenant
+	if key == "" {
+		return t, fiber.NewError(fiber.StatusBadRequest, "widget key is required")
+	}
+	if err := db.Where("widget_key = ?", key).First(&t).Error; err != nil {
+		return t, fiber.NewError(fiber.StatusUnauthorized, "unknown widget key")
+	}
+	return t, nil
+}
+
+// widgetConfig handles GET /widget/config: the branding a chat widget shows.
+func widgetConfig(c *fiber.Ctx) error {
+	t, err := widgetTenant(c, c.Query("key"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"name":            t.Name,
+		"clinic_name":     choose(t.ClinicName, t.Name),
+		"welcome_message": t.WelcomeMessage,
+		"primary_color":   t.PrimaryColor,
+		"logo_url":        t.LogoURL,
+	})
+}
+
+var slugRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+// tenantViolations normalises a tenant and reports what is wrong.
+func tenantViolations(t *Tenant) []PolicyViolation {
+	var out []PolicyViolation
+	t.Slug = strings.ToLower(strings.TrimSpace(t.Slug))
+	t.Name = strings.TrimSpace(t.Name)
+	if !slugRe.MatchString(t.Slug) {
+		out = append(out, PolicyViolation{"slug", "invalid_slug", "Use 2-63 lowercase letters, digits and dashes."})
+	}
+	if t.Name == "" {
+		out = append(out, PolicyViolation{"name", "required", "Please give the practice a name."})
+	}
+	switch t.LLMProvider = strings.ToLower(t.LLMProvider); t.LLMProvider {
+	case "", "groq", "ollama":
+	default:
+		out = append(out, PolicyViolation{"llm_provider", "invalid_provider", "The LLM provider must be groq or ollama."})
+	}
+	if t.PromptVersion != "" {
+		if _, err := promptsFor(t.PromptVersion); err != nil {
+			out = append(out, PolicyViolation{"prompt_version", "unknown_prompt_version", err.Error()})
+		}
+	}
+	return out
+}
+
+// platformAdmin rejects requests from anyone but a platform admin of the
+// default tenant. Being staff of the hosting practice isn't enough.
+func platformAdmin(c *fiber.Ctx) error {
+	id, _ := c.Locals("user").(uint)
+	var u User
+	if requestTenant(c) != defaultTenantID || id == 0 ||
+		forTenant(defaultTenantID).First(&u, id).Error != nil || !u.PlatformAdmin {
+		return fiber.NewError(fiber.StatusForbidden, "only platform admins can manage tenants")
+	}
+	return c.Next()
+}
+
+// listTenants handles GET /admin/tenants. Each practice's widget key and
+// LLM API key stay with that practice (see GET /admin/tenant).
+func listTenants(c *fiber.Ctx) error {
+	var ts []Tenant
+	if err := db.Order("id").Find(&ts).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to fetch")
+	}
+	for i := range ts {
+		ts[i] = withoutKey(ts[i])
+		ts[i].WidgetKey = ""
+	}
+	return c.JSON(ts)
+}
+
+// tenantRequest is the body of POST /admin/tenants: the tenant and the
+// login of its first admin.
+type tenantRequest struct {
+	Tenant
+	AdminEmail    string `json:"admin_email"`
+	AdminPassword string `json:"admin_password"`
+}
+
+// createTenant handles POST /admin/tenants. The new tenant gets its own
+// widget key, an admin login and the starter appointment types.
+func createTenant(c *fiber.Ctx) error {
+	var in tenantRequest
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	t := in.Tenant
+	t.ID = 0
+	v := tenantViolations(&t)
+	if !validateEmail(in.AdminEmail) || len(in.AdminPassword) < 6 {
+		v = append(v, PolicyViolation{"admin_email", "invalid_credentials", "Give the first admin a valid email and a password of at least 6 characters."})
+	}
+	if len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	key, err := offerToken()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create widget key")
+	}
+	t.WidgetKey = key
+	hash, err := hashPassword(in.AdminPassword)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to hash password")
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&t).Error; err != nil {
+			return fiber.NewError(fiber.StatusConflict, "a tenant with this slug already exists")
+		}
+		scoped := tx.WithContext(context.WithValue(context.Background(), tenantKey{}, t.ID))
+		if err := scoped.Create(&User{Email: in.AdminEmail, Password: hash}).Error; err != nil {
+			return err
+		}
+		return seedAppointmentTypes(scoped)
+	})
+	if err != nil {
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			return fe
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to create tenant")
+	}
+	return c.Status(fiber.StatusCreated).JSON(t.redacted())
+}
+
+// getTenant handles GET /admin/tenant: the caller's own practice settings.
+func getTenant(c *fiber.Ctx) error {
+	var t Tenant
+	if err := db.First(&t, requestTenant(c)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	return c.JSON(t.redacted())
+}
+
+// updateTenant handles PUT /admin/tenant. Staff edit their own practice's
+// doctors, branding, prompts and LLM settings; an empty llm_api_key keeps
+// the stored key and "rotate_widget_key" issues a new widget key.
+func updateTenant(c *fiber.Ctx) error {
+	var t Tenant
+	if err := db.First(&t, requestTenant(c)).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	id, slug, key, apiKey := t.ID, t.Slug, t.WidgetKey, t.LLMAPIKey
+	var in struct {
+		Tenant
+		RotateWidgetKey bool `json:"rotate_widget_key"`
+	}
+	in.Tenant = t
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	t = in.Tenant
+	t.ID, t.Slug, t.WidgetKey = id, slug, key
+	if t.LLMAPIKey == "" {
+		t.LLMAPIKey = apiKey
+	}
+	if in.RotateWidgetKey {
+		var err error
+		if t.WidgetKey, err = offerToken(); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to create widget key")
+		}
+	}
+	if v := tenantViolations(&t); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	if err := db.Save(&t).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to update")
+	}
+	return c.JSON(t.redacted())
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestTenantIsolation books the same doctor, day and reason in two tenants
+// and checks that neither tenant's staff can reach the other's appointment.
+func TestTenantIsolation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:isolation?mode=memory&cache=shared")
+	north := Tenant{Slug: "north", Name: "North Clinic", WidgetKey: "north-key"}
+	mustCreate(t, db.Create(&north).Error)
+
+	const date = "2030-01-07"
+	book := func(tenant uint, name string) Appointment {
+		ap := Appointment{PatientName: name, Doctor: "Dr. Lee", Date: date, Time: "10:00", TimeZone: "UTC",
+			Reason: "checkup", Status: StatusConfirmed}
+		mustCreate(t, createWithStatus(forTenant(tenant), &ap, PatientContact{}, "test", ""))
+		return ap
+	}
+	home := book(defaultTenantID, "Wanjiru Otieno")
+	away := book(north.ID, "Wanjiku Odhiambo")
+
+	app := fiber.New()
+	admin := app.Group("/admin", jwtMiddleware)
+	admin.Get("/appointments", listAppointments)
+	admin.Get("/appointments/search", searchAppointments)
+	admin.Get("/appointments/export", exportAppointments)
+	admin.Post("/appointments/bulk", bulkUpdateAppointments)
+	admin.Put("/appointments/:id", updateAppointment)
+	admin.Post("/appointments/:id/cancel", statusAction(StatusCancelled))
+	admin.Get("/appointments/:id/history", statusHistory)
+	admin.Get("/patients", listPatients)
+	admin.Get("/doctors/:id/agenda", doctorDayAgenda)
+
+	for _, tc := range []struct {
+		tenant      uint
+		own, other  Appointment
+		searchTerms string
+	}{
+		{defaultTenantID, home, away, "checkup wanjiku"},
+		{north.ID, away, home, "checkup wanjiru"},
+	} {
+		token, err := createJWTToken(1, tc.tenant, "staff@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		get := func(path string) []byte {
+			status, body := call(t, app, "GET", path, token, "")
+			if status != fiber.StatusOK {
+				t.Fatalf("tenant %d GET %s: %d %s", tc.tenant, path, status, body)
+			}
+			return body
+		}
+
+		var page appointmentPage
+		if err := json.Unmarshal(get("/admin/appointments?page_size=100"), &page); err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, ap := range page.Appointments {
+			found = found || ap.ID == tc.own.ID
+			if ap.ID == tc.other.ID {
+				t.Errorf("tenant %d lists the other tenant's appointment", tc.tenant)
+			}
+		}
+		if !found {
+			t.Errorf("tenant %d does not list its own appointment", tc.tenant)
+		}
+
+		// Search both patients by name: only the tenant's own one may match
+		var search struct {
+			Results []searchHit `json:"results"`
+		}
+		if err := json.Unmarshal(get("/admin/appointments/search?q=checkup+wanji"), &search); err != nil {
+			t.Fatal(err)
+		}
+		if len(search.Results) != 1 || search.Results[0].Appointment.ID != tc.own.ID {
+			t.Errorf("tenant %d search found %d results, want only its own appointment", tc.tenant, len(search.Results))
+		}
+		// Each search term matches the other tenant's row too; a typo away from
+		// the other patient's name shouldn't find it either
+		for _, q := range strings.Fields(tc.searchTerms) {
+			if err := json.Unmarshal(get("/admin/appointments/search?q="+q), &search); err != nil {
+				t.Fatal(err)
+			}
+			for _, hit := range search.Results {
+				if hit.Appointment.ID == tc.other.ID {
+					t.Errorf("tenant %d search %q finds the other tenant's appointment", tc.tenant, q)
+				}
+			}
+		}
+
+		if body := string(get("/admin/appointments/export")); strings.Contains(body, tc.other.PatientName) ||
+			!strings.Contains(body, tc.own.PatientName) {
+			t.Errorf("tenant %d export = %s, want only its own appointment", tc.tenant, body)
+		}
+
+		var agenda doctorAgenda
+		if err := json.Unmarshal(get("/admin/doctors/Dr.%20Lee/agenda?date="+date), &agenda); err != nil {
+			t.Fatal(err)
+		}
+		if len(agenda.Appointments) != 1 || agenda.Appointments[0].ID != tc.own.ID {
+			t.Errorf("tenant %d agenda has %d appointments, want only its own", tc.tenant, len(agenda.Appointments))
+		}
+
+		if body := string(get("/admin/patients")); strings.Contains(body, tc.other.PatientName) ||
+			!strings.Contains(body, tc.own.PatientName) {
+			t.Errorf("tenant %d patients = %s, want only its own patient", tc.tenant, body)
+		}
+
+		other := fmt.Sprintf("/admin/appointments/%d", tc.other.ID)
+		for _, req := range [][2]string{{"GET", other + "/history"}, {"PUT", other}, {"POST", other + "/cancel"}} {
+			if status, body := call(t, app, req[0], req[1], token, `{"reason": "test"}`); status != fiber.StatusNotFound {
+				t.Errorf("tenant %d %s %s: %d %s, want 404", tc.tenant, req[0], req[1], status, body)
+			}
+		}
+		bulk := fmt.Sprintf(`{"ids": [%d], "action": "cancel"}`, tc.other.ID)
+		if _, body := call(t, app, "POST", "/admin/appointments/bulk", token, bulk); !strings.Contains(string(body), `"error":"not found"`) {
+			t.Errorf("tenant %d bulk cancel of the other tenant's appointment: %s, want not found", tc.tenant, body)
+		}
+		var stored Appointment
+		mustCreate(t, systemDB().First(&stored, tc.other.ID).Error)
+		if stored.Status != StatusConfirmed || stored.Reason != "checkup" {
+			t.Errorf("other tenant's appointment is %s for %q, want it untouched", stored.Status, stored.Reason)
+		}
+	}
+
+	// Hand-written SQL can't be scoped, so a tenant handle refuses it
+	var rows []Appointment
+	if err := forTenant(north.ID).Raw("SELECT * FROM appointments").Scan(&rows).Error; !errors.Is(err, errRawTenantSQL) {
+		t.Errorf("raw query on a tenant handle: got %v (%d rows), want errRawTenantSQL", err, len(rows))
+	}
+	if err := forTenant(north.ID).Exec("UPDATE appointments SET status = ?", StatusCancelled).Error; !errors.Is(err, errRawTenantSQL) {
+		t.Errorf("raw update on a tenant handle: got %v, want errRawTenantSQL", err)
+	}
+}
+
+func TestPlatformAdmin(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	initDatabase("file:platform?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+	if err := ensureDefaultAdmin("root@example.com", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	var root User
+	if err := db.Where("email = ?", "root@example.com").First(&root).Error; err != nil {
+		t.Fatal(err)
+	}
+	rootToken, err := createJWTToken(root.ID, defaultTenantID, root.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	admin := app.Group("/admin", jwtMiddleware)
+	admin.Post("/users", createUser)
+	admin.Get("/tenants", platformAdmin, listTenants)
+
+	status, body := call(t, app, "POST", "/admin/users", rootToken, `{"email": "desk@example.com", "password": "secret123"}`)
+	if status != fiber.StatusCreated {
+		t.Fatalf("create user: %d %s", status, body)
+	}
+	var staff User
+	if err := json.Unmarshal(body, &staff); err != nil {
+		t.Fatal(err)
+	}
+	if staff.PlatformAdmin {
+		t.Error("a user added by staff is a platform admin")
+	}
+	staffToken, err := createJWTToken(staff.ID, defaultTenantID, staff.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default-tenant staff are not platform admins
+	if status, body := call(t, app, "GET", "/admin/tenants", staffToken, ""); status != fiber.StatusForbidden {
+		t.Errorf("staff list tenants: %d %s, want 403", status, body)
+	}
+	status, body = call(t, app, "GET", "/admin/tenants", rootToken, "")
+	if status != fiber.StatusOK {
+		t.Fatalf("admin list tenants: %d %s", status, body)
+	}
+	var ts []map[string]interface{}
+	if err := json.Unmarshal(body, &ts); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) == 0 {
+		t.Fatal("no tenants listed")
+	}
+	for _, tn := range ts {
+		if key, _ := tn["widget_key"].(string); key != "" {
+			t.Errorf("tenant %v lists its widget key", tn["slug"])
+		}
+	}
+}
+
+// TestUnresolvedTenant checks that a request whose tenant can't be worked
+// out is refused instead of falling back to the default tenant.
+func TestUnresolvedTenant(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	t.Setenv("JWT_SECRET", "tenant-test-secret")
+	initDatabase("file:unresolved?mode=memory&cache=shared")
+	north := Tenant{Slug: "north", Name: "North Clinic", WidgetKey: "north-key"}
+	mustCreate(t, db.Create(&north).Error)
+	ap := Appointment{PatientName: "Wanjiru Otieno", Doctor: "Dr. Lee", Date: "2030-01-07", Time: "10:00", TimeZone: "UTC",
+		Reason: "checkup", Status: StatusConfirmed}
+	mustCreate(t, createWithStatus(forTenant(defaultTenantID), &ap, PatientContact{}, "test", ""))
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["sub"], claims["email"], claims["exp"] = 1, "staff@example.com", time.Now().Add(time.Hour).Unix()
+		tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("tenant-test-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	app := fiber.New()
+	app.Get("/admin/appointments", jwtMiddleware, listAppointments)
+	app.Get("/unguarded/appointments", listAppointments)
+	app.Post("/chat", chatHandler)
+	app.Get("/widget/config", widgetConfig)
+
+	for _, tc := range []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{"token without a tenant", "GET", "/admin/appointments", sign(jwt.MapClaims{}), "", fiber.StatusUnauthorized},
+		{"token for a deleted tenant", "GET", "/admin/appointments", sign(jwt.MapClaims{"tenant": 99}), "", fiber.StatusUnauthorized},
+		{"token for a tenant", "GET", "/admin/appointments", sign(jwt.MapClaims{"tenant": north.ID}), "", fiber.StatusOK},
+		{"chat without a widget key", "POST", "/chat", "", `{"message": "hello"}`, fiber.StatusBadRequest},
+		{"chat with an unknown key", "POST", "/chat", "", `{"message": "hello", "widget_key": "nope"}`, fiber.StatusUnauthorized},
+		{"widget config without a key", "GET", "/widget/config", "", "", fiber.StatusBadRequest},
+		{"widget config with a key", "GET", "/widget/config?key=north-key", "", "", fiber.StatusOK},
+	} {
+		status, body := call(t, app, tc.method, tc.path, tc.token, tc.body)
+		if status != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, status, body, tc.want)
+		}
+		if strings.Contains(string(body), ap.PatientName) {
+			t.Errorf("%s: the default tenant's appointment leaked: %s", tc.name, body)
+		}
+	}
+
+	// A handler reached without jwtMiddleware has no tenant, and its
+	// queries fail rather than read the default tenant's rows
+	status, body := call(t, app, "GET", "/unguarded/appointments", "", "")
+	if status == fiber.StatusOK || strings.Contains(string(body), ap.PatientName) {
+		t.Errorf("no tenant: %d %s, want an error", status, body)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a range of acceptable start times such as "morning" or
+// "between 14:00 and 16:00". From is inclusive and To exclusive (HH:MM).
+// Near, when set, is the time the patient actually named ("around 3"), so
+// slots closest to it are offered first.
+type TimeWindow struct {
+	From  string
+	To    string
+	Near  string
+	Label string
+}
+
+func (w TimeWindow) IsZero() bool { return w.From == "" && w.To == "" && w.Near == "" }
+
+// TimeExpr is a time of day found in free text: either an exact HH:MM time or
+// a window. Start and End are byte offsets of the phrase that produced it.
+type TimeExpr struct {
+	Exact      string
+	Window     TimeWindow
+	Start, End int
+}
+
+func (t TimeExpr) IsWindow() bool { return t.Exact == "" }
+
+const hourWords = `one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve`
+const clockToken = `(\d{1,2}(?:[:.]\d{2})?|noon|midday|` + hourWords + `)\s*(a\.?m\.?|p\.?m\.?)?`
+
+var (
+	rangeTimeRe     = regexp.MustCompile(`(?i)\b(?:between|from)\s+` + clockToken + `\s*(?:and|to|until|till|-)\s*` + clockToken)
+	bareRangeTimeRe = regexp.MustCompile(`(?i)\b` + clockToken + `\s*(?:-|to|until|till)\s*(\d{1,2}(?:[:.]\d{2})?|` + hourWords + `)\s*(a\.?m\.?|p\.?m\.?)`)
+	aroundTimeRe    = regexp.MustCompile(`(?i)\b(?:at\s+)?(?:around|about|approximately|roughly|near)\s+` + clockToken)
+	ishTimeRe       = regexp.MustCompile(`(?i)\b(\d{1,2}|` + hourWords + `)\s*(a\.?m\.?|p\.?m\.?)?\s*-?ish\b`)
+	boundTimeRe     = regexp.MustCompile(`(?i)\b(before|by|until|after|from)\s+` + clockToken)
+	pastToTimeRe    = regexp.MustCompile(`(?i)\b(half|quarter|five|ten|twenty|twenty[\s-]five|\d{1,2}\s+minutes)\s+(past|after|to|before)\s+(\d{1,2}|` + hourWords + `)\s*(a\.?m\.?|p\.?m\.?)?`)
+	halfHourTimeRe  = regexp.MustCompile(`(?i)\bhalf\s+(\d{1,2}|` + hourWords + `)\b\s*(a\.?m\.?|p\.?m\.?)?`)
+	dayPartHourRe   = regexp.MustCompile(`(?i)\b(\d{1,2}(?:[:.]\d{2})?|` + hourWords + `)\s*(?:o'?clock\s+)?in\s+the\s+(morning|afternoon|evening)\b`)
+	colonTimeRe     = regexp.MustCompile(`(?i)\b(\d{1,2})[:.](\d{2})(?:\s*(a\.?m\.?|p\.?m\.?)|\b)`)
+	meridiemTimeRe  = regexp.MustCompile(`(?i)\b(\d{1,2}(?:\.\d{2})?|` + hourWords + `)\s*(a\.?m\.?|p\.?m\.?|o'?clock)(?:\W|$)`)
+	atHourRe        = regexp.MustCompile(`(?i)\bat\s+(\d{1,2}|` + hourWords + `)\b`)
+	bareHourRe      = regexp.MustCompile(`^\s*(\d{1,2})\s*[.!]?\s*$`)
+	noonRe          = regexp.MustCompile(`(?i)\b(noon|midday|midnight)\b`)
+	namedWindowRe   = regexp.MustCompile(`(?i)\b(first\s+thing|before\s+lunch|after\s+lunch|lunch\s*time|over\s+lunch|around\s+lunch|(?:early|late|mid)?[\s-]*(?:morning|afternoon|evening)|tonight)\b`)
+	dayPartWordRe   = regexp.MustCompile(`(?i)\b(morning|afternoon|evening|tonight)\b`)
+)
+
+var minuteWords = map[string]int{"half": 30, "quarter": 15, "five": 5, "ten": 10, "twenty": 20, "twenty five": 25, "twenty-five": 25}
+
+// extractTime finds the time expression in a chat message, ignoring its date
+// phrase (see withoutDate).
+func extractTime(message string) (TimeExpr, bool) {
+	open, close := clinicHours()
+	return resolveTime(withoutDate(message, clinicNow(), configuredDateOrder()), open, close)
+}
+
+// withoutDate blanks the date phrase found by resolveDate so "30th October"
+// or "4/11" are never read as hours. A day part inside it ("this morning")
+// is kept. Offsets into the result match the original message.
+func withoutDate(message string, now time.Time, order DateOrder) string {
+	dm, ok := resolveDate(message, now, order)
+	if !ok {
+		return message
+	}
+	blank := []byte(strings.Repeat(" ", dm.End-dm.Start))
+	span := message[dm.Start:dm.End]
+	for _, m := range dayPartWordRe.FindAllStringIndex(span, -1) {
+		copy(blank[m[0]:m[1]], span[m[0]:m[1]])
+	}
+	return message[:dm.Start] + string(blank) + message[dm.End:]
+}
+
+// resolveTime finds the first time expression in text. Hours without am/pm
+// are read as afternoon when they fall before the clinic opens ("at 3" is
+// 15:00 for a clinic opening at 08:00). Supported forms, in priority order:
+//
+//	between 2 and 4, from 9:30 to 11     window
+//	2-4pm, 10 to 11am                     window
+//	around 3, about 10:30, 3ish           window of an hour either side, nearest first
+//	before 11, by 10, after 2, from 3     window bounded by opening or closing time
+//	half past two, quarter to 4, half two exact
+//	9 in the morning, 7 o'clock in the evening
+//	14:30, 10.30, 2:30pm, 3pm, 10.30am, 4 o'clock
+//	at 3, a bare "3" as the whole message
+//	noon, midday, midnight
+//	morning, early morning, late afternoon, evening, tonight,
+//	lunchtime, before lunch, after lunch, first thing
+func resolveTime(text, open, close string) (TimeExpr, bool) {
+	openMin, _ := clockMinutes(open)
+	closeMin, ok := clockMinutes(close)
+	if !ok {
+		closeMin = 24 * 60
+	}
+
+	if m := rangeTimeRe.FindStringSubmatchIndex(text); m != nil {
+		if te, ok := rangeExpr(text, m, openMin); ok {
+			return te, true
+		}
+	}
+	if m := bareRangeTimeRe.FindStringSubmatchIndex(text); m != nil {
+		if te, ok := rangeExpr(text, m, openMin); ok {
+			return te, true
+		}
+	}
+
+	for _, re := range []*regexp.Regexp{aroundTimeRe, ishTimeRe} {
+		if m := re.FindStringSubmatchIndex(text); m != nil {
+			if at, ok := parseClock(group(text, m, 1), group(text, m, 2), openMin); ok {
+				w := TimeWindow{
+					From:  formatClock(at - 60),
+					To:    formatClock(at + 60),
+					Near:  formatClock(at),
+					Label: "around " + formatClock(at),
+				}
+				return TimeExpr{Window: w, Start: m[0], End: m[1]}, true
+			}
+		}
+	}
+
+	if m := boundTimeRe.FindStringSubmatchIndex(text); m != nil {
+		if at, ok := parseClock(group(text, m, 2), group(text, m, 3), openMin); ok {
+			var w TimeWindow
+			switch strings.ToLower(group(text, m, 1)) {
+			case "after", "from":
+				w = TimeWindow{From: formatClock(at), To: formatClock(closeMin), Label: "after " + formatClock(at)}
+			default:
+				w = TimeWindow{From: formatClock(openMin), To: formatClock(at), Label: "before " + formatClock(at)}
+			}
+			return TimeExpr{Window: w, Start: m[0], End: m[1]}, true
+		}
+	}
+
+	if m := pastToTimeRe.FindStringSubmatchIndex(text); m != nil {
+		word := strings.ToLower(strings.Join(strings.Fields(group(text, m, 1)), " "))
+		mins, known := minuteWords[word]
+		if !known {
+			mins, _ = strconv.Atoi(strings.Fields(word)[0])
+		}
+		if hour, ok := parseClock(group(text, m, 3), group(text, m, 4), openMin); ok && mins > 0 && mins < 60 {
+			rel := strings.ToLower(group(text, m, 2))
+			if rel == "to" || rel == "before" {
+				mins = -mins
+			}
+			return TimeExpr{Exact: formatClock(hour + mins), Start: m[0], End: m[1]}, true
+		}
+	}
+	if m := halfHourTimeRe.FindStringSubmatchIndex(text); m != nil {
+		// British "half two" is 2:30
+		if hour, ok := parseClock(group(text, m, 1), group(text, m, 2), openMin); ok {
+			return TimeExpr{Exact: formatClock(hour + 30), Start: m[0], End: m[1]}, true
+		}
+	}
+
+	if m := dayPartHourRe.FindStringSubmatchIndex(text); m != nil {
+		mer := "pm"
+		if strings.EqualFold(group(text, m, 2), "morning") {
+			mer = "am"
+		}
+		if at, ok := parseClock(group(text, m, 1), mer, openMin); ok {
+			return TimeExpr{Exact: formatClock(at), Start: m[0], End: m[1]}, true
+		}
+	}
+
+	if m := colonTimeRe.FindStringSubmatchIndex(text); m != nil {
+		mer := group(text, m, 3)
+		if mer == "" && (strings.HasPrefix(group(text, m, 1), "0") || atoiAt(text, m, 1) > 12) {
+			mer = "24h"
+		}
+		if at, ok := parseClock(group(text, m, 1)+":"+group(text, m, 2), mer, openMin); ok {
+			return TimeExpr{Exact: formatClock(at), Start: m[0], End: m[1]}, true
+		}
+	}
+	if m := meridiemTimeRe.FindStringSubmatchIndex(text); m != nil {
+		mer := group(text, m, 2)
+		if strings.Contains(strings.ToLower(mer), "clock") {
+			mer = ""
+		}
+		if at, ok := parseClock(group(text, m, 1), mer, openMin); ok {
+			return TimeExpr{Exact: formatClock(at), Start: m[0], End: m[5]}, true
+		}
+	}
+	for _, re := range []*regexp.Regexp{atHourRe, bareHourRe} {
+		if m := re.FindStringSubmatchIndex(text); m != nil {
+			if at, ok := parseClock(group(text, m, 1), "", openMin); ok {
+				return TimeExpr{Exact: formatClock(at), Start: m[0], End: m[1]}, true
+			}
+		}
+	}
+
+	if m := noonRe.FindStringSubmatchIndex(text); m != nil {
+		exact := "12:00"
+		if strings.EqualFold(group(text, m, 1), "midnight") {
+			exact = "00:00"
+		}
+		return TimeExpr{Exact: exact, Start: m[0], End: m[1]}, true
+	}
+
+	if m := namedWindowRe.FindStringSubmatchIndex(text); m != nil {
+		phrase := strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(group(text, m, 1), "-", " ")), " "))
+		if w, ok := namedWindow(phrase, openMin, closeMin); ok {
+			return TimeExpr{Window: w, Start: m[0], End: m[1]}, true
+		}
+	}
+
+	return TimeExpr{}, false
+}
+
+// namedWindow maps a day part to clinic-relative bounds.
+func namedWindow(phrase string, openMin, closeMin int) (TimeWindow, bool) {
+	bounds := map[string][2]int{
+		"first thing":     {openMin, openMin + 60},
+		"early morning":   {openMin, 10 * 60},
+		"morning":         {openMin, 12 * 60},
+		"mid morning":     {10 * 60, 11*60 + 30},
+		"late morning":    {10 * 60, 12 * 60},
+		"before lunch":    {openMin, 12 * 60},
+		"lunchtime":       {12 * 60, 13 * 60},
+		"lunch time":      {12 * 60, 13 * 60},
+		"over lunch":      {12 * 60, 13 * 60},
+		"around lunch":    {12 * 60, 13 * 60},
+		"after lunch":     {13 * 60, closeMin},
+		"early afternoon": {12 * 60, 14 * 60},
+		"afternoon":       {12 * 60, 17 * 60},
+		"mid afternoon":   {14 * 60, 16 * 60},
+		"late afternoon":  {15 * 60, 17 * 60},
+		"early evening":   {17 * 60, 19 * 60},
+		"evening":         {17 * 60, closeMin},
+		"late evening":    {19 * 60, closeMin},
+		"tonight":         {17 * 60, closeMin},
+	}
+	b, ok := bounds[phrase]
+	if !ok {
+		return TimeWindow{}, false
+	}
+	label := phrase
+	if label == "tonight" {
+		label = "evening"
+	}
+	if label != "first thing" && !strings.Contains(label, "lunch") {
+		label = "in the " + label
+	}
+	return TimeWindow{From: formatClock(b[0]), To: formatClock(b[1]), Label: label}, true
+}
+
+func rangeExpr(text string, m []int, openMin int) (TimeExpr, bool) {
+	fromTok, fromMer := group(text, m, 1), group(text, m, 2)
+	toTok, toMer := group(text, m, 3), group(text, m, 4)
+	if fromMer == "" && toMer != "" {
+		// "2-4pm": the second meridiem applies to both ends unless that
+		// would put the start after the end ("11 to 1pm")
+		if from, ok := parseClock(fromTok, toMer, openMin); ok {
+			if to, ok := parseClock(toTok, toMer, openMin); ok && from < to {
+				fromMer = toMer
+			}
+		}
+	}
+	from, ok1 := parseClock(fromTok, fromMer, openMin)
+	to, ok2 := parseClock(toTok, toMer, openMin)
+	if !ok1 || !ok2 || from >= to {
+		return TimeExpr{}, false
+	}
+	w := TimeWindow{
+		From:  formatClock(from),
+		To:    formatClock(to),
+		Label: "between " + formatClock(from) + " and " + formatClock(to),
+	}
+	return TimeExpr{Window: w, Start: m[0], End: m[1]}, true
+}
+
+// parseClock converts an hour token ("3", "two", "10:30", "10.30", "noon")
+// and an optional meridiem into minutes after midnight. meridiem "24h" marks
+// a token that must not be shifted to the afternoon ("07:30", "14:00").
+func parseClock(tok, meridiem string, openMin int) (int, bool) {
+	tok = strings.ToLower(strings.TrimSpace(tok))
+	mer := strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(meridiem))
+	if tok == "noon" || tok == "midday" {
+		return 12 * 60, mer == "" || mer == "pm"
+	}
+	hourStr, minStr := tok, "0"
+	if i := strings.IndexAny(tok, ":."); i >= 0 {
+		hourStr, minStr = tok[:i], tok[i+1:]
+	}
+	hour, err := strconv.Atoi(hourStr)
+	if err != nil {
+		n, ok := numberWords[hourStr]
+		if !ok || hourStr == "a" || hourStr == "an" {
+			return 0, false
+		}
+		hour = n
+	}
+	min, err := strconv.Atoi(minStr)
+	if err != nil || min < 0 || min > 59 {
+		return 0, false
+	}
+	switch mer {
+	case "am", "pm":
+		if hour < 1 || hour > 12 {
+			return 0, false
+		}
+		if mer == "pm" && hour < 12 {
+			hour += 12
+		}
+		if mer == "am" && hour == 12 {
+			hour = 0
+		}
+	case "24h":
+		if hour > 23 {
+			return 0, false
+		}
+	default:
+		if hour > 23 {
+			return 0, false
+		}
+		// No am/pm: nobody books at 3 in the night
+		if hour >= 1 && hour < 12 && hour*60+min < openMin {
+			hour += 12
+		}
+	}
+	return hour*60 + min, true
+}
+
+func clockMinutes(hhmm string) (int, bool) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// formatClock renders minutes after midnight as HH:MM, clamped to the day.
+func formatClock(mins int) string {
+	if mins < 0 {
+		mins = 0
+	}
+	if mins >= 24*60 {
+		return "24:00"
+	}
+	return formatTwo(mins/60) + ":" + formatTwo(mins%60)
+}
+
+func group(text string, m []int, n int) string {
+	if 2*n+1 >= len(m) || m[2*n] < 0 {
+		return ""
+	}
+	return text[m[2*n]:m[2*n+1]]
+}
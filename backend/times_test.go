@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeCorpus(t *testing.T) {
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2025, 10, 20, 9, 0, 0, 0, time.UTC) }
+
+	cases := 0
+	err := eachCorpusCase("testdata/times.jsonl", func(line int, raw []byte) error {
+		cases++
+		failure, err := checkTimeCase(raw, "08:00", "18:00")
+		if err != nil {
+			t.Errorf("times.jsonl:%d: %v", line, err)
+		} else if failure != "" {
+			t.Errorf("times.jsonl:%d: %s", line, failure)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cases == 0 {
+		t.Fatal("times.jsonl has no cases")
+	}
+}
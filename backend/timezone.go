@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // the alpine runtime image ships no zoneinfo
+)
+
+var (
+	clinicTZOnce sync.Once
+	clinicTZLoc  *time.Location
+)
+
+// clinicTZ returns the clinic's time zone from CLINIC_TIMEZONE (an IANA name
+// such as "Africa/Nairobi"), falling back to the server's local zone.
+func clinicTZ() *time.Location {
+	clinicTZOnce.Do(func() {
+		clinicTZLoc = time.Local
+		if name := strings.TrimSpace(os.Getenv("CLINIC_TIMEZONE")); name != "" {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				log.Fatalf("invalid CLINIC_TIMEZONE %q: %v", name, err)
+			}
+			clinicTZLoc = loc
+		}
+		log.Printf("[config] Clinic time zone: %s", clinicTZLoc)
+	})
+	return clinicTZLoc
+}
+
+// clinicNow is the current time on the clinic's wall clock. "Today",
+// "tomorrow" and "already passed" are all decided in this zone.
+func clinicNow() time.Time {
+	return nowFunc().In(clinicTZ())
+}
+
+// zoneFor resolves the zone an appointment is kept in: empty means the
+// clinic zone, and anything else must be an IANA zone name. A branch's zone
+// is its Location.TimeZone, copied onto the booking by resolveLocation.
+func zoneFor(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return clinicTZ(), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// errNonexistentTime is returned for wall-clock times skipped when the
+// clocks go forward, such as 02:30 on the last Sunday of March in Europe.
+type errNonexistentTime struct {
+	Date, Time string
+	Zone       *time.Location
+}
+
+func (e errNonexistentTime) Error() string {
+	return fmt.Sprintf("%s does not exist on %s in %s (clocks go forward)", e.Time, e.Date, e.Zone)
+}
+
+// localInstant turns a clinic date (YYYY-MM-DD) and wall-clock time (HH:MM)
+// into an instant. Times skipped by a DST change are rejected; times that
+// occur twice when the clocks go back resolve to the first occurrence.
+func localInstant(date, hhmm string, loc *time.Location) (time.Time, error) {
+	wall := date + " " + hhmm
+	t, err := time.ParseInLocation("2006-01-02 15:04", wall, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.Format("2006-01-02 15:04") != wall {
+		return time.Time{}, errNonexistentTime{Date: date, Time: hhmm, Zone: loc}
+	}
+	_, before := t.Add(-3 * time.Hour).Zone()
+	_, after := t.Add(3 * time.Hour).Zone()
+	if before > after {
+		if earlier := t.Add(-time.Duration(before-after) * time.Second); earlier.Format("2006-01-02 15:04") == wall {
+			t = earlier
+		}
+	}
+	return t, nil
+}
@@ -10,15 +10,14 @@ import (
 var (
 	dateRegex     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
 	timeRegex     = regexp.MustCompile(`^\d{2}:\d{2}$`)
-	monthNameRe   = regexp.MustCompile(`(?i)\b(january|february|march|april|may|june|july|august|september|october|november|december|jan|feb|mar|apr|jun|jul|aug|sep|sept|oct|nov|dec)\b`)
-	ordinalDayRe  = regexp.MustCompile(`(?i)\b(\d{1,2})(st|nd|rd|th)?\b`)
-	timePhraseRe  = regexp.MustCompile(`(?i)\b(\d{1,2})(?::(\d{2}))?\s*(am|pm)?\b`)
-	tomorrowRe    = regexp.MustCompile(`(?i)\btomorrow\b`)
-	todayRe       = regexp.MustCompile(`(?i)\btoday\b`)
 	doctorNameRe  = regexp.MustCompile(`(?i)\bdoctor\s+([a-zA-Z]+)\b`)
 	patientNameRe = regexp.MustCompile(`(?i)\bmy\s+name\s+is\s+([a-zA-Z]+(?:\s+[a-zA-Z]+)?)\b`)
 )
 
+// nowFunc is the clock used for resolving relative dates; see clinicNow for
+// the clinic's wall clock. The eval harness pins it to a fixed instant.
+var nowFunc = time.Now
+
 func isValidDate(date string) bool {
 	if !dateRegex.MatchString(date) {
 		return false
@@ -71,72 +70,22 @@ func setConversation(sessionID string, s ConversationState) {
 // Handles examples like:
 // - "book me for 11am on 30th october with doctor Mercy"
 // - "tomorrow at 14:30 with doctor Kim"
-// Returns (draft appointment, true) if confident.
+// - "next Monday at 9am", "4/11 at 2pm", "half past two on Friday"
+// Dates are resolved by resolveDate and times by extractTime. Returns (draft appointment, true) if confident.
 func tryLocalParse(message string) (Appointment, bool) {
 	msg := strings.ToLower(message)
 
-	// Time
-	hhmm := ""
-	if m := timePhraseRe.FindStringSubmatch(msg); len(m) > 0 {
-		hour, _ := strconv.Atoi(m[1])
-		min := 0
-		if len(m) > 2 && m[2] != "" {
-			min, _ = strconv.Atoi(m[2])
-		}
-		ampm := ""
-		if len(m) > 3 {
-			ampm = strings.ToLower(m[3])
-		}
-		// Handle 12-hour format
-		if ampm == "pm" && hour < 12 {
-			hour += 12
-		}
-		if ampm == "am" && hour == 12 {
-			hour = 0
-		}
-		if hour >= 0 && hour <= 23 {
-			hhmm = formatTwo(hour) + ":" + formatTwo(min)
-		}
-	} else {
-		// Fallback: check for simple patterns like "5pm", "3am"
-		simpleTimeRe := regexp.MustCompile(`(?i)\b(\d{1,2})\s*(am|pm)\b`)
-		if m := simpleTimeRe.FindStringSubmatch(msg); len(m) > 2 {
-			hour, _ := strconv.Atoi(m[1])
-			ampm := strings.ToLower(m[2])
-			if ampm == "pm" && hour < 12 {
-				hour += 12
-			}
-			if ampm == "am" && hour == 12 {
-				hour = 0
-			}
-			if hour >= 0 && hour <= 23 {
-				hhmm = formatTwo(hour) + ":00"
-			}
-		}
-	}
-
 	// Date
 	var dateStr string
-	now := time.Now()
-	if tomorrowRe.MatchString(msg) {
-		dateStr = now.Add(24 * time.Hour).Format("2006-01-02")
-	} else if todayRe.MatchString(msg) {
-		dateStr = now.Format("2006-01-02")
-	} else if monthNameRe.MatchString(msg) && ordinalDayRe.MatchString(msg) {
-		// Extract day and month
-		dayMatch := ordinalDayRe.FindStringSubmatch(msg)
-		monthMatch := monthNameRe.FindStringSubmatch(msg)
-		day, _ := strconv.Atoi(dayMatch[1])
-		monName := strings.ToLower(monthMatch[1])
-		mon := monthNameToNumber(monName)
-		year := now.Year()
-		// If month has passed this year and no explicit year, assume next year
-		cand := time.Date(year, time.Month(mon), day, 0, 0, 0, 0, time.Local)
-		if cand.Before(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)) {
-			year++
-			cand = time.Date(year, time.Month(mon), day, 0, 0, 0, 0, time.Local)
-		}
-		dateStr = cand.Format("2006-01-02")
+	if dm, ok := resolveDate(message, clinicNow(), configuredDateOrder()); ok {
+		dateStr = dm.Date.Format("2006-01-02")
+	}
+
+	// Time: only an exact time counts here; windows like "morning" are
+	// handled by the chat flow, which offers free slots
+	hhmm := ""
+	if te, ok := extractTime(message); ok && !te.IsWindow() {
+		hhmm = te.Exact
 	}
 
 	// Doctor
@@ -154,7 +103,7 @@ func tryLocalParse(message string) (Appointment, bool) {
 	// Reason extraction (from patterns like "for Dentist", "for checkup", or standalone medical terms)
 	reason := ""
 	reasonPatterns := []*regexp.Regexp{
-		regexp.MustCompile(`(?i)\b(?:for|because of|reason is|need)\s+([a-zA-Z]+(?:\s+[a-zA-Z]+)?)\b`),
+		regexp.MustCompile(`(?i)\b(?:for|because of|reason is|need)\s+(?:an?\s+|the\s+|my\s+)?([a-zA-Z]+(?:\s+[a-zA-Z]+)?)\b`),
 		regexp.MustCompile(`(?i)\b(dentist|dental|checkup|consultation|examination|exam|headache|pain|injury|surgery|treatment|therapy|routine|annual|physical|screening)\b`),
 	}
 	for _, pattern := range reasonPatterns {
@@ -191,7 +140,7 @@ func monthNameToNumber(m string) int {
 	case "nov": return 11
 	case "dec": return 12
 	}
-	return int(time.Now().Month())
+	return int(clinicNow().Month())
 }
 
 func formatTwo(n int) string {
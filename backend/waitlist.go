@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// WaitlistEntry is a patient waiting for a doctor on any day from DateFrom
+// to DateTo, optionally only between TimeFrom and TimeTo and only at one
+// branch (LocationID). Entries are served first come, first served.
+type WaitlistEntry struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	TenantID          uint      `gorm:"not null;default:1;index" json:"-"`
+	PatientID         *uint     `gorm:"index" json:"patient_id"`
+	PatientName       string    `gorm:"size:255;not null" json:"patient_name"`
+	Phone             string    `gorm:"size:32" json:"phone"`
+	Email             string    `gorm:"size:255" json:"email"`
+	Doctor            string    `gorm:"size:255;not null;index:idx_waitlist_doctor_status,priority:1" json:"doctor"`
+	DateFrom          string    `gorm:"size:10;not null" json:"date_from"`
+	DateTo            string    `gorm:"size:10;not null" json:"date_to"`
+	TimeFrom          string    `gorm:"size:5" json:"time_from"`
+	TimeTo            string    `gorm:"size:5" json:"time_to"`
+	Reason            string    `gorm:"size:500" json:"reason"`
+	AppointmentTypeID *uint     `json:"appointment_type_id"`
+	LocationID        *uint     `gorm:"index" json:"location_id"`
+	Status            string    `gorm:"size:20;not null;default:waiting;index:idx_waitlist_doctor_status,priority:2" json:"status"` // waiting, offered, booked or cancelled
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// WaitlistOffer holds a freed slot for one waitlisted patient until
+// ExpiresAt. The patient accepts or declines it through Token. While it is
+// open, HeldFrom to HeldUntil (their visit with its buffers) is busy for
+// everyone else.
+type WaitlistOffer struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	TenantID      uint      `gorm:"not null;default:1;index" json:"-"`
+	EntryID       uint      `gorm:"index;not null" json:"entry_id"`
+	Doctor        string    `gorm:"size:255;not null" json:"doctor"`
+	Date          string    `gorm:"size:10;not null" json:"date"`
+	Time          string    `gorm:"size:5;not null" json:"time"`
+	TimeZone      string    `gorm:"size:64" json:"time_zone"`
+	LocationID    *uint     `json:"location_id"`
+	HeldFrom      time.Time `gorm:"index" json:"held_from"`
+	HeldUntil     time.Time `json:"held_until"`
+	Token         string    `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ExpiresAt     time.Time `gorm:"index" json:"expires_at"`
+	Status        string    `gorm:"size:20;not null;default:open;index" json:"status"` // open, accepted, declined or expired
+	AppointmentID *uint     `json:"appointment_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// waitlistOfferTTL is how long a freed slot is held for a waitlisted
+// patient (WAITLIST_OFFER_MINUTES, default 120).
+func waitlistOfferTTL() time.Duration {
+	return time.Duration(envInt("WAITLIST_OFFER_MINUTES", 120, 1)) * time.Minute
+}
+
+func (e WaitlistEntry) contact() PatientContact {
+	return PatientContact{Phone: e.Phone, Email: e.Email}
+}
+
+// wants reports whether slot falls inside the entry's days, time window
+// and branch.
+func (e WaitlistEntry) wants(slot Appointment) bool {
+	date, hhmm := slot.Date, slot.Time
+	if date < e.DateFrom || date > e.DateTo {
+		return false
+	}
+	if e.LocationID != nil && (slot.LocationID == nil || *slot.LocationID != *e.LocationID) {
+		return false
+	}
+	return (e.TimeFrom == "" || hhmm >= e.TimeFrom) && (e.TimeTo == "" || hhmm < e.TimeTo)
+}
+
+// waitlistEntryViolations normalises an entry and reports what is wrong.
+func waitlistEntryViolations(db *gorm.DB, e *WaitlistEntry) []PolicyViolation {
+	e.PatientName = strings.TrimSpace(e.PatientName)
+	e.Phone = normalizePhone(e.Phone)
+	e.Email = strings.ToLower(strings.TrimSpace(e.Email))
+	if e.DateTo == "" {
+		e.DateTo = e.DateFrom
+	}
+	var out []PolicyViolation
+	if e.PatientName == "" {
+		out = append(out, PolicyViolation{"patient_name", "required", "Patient name is required."})
+	}
+	if e.Doctor == "" {
+		out = append(out, PolicyViolation{"doctor", "required", "Doctor is required."})
+	} else if canon, ok := canonicalDoctor(db, e.Doctor); ok {
+		e.Doctor = canon
+	} else {
+		out = append(out, PolicyViolation{"doctor", "unknown_doctor", fmt.Sprintf("We don't have a doctor called %s.", e.Doctor)})
+	}
+	today := clinicNow().Format("2006-01-02")
+	switch {
+	case !isValidDate(e.DateFrom) || !isValidDate(e.DateTo):
+		out = append(out, PolicyViolation{"date_from", "invalid_date", "date_from and date_to must be YYYY-MM-DD."})
+	case e.DateTo < e.DateFrom:
+		out = append(out, PolicyViolation{"date_to", "invalid_range", "date_to is before date_from."})
+	case e.DateTo < today:
+		out = append(out, PolicyViolation{"date_to", "past_date", fmt.Sprintf("%s is in the past.", e.DateTo)})
+	}
+	for _, t := range []struct{ field, value string }{{"time_from", e.TimeFrom}, {"time_to", e.TimeTo}} {
+		if t.value != "" && !isValidTime(t.value) {
+			out = append(out, PolicyViolation{t.field, "invalid_time", fmt.Sprintf("%s isn't a valid time.", t.value)})
+		}
+	}
+	return append(out, contactViolations(e.contact())...)
+}
+
+// joinWaitlist validates and stores a new entry, linked to its patient.
+func joinWaitlist(db *gorm.DB, e *WaitlistEntry) []PolicyViolation {
+	e.ID, e.Status = 0, "waiting"
+	if v := waitlistEntryViolations(db, e); len(v) > 0 {
+		return v
+	}
+	if e.LocationID != nil && db.First(&Location{}, *e.LocationID).Error != nil {
+		return []PolicyViolation{{"location_id", "unknown_location", fmt.Sprintf("Location %d doesn't exist.", *e.LocationID)}}
+	}
+	if t, ok := matchAppointmentType(db, e.Reason); ok && e.AppointmentTypeID == nil {
+		e.AppointmentTypeID = &t.ID
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		p, err := findOrCreatePatient(tx, Patient{Name: e.PatientName, Phone: e.Phone, Email: e.Email})
+		if err != nil {
+			return err
+		}
+		e.PatientID = &p.ID
+		return tx.Create(e).Error
+	})
+	if err != nil {
+		log.Printf("[waitlist] join failed: %v", err)
+		return []PolicyViolation{{"", "internal", "Couldn't add you to the waitlist. Please try again."}}
+	}
+	log.Printf("[waitlist] entry %d: %s for %s %s..%s", e.ID, e.PatientName, e.Doctor, e.DateFrom, e.DateTo)
+	return nil
+}
+
+// visitFor is the appointment entry would get in slot.
+func (e WaitlistEntry) visitFor(db *gorm.DB, slot Appointment) Appointment {
+	ap := Appointment{
+		PatientName: e.PatientName, PatientID: e.PatientID, Doctor: e.Doctor, Date: slot.Date, Time: slot.Time,
+		Reason: e.Reason, TimeZone: slot.TimeZone, LocationID: slot.LocationID, Status: StatusPending,
+		AppointmentTypeID: e.AppointmentTypeID,
+	}
+	resolveAppointmentType(db, &ap)
+	return ap
+}
+
+// slotBookable reports whether ap could be booked right now.
+func slotBookable(db *gorm.DB, ap Appointment) bool {
+	if len(validateBookingRules(db, &ap)) > 0 {
+		return false
+	}
+	v, err := scheduleViolations(db, ap)
+	return err == nil && len(v) == 0
+}
+
+// offerFreedSlot offers the slot freed by a cancelled, moved or deleted
+// appointment to the first waiting patient it suits who can be told, and
+// queues the notification. Errors are logged; freeing the slot itself has already
+// succeeded.
+func offerFreedSlot(db *gorm.DB, freed Appointment) {
+	if freed.Doctor == "" || !isValidDate(freed.Date) || !isValidTime(freed.Time) {
+		return
+	}
+	var open int64
+	db.Model(&WaitlistOffer{}).Where("doctor = ? AND date = ? AND time = ? AND status = ?",
+		freed.Doctor, freed.Date, freed.Time, "open").Count(&open)
+	if open > 0 {
+		return
+	}
+	var entries []WaitlistEntry
+	err := db.Where("doctor = ? AND status = ? AND date_from <= ? AND date_to >= ?", freed.Doctor, "waiting", freed.Date, freed.Date).
+		Order("created_at, id").Find(&entries).Error
+	if err != nil {
+		log.Printf("[waitlist] lookup failed: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if !e.wants(freed) {
+			continue
+		}
+		if !canReach(e.contact()) {
+			// Holding the slot for a patient who is never told would only
+			// keep it from everyone else
+			log.Printf("[waitlist] entry %d skipped: NOTIFIER can't reach them", e.ID)
+			continue
+		}
+		var before int64
+		db.Model(&WaitlistOffer{}).Where("entry_id = ? AND date = ? AND time = ?", e.ID, freed.Date, freed.Time).Count(&before)
+		if before > 0 || !slotBookable(db, e.visitFor(db, freed)) {
+			// Already turned this slot down, or it doesn't fit their visit
+			continue
+		}
+		if err := makeWaitlistOffer(db, e, freed); err != nil {
+			log.Printf("[waitlist] offer to entry %d failed: %v", e.ID, err)
+		}
+		return
+	}
+}
+
+func makeWaitlistOffer(db *gorm.DB, e WaitlistEntry, slot Appointment) error {
+	token, err := offerToken()
+	if err != nil {
+		return err
+	}
+	visit := e.visitFor(db, slot)
+	if err := visit.normalizeSchedule(); err != nil {
+		return err
+	}
+	offer := WaitlistOffer{
+		EntryID: e.ID, Doctor: slot.Doctor, Date: slot.Date, Time: slot.Time, TimeZone: slot.TimeZone, LocationID: slot.LocationID,
+		HeldFrom: visit.BlockedFrom.UTC(), HeldUntil: visit.BlockedUntil.UTC(),
+		Token: token, ExpiresAt: nowFunc().Add(waitlistOfferTTL()).UTC(), Status: "open",
+	}
+	loc, err := zoneFor(slot.TimeZone)
+	if err != nil {
+		loc = clinicTZ()
+	}
+	body := fmt.Sprintf("Good news, %s: %s has a free slot on %s at %s. It's held for you until %s. Book it or let it go here: %s",
+		e.PatientName, slot.Doctor, slot.Date, slot.Time, offer.ExpiresAt.In(loc).Format("2006-01-02 15:04"), offerLink(token))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// The slot may have been booked or offered since offerFreedSlot
+		// checked it
+		clash, err := conflictingAppointment(tx, visit)
+		if err != nil {
+			return err
+		}
+		held, err := heldOffer(tx, visit)
+		if err != nil {
+			return err
+		}
+		if clash != nil || held != nil {
+			return errTimeTaken
+		}
+		if err := tx.Create(&offer).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&WaitlistEntry{}).Where("id = ?", e.ID).Update("status", "offered").Error; err != nil {
+			return err
+		}
+		return notifyPatient(tx, e.contact(), "A slot opened up with "+slot.Doctor, body)
+	})
+	if err == nil {
+		log.Printf("[waitlist] offered %s %s %s to entry %d until %s", slot.Doctor, slot.Date, slot.Time, e.ID, offer.ExpiresAt.Format(time.RFC3339))
+	}
+	return err
+}
+
+// offerLink is the page where a patient books or declines the offer for
+// token. Following it only shows the offer, so link checkers that fetch it
+// can't answer for the patient.
+func offerLink(token string) string {
+	return strings.TrimRight(getEnv("FRONTEND_URL", "http://localhost:3000"), "/") + "/waitlist/" + token
+}
+
+// slot is the freed appointment slot the offer holds.
+func (o WaitlistOffer) slot() Appointment {
+	return Appointment{Doctor: o.Doctor, Date: o.Date, Time: o.Time, TimeZone: o.TimeZone, LocationID: o.LocationID}
+}
+
+func offerToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// closeOffer ends an open offer with status, puts the patient back in the
+// queue and passes the slot on to the next waiting patient. An offer that
+// was answered or closed in the meantime is left as it is, with errOfferGone.
+func closeOffer(db *gorm.DB, offer WaitlistOffer, status string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&WaitlistOffer{}).Where("id = ? AND status = ?", offer.ID, "open").Update("status", status)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errOfferGone
+		}
+		return tx.Model(&WaitlistEntry{}).Where("id = ? AND status = ?", offer.EntryID, "offered").Update("status", "waiting").Error
+	})
+	if err != nil {
+		return err
+	}
+	offerFreedSlot(db, offer.slot())
+	return nil
+}
+
+// expireWaitlistOffers closes offers nobody answered in time, each within
+// its own tenant.
+func expireWaitlistOffers() {
+	var offers []WaitlistOffer
+	if err := systemDB().Where("status = ? AND expires_at <= ?", "open", nowFunc().UTC()).Find(&offers).Error; err != nil {
+		log.Printf("[waitlist] expiry check failed: %v", err)
+		return
+	}
+	for _, o := range offers {
+		if err := closeOffer(forTenant(o.TenantID), o, "expired"); err != nil && !errors.Is(err, errOfferGone) {
+			log.Printf("[waitlist] expiring offer %d failed: %v", o.ID, err)
+		}
+	}
+}
+
+var errOfferGone = errors.New("this offer is no longer available")
+
+// findOffer loads the offer for token. Patients follow the link without
+// logging in, so the token alone decides the tenant.
+func findOffer(token string) (WaitlistOffer, error) {
+	var offer WaitlistOffer
+	if err := systemDB().Where("token = ?", token).First(&offer).Error; err != nil {
+		return offer, fiber.NewError(fiber.StatusNotFound, "offer not found")
+	}
+	return offer, nil
+}
+
+// openOffer loads the offer for token, expiring it first if its time is up.
+func openOffer(token string) (WaitlistOffer, error) {
+	offer, err := findOffer(token)
+	if err != nil {
+		return offer, err
+	}
+	if offer.Status == "open" && !nowFunc().Before(offer.ExpiresAt) {
+		_ = closeOffer(forTenant(offer.TenantID), offer, "expired")
+		offer.Status = "expired"
+	}
+	if offer.Status != "open" {
+		return offer, fiber.NewError(fiber.StatusGone, errOfferGone.Error())
+	}
+	return offer, nil
+}
+
+// getWaitlistOffer handles GET /waitlist/offers/:token.
+func getWaitlistOffer(c *fiber.Ctx) error {
+	offer, err := findOffer(c.Params("token"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(offer)
+}
+
+// errSlotTaken rolls back an accept whose slot was booked in the meantime.
+var errSlotTaken = errors.New("the offered slot is no longer free")
+
+// acceptWaitlistOffer handles POST /waitlist/offers/:token/accept and books
+// the held slot. The offer is claimed and the slot checked again inside the
+// booking transaction, so two accepts (or an accept racing the expiry job)
+// can't both book it.
+func acceptWaitlistOffer(c *fiber.Ctx) error {
+	offer, err := openOffer(c.Params("token"))
+	if err != nil {
+		return err
+	}
+	db := forTenant(offer.TenantID)
+	var e WaitlistEntry
+	if err := db.First(&e, offer.EntryID).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "waitlist entry not found")
+	}
+	ap := e.visitFor(db, offer.slot())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&WaitlistOffer{}).Where("id = ? AND status = ?", offer.ID, "open").Update("status", "accepted")
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return errOfferGone
+		}
+		if !slotBookable(tx, ap) {
+			return errSlotTaken
+		}
+		if err := insertWithStatus(tx, &ap, e.contact(), "waitlist", fmt.Sprintf("waitlist offer %d", offer.ID)); err != nil {
+			return err
+		}
+		if err := tx.Model(&WaitlistOffer{}).Where("id = ?", offer.ID).Update("appointment_id", ap.ID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&WaitlistEntry{}).Where("id = ?", e.ID).Update("status", "booked").Error
+	})
+	switch {
+	case errors.Is(err, errOfferGone):
+		return fiber.NewError(fiber.StatusGone, errOfferGone.Error())
+	case errors.Is(err, errSlotTaken):
+		// Taken or too late after all; let the next patient try
+		_ = closeOffer(db, offer, "expired")
+		return fiber.NewError(fiber.StatusGone, errOfferGone.Error())
+	case err != nil:
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to book")
+	}
+	return c.Status(fiber.StatusCreated).JSON(ap)
+}
+
+// declineWaitlistOffer handles POST /waitlist/offers/:token/decline. The
+// patient stays on the waitlist.
+func declineWaitlistOffer(c *fiber.Ctx) error {
+	offer, err := openOffer(c.Params("token"))
+	if err != nil {
+		return err
+	}
+	if err := closeOffer(forTenant(offer.TenantID), offer, "declined"); errors.Is(err, errOfferGone) {
+		return fiber.NewError(fiber.StatusGone, errOfferGone.Error())
+	} else if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to decline")
+	}
+	return c.JSON(fiber.Map{"status": "declined"})
+}
+
+// listWaitlist handles GET /admin/waitlist, optionally filtered by ?doctor=,
+// ?status= and ?location_id=, in queue order.
+func listWaitlist(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	q, err := locationFilter(c, db.Order("created_at, id"))
+	if err != nil {
+		return err
+	}
+	if d := strings.TrimSpace(c.Query("doctor")); d != "" {
+		if canon, ok := canonicalDoctor(db, d); ok {
+			d = canon
+		}
+		q = q.Where("doctor = ?", d)
+	}
+	if s := strings.TrimSpace(c.Query("status")); s != "" {
+		q = q.Where("status = ?", s)
+	}
+	var entries []WaitlistEntry
+	if err := q.Find(&entries).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to list waitlist")
+	}
+	return c.JSON(entries)
+}
+
+// createWaitlistEntry handles POST /admin/waitlist.
+func createWaitlistEntry(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var in WaitlistEntry
+	if err := c.BodyParser(&in); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid body")
+	}
+	if v := joinWaitlist(db, &in); len(v) > 0 {
+		return validationFailed(c, v)
+	}
+	return c.Status(fiber.StatusCreated).JSON(in)
+}
+
+// cancelWaitlistEntry handles DELETE /admin/waitlist/:id. An open offer is
+// passed on to the next patient.
+func cancelWaitlistEntry(c *fiber.Ctx) error {
+	db := tenantDB(c)
+	var e WaitlistEntry
+	if err := db.First(&e, c.Params("id")).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "not found")
+	}
+	var offers []WaitlistOffer
+	db.Where("entry_id = ? AND status = ?", e.ID, "open").Find(&offers)
+	if err := db.Model(&e).Update("status", "cancelled").Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to cancel")
+	}
+	for _, o := range offers {
+		_ = closeOffer(db, o, "declined")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+var (
+	yesRe = regexp.MustCompile(`(?i)^\s*(yes|yeah|yep|sure|ok|okay|please|please do|go ahead|sounds good)\b`)
+	noRe  = regexp.MustCompile(`(?i)^\s*(no|nope|nah|not now|no thanks)\b`)
+)
+
+// waitlistQuestion tells the patient nothing is free and offers the waitlist.
+func waitlistQuestion(doctor, date string, w TimeWindow) string {
+	when := date
+	if w.Label != "" {
+		when += " " + w.Label
+	}
+	return fmt.Sprintf("Sorry, %s has no free times on %s. Would you like to join the waitlist? We'll let you know if a time opens up.", doctor, when)
+}
+
+// joinWaitlistFromChat puts the conversation's patient on the waitlist for
+// the day (and window) that was full, and says how they will hear back.
+func joinWaitlistFromChat(db *gorm.DB, conv ConversationState) string {
+	e := WaitlistEntry{
+		PatientName: conv.Draft.PatientName, Phone: conv.Contact.Phone, Email: conv.Contact.Email,
+		Doctor: conv.Draft.Doctor, DateFrom: conv.Draft.Date, DateTo: conv.Draft.Date, LocationID: conv.Draft.LocationID,
+		TimeFrom: conv.WaitlistWindow.From, TimeTo: conv.WaitlistWindow.To, Reason: conv.Draft.Reason,
+	}
+	if v := joinWaitlist(db, &e); len(v) > 0 {
+		return violationMessages(v)
+	}
+	reach := "Please check back with us, as " + unreachableReason(e.contact()) + "."
+	if canReach(e.contact()) && e.Email != "" {
+		reach = "We'll email " + e.Email + " as soon as a time opens up."
+	} else if canReach(e.contact()) {
+		reach = "We'll text " + e.Phone + " as soon as a time opens up."
+	}
+	return fmt.Sprintf("Done, %s! You're on the waitlist for %s on %s. %s", e.PatientName, e.Doctor, e.DateFrom, reach)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// outboxNotifier delivers channels by keeping what it is sent.
+type outboxNotifier struct {
+	channels []string
+	sent     []Notification
+}
+
+func (o *outboxNotifier) Channels() []string { return o.channels }
+
+func (o *outboxNotifier) Send(n Notification) error {
+	o.sent = append(o.sent, n)
+	return nil
+}
+
+// TestWaitlistOfferHold cancels a booking so its slot is offered to a
+// waitlisted patient, and checks the slot is held for them alone, the
+// message links to the offer page, and only one accept books it. No slot
+// is held while the notifier can't reach the patient.
+func TestWaitlistOfferHold(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig Notifier) { notifier = orig }(notifier)
+	defer func(orig func() time.Time) { nowFunc = orig }(nowFunc)
+	nowFunc = func() time.Time { return time.Date(2030, 1, 7, 7, 0, 0, 0, time.UTC) }
+	initDatabase("file:waitlist?mode=memory&cache=shared")
+	db := forTenant(defaultTenantID)
+
+	booked := Appointment{PatientName: "Ann Wambui", Doctor: "Dr. Lee", Date: "2030-01-07", Time: "10:00", TimeZone: "UTC",
+		Reason: "consultation", Status: StatusConfirmed}
+	resolveAppointmentType(db, &booked)
+	mustCreate(t, createWithStatus(db, &booked, PatientContact{}, "test", ""))
+	entry := WaitlistEntry{PatientName: "Ben Otieno", Email: "ben@example.com", Doctor: "Dr. Lee",
+		DateFrom: "2030-01-07", Reason: "consultation"}
+	if v := joinWaitlist(db, &entry); len(v) > 0 {
+		t.Fatalf("join: %+v", v)
+	}
+	mustCreate(t, transitionStatus(db, &booked, StatusCancelled, "test", ""))
+
+	// The log notifier can't email Ben, so nothing is held for him
+	notifier = logNotifier{}
+	offerFreedSlot(db, booked)
+	var offers int64
+	db.Model(&WaitlistOffer{}).Count(&offers)
+	if offers != 0 {
+		t.Fatalf("%d offers made that no one can be told about, want 0", offers)
+	}
+	if err := db.First(&entry, entry.ID).Error; err != nil || entry.Status != "waiting" {
+		t.Fatalf("entry is %q (%v), want still waiting", entry.Status, err)
+	}
+
+	email := &outboxNotifier{channels: []string{"email"}}
+	notifier = email
+	offerFreedSlot(db, booked)
+	var offer WaitlistOffer
+	if err := db.Where("entry_id = ?", entry.ID).First(&offer).Error; err != nil {
+		t.Fatalf("no offer: %v", err)
+	}
+
+	// Someone else can't have the slot while it's held
+	other := Appointment{PatientName: "Carl Mwangi", Doctor: "Dr. Lee", Date: "2030-01-07", Time: "10:00", TimeZone: "UTC",
+		Reason: "consultation", Status: StatusPending}
+	resolveAppointmentType(db, &other)
+	v, err := scheduleViolations(db, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 || v[0].Code != "held" {
+		t.Errorf("booking the held slot: got %+v, want a held violation", v)
+	}
+	slots, err := freeSlots(db, other, TimeWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range slots {
+		if s == "10:00" {
+			t.Errorf("free slots %v include the held 10:00", slots)
+		}
+	}
+	// The patient it's offered to can
+	if v, err := scheduleViolations(db, entry.visitFor(db, offer.slot())); err != nil || len(v) > 0 {
+		t.Errorf("the offered patient can't book the held slot: %+v %v", v, err)
+	}
+
+	// The message links to the offer page and is emailed
+	var n Notification
+	if err := db.Where("recipient = ?", "ben@example.com").First(&n).Error; err != nil {
+		t.Fatalf("no notification: %v", err)
+	}
+	if !strings.Contains(n.Body, "/waitlist/"+offer.Token) || strings.Contains(n.Body, "POST") {
+		t.Errorf("offer message %q should link to the offer page", n.Body)
+	}
+	dispatchNotifications()
+	if err := db.First(&n, n.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n.Status != "sent" || len(email.sent) != 1 || email.sent[0].ID != n.ID {
+		t.Errorf("email notification is %s, %d sent; want it sent", n.Status, len(email.sent))
+	}
+
+	// Only the first of two accepts books the slot
+	app := fiber.New()
+	app.Post("/waitlist/offers/:token/accept", acceptWaitlistOffer)
+	for i, want := range []int{fiber.StatusCreated, fiber.StatusGone} {
+		resp, err := app.Test(httptest.NewRequest("POST", "/waitlist/offers/"+offer.Token+"/accept", nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("accept %d: status %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	var count int64
+	db.Model(&Appointment{}).Where("patient_name = ? AND status <> ?", "Ben Otieno", StatusCancelled).Count(&count)
+	if count != 1 {
+		t.Errorf("%d appointments booked for the offer, want 1", count)
+	}
+}
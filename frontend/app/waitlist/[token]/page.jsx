@@ -0,0 +1,5 @@
+import WaitlistOffer from '../../../components/WaitlistOffer'
+
+export default function Page({ params }) {
+  return <WaitlistOffer token={params.token} />
+}
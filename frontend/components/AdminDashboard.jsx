@@ -1,32 +1,64 @@
 "use client"
-import { useEffect, useMemo, useState } from 'react'
+import { useEffect, useState } from 'react'
 import { useRouter } from 'next/navigation'
 import api from '../lib/api'
 import AppointmentTable from './AppointmentTable'
 import Calendar from './Calendar'
+import ResourceUtilization from './ResourceUtilization'
+import Closures from './Closures'
+import SearchResults from './SearchResults'
+
+const FALLBACK_STATUSES = ['pending', 'confirmed', 'checked_in', 'completed', 'cancelled', 'no_show']
+const PAGE_SIZE = 50
+const pad = (n) => String(n).padStart(2, '0')
+const ymd = (d) => `${d.getFullYear()}-${pad(d.getMonth() + 1)}-${pad(d.getDate())}`
 
 export default function AdminDashboard() {
   const [appointments, setAppointments] = useState([])
   const [editing, setEditing] = useState(null)
+  const [violations, setViolations] = useState([])
+  const [statuses, setStatuses] = useState(FALLBACK_STATUSES)
+  const [transitions, setTransitions] = useState({})
   const [loading, setLoading] = useState(true)
   const [view, setView] = useState('table')
   const [calendarMode, setCalendarMode] = useState('month')
   const [currentDate, setCurrentDate] = useState(new Date())
   const router = useRouter()
 
-  // Filters
+  // Filters, sorting and paging run on the server
   const [fPatient, setFPatient] = useState('')
   const [fDoctor, setFDoctor] = useState('')
-  const [fDate, setFDate] = useState('')
-  const [fTime, setFTime] = useState('')
-  const [fReason, setFReason] = useState('')
+  const [fFrom, setFFrom] = useState('')
+  const [fTo, setFTo] = useState('')
   const [fStatus, setFStatus] = useState('')
+  const [search, setSearch] = useState('')
+  const [sort, setSort] = useState('created_at:desc')
+  const [page, setPage] = useState(1)
+  const [total, setTotal] = useState(0)
+
+  // Bulk changes act on the ticked rows of the current page
+  const [selected, setSelected] = useState(new Set())
+  const [bulkStatus, setBulkStatus] = useState('')
+  const [bulkDoctor, setBulkDoctor] = useState('')
+  const [bulkFailures, setBulkFailures] = useState([])
+  const [importErrors, setImportErrors] = useState([])
 
   const load = async () => {
     setLoading(true)
+    const [field, order] = sort.split(':')
+    const params = { patient: fPatient, doctor: fDoctor, status: fStatus, from: fFrom, to: fTo, sort: field, order, page, page_size: PAGE_SIZE }
+    if (view === 'calendar') {
+      // The visible month plus the spill-over days around it
+      const first = new Date(currentDate.getFullYear(), currentDate.getMonth(), 1 - 7)
+      const last = new Date(currentDate.getFullYear(), currentDate.getMonth() + 1, 7)
+      Object.assign(params, { from: ymd(first), to: ymd(last), sort: 'starts_at', order: 'asc', page: 1, page_size: 500 })
+    }
+    for (const k of Object.keys(params)) if (params[k] === '') delete params[k]
     try {
-      const res = await api.get('/admin/appointments')
-      setAppointments(res.data || [])
+      const res = await api.get('/admin/appointments', { params })
+      setAppointments(res.data?.appointments || [])
+      setTotal(res.data?.total || 0)
+      setSelected(new Set())
     } catch (e) {
       if (e?.response?.status === 401) {
         localStorage.removeItem('token')
@@ -37,22 +69,48 @@ export default function AdminDashboard() {
     }
   }
 
-  useEffect(() => { load() }, [])
+  const loadStatuses = async () => {
+    try {
+      const res = await api.get('/admin/appointment-statuses')
+      setStatuses(res.data?.statuses || FALLBACK_STATUSES)
+      setTransitions(res.data?.transitions || {})
+    } catch (e) {
+      // Keep the fallback list; the server still rejects illegal changes
+    }
+  }
+
+  useEffect(() => { loadStatuses() }, [])
+
+  // Typing in a filter waits a moment before asking the server again
+  useEffect(() => {
+    const t = setTimeout(load, 250)
+    return () => clearTimeout(t)
+  }, [fPatient, fDoctor, fFrom, fTo, fStatus, sort, page, view, currentDate])
 
-  const filtered = useMemo(() => {
-    const match = (val, q) => String(val || '').toLowerCase().includes(String(q || '').toLowerCase())
-    return (appointments || []).filter((a) =>
-      match(a.patient_name, fPatient) &&
-      match(a.doctor, fDoctor) &&
-      (fDate ? String(a.date || '').startsWith(fDate) : true) &&
-      match(a.time, fTime) &&
-      match(a.reason, fReason) &&
-      (fStatus ? String(a.status || '') === fStatus : true)
-    )
-  }, [appointments, fPatient, fDoctor, fDate, fTime, fReason, fStatus])
+  // A new filter or order starts again from the first page
+  useEffect(() => { setPage(1) }, [fPatient, fDoctor, fFrom, fTo, fStatus, sort])
 
   const clearFilters = () => {
-    setFPatient(''); setFDoctor(''); setFDate(''); setFTime(''); setFReason(''); setFStatus('')
+    setFPatient(''); setFDoctor(''); setFFrom(''); setFTo(''); setFStatus(''); setSort('created_at:desc')
+  }
+  const pages = Math.max(1, Math.ceil(total / PAGE_SIZE))
+
+  // Downloads every appointment matching the filters, not just this page
+  const onExport = async (format) => {
+    const [field, order] = sort.split(':')
+    const params = { format, patient: fPatient, doctor: fDoctor, status: fStatus, from: fFrom, to: fTo, sort: field, order }
+    for (const k of Object.keys(params)) if (params[k] === '') delete params[k]
+    try {
+      const res = await api.get('/admin/appointments/export', { params, responseType: 'blob' })
+      const url = URL.createObjectURL(res.data)
+      const link = document.createElement('a')
+      link.href = url
+      link.download = `appointments-${ymd(new Date())}.${format}`
+      link.click()
+      URL.revokeObjectURL(url)
+    } catch (e) {
+      alert('Export failed')
+    }
   }
 
   const onDelete = async (a) => {
@@ -61,20 +119,87 @@ export default function AdminDashboard() {
     load()
   }
 
+  const onTransition = async (a, action) => {
+    const reason = action === 'cancel' || action === 'no-show' ? prompt('Reason (optional)') : ''
+    if (reason === null) return
+    try {
+      await api.post(`/admin/appointments/${a.id}/${action}`, reason ? { reason } : {})
+    } catch (e) {
+      alert(e?.response?.data?.error || e?.response?.data?.message || 'Status change failed')
+    }
+    load()
+  }
+
+  // A file is checked with a dry run first and only imported once every line
+  // passes, since the server saves all lines or none
+  const onImport = async (e) => {
+    const file = e.target.files?.[0]
+    e.target.value = ''
+    if (!file) return
+    const body = new FormData()
+    body.append('file', file)
+    try {
+      const check = await api.post('/admin/appointments/import', body, { params: { dry_run: true } })
+      setImportErrors(check.data?.errors || [])
+      if (check.data?.invalid > 0 || !confirm(`Import ${check.data?.valid} appointments from ${file.name}?`)) return
+      await api.post('/admin/appointments/import', body)
+      load()
+    } catch (err) {
+      const errors = err?.response?.data?.errors
+      setImportErrors(errors?.length ? errors : [{ line: 0, violations: [{ message: err?.response?.data?.error || err?.response?.data || 'Import failed' }] }])
+    }
+  }
+
+  // Each appointment succeeds or fails on its own; the failures stay listed
+  // until the next bulk change
+  const onBulk = async (body) => {
+    if (body.action === 'cancel') {
+      const reason = prompt(`Cancel ${selected.size} appointments? Reason (optional)`)
+      if (reason === null) return
+      body.reason = reason
+    }
+    try {
+      const res = await api.post('/admin/appointments/bulk', { ids: [...selected], ...body })
+      setBulkFailures((res.data?.results || []).filter((r) => !r.ok))
+    } catch (e) {
+      const results = e?.response?.data?.results
+      const v = e?.response?.data?.violations
+      setBulkFailures(results ? results.filter((r) => !r.ok) : [{ id: '', violations: v || [{ message: e?.response?.data?.error || 'Bulk change failed' }] }])
+    }
+    load()
+  }
+
+  // The editor offers the current status plus the ones it may move to
+  const editorStatuses = (a) => {
+    if (!a?.id) return ['pending', 'confirmed']
+    const next = transitions[a.status]
+    return next ? [a.status, ...next] : statuses
+  }
+
   const onSave = async () => {
     const { id, ...rest } = editing
-    if (id) {
-      await api.put(`/admin/appointments/${id}`, rest)
-    } else {
-      await api.post('/admin/appointments', rest)
+    try {
+      if (id) {
+        await api.put(`/admin/appointments/${id}`, rest)
+      } else {
+        await api.post('/admin/appointments', rest)
+      }
+    } catch (e) {
+      // 422 carries one message per rejected field (past date, off-grid time, ...)
+      const v = e?.response?.data?.violations
+      setViolations(v?.length ? v : [{ field: '', message: e?.response?.data?.error || 'Failed to save appointment' }])
+      return
     }
-    setEditing(null)
+    closeEditor()
     await load() // Always refresh for modal adds/edits
   }
 
-  const onAddFromCalendar = (draft) => { setEditing({ ...draft }) }
+  const openEditor = (a) => { setViolations([]); setEditing(a) }
+  const closeEditor = () => { setViolations([]); setEditing(null) }
+
+  const onAddFromCalendar = (draft) => { openEditor({ ...draft }) }
   const onAddFromTable = () => {
-    setEditing({ patient_name: '', doctor: '', date: '', time: '', reason: '', status: 'pending' })
+    openEditor({ patient_name: '', doctor: '', date: '', time: '', reason: '', status: 'pending' })
   }
 
   return (
@@ -86,6 +211,8 @@ export default function AdminDashboard() {
           <div className="inline-flex border rounded overflow-hidden">
             <button className={`px-3 py-1 text-sm ${view === 'table' ? 'bg-blue-600 text-white' : 'bg-white'}`} onClick={() => setView('table')}>Table</button>
             <button className={`px-3 py-1 text-sm ${view === 'calendar' ? 'bg-blue-600 text-white' : 'bg-white'}`} onClick={() => setView('calendar')}>Calendar</button>
+            <button className={`px-3 py-1 text-sm ${view === 'resources' ? 'bg-blue-600 text-white' : 'bg-white'}`} onClick={() => setView('resources')}>Resources</button>
+            <button className={`px-3 py-1 text-sm ${view === 'closures' ? 'bg-blue-600 text-white' : 'bg-white'}`} onClick={() => setView('closures')}>Closures</button>
           </div>
           {view === 'calendar' && (
             <div className="inline-flex border rounded overflow-hidden">
@@ -93,37 +220,98 @@ export default function AdminDashboard() {
               <button className={`px-3 py-1 text-sm ${calendarMode === 'week' ? 'bg-gray-900 text-white' : 'bg-white'}`} onClick={() => setCalendarMode('week')}>Week</button>
             </div>
           )}
+          {view === 'calendar' && calendarMode === 'week' && (
+            <input value={fDoctor} onChange={(e)=>setFDoctor(e.target.value)} className="border rounded px-2 py-1 text-sm w-32" placeholder="Doctor agenda" />
+          )}
           <button className="text-sm text-red-600" onClick={() => { localStorage.removeItem('token'); router.replace('/admin/login') }}>Log out</button>
         </div>
       </div>
 
       {view === 'table' && (
         <div className="bg-white border rounded p-3 shadow space-y-2">
-          <div className="grid grid-cols-6 gap-2">
+          <input value={search} onChange={(e)=>setSearch(e.target.value)} className="border rounded p-2 w-full" placeholder="Search names, reasons and notes" />
+          <div className="grid grid-cols-5 gap-2">
             <input value={fPatient} onChange={(e)=>setFPatient(e.target.value)} className="border rounded p-2" placeholder="Filter patient" />
             <input value={fDoctor} onChange={(e)=>setFDoctor(e.target.value)} className="border rounded p-2" placeholder="Filter doctor" />
-            <input value={fDate} onChange={(e)=>setFDate(e.target.value)} className="border rounded p-2" placeholder="Filter date YYYY-MM-DD" />
-            <input value={fTime} onChange={(e)=>setFTime(e.target.value)} className="border rounded p-2" placeholder="Filter time HH:MM" />
-            <input value={fReason} onChange={(e)=>setFReason(e.target.value)} className="border rounded p-2" placeholder="Filter reason" />
+            <input type="date" value={fFrom} onChange={(e)=>setFFrom(e.target.value)} className="border rounded p-2" title="From" />
+            <input type="date" value={fTo} onChange={(e)=>setFTo(e.target.value)} className="border rounded p-2" title="To" />
             <select value={fStatus} onChange={(e)=>setFStatus(e.target.value)} className="border rounded p-2">
               <option value="">All statuses</option>
-              <option value="pending">pending</option>
-              <option value="confirmed">confirmed</option>
-              <option value="cancelled">cancelled</option>
+              {statuses.map((st) => <option key={st} value={st}>{st.replace('_', ' ')}</option>)}
             </select>
           </div>
-          <div className="flex justify-end">
-            <button className="text-sm text-gray-600 hover:underline" onClick={clearFilters}>Clear filters</button>
+          <div className="flex items-center justify-between">
+            <select value={sort} onChange={(e)=>setSort(e.target.value)} className="border rounded p-1 text-sm">
+              <option value="created_at:desc">Newest first</option>
+              <option value="starts_at:asc">Appointment time, earliest first</option>
+              <option value="starts_at:desc">Appointment time, latest first</option>
+              <option value="patient_name:asc">Patient A–Z</option>
+              <option value="doctor:asc">Doctor A–Z</option>
+              <option value="status:asc">Status</option>
+            </select>
+            <div className="flex items-center gap-3 text-sm">
+              <button className="text-blue-600 hover:underline" onClick={() => onExport('csv')}>Export CSV</button>
+              <button className="text-blue-600 hover:underline" onClick={() => onExport('xlsx')}>Export Excel</button>
+              <label className="text-blue-600 hover:underline cursor-pointer">
+                Import CSV
+                <input type="file" accept=".csv,text/csv" className="hidden" onChange={onImport} />
+              </label>
+              <button className="text-gray-600 hover:underline" onClick={clearFilters}>Clear filters</button>
+            </div>
           </div>
+          {importErrors.length > 0 && (
+            <ul className="text-sm text-red-600 list-disc pl-5">
+              {importErrors.map((e, i) => (
+                <li key={i}>{e.line ? `Line ${e.line}: ` : ''}{(e.violations || []).map((v) => v.message).join(' ')}</li>
+              ))}
+            </ul>
+          )}
         </div>
       )}
 
-      {loading ? (
+      {view === 'resources' ? (
+        <ResourceUtilization />
+      ) : view === 'closures' ? (
+        <Closures onChanged={load} />
+      ) : view === 'table' && search.trim() ? (
+        <SearchResults query={search} onEdit={openEditor} />
+      ) : loading ? (
         <p>Loading...</p>
       ) : view === 'table' ? (
-        <AppointmentTable appointments={filtered} onEdit={setEditing} onDelete={onDelete} />
+        <>
+          {selected.size > 0 && (
+            <div className="flex flex-wrap items-center gap-2 bg-blue-50 border border-blue-200 rounded p-2 text-sm">
+              <span className="font-medium">{selected.size} selected</span>
+              <select value={bulkStatus} onChange={(e)=>setBulkStatus(e.target.value)} className="border rounded p-1">
+                <option value="">Set status…</option>
+                {statuses.map((st) => <option key={st} value={st}>{st.replace('_', ' ')}</option>)}
+              </select>
+              <button className="px-2 py-1 rounded bg-blue-600 text-white disabled:opacity-40" disabled={!bulkStatus} onClick={() => onBulk({ action: 'status', status: bulkStatus })}>Apply</button>
+              <input value={bulkDoctor} onChange={(e)=>setBulkDoctor(e.target.value)} className="border rounded p-1" placeholder="Doctor" />
+              <button className="px-2 py-1 rounded bg-yellow-500 text-white disabled:opacity-40" disabled={!bulkDoctor.trim()} onClick={() => onBulk({ action: 'reassign', doctor: bulkDoctor })}>Reassign</button>
+              <button className="px-2 py-1 rounded bg-gray-500 text-white" onClick={() => onBulk({ action: 'cancel' })}>Cancel appointments</button>
+              <button className="ml-auto text-gray-600 hover:underline" onClick={() => setSelected(new Set())}>Clear selection</button>
+            </div>
+          )}
+          {bulkFailures.length > 0 && (
+            <ul className="text-sm text-red-600 list-disc pl-5">
+              {bulkFailures.map((r, i) => (
+                <li key={i}>{r.id ? `#${r.id}: ` : ''}{r.error || (r.violations || []).map((v) => v.message).join(' ')}</li>
+              ))}
+            </ul>
+          )}
+          <AppointmentTable appointments={appointments} transitions={transitions} onTransition={onTransition} onEdit={openEditor} onDelete={onDelete} selected={selected} onSelect={(ids) => setSelected(new Set(ids))} />
+          <div className="flex items-center justify-between text-sm text-gray-600">
+            <span>{total === 0 ? 'No appointments' : `${(page - 1) * PAGE_SIZE + 1}–${Math.min(page * PAGE_SIZE, total)} of ${total}`}</span>
+            <div className="space-x-2">
+              <button className="px-2 py-1 border rounded disabled:opacity-40" disabled={page <= 1} onClick={() => setPage(page - 1)}>Previous</button>
+              <span>Page {page} of {pages}</span>
+              <button className="px-2 py-1 border rounded disabled:opacity-40" disabled={page >= pages} onClick={() => setPage(page + 1)}>Next</button>
+            </div>
+          </div>
+        </>
       ) : (
-        <Calendar view={calendarMode} date={currentDate} onChangeDate={setCurrentDate} appointments={filtered} onAdd={onAddFromCalendar} onEdit={setEditing} onDelete={onDelete} />
+        <Calendar view={calendarMode} date={currentDate} doctor={fDoctor} onChangeDate={setCurrentDate} appointments={appointments} onAdd={onAddFromCalendar} onEdit={openEditor} onDelete={onDelete} />
       )}
 
       {editing && (
@@ -136,16 +324,20 @@ export default function AdminDashboard() {
               <L label="Date"><input className="border rounded p-2 w-full" value={editing.date || ''} onChange={(e) => setEditing({ ...editing, date: e.target.value })} placeholder="YYYY-MM-DD" /></L>
               <L label="Time"><input className="border rounded p-2 w-full" value={editing.time || ''} onChange={(e) => setEditing({ ...editing, time: e.target.value })} placeholder="HH:MM" /></L>
               <L label="Reason" className="col-span-2"><input className="border rounded p-2 w-full" value={editing.reason || ''} onChange={(e) => setEditing({ ...editing, reason: e.target.value })} /></L>
+              <L label="Notes (staff only)" className="col-span-2"><textarea className="border rounded p-2 w-full" rows={2} value={editing.notes || ''} onChange={(e) => setEditing({ ...editing, notes: e.target.value })} /></L>
               <L label="Status" className="col-span-2">
                 <select className="border rounded p-2 w-full" value={editing.status || 'pending'} onChange={(e) => setEditing({ ...editing, status: e.target.value })}>
-                  <option value="pending">pending</option>
-                  <option value="confirmed">confirmed</option>
-                  <option value="cancelled">cancelled</option>
+                  {editorStatuses(editing).map((st) => <option key={st} value={st}>{st.replace('_', ' ')}</option>)}
                 </select>
               </L>
             </div>
+            {violations.length > 0 && (
+              <ul className="text-sm text-red-600 list-disc pl-5">
+                {violations.map((v, i) => <li key={i}>{v.message}</li>)}
+              </ul>
+            )}
             <div className="flex justify-end gap-2">
-              <button className="px-4 py-2 rounded border" onClick={() => setEditing(null)}>Cancel</button>
+              <button className="px-4 py-2 rounded border" onClick={closeEditor}>Cancel</button>
               <button className="px-4 py-2 rounded bg-blue-600 text-white" onClick={onSave}>{editing.id ? 'Save' : 'Create'}</button>
             </div>
           </div>
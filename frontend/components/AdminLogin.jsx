@@ -6,6 +6,7 @@ import api from '../lib/api'
 export default function AdminLogin() {
   const [email, setEmail] = useState('admin@example.com')
   const [password, setPassword] = useState('admin123')
+  const [tenant, setTenant] = useState('')
   const [error, setError] = useState('')
   const [loading, setLoading] = useState(false)
   const router = useRouter()
@@ -15,7 +16,7 @@ export default function AdminLogin() {
     setLoading(true)
     setError('')
     try {
-      const res = await api.post('/login', { email, password })
+      const res = await api.post('/login', { email, password, tenant })
       localStorage.setItem('token', res.data?.token || '')
       router.replace('/admin/dashboard')
     } catch (e) {
@@ -31,6 +32,7 @@ export default function AdminLogin() {
         <h2 className="text-xl font-semibold">Admin Login</h2>
         <input value={email} onChange={(e) => setEmail(e.target.value)} type="email" placeholder="Email" className="w-full border rounded p-2" />
         <input value={password} onChange={(e) => setPassword(e.target.value)} type="password" placeholder="Password" className="w-full border rounded p-2" />
+        <input value={tenant} onChange={(e) => setTenant(e.target.value)} placeholder="Practice (leave empty for the main clinic)" className="w-full border rounded p-2" />
         {error && <p className="text-red-600 text-sm">{error}</p>}
         <button className="w-full bg-blue-600 text-white rounded p-2" disabled={loading}>{loading ? 'Signing in...' : 'Sign In'}</button>
       </form>
@@ -1,10 +1,28 @@
 "use client"
-export default function AppointmentTable({ appointments, onEdit, onDelete }) {
+// Lifecycle actions: target status -> endpoint and button label
+const ACTIONS = {
+  confirmed: { path: 'confirm', label: 'Confirm', className: 'bg-emerald-600' },
+  checked_in: { path: 'check-in', label: 'Check in', className: 'bg-blue-600' },
+  completed: { path: 'complete', label: 'Complete', className: 'bg-gray-700' },
+  no_show: { path: 'no-show', label: 'No-show', className: 'bg-orange-500' },
+  cancelled: { path: 'cancel', label: 'Cancel', className: 'bg-gray-500' },
+}
+
+export default function AppointmentTable({ appointments, transitions = {}, onTransition, onEdit, onDelete, selected, onSelect }) {
+  // selected is a Set of ids; without onSelect the table has no checkboxes
+  const allSelected = appointments.length > 0 && appointments.every((a) => selected?.has(a.id))
+  const toggleAll = () => onSelect(allSelected ? [] : appointments.map((a) => a.id))
+  const toggle = (id) => {
+    const next = new Set(selected)
+    next.has(id) ? next.delete(id) : next.add(id)
+    onSelect([...next])
+  }
   return (
     <div className="overflow-x-auto border rounded bg-white shadow">
       <table className="min-w-full text-sm">
         <thead className="bg-gray-100">
           <tr>
+            {onSelect && <Th><input type="checkbox" checked={allSelected} onChange={toggleAll} aria-label="Select all" /></Th>}
             <Th>ID</Th>
             <Th>Patient</Th>
             <Th>Doctor</Th>
@@ -18,15 +36,19 @@ export default function AppointmentTable({ appointments, onEdit, onDelete }) {
         <tbody>
           {appointments.map((a) => (
             <tr key={a.id} className="border-t">
+              {onSelect && <Td><input type="checkbox" checked={selected.has(a.id)} onChange={() => toggle(a.id)} aria-label={`Select #${a.id}`} /></Td>}
               <Td>{a.id}</Td>
               <Td>{a.patient_name}</Td>
               <Td>{a.doctor}</Td>
               <Td>{a.date}</Td>
               <Td>{a.time}</Td>
               <Td>{a.reason}</Td>
-              <Td>{a.status}</Td>
+              <Td>{String(a.status || '').replace('_', ' ')}</Td>
               <Td>
                 <div className="flex gap-2">
+                  {onTransition && (transitions[a.status] || []).map((st) => ACTIONS[st] && (
+                    <button key={st} className={`px-2 py-1 rounded text-white ${ACTIONS[st].className}`} onClick={() => onTransition(a, ACTIONS[st].path)}>{ACTIONS[st].label}</button>
+                  ))}
                   <button className="px-2 py-1 rounded bg-yellow-500 text-white" onClick={() => onEdit(a)}>Edit</button>
                   <button className="px-2 py-1 rounded bg-red-600 text-white" onClick={() => onDelete(a)}>Delete</button>
                 </div>
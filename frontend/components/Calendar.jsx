@@ -1,5 +1,6 @@
 "use client"
 import { useEffect, useMemo, useState, useRef } from 'react'
+import api from '../lib/api'
 
 function startOfMonth(date) { const d = new Date(date.getFullYear(), date.getMonth(), 1); return d }
 function endOfMonth(date) { const d = new Date(date.getFullYear(), date.getMonth() + 1, 0); return d }
@@ -14,16 +15,38 @@ function weekLabel(date) { const s=startOfWeek(date); const e=addDays(s,6); cons
 const HOURS = Array.from({ length: 24 }, (_, i) => `${String(i).padStart(2, '0')}:00`)
 const SLOT_PX = 48
 function weekdayWithDate(d){ const name=d.toLocaleDateString(undefined,{weekday:'short'}); return `${name} ${d.getDate()}` }
-function colorFor(ap){ if(!ap) return 'bg-sky-500'; if(ap.status==='cancelled') return 'bg-gray-500'; if(ap.status==='confirmed') return 'bg-emerald-500'; const key=(ap.doctor||ap.patient_name||'').toLowerCase(); let hash=0; for(let i=0;i<key.length;i++) hash=(hash*31+key.charCodeAt(i))>>>0; const palette=['bg-sky-500','bg-indigo-500','bg-purple-500','bg-pink-500','bg-rose-500','bg-orange-500','bg-amber-500','bg-lime-500','bg-teal-500','bg-cyan-500']; return palette[hash%palette.length] }
+function colorFor(ap){ if(!ap) return 'bg-sky-500'; if(ap.status==='cancelled'||ap.status==='no_show') return 'bg-gray-500'; if(ap.status==='completed') return 'bg-gray-400'; if(ap.status==='checked_in') return 'bg-blue-600'; if(ap.status==='confirmed') return 'bg-emerald-500'; const key=(ap.doctor||ap.patient_name||'').toLowerCase(); let hash=0; for(let i=0;i<key.length;i++) hash=(hash*31+key.charCodeAt(i))>>>0; const palette=['bg-sky-500','bg-indigo-500','bg-purple-500','bg-pink-500','bg-rose-500','bg-orange-500','bg-amber-500','bg-lime-500','bg-teal-500','bg-cyan-500']; return palette[hash%palette.length] }
 
-export default function Calendar({ date = new Date(), view = 'month', appointments = [], onAdd, onEdit, onDelete, onChangeDate }) {
+// spanState says how an hour cell sits in a doctor's agenda: blocked when a
+// blocked span covers its start, free when any free time falls inside it
+function spanState(agenda, h) {
+  if (!agenda) return null
+  const end = `${String(Number(h.slice(0, 2)) + 1).padStart(2, '0')}:00`
+  const blocked = agenda.blocked.find((s) => s.start <= h && s.end > h)
+  if (blocked) return { className: 'bg-gray-100', title: blocked.note || blocked.reason.replace('_', ' ') }
+  if (agenda.free.some((s) => s.start < end && s.end > h)) return { className: 'bg-emerald-50', title: 'free' }
+  return null
+}
+
+export default function Calendar({ date = new Date(), view = 'month', appointments = [], doctor = '', onAdd, onEdit, onDelete, onChangeDate }) {
   const [now, setNow] = useState(new Date())
+  const [week, setWeek] = useState(null)
   const scrollRef = useRef(null)
   useEffect(()=>{ const id=setInterval(()=>setNow(new Date()),60*1000); return ()=>clearInterval(id) },[])
 
   const monthStart=startOfMonth(date); const gridStart=view==='month'?startOfWeek(monthStart):startOfWeek(date); const numCells=view==='month'?42:7
   const gridDays=useMemo(()=>{ const days=[]; for(let i=0;i<numCells;i++) days.push(addDays(gridStart,i)); return days },[gridStart,numCells])
-  const apByDate=useMemo(()=>{ const map={}; for(const ap of appointments){ const key=ap.date; if(!map[key]) map[key]=[]; map[key].push(ap)} return map },[appointments])
+  // With a doctor picked, the week view shows that doctor's agenda as the
+  // server works it out from shifts, closures and bookings
+  useEffect(()=>{
+    if(view!=='week'||!doctor.trim()){ setWeek(null); return }
+    const t=setTimeout(async()=>{
+      try { const res=await api.get(`/admin/doctors/${encodeURIComponent(doctor.trim())}/week`,{params:{date:ymd(date)}}); setWeek(res.data) } catch(e){ setWeek(null) }
+    },250)
+    return ()=>clearTimeout(t)
+  },[view,doctor,date,appointments])
+  const agendaByDate=useMemo(()=>{ const map={}; for(const day of week?.days||[]) map[day.date]=day; return map },[week])
+  const apByDate=useMemo(()=>{ const map={}; const list=week?(week.days||[]).flatMap((d)=>d.appointments):appointments; for(const ap of list){ const key=ap.date; if(!map[key]) map[key]=[]; map[key].push(ap)} return map },[appointments,week])
 
   const isSameMonth=(d)=>d.getMonth()===date.getMonth()
   const headerLabel=view==='month'?monthLabel(date):weekLabel(date)
@@ -41,7 +64,7 @@ export default function Calendar({ date = new Date(), view = 'month', appointmen
           <button className="px-2 py-1 border rounded border-gray-200 hover:bg-gray-50" onClick={()=>onChangeDate&&onChangeDate(new Date())}>Today</button>
           <button className="px-2 py-1 border rounded border-gray-200 hover:bg-gray-50" onClick={goNext}>→</button>
         </div>
-        <div className="text-sm font-semibold">{headerLabel}</div>
+        <div className="text-sm font-semibold">{headerLabel}{week?` · ${week.doctor}`:''}</div>
         <div className="w-20" />
       </div>
 
@@ -85,8 +108,8 @@ export default function Calendar({ date = new Date(), view = 'month', appointmen
               {HOURS.map((h)=>(
                 <>
                   <div key={`h-${h}`} className="border-r p-2 text-xs h-12 leading-[48px] text-gray-500 border-gray-200">{h}</div>
-                  {Array.from({length:7}).map((_,dayIdx)=>{ const day=addDays(gridStart,dayIdx); const key=ymd(day); const items=(apByDate[key]||[]).filter((ap)=>ap.time?.startsWith(h)); const onCellClick=(e)=>{ if(!onAdd) return; const rect=e.currentTarget.getBoundingClientRect(); const y=e.clientY-rect.top; const minute=y<rect.height/2?'00':'30'; const hh=h.slice(0,2); onAdd({date:key,time:`${hh}:${minute}`,patient_name:'',doctor:'',reason:'',status:'pending'})}; return (
-                    <div key={`${key}-${h}`} className="border h-12 p-1 cursor-crosshair hover:bg-gray-50/70 border-gray-200" onClick={onCellClick}>
+                  {Array.from({length:7}).map((_,dayIdx)=>{ const day=addDays(gridStart,dayIdx); const key=ymd(day); const items=(apByDate[key]||[]).filter((ap)=>ap.time?.startsWith(h)); const state=spanState(agendaByDate[key],h); const onCellClick=(e)=>{ if(!onAdd) return; const rect=e.currentTarget.getBoundingClientRect(); const y=e.clientY-rect.top; const minute=y<rect.height/2?'00':'30'; const hh=h.slice(0,2); onAdd({date:key,time:`${hh}:${minute}`,patient_name:'',doctor:week?.doctor||'',reason:'',status:'pending'})}; return (
+                    <div key={`${key}-${h}`} className={`border h-12 p-1 cursor-crosshair hover:bg-gray-50/70 border-gray-200 ${state?.className||''}`} title={state?.title} onClick={onCellClick}>
                       <div className="flex flex-col gap-1 pointer-events-none">
                         {items.map((ap)=>(
                           <div key={ap.id ?? `${ap.date}-${ap.time}-${ap.patient_name}`} className={`text-xs ${colorFor(ap)} text-white/90 rounded px-2 py-1 flex items-center justify-between`}>
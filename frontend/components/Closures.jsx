@@ -0,0 +1,136 @@
+"use client"
+import { useEffect, useState } from 'react'
+import api from '../lib/api'
+
+const EMPTY = { date_from: '', date_to: '', doctor: '', reason: '' }
+
+// Holidays and absences, with the appointments each one affects
+export default function Closures({ onChanged }) {
+  const [closures, setClosures] = useState([])
+  const [form, setForm] = useState(EMPTY)
+  const [open, setOpen] = useState(null) // { closure, appointments }
+  const [results, setResults] = useState(null)
+  const [error, setError] = useState('')
+
+  const load = async () => {
+    try {
+      const res = await api.get('/admin/closures')
+      setClosures(res.data || [])
+    } catch (e) {
+      setError(e?.response?.data?.error || 'Failed to load closures')
+    }
+  }
+
+  useEffect(() => { load() }, [])
+
+  const fail = (e) => {
+    const v = e?.response?.data?.violations
+    setError(v?.length ? v.map((x) => x.message).join(' ') : (e?.response?.data?.error || 'Request failed'))
+  }
+
+  const show = async (id) => {
+    setResults(null)
+    try {
+      const res = await api.get(`/admin/closures/${id}`)
+      setOpen(res.data)
+    } catch (e) { fail(e) }
+  }
+
+  const create = async () => {
+    setError('')
+    try {
+      const res = await api.post('/admin/closures', form)
+      setForm(EMPTY)
+      setOpen(res.data)
+      setResults(null)
+      await load()
+      onChanged?.()
+    } catch (e) { fail(e) }
+  }
+
+  const remove = async (id) => {
+    if (!confirm('Reopen these days?')) return
+    try {
+      await api.delete(`/admin/closures/${id}`)
+      if (open?.closure?.id === id) setOpen(null)
+      await load()
+      onChanged?.()
+    } catch (e) { fail(e) }
+  }
+
+  const act = async (action) => {
+    const id = open.closure.id
+    if (!confirm(action === 'cancel' ? 'Cancel every affected appointment and notify the patients?' : 'Move every affected appointment and notify the patients?')) return
+    try {
+      const res = await api.post(`/admin/closures/${id}/${action}`, {})
+      await show(id)
+      setResults(res.data?.results || [])
+      onChanged?.()
+    } catch (e) { fail(e) }
+  }
+
+  const waiting = (open?.appointments || []).filter((a) => ['pending', 'confirmed', 'checked_in'].includes(a.status))
+
+  return (
+    <div className="border rounded bg-white shadow p-3 space-y-3">
+      <div className="grid grid-cols-5 gap-2 text-sm">
+        <input type="date" value={form.date_from} onChange={(e) => setForm({ ...form, date_from: e.target.value })} className="border rounded p-2" />
+        <input type="date" value={form.date_to} onChange={(e) => setForm({ ...form, date_to: e.target.value })} className="border rounded p-2" />
+        <input value={form.doctor} onChange={(e) => setForm({ ...form, doctor: e.target.value })} className="border rounded p-2" placeholder="Doctor (blank = whole clinic)" />
+        <input value={form.reason} onChange={(e) => setForm({ ...form, reason: e.target.value })} className="border rounded p-2" placeholder="Reason" />
+        <button className="px-3 py-1 rounded bg-blue-600 text-white" onClick={create}>Close days</button>
+      </div>
+      {error && <p className="text-sm text-red-600">{error}</p>}
+      {closures.length === 0 ? (
+        <p className="text-sm text-gray-600">No closures yet.</p>
+      ) : (
+        <table className="min-w-full text-sm">
+          <thead className="bg-gray-100">
+            <tr>
+              <th className="text-left p-2">Days</th>
+              <th className="text-left p-2">Who</th>
+              <th className="text-left p-2">Reason</th>
+              <th className="p-2"></th>
+            </tr>
+          </thead>
+          <tbody>
+            {closures.map((c) => (
+              <tr key={c.id} className={`border-t ${open?.closure?.id === c.id ? 'bg-blue-50' : ''}`}>
+                <td className="p-2">{c.date_from === c.date_to ? c.date_from : `${c.date_from} – ${c.date_to}`}</td>
+                <td className="p-2">{c.doctor || 'Whole clinic'}</td>
+                <td className="p-2">{c.reason}</td>
+                <td className="p-2 text-right space-x-3">
+                  <button className="text-blue-600 hover:underline" onClick={() => show(c.id)}>Appointments</button>
+                  <button className="text-red-600 hover:underline" onClick={() => remove(c.id)}>Delete</button>
+                </td>
+              </tr>
+            ))}
+          </tbody>
+        </table>
+      )}
+      {open && (
+        <div className="border-t pt-3 space-y-2 text-sm">
+          <div className="flex items-center justify-between">
+            <span className="font-medium">{waiting.length} appointment(s) still on closed days</span>
+            {waiting.length > 0 && (
+              <div className="space-x-2">
+                <button className="px-3 py-1 rounded bg-blue-600 text-white" onClick={() => act('reschedule')}>Reschedule all</button>
+                <button className="px-3 py-1 rounded bg-red-600 text-white" onClick={() => act('cancel')}>Cancel all</button>
+              </div>
+            )}
+          </div>
+          <ul className="space-y-1">
+            {(open.appointments || []).map((a) => (
+              <li key={a.id}>#{a.id} {a.patient_name} · {a.doctor} · {a.date} {a.time} · {a.status.replace('_', ' ')}</li>
+            ))}
+          </ul>
+          {results && results.filter((r) => !r.ok).map((r) => (
+            <p key={r.appointment_id} className="text-red-600">
+              #{r.appointment_id}: {r.error || (r.violations || []).map((v) => v.message).join(' ')}
+            </p>
+          ))}
+        </div>
+      )}
+    </div>
+  )
+}
@@ -0,0 +1,71 @@
+"use client"
+import { useEffect, useState } from 'react'
+import api from '../lib/api'
+
+const pad = (n) => String(n).padStart(2, '0')
+const ymd = (d) => `${d.getFullYear()}-${pad(d.getMonth() + 1)}-${pad(d.getDate())}`
+
+// How busy each room or device is over a date range (defaults to this week)
+export default function ResourceUtilization() {
+  const [from, setFrom] = useState(ymd(new Date()))
+  const [to, setTo] = useState(ymd(new Date(Date.now() + 6 * 86400000)))
+  const [rows, setRows] = useState([])
+  const [error, setError] = useState('')
+
+  const load = async () => {
+    setError('')
+    try {
+      const res = await api.get('/admin/resources/utilization', { params: { from, to } })
+      setRows(res.data?.resources || [])
+    } catch (e) {
+      setError(e?.response?.data?.error || 'Failed to load utilization')
+    }
+  }
+
+  useEffect(() => { load() }, [from, to])
+
+  return (
+    <div className="border rounded bg-white shadow p-3 space-y-3">
+      <div className="flex items-center gap-2 text-sm">
+        <span className="text-gray-600">From</span>
+        <input type="date" value={from} onChange={(e) => setFrom(e.target.value)} className="border rounded p-1" />
+        <span className="text-gray-600">to</span>
+        <input type="date" value={to} onChange={(e) => setTo(e.target.value)} className="border rounded p-1" />
+      </div>
+      {error && <p className="text-sm text-red-600">{error}</p>}
+      {rows.length === 0 ? (
+        <p className="text-sm text-gray-600">No rooms or equipment yet.</p>
+      ) : (
+        <table className="min-w-full text-sm">
+          <thead className="bg-gray-100">
+            <tr>
+              <th className="text-left p-2">Resource</th>
+              <th className="text-left p-2">Kind</th>
+              <th className="text-left p-2">Appointments</th>
+              <th className="text-left p-2">Booked</th>
+              <th className="text-left p-2 w-1/3">Utilization</th>
+            </tr>
+          </thead>
+          <tbody>
+            {rows.map((r) => (
+              <tr key={r.resource.id} className="border-t">
+                <td className="p-2">{r.resource.name}</td>
+                <td className="p-2">{r.resource.kind}</td>
+                <td className="p-2">{r.appointments}</td>
+                <td className="p-2">{Math.round(r.booked_minutes / 6) / 10} h</td>
+                <td className="p-2">
+                  <div className="flex items-center gap-2">
+                    <div className="flex-1 h-2 bg-gray-200 rounded">
+                      <div className="h-2 bg-blue-600 rounded" style={{ width: `${Math.min(100, r.utilization * 100)}%` }} />
+                    </div>
+                    <span className="w-12 text-right">{Math.round(r.utilization * 100)}%</span>
+                  </div>
+                </td>
+              </tr>
+            ))}
+          </tbody>
+        </table>
+      )}
+    </div>
+  )
+}
@@ -0,0 +1,42 @@
+"use client"
+import { useEffect, useState } from 'react'
+import api from '../lib/api'
+
+// Ranked full-text matches for a query. The server escapes the text and
+// wraps the matched words in <mark>, so the highlights can go in as HTML.
+export default function SearchResults({ query, onEdit }) {
+  const [results, setResults] = useState([])
+  const [error, setError] = useState('')
+
+  useEffect(() => {
+    const t = setTimeout(async () => {
+      setError('')
+      try {
+        const res = await api.get('/admin/appointments/search', { params: { q: query } })
+        setResults(res.data?.results || [])
+      } catch (e) {
+        setError(e?.response?.data?.error || 'Search failed')
+      }
+    }, 250)
+    return () => clearTimeout(t)
+  }, [query])
+
+  if (error) return <p className="text-sm text-red-600">{error}</p>
+  if (results.length === 0) return <p className="text-sm text-gray-600">No matches.</p>
+  return (
+    <ul className="border rounded bg-white shadow divide-y text-sm">
+      {results.map(({ appointment: a, highlights }) => (
+        <li key={a.id} className="p-3 hover:bg-gray-50 cursor-pointer" onClick={() => onEdit(a)}>
+          <div className="flex justify-between">
+            <span className="font-medium" dangerouslySetInnerHTML={{ __html: highlights.patient_name || escape(a.patient_name) }} />
+            <span className="text-gray-600">{a.doctor} · {a.date} {a.time} · {String(a.status || '').replace('_', ' ')}</span>
+          </div>
+          {highlights.reason && <div dangerouslySetInnerHTML={{ __html: highlights.reason }} />}
+          {highlights.notes && <div className="text-gray-600" dangerouslySetInnerHTML={{ __html: highlights.notes }} />}
+        </li>
+      ))}
+    </ul>
+  )
+}
+
+const escape = (s) => String(s || '').replace(/[&<>"']/g, (c) => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c]))
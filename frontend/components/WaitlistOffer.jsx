@@ -0,0 +1,58 @@
+"use client"
+import { useEffect, useState } from 'react'
+import api from '../lib/api'
+
+// The page a waitlisted patient lands on from an offer message. Following
+// the link only shows the held slot; booking or declining it takes a click.
+export default function WaitlistOffer({ token }) {
+  const [offer, setOffer] = useState(null)
+  const [result, setResult] = useState('')
+  const [error, setError] = useState('')
+  const [loading, setLoading] = useState(false)
+
+  useEffect(() => {
+    api.get(`/waitlist/offers/${token}`)
+      .then((res) => setOffer(res.data))
+      .catch(() => setError('We could not find this offer.'))
+  }, [token])
+
+  const answer = async (action) => {
+    setLoading(true)
+    setError('')
+    try {
+      await api.post(`/waitlist/offers/${token}/${action}`)
+      setResult(action === 'accept'
+        ? `You're booked with ${offer.doctor} on ${offer.date} at ${offer.time}. See you then!`
+        : "No problem. You're still on the waitlist, and we'll let you know if another time opens up.")
+    } catch (e) {
+      setError(e.response?.status === 410 ? 'Sorry, this slot is no longer available.' : 'Something went wrong. Please try again.')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const open = offer && offer.status === 'open' && new Date(offer.expires_at) > new Date()
+
+  return (
+    <div className="min-h-screen grid place-items-center p-4">
+      <div className="bg-white border rounded p-6 w-full max-w-sm shadow space-y-3">
+        <h2 className="text-xl font-semibold">A slot opened up</h2>
+        {offer && (
+          <p>
+            {offer.doctor} on {offer.date} at {offer.time}
+            {open && <>, held for you until {new Date(offer.expires_at).toLocaleString()}</>}.
+          </p>
+        )}
+        {offer && !open && !result && <p className="text-gray-600 text-sm">This offer is no longer available.</p>}
+        {result && <p className="text-green-700">{result}</p>}
+        {error && <p className="text-red-600 text-sm">{error}</p>}
+        {open && !result && (
+          <div className="flex gap-2">
+            <button onClick={() => answer('accept')} className="flex-1 bg-blue-600 text-white rounded p-2" disabled={loading}>Book it</button>
+            <button onClick={() => answer('decline')} className="flex-1 border rounded p-2" disabled={loading}>No thanks</button>
+          </div>
+        )}
+      </div>
+    </div>
+  )
+}
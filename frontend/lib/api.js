@@ -9,6 +9,8 @@ api.interceptors.request.use((config) => {
     const token = localStorage.getItem('token')
     if (token) config.headers.Authorization = `Bearer ${token}`
   }
+  // Picks the practice the chat widget talks to; unset means the default one
+  if (process.env.NEXT_PUBLIC_WIDGET_KEY) config.headers['X-Widget-Key'] = process.env.NEXT_PUBLIC_WIDGET_KEY
   return config
 })
 